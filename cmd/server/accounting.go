@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+	"github.com/abdullah2993/socks5-server/socks5/accounting"
+)
+
+//csvMaxSize is the size the -accounting csv files are rotated at
+const csvMaxSize = 64 << 20
+
+//sqliteDriver is the database/sql driver of -accounting sqlite:path, it's only registered in
+//the builds with -tags sqlite
+var sqliteDriver string
+
+//openAccounting opens the store of -accounting, csv:path or sqlite:path
+func openAccounting(spec string) (socks5.Accounting, error) {
+	i := strings.IndexByte(spec, ':')
+	if i < 0 || i == len(spec)-1 {
+		return nil, fmt.Errorf("invalid accounting %q, use csv:path or sqlite:path", spec)
+	}
+	kind, path := spec[:i], spec[i+1:]
+	switch kind {
+	case "csv":
+		return accounting.NewCSV(path, csvMaxSize)
+	case "sqlite":
+		if sqliteDriver == "" {
+			return nil, errors.New("sqlite accounting requires a build with -tags sqlite")
+		}
+		db, err := sql.Open(sqliteDriver, path)
+		if err != nil {
+			return nil, err
+		}
+		a, err := accounting.NewSQL(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("unknown accounting %q, use csv:path or sqlite:path", kind)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenAccounting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := openAccounting("csv:" + filepath.Join(dir, "usage.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.(io.Closer).Close()
+	if _, err := os.Stat(filepath.Join(dir, "usage.csv")); err != nil {
+		t.Errorf("expected the csv file to be created got %v", err)
+	}
+
+	tts := []struct {
+		spec string
+		err  string
+	}{
+		{"usage.csv", "invalid accounting"},
+		{"csv:", "invalid accounting"},
+		{"postgres:usage", "unknown accounting"},
+	}
+	if sqliteDriver == "" {
+		tts = append(tts, struct{ spec, err string }{"sqlite:" + filepath.Join(dir, "usage.db"), "-tags sqlite"})
+	}
+	for _, tt := range tts {
+		if _, err := openAccounting(tt.spec); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected %q got %v", tt.spec, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+//the categories the errors of the bench are counted by
+const (
+	benchErrConnect   = "connect"
+	benchErrHandshake = "handshake"
+	benchErrAuth      = "auth"
+	benchErrDial      = "dial"
+	benchErrTransfer  = "transfer"
+)
+
+//benchSessionTimeout bounds a session of the bench
+const benchSessionTimeout = 30 * time.Second
+
+//benchConfig is what socks5-server bench runs
+type benchConfig struct {
+	proxy string
+	//target is the host:port of a TCP echo server, if empty a local one is started
+	target             string
+	username, password string
+	concurrency        int
+	duration           time.Duration
+	payload            int
+	//connRate is the number of sessions started per second, unlimited if 0
+	connRate float64
+}
+
+//latencyStats are the percentiles of latencies in milliseconds
+type latencyStats struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+//benchReport is the result of a bench, printed as JSON with -json
+type benchReport struct {
+	Proxy       string  `json:"proxy"`
+	Target      string  `json:"target"`
+	Concurrency int     `json:"concurrency"`
+	Duration    float64 `json:"duration_s"`
+	Payload     int     `json:"payload_bytes"`
+	Sessions    int     `json:"sessions"`
+	//SessionsPerSecond is the rate of sessions completed
+	SessionsPerSecond float64 `json:"sessions_per_s"`
+	//Bytes are the bytes sent and received through the proxy
+	Bytes      int64   `json:"bytes"`
+	Throughput float64 `json:"throughput_bytes_per_s"`
+	//Connect is the latency of connecting to the proxy, Handshake of connecting and
+	//authenticating and Dial of the CONNECT request until the reply
+	Connect   latencyStats   `json:"connect_latency_ms"`
+	Handshake latencyStats   `json:"handshake_latency_ms"`
+	Dial      latencyStats   `json:"dial_latency_ms"`
+	Errors    map[string]int `json:"errors"`
+}
+
+//benchStats are collected by the sessions of a bench
+type benchStats struct {
+	mu                       sync.Mutex
+	connect, handshake, dial []time.Duration
+	bytes                    int64
+	errors                   map[string]int
+}
+
+func (s *benchStats) session(connect, handshake, dial time.Duration, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connect = append(s.connect, connect)
+	s.handshake = append(s.handshake, handshake)
+	s.dial = append(s.dial, dial)
+	s.bytes += bytes
+}
+
+func (s *benchStats) failure(category string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[category]++
+}
+
+//runBench runs sessions through the proxy until cfg.duration is over
+func runBench(cfg benchConfig) (*benchReport, error) {
+	if cfg.proxy == "" {
+		return nil, errors.New("-proxy is required")
+	}
+	if cfg.concurrency < 1 || cfg.duration <= 0 || cfg.payload < 0 || cfg.connRate < 0 {
+		return nil, errors.New("-concurrency and -duration must be positive and -payload and -conn-rate not negative")
+	}
+	if cfg.target == "" {
+		echo, err := listenEcho()
+		if err != nil {
+			return nil, err
+		}
+		defer echo.Close()
+		cfg.target = echo.Addr().String()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.duration)
+	defer cancel()
+
+	//the sessions are started at most at cfg.connRate so the bench isn't only measuring how
+	//fast the proxy accepts
+	var tokens <-chan time.Time
+	if cfg.connRate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / cfg.connRate))
+		defer t.Stop()
+		tokens = t.C
+	}
+
+	payload := make([]byte, cfg.payload)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	stats := &benchStats{errors: make(map[string]int)}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				benchSession(ctx, cfg, payload, stats)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	r := &benchReport{
+		Proxy:       cfg.proxy,
+		Target:      cfg.target,
+		Concurrency: cfg.concurrency,
+		Duration:    elapsed.Seconds(),
+		Payload:     cfg.payload,
+		Sessions:    len(stats.dial),
+		Bytes:       stats.bytes,
+		Connect:     percentiles(stats.connect),
+		Handshake:   percentiles(stats.handshake),
+		Dial:        percentiles(stats.dial),
+		Errors:      stats.errors,
+	}
+	r.SessionsPerSecond = float64(r.Sessions) / elapsed.Seconds()
+	r.Throughput = float64(r.Bytes) / elapsed.Seconds()
+	return r, nil
+}
+
+//benchSession dials the target through the proxy and exchanges the payload, the sessions cut
+//short by the end of the bench aren't counted
+func benchSession(ctx context.Context, cfg benchConfig, payload []byte, stats *benchStats) {
+	var connected, authenticated time.Time
+	trace := &socks5.ClientTrace{
+		ProxyConnected: func() { connected = time.Now() },
+		Authenticated:  func() { authenticated = time.Now() },
+	}
+	client := socks5.NewClient(cfg.proxy, socks5.WithClientAuth(cfg.username, cfg.password), socks5.WithClientTrace(trace))
+
+	//the deadlines of the connections may expire before ctx reports it
+	deadline, _ := ctx.Deadline()
+	over := func() bool {
+		return ctx.Err() != nil || !time.Now().Before(deadline)
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, benchSessionTimeout)
+	defer cancel()
+	start := time.Now()
+	c, err := client.DialContext(sctx, "tcp", cfg.target)
+	if err != nil {
+		if over() {
+			return
+		}
+		switch {
+		case connected.IsZero():
+			stats.failure(benchErrConnect)
+		case err == socks5.ErrAuthFailed || err == socks5.ErrNoAcceptableMethod:
+			stats.failure(benchErrAuth)
+		case authenticated.IsZero():
+			stats.failure(benchErrHandshake)
+		default:
+			stats.failure(benchErrDial)
+		}
+		return
+	}
+	defer c.Close()
+	replied := time.Now()
+
+	if deadline, ok := sctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write(payload)
+		written <- err
+	}()
+	_, err = io.ReadFull(c, make([]byte, len(payload)))
+	if werr := <-written; err == nil {
+		err = werr
+	}
+	if err != nil {
+		if !over() {
+			stats.failure(benchErrTransfer)
+		}
+		return
+	}
+	stats.session(connected.Sub(start), authenticated.Sub(start), replied.Sub(authenticated), 2*int64(len(payload)))
+}
+
+//percentiles returns the nearest rank percentiles of d
+func percentiles(d []time.Duration) latencyStats {
+	if len(d) == 0 {
+		return latencyStats{}
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	ms := func(p float64) float64 {
+		return float64(d[int(p*float64(len(d)-1))]) / float64(time.Millisecond)
+	}
+	return latencyStats{P50: ms(0.5), P90: ms(0.9), P99: ms(0.99), Max: ms(1)}
+}
+
+//parseSize parses a size in bytes with an optional k or m suffix for KiB and MiB
+func parseSize(s string) (int, error) {
+	digits, mult := s, 1
+	switch {
+	case strings.HasSuffix(strings.ToLower(s), "k"):
+		digits, mult = s[:len(s)-1], 1<<10
+	case strings.HasSuffix(strings.ToLower(s), "m"):
+		digits, mult = s[:len(s)-1], 1<<20
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+//writeText writes the report for humans
+func (r *benchReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "proxy %s, target %s, %d concurrent sessions for %.1fs, payload %d bytes\n",
+		r.Proxy, r.Target, r.Concurrency, r.Duration, r.Payload)
+	fmt.Fprintf(w, "sessions:   %d (%.1f/s)\n", r.Sessions, r.SessionsPerSecond)
+	fmt.Fprintf(w, "throughput: %.2f MiB/s (%d bytes)\n", r.Throughput/(1<<20), r.Bytes)
+	for _, l := range []struct {
+		name  string
+		stats latencyStats
+	}{{"connect", r.Connect}, {"handshake", r.Handshake}, {"dial", r.Dial}} {
+		fmt.Fprintf(w, "%-10s  p50 %.2fms  p90 %.2fms  p99 %.2fms  max %.2fms\n",
+			l.name+":", l.stats.P50, l.stats.P90, l.stats.P99, l.stats.Max)
+	}
+	categories := make([]string, 0, len(r.Errors))
+	for c := range r.Errors {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+	fmt.Fprint(w, "errors:    ")
+	if len(categories) == 0 {
+		fmt.Fprint(w, " none")
+	}
+	for _, c := range categories {
+		fmt.Fprintf(w, " %s %d", c, r.Errors[c])
+	}
+	fmt.Fprintln(w)
+}
+
+//runBenchCommand runs socks5-server bench with args and returns the exit code
+func runBenchCommand(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var cfg benchConfig
+	var payload, passwordFile string
+	var asJSON bool
+	fs.StringVar(&cfg.proxy, "proxy", "", "host:port of the proxy")
+	fs.StringVar(&cfg.target, "target", "", "host:port of a TCP echo server, a local one if empty")
+	fs.StringVar(&cfg.username, "username", "", "username for authentication")
+	fs.StringVar(&passwordFile, "password-file", "", "file holding the password for authentication")
+	fs.IntVar(&cfg.concurrency, "concurrency", 10, "number of concurrent sessions")
+	fs.DurationVar(&cfg.duration, "duration", 30*time.Second, "how long the bench runs")
+	fs.StringVar(&payload, "payload", "64k", "bytes sent and echoed back by each session, with an optional k or m suffix")
+	fs.Float64Var(&cfg.connRate, "conn-rate", 0, "sessions started per second, unlimited if 0")
+	fs.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if cfg.payload, err = parseSize(payload); err != nil {
+		fmt.Fprintf(os.Stderr, "-payload: %v\n", err)
+		return 2
+	}
+	if passwordFile != "" {
+		if cfg.password, err = readPasswordFile(passwordFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	r, err := runBench(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		return 2
+	}
+	if asJSON {
+		json.NewEncoder(out).Encode(r)
+	} else {
+		r.writeText(out)
+	}
+	if r.Sessions == 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func TestBench(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5.Server{Cmds: []socks5.Command{socks5.CommandConnect}, Dialer: new(net.Dialer)}
+	socks5.WithAuth("username", "password")(s)
+	go s.Serve(l)
+	defer s.Close()
+
+	r, err := runBench(benchConfig{
+		proxy:       l.Addr().String(),
+		username:    "username",
+		password:    "password",
+		concurrency: 2,
+		duration:    300 * time.Millisecond,
+		payload:     1 << 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Sessions == 0 || r.Bytes != int64(r.Sessions)*2<<10 || r.Throughput <= 0 {
+		t.Errorf("unexpected sessions %d and bytes %d", r.Sessions, r.Bytes)
+	}
+	if len(r.Errors) != 0 {
+		t.Errorf("unexpected errors %v", r.Errors)
+	}
+	for _, l := range []latencyStats{r.Connect, r.Handshake, r.Dial} {
+		if l.P50 <= 0 || l.P50 > l.P90 || l.P90 > l.P99 || l.P99 > l.Max {
+			t.Errorf("unexpected latencies %+v", l)
+		}
+	}
+
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(r)
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"sessions", "throughput_bytes_per_s", "connect_latency_ms", "handshake_latency_ms", "dial_latency_ms", "errors"} {
+		if _, ok := fields[f]; !ok {
+			t.Errorf("expected %s in %s", f, b.String())
+		}
+	}
+
+	//the sessions failing authentication are counted by category
+	r, err = runBench(benchConfig{proxy: l.Addr().String(), username: "username", password: "wrong",
+		concurrency: 1, duration: 100 * time.Millisecond, connRate: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Sessions != 0 || r.Errors[benchErrAuth] == 0 || r.Errors[benchErrAuth] > 6 {
+		t.Errorf("expected a few auth errors got %d sessions and %v", r.Sessions, r.Errors)
+	}
+
+	b.Reset()
+	r.writeText(&b)
+	if !strings.Contains(b.String(), "errors:     auth ") {
+		t.Errorf("expected the auth errors in\n%s", b.String())
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tts := []struct {
+		s    string
+		size int
+		err  bool
+	}{
+		{"512", 512, false},
+		{"64k", 64 << 10, false},
+		{"2M", 2 << 20, false},
+		{"k", 0, true},
+		{"-1", 0, true},
+	}
+	for _, tt := range tts {
+		size, err := parseSize(tt.s)
+		if size != tt.size || (err != nil) != tt.err {
+			t.Errorf("%q: expected %d %v got %d %v", tt.s, tt.size, tt.err, size, err)
+		}
+	}
+}
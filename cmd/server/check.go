@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+//the stages of the check a failure is classified with
+const (
+	stageConnect   = "connect"
+	stageHandshake = "handshake"
+	stageAuth      = "auth"
+	stageDial      = "dial"
+	stageTransfer  = "transfer"
+	stageBind      = "bind"
+	stageUDP       = "udp"
+	stageTimeout   = "timeout"
+)
+
+//checkPayload is sent through the proxy and expected back
+var checkPayload = []byte("socks5-server check")
+
+//checkConfig is what -check probes
+type checkConfig struct {
+	//target is the address of the proxy
+	target             string
+	username, password string
+	//probe is the host:port of a TCP echo server dialed through the proxy, if empty a local one
+	//is started
+	probe string
+	//cmds are the commands enabled on the proxy, BIND and UDP ASSOCIATE are probed if enabled
+	cmds    []socks5.Command
+	timeout time.Duration
+}
+
+//checkResult is the verdict of a check printed as JSON, Bind and UDP are nil if not probed
+type checkResult struct {
+	OK        bool    `json:"ok"`
+	Target    string  `json:"target"`
+	Handshake bool    `json:"handshake"`
+	Auth      bool    `json:"auth"`
+	Dial      bool    `json:"dial"`
+	Bind      *bool   `json:"bind,omitempty"`
+	UDP       *bool   `json:"udp,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	//Failure is the stage that failed and Error its error
+	Failure string `json:"failure,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+//checkError is the error of a stage of the check
+type checkError struct {
+	stage string
+	err   error
+}
+
+func (e *checkError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+//runCheck dials through the proxy of cfg, it returns once every probe is done or cfg.timeout
+//is over
+func runCheck(cfg checkConfig) *checkResult {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+	res := &checkResult{Target: cfg.target}
+
+	err := func() error {
+		probe := cfg.probe
+		if probe == "" {
+			echo, err := listenEcho()
+			if err != nil {
+				return &checkError{stageConnect, err}
+			}
+			defer echo.Close()
+			probe = echo.Addr().String()
+		}
+
+		start := time.Now()
+		c, _, err := checkRequest(ctx, cfg, res, socks5.CommandConnect, probe)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		res.Dial = true
+		if err := checkEcho(c, c); err != nil {
+			return &checkError{stageTransfer, err}
+		}
+		res.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+
+		for _, cmd := range cfg.cmds {
+			switch cmd {
+			case socks5.CommandBind:
+				ok := false
+				res.Bind = &ok
+				if err := checkBind(ctx, cfg, res); err != nil {
+					return err
+				}
+				ok = true
+			case socks5.CommandUDPAssociation:
+				ok := false
+				res.UDP = &ok
+				if err := checkUDP(ctx, cfg, res); err != nil {
+					return err
+				}
+				ok = true
+			}
+		}
+		return nil
+	}()
+
+	if err != nil {
+		ce, ok := err.(*checkError)
+		if !ok {
+			ce = &checkError{stageHandshake, err}
+		}
+		//the deadlines of the connections are the one of ctx and may expire before ctx reports it
+		if ne, ok := ce.err.(net.Error); ctx.Err() != nil || (ok && ne.Timeout()) {
+			ce.stage = stageTimeout
+		}
+		res.Failure, res.Error = ce.stage, ce.err.Error()
+		return res
+	}
+	res.OK = true
+	return res
+}
+
+//runCheckMode checks cfg.target or s served on an ephemeral port if it's empty, it prints the
+//verdict to stdout and returns the exit code
+func runCheckMode(s *socks5.Server, cfg checkConfig) int {
+	if cfg.target == "" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Printf("unable to start the server: %v", err)
+			return 1
+		}
+		go s.Serve(l)
+		defer s.Close()
+		cfg.target = l.Addr().String()
+	}
+
+	res := runCheck(cfg)
+	json.NewEncoder(os.Stdout).Encode(res)
+	if !res.OK {
+		return 1
+	}
+	return 0
+}
+
+//checkRequest connects to the proxy, authenticates and sends cmd for dst recording the stages
+//that succeeded in res. The connection has the deadline of ctx
+func checkRequest(ctx context.Context, cfg checkConfig, res *checkResult, cmd socks5.Command, dst string) (net.Conn, *socks5.SocksAddr, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", cfg.target)
+	if err != nil {
+		return nil, nil, &checkError{stageConnect, err}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	addr, err := checkHandshake(c, cfg, res, cmd, dst)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, addr, nil
+}
+
+func checkHandshake(c net.Conn, cfg checkConfig, res *checkResult, cmd socks5.Command, dst string) (*socks5.SocksAddr, error) {
+	const (
+		noAuth       = 0x00
+		userPassAuth = 0x02
+	)
+	methods := []byte{noAuth}
+	if cfg.username != "" || cfg.password != "" {
+		methods = append(methods, userPassAuth)
+	}
+	if _, err := c.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return nil, &checkError{stageHandshake, err}
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, &checkError{stageHandshake, err}
+	}
+	if b[0] != 5 {
+		return nil, &checkError{stageHandshake, socks5.ErrInvalidSocksVer}
+	}
+	res.Handshake = true
+	if bytes.IndexByte(methods, b[1]) == -1 {
+		return nil, &checkError{stageAuth, socks5.ErrNoAcceptableMethod}
+	}
+
+	if b[1] == userPassAuth {
+		if len(cfg.username) > 255 || len(cfg.password) > 255 {
+			return nil, &checkError{stageAuth, errors.New("credentials too long")}
+		}
+		req := append([]byte{1, byte(len(cfg.username))}, cfg.username...)
+		req = append(append(req, byte(len(cfg.password))), cfg.password...)
+		if _, err := c.Write(req); err != nil {
+			return nil, &checkError{stageAuth, err}
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return nil, &checkError{stageAuth, err}
+		}
+		if b[1] != 0 {
+			return nil, &checkError{stageAuth, socks5.ErrAuthFailed}
+		}
+	}
+	res.Auth = true
+
+	stage := stageDial
+	switch cmd {
+	case socks5.CommandBind:
+		stage = stageBind
+	case socks5.CommandUDPAssociation:
+		stage = stageUDP
+	}
+	addr, err := socks5.ParseAddr(dst)
+	if err != nil {
+		return nil, &checkError{stage, err}
+	}
+	req, err := addr.AppendTo([]byte{5, byte(cmd), 0})
+	if err != nil {
+		return nil, &checkError{stage, err}
+	}
+	if _, err := c.Write(req); err != nil {
+		return nil, &checkError{stage, err}
+	}
+	bound, err := checkReply(c)
+	if err != nil {
+		return nil, &checkError{stage, err}
+	}
+	return bound, nil
+}
+
+//checkReply reads a reply and returns its address
+func checkReply(r io.Reader) (*socks5.SocksAddr, error) {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[0] != 5 {
+		return nil, socks5.ErrInvalidSocksVer
+	}
+	if b[1] != 0 {
+		return nil, fmt.Errorf("reply code %d", b[1])
+	}
+	return socks5.UnmarshalFrom(r)
+}
+
+//checkEcho writes the payload to w and expects it back from r
+func checkEcho(w io.Writer, r io.Reader) error {
+	if _, err := w.Write(checkPayload); err != nil {
+		return err
+	}
+	b := make([]byte, len(checkPayload))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	if !bytes.Equal(b, checkPayload) {
+		return fmt.Errorf("expected %q got %q", checkPayload, b)
+	}
+	return nil
+}
+
+//checkBind has the proxy accept a connection from the check and relays the payload over it
+func checkBind(ctx context.Context, cfg checkConfig, res *checkResult) error {
+	c, bound, err := checkRequest(ctx, cfg, res, socks5.CommandBind, "0.0.0.0:0")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var d net.Dialer
+	peer, err := d.DialContext(ctx, "tcp", reachableAddr(bound.String(), cfg.target))
+	if err != nil {
+		return &checkError{stageBind, err}
+	}
+	defer peer.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		peer.SetDeadline(deadline)
+	}
+	if _, err := checkReply(c); err != nil {
+		return &checkError{stageBind, err}
+	}
+	if err := checkEcho(peer, c); err != nil {
+		return &checkError{stageBind, err}
+	}
+	return nil
+}
+
+//checkUDP relays a datagram to a local UDP echo server through an association
+func checkUDP(ctx context.Context, cfg checkConfig, res *checkResult) error {
+	echo, err := listenUDPEcho()
+	if err != nil {
+		return &checkError{stageUDP, err}
+	}
+	defer echo.Close()
+
+	c, relay, err := checkRequest(ctx, cfg, res, socks5.CommandUDPAssociation, "0.0.0.0:0")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	u, err := net.Dial("udp", reachableAddr(relay.String(), cfg.target))
+	if err != nil {
+		return &checkError{stageUDP, err}
+	}
+	defer u.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		u.SetDeadline(deadline)
+	}
+
+	dst, err := socks5.ParseAddr(echo.LocalAddr().String())
+	if err != nil {
+		return &checkError{stageUDP, err}
+	}
+	hdr, err := dst.AppendTo([]byte{0, 0, 0})
+	if err != nil {
+		return &checkError{stageUDP, err}
+	}
+	if _, err := u.Write(append(hdr, checkPayload...)); err != nil {
+		return &checkError{stageUDP, err}
+	}
+	b := make([]byte, 512)
+	n, err := u.Read(b)
+	if err != nil {
+		return &checkError{stageUDP, err}
+	}
+	if n < len(hdr) || !bytes.Equal(b[len(hdr):n], checkPayload) {
+		return &checkError{stageUDP, fmt.Errorf("unexpected datagram % x", b[:n])}
+	}
+	return nil
+}
+
+//reachableAddr replaces an unspecified host of addr by the host of the proxy
+func reachableAddr(addr, proxy string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		if h, _, err := net.SplitHostPort(proxy); err == nil {
+			host = h
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+//listenEcho starts a TCP echo server on the loopback interface
+func listenEcho() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l, nil
+}
+
+//listenUDPEcho starts a UDP echo server on the loopback interface
+func listenUDPEcho() (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	return pc, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func TestCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := []socks5.Command{socks5.CommandConnect, socks5.CommandBind, socks5.CommandUDPAssociation}
+	s := &socks5.Server{Cmds: cmds}
+	socks5.WithAuth("user", "secret")(s)
+	go s.Serve(l)
+	defer s.Close()
+
+	//a server that accepts and never answers
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	proxy := l.Addr().String()
+	yes := true
+	tts := []struct {
+		name     string
+		cfg      checkConfig
+		expected checkResult
+	}{
+		{"ok", checkConfig{target: proxy, username: "user", password: "secret", cmds: cmds},
+			checkResult{OK: true, Handshake: true, Auth: true, Dial: true, Bind: &yes, UDP: &yes}},
+		{"wrong password", checkConfig{target: proxy, username: "user", password: "wrong", cmds: cmds},
+			checkResult{Handshake: true, Failure: stageAuth, Error: socks5.ErrAuthFailed.Error()}},
+		{"no credentials", checkConfig{target: proxy},
+			checkResult{Handshake: true, Failure: stageAuth, Error: socks5.ErrNoAcceptableMethod.Error()}},
+		{"unreachable probe", checkConfig{target: proxy, username: "user", password: "secret", probe: closedAddr},
+			checkResult{Handshake: true, Auth: true, Failure: stageDial, Error: "reply code 4"}},
+		{"no proxy", checkConfig{target: closedAddr},
+			checkResult{Failure: stageConnect}},
+		{"silent proxy", checkConfig{target: silent.Addr().String(), timeout: 100 * time.Millisecond},
+			checkResult{Failure: stageTimeout}},
+	}
+	for _, tt := range tts {
+		if tt.cfg.timeout == 0 {
+			tt.cfg.timeout = 5 * time.Second
+		}
+		res := runCheck(tt.cfg)
+		if res.Target != tt.cfg.target {
+			t.Errorf("%s: expected the target %s got %s", tt.name, tt.cfg.target, res.Target)
+		}
+		if res.OK != tt.expected.OK || res.Handshake != tt.expected.Handshake || res.Auth != tt.expected.Auth ||
+			res.Dial != tt.expected.Dial || !sameProbe(res.Bind, tt.expected.Bind) || !sameProbe(res.UDP, tt.expected.UDP) ||
+			res.Failure != tt.expected.Failure || (tt.expected.Error != "" && res.Error != tt.expected.Error) {
+			t.Errorf("%s: expected %+v got %+v", tt.name, tt.expected, res)
+		}
+		if res.OK && res.LatencyMS <= 0 {
+			t.Errorf("%s: expected a latency got %v", tt.name, res.LatencyMS)
+		}
+	}
+}
+
+func sameProbe(a, b *bool) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
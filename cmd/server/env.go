@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//envPrefix is the prefix of the environment variables setting the flags
+const envPrefix = "SOCKS5_"
+
+//envName returns the environment variable of the flag name e.g. SOCKS5_USERS_FILE for -users-file
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+//setFromEnv sets the flags of fs that weren't set on the command line from their environment
+//variable. The variable with a _FILE suffix names a file the value is read from instead, for
+//secrets mounted as files, unless it's the variable of another flag
+func setFromEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		//NAME_FILE is the variable of the flag name-file if there's one e.g. -password-file
+		path, fromFile := os.LookupEnv(name + "_FILE")
+		if fromFile && fs.Lookup(f.Name+"-file") == nil {
+			if ok {
+				err = fmt.Errorf("%s and %s_FILE can't be used together", name, name)
+				return
+			}
+			b, rerr := ioutil.ReadFile(path)
+			if rerr != nil {
+				err = fmt.Errorf("%s_FILE: %v", name, rerr)
+				return
+			}
+			name, value, ok = name+"_FILE", strings.TrimRight(string(b), "\r\n"), true
+		}
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("%s: %v", name, serr)
+		}
+	})
+	return err
+}
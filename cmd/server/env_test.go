@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func TestEnvName(t *testing.T) {
+	tts := []struct {
+		flag, env string
+	}{
+		{"addr", "SOCKS5_ADDR"},
+		{"users-file", "SOCKS5_USERS_FILE"},
+		{"drain-timeout", "SOCKS5_DRAIN_TIMEOUT"},
+	}
+	for _, tt := range tts {
+		if got := envName(tt.flag); got != tt.env {
+			t.Errorf("%s: expected %s got %s", tt.flag, tt.env, got)
+		}
+	}
+}
+
+func TestSetFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(secret, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tts := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		addr     string
+		password string
+		drain    time.Duration
+		upnp     bool
+		err      string
+	}{
+		{"defaults", nil, nil, ":5555", "", 30 * time.Second, false, ""},
+		{"env", nil, map[string]string{
+			"SOCKS5_ADDR":          "127.0.0.1:1080",
+			"SOCKS5_PASSWORD":      "from-env",
+			"SOCKS5_DRAIN_TIMEOUT": "5s",
+			"SOCKS5_UPNP":          "true",
+		}, "127.0.0.1:1080", "from-env", 5 * time.Second, true, ""},
+		{"flags over env", []string{"-addr", ":1081", "-password", "from-flag", "-upnp=false"}, map[string]string{
+			"SOCKS5_ADDR":     "127.0.0.1:1080",
+			"SOCKS5_PASSWORD": "from-env",
+			"SOCKS5_UPNP":     "true",
+		}, ":1081", "from-flag", 30 * time.Second, false, ""},
+		{"file", nil, map[string]string{"SOCKS5_PASSWORD_FILE": secret}, ":5555", "from-file", 30 * time.Second, false, ""},
+		{"flags over file", []string{"-password", "from-flag"}, map[string]string{"SOCKS5_PASSWORD_FILE": secret},
+			":5555", "from-flag", 30 * time.Second, false, ""},
+		{"env and file", nil, map[string]string{"SOCKS5_PASSWORD": "from-env", "SOCKS5_PASSWORD_FILE": secret},
+			"", "", 0, false, "SOCKS5_PASSWORD and SOCKS5_PASSWORD_FILE can't be used together"},
+		{"missing file", nil, map[string]string{"SOCKS5_PASSWORD_FILE": filepath.Join(dir, "missing")},
+			"", "", 0, false, "SOCKS5_PASSWORD_FILE: open"},
+		{"invalid value", nil, map[string]string{"SOCKS5_DRAIN_TIMEOUT": "soon"},
+			"", "", 0, false, "SOCKS5_DRAIN_TIMEOUT: "},
+	}
+	for _, tt := range tts {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				defer setenv(k, v)()
+			}
+			fs := flag.NewFlagSet("socks5-server", flag.ContinueOnError)
+			addr := fs.String("addr", ":5555", "")
+			password := fs.String("password", "", "")
+			drain := fs.Duration("drain-timeout", 30*time.Second, "")
+			upnp := fs.Bool("upnp", false, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := setFromEnv(fs)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected %q got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *addr != tt.addr || *password != tt.password || *drain != tt.drain || *upnp != tt.upnp {
+				t.Errorf("expected %q %q %v %v got %q %q %v %v", tt.addr, tt.password, tt.drain, tt.upnp,
+					*addr, *password, *drain, *upnp)
+			}
+		})
+	}
+}
+
+//setenv sets the variable k to v, the returned function restores it
+func setenv(k, v string) func() {
+	old, ok := os.LookupEnv(k)
+	os.Setenv(k, v)
+	return func() {
+		if ok {
+			os.Setenv(k, old)
+		} else {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestParseCommands(t *testing.T) {
+	cmds, err := parseCommands("connect, bind,udp-associate")
+	expected := []socks5.Command{socks5.CommandConnect, socks5.CommandBind, socks5.CommandUDPAssociation}
+	if err != nil || !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("expected %v got %v %v", expected, cmds, err)
+	}
+	if _, err := parseCommands("connect,socks4"); err == nil || !strings.Contains(err.Error(), `"socks4"`) {
+		t.Errorf("expected an unknown command error got %v", err)
+	}
+}
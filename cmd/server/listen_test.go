@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func TestListen(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	s := &socks5.Server{Cmds: []socks5.Command{socks5.CommandConnect}, Dialer: new(net.Dialer)}
+	ls, err := listen(s, []string{"127.0.0.1:0", " 127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 2 {
+		t.Fatalf("expected 2 listeners got %d", len(ls))
+	}
+	done := make(chan error)
+	go func() {
+		done <- s.ServeAll(ls...)
+	}()
+
+	for _, l := range ls {
+		c, err := socks5.NewClient(l.Addr().String()).Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %v", l.Addr(), err)
+		}
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Fatalf("%s: expected hello got %q %v", l.Addr(), b, err)
+		}
+		c.Close()
+	}
+
+	s.Close()
+	if err := <-done; err != socks5.ErrServerClosed {
+		t.Errorf("expected %v got %v", socks5.ErrServerClosed, err)
+	}
+}
+
+func TestListenFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	s := &socks5.Server{}
+	_, err = listen(s, []string{freeAddr, busy.Addr().String()})
+	if err == nil || !strings.Contains(err.Error(), busy.Addr().String()) {
+		t.Fatalf("expected an error naming %s got %v", busy.Addr(), err)
+	}
+	//the addresses bound before the failure are released
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestWriteReadyFile(t *testing.T) {
+	s := &socks5.Server{}
+	ls, err := s.ListenAll("127.0.0.1:0", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range ls {
+		defer l.Close()
+	}
+
+	dir, err := ioutil.TempDir("", "ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ready")
+	if err := writeReadyFile(path, ls); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ls[0].Addr().String() + "\n" + ls[1].Addr().String() + "\n"
+	if string(b) != want {
+		t.Errorf("expected %q got %q", want, b)
+	}
+	//only the ready file is left behind
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 1 {
+		t.Errorf("expected only the ready file got %d files", len(fis))
+	}
+}
@@ -1,48 +1,683 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	igd "github.com/abdullah2993/go-fwdlistener"
 	"github.com/abdullah2993/socks5-server/socks5"
+	"github.com/abdullah2993/socks5-server/socks5/mdns"
+	"github.com/abdullah2993/socks5-server/socks5/portmap"
+	"github.com/abdullah2993/socks5-server/socks5/stun"
+	"golang.org/x/crypto/bcrypt"
 )
 
+//dialFailCacheEntries is the most destinations -dial-fail-cache remembers
+const dialFailCacheEntries = 10000
+
 func init() {
 	log.SetFlags(log.LstdFlags | log.Llongfile)
 }
 
 func main() {
-	var addr, user, pass, host string
-	var upnp bool
+	var (
+		//listening
+		addr, commands, host, reverse, readyFile string
+		transparentAddr                          string
+		tproxy, fastOpen                         bool
+		listenRetries                            int
+
+		//authentication and rules
+		user, usersFile, aclFile     string
+		insecureUsersFile, aclDryRun bool
+		bcryptCost                   int
+		pf                           passwordFlags
+		tf                           tlsFlags
+
+		//address discovery and advertising
+		stunServers, portMapping, mdnsName, pacAddr, pacDirect string
+		upnp, pacSOCKS4                                        bool
+
+		//logging and observability
+		accessLog, accessLogFormat, accountingSpec, logLevel string
+		redactClient, redactDestination, redactKeyFile       string
+		metricsAddr, adminToken, mirrorAddr                  string
+
+		//sessions
+		nat64Prefix                           string
+		dnsIntercept                          bool
+		drainTimeout, idleExit, dialFailCache time.Duration
+		tarpitHold                            time.Duration
+		tarpitMax                             int
+
+		//the check mode
+		check                   bool
+		checkTarget, checkProbe string
+		checkTimeout            time.Duration
 
-	flag.StringVar(&addr, "addr", ":5555", "port to listen on")
+		//privileges and the windows service
+		runAsUser, runAsGroup, chroot               string
+		serviceCmd, serviceName, serviceDescription string
+	)
+
+	flag.StringVar(&addr, "addr", ":5555", "comma separated addresses to listen on, use unix:/path/to/socket for a unix socket")
+	flag.StringVar(&commands, "commands", "connect", "comma separated commands to enable: connect, bind and udp-associate")
 	flag.StringVar(&user, "username", "", "username for authentication")
-	flag.StringVar(&pass, "password", "", "password for authentication")
+	flag.StringVar(&pf.password, "password", "", "password for authentication, deprecated as it's visible in the process list")
+	flag.StringVar(&pf.file, "password-file", "", "file holding the password for authentication")
+	flag.BoolVar(&pf.stdin, "password-stdin", false, "read the password for authentication from the first line of stdin")
+	flag.StringVar(&usersFile, "users-file", "", "file of username:secret lines for authentication, the secret is a password or a bcrypt or argon2 hash, reloaded on SIGHUP")
+	flag.IntVar(&bcryptCost, "bcrypt-cost", bcrypt.DefaultCost, "cost of the bcrypt hashes written by the user add command")
+	flag.StringVar(&aclFile, "acl", "", "file of allow and deny rules for the requests, reloaded on SIGHUP")
+	flag.BoolVar(&aclDryRun, "acl-dry-run", false, "serve the requests -acl denies, logging them and counting them by rule in socks5_would_deny_total")
+	flag.BoolVar(&insecureUsersFile, "users-file-insecure", false, "allow a -users-file readable by everyone")
 	flag.StringVar(&host, "host", "", "host used for incomming connections")
-	flag.BoolVar(&upnp, "upnp", false, "use upnp")
+	flag.BoolVar(&upnp, "upnp", false, "use upnp, same as -portmap upnp")
+	flag.StringVar(&portMapping, "portmap", "", "port mapping protocol used for bind and udp: upnp, natpmp, pcp or auto, the last three find the gateway on linux only")
+	flag.StringVar(&stunServers, "stun", "", "comma separated STUN servers used to discover the public address instead of -host")
+	flag.StringVar(&mdnsName, "mdns", "", "advertise the proxy on the local network with mDNS under this instance name")
+	flag.StringVar(&pacAddr, "pac-addr", "", "address to serve /proxy.pac and /wpad.dat on")
+	flag.StringVar(&pacDirect, "pac-direct", "", "comma separated domains and CIDRs the PAC sends directly instead of through the proxy")
+	flag.BoolVar(&pacSOCKS4, "pac-socks4", false, "add a SOCKS entry to the PAC for browsers without SOCKS5 support")
+	flag.StringVar(&accessLog, "access-log", "", "file to write a record of every session to, - for stdout")
+	flag.StringVar(&accessLogFormat, "access-log-format", "jsonl", "format of the access log: jsonl or cef")
+	flag.StringVar(&accountingSpec, "accounting", "", "store of the transfer totals of the users surviving restarts: csv:path or sqlite:path")
+	flag.StringVar(&redactClient, "redact-client", "none", "redaction of client addresses in logs: none, drop, prefix or hash")
+	flag.StringVar(&redactDestination, "redact-destination", "none", "redaction of destinations in logs: none, drop, prefix or hash")
+	flag.StringVar(&redactKeyFile, "redact-key-file", "", "file holding the HMAC key of the hash redaction")
+	flag.StringVar(&logLevel, "log-level", "info", "least severe level logged: trace, debug, info or error, trace dumps handshakes unless redacting")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "how long active sessions are waited for on SIGINT or SIGTERM before they're closed")
+	flag.DurationVar(&dialFailCache, "dial-fail-cache", 0, "how long a destination that refused or was unreachable is replied the same failure without being dialed again, disabled if 0")
+	flag.DurationVar(&idleExit, "idle-exit", 0, "exit with 0 once no session was active for this long e.g. when started by socket activation, disabled if 0")
+	flag.StringVar(&serviceCmd, "service", "", "install, uninstall, start or stop the windows service running the server with the other flags")
+	flag.StringVar(&serviceName, "service-name", "socks5-server", "name of the windows service")
+	flag.StringVar(&serviceDescription, "service-description", "SOCKS5 proxy server", "description of the windows service")
+	flag.StringVar(&tf.certFile, "tls-cert", "", "PEM certificate file to serve over TLS with -tls-key, reloaded on SIGHUP")
+	flag.StringVar(&tf.keyFile, "tls-key", "", "PEM key file of -tls-cert")
+	flag.DurationVar(&tf.reloadInterval, "tls-reload-interval", time.Minute, "how often -tls-cert and -tls-key are checked for changes and reloaded once they changed, disabled if 0")
+	flag.StringVar(&tf.acmeDomains, "acme-domain", "", "comma separated domains to serve over TLS with a certificate obtained and renewed from Let's Encrypt")
+	flag.StringVar(&tf.acmeCache, "acme-cache", "acme-cache", "directory the ACME certificates are cached in")
+	flag.StringVar(&tf.acmeHTTPAddr, "acme-http-addr", "", "address to answer ACME HTTP-01 challenges on, e.g. :80 when not listening on port 443")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address to serve /metrics and /healthz on")
+	flag.StringVar(&mirrorAddr, "mirror", "", "address of a collector, host:port or unix:/path, the relayed streams are copied to live as length-prefixed frames")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token of the admin handler served under /admin on -metrics-addr, it's disabled if empty")
+	flag.BoolVar(&check, "check", false, "check the configuration by dialing through it, print a JSON verdict and exit non-zero on failure")
+	flag.StringVar(&checkTarget, "check-target", "", "address of a running server to check instead of starting one on an ephemeral port")
+	flag.StringVar(&checkProbe, "check-probe", "", "host:port of a TCP echo server the check connects to, a local one if empty")
+	flag.DurationVar(&checkTimeout, "check-timeout", 10*time.Second, "how long the check may take")
+	flag.IntVar(&listenRetries, "listen-retries", 0, "attempts to listen again on an address whose listener failed before exiting, disabled if 0")
+	flag.StringVar(&readyFile, "ready-file", "", "file the bound addresses are written to, one per line, once the server accepts connections")
+	flag.StringVar(&nat64Prefix, "nat64", "", "IPv6 prefix of the NAT64 the IPv4 destinations are reached through when the host has no IPv4 route e.g. 64:ff9b::/96, or auto to discover it with ipv4only.arpa")
+	flag.BoolVar(&fastOpen, "tcp-fastopen", false, "enable TCP Fast Open on the listeners and on the connections to the targets, linux only")
+	flag.BoolVar(&dnsIntercept, "dns-intercept", false, "answer the A and AAAA queries sent to port 53 through udp associations instead of relaying them, the domains -acl denies are refused")
+	flag.StringVar(&transparentAddr, "transparent-addr", "", "address to accept connections redirected by iptables REDIRECT rules on and relay them to their original destination, linux only")
+	flag.BoolVar(&tproxy, "tproxy", false, "accept the connections of iptables TPROXY rules on -transparent-addr instead of REDIRECT ones, requires CAP_NET_ADMIN")
+	flag.StringVar(&runAsUser, "run-as-user", "", "user to switch to once the addresses are bound, not supported on windows")
+	flag.StringVar(&runAsGroup, "run-as-group", "", "group to switch to once the addresses are bound, the primary group of -run-as-user if empty")
+	flag.StringVar(&chroot, "chroot", "", "directory to make the root of the file system once the addresses are bound, the reloaded files are read relative to it")
+	flag.DurationVar(&tarpitHold, "tarpit-hold", 0, "how long banned clients, clients -acl denies and clients not speaking SOCKS5 are held instead of closed, disabled if 0")
+	flag.IntVar(&tarpitMax, "tarpit-max", 100, "most connections held by -tarpit-hold at once, the others are closed")
+	flag.StringVar(&reverse, "reverse", "", "dial out to the rendezvous host:port and serve over it instead of listening")
 
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		pf.onCommandLine = pf.onCommandLine || f.Name == "password"
+	})
+	//the flags not on the command line are taken from the environment e.g. SOCKS5_ADDR
+	if err := setFromEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+
+	if serviceCmd != "" {
+		if err := controlService(serviceCmd, serviceName, serviceDescription, serviceArgs(os.Args[1:])); err != nil {
+			log.Fatalf("unable to %s the service: %v", serviceCmd, err)
+		}
+		return
+	}
+	if flag.Arg(0) == "bench" {
+		os.Exit(runBenchCommand(flag.Args()[1:], os.Stdout))
+	}
+	if flag.Arg(0) == "user" {
+		c := &userCommand{usersFile: usersFile, cost: bcryptCost, password: &pf, stdin: os.Stdin, ask: terminalPrompt(), out: os.Stdout}
+		if err := c.run(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	asService := inService()
+	//eventLog is closed explicitly as os.Exit skips deferred calls
+	var eventLog io.Closer
+	if asService {
+		l, err := startEventLog(serviceName)
+		if err != nil {
+			log.Printf("unable to log to the event log: %v", err)
+		}
+		eventLog = l
+	}
 
 	opts := []socks5.Option{}
+	//accessLogFile is closed explicitly as os.Exit skips deferred calls
+	var accessLogFile io.Closer
 
-	var err error
+	//the password is prompted for on the terminal when -username has none
+	var prompt func() (string, error)
+	if ask := terminalPrompt(); ask != nil && (usersFile == "" || check) {
+		prompt = func() (string, error) {
+			return ask("password for " + user + ": ")
+		}
+	}
+	pass, err := pf.resolve(user, os.Stdin, prompt)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if user != "" || pass != "" {
 		opts = append(opts, socks5.WithAuth(user, pass))
 	}
 
+	//the check authenticates with -username and -password against the users of -users-file
+	if usersFile != "" && (user != "" || pass != "") && !check {
+		log.Fatalf("-users-file and -username can't be used together")
+	}
+
+	if readyFile != "" && reverse != "" {
+		log.Fatalf("-ready-file can't be used with -reverse")
+	}
+
+	if adminToken != "" && metricsAddr == "" {
+		log.Fatalf("-admin-token requires -metrics-addr")
+	}
+
+	tlsConf, err := tf.setup()
+	if err != nil {
+		log.Fatalf("unable to set up tls: %v", err)
+	}
+	if tlsConf.config != nil {
+		if reverse != "" {
+			log.Fatalf("tls can't be used with -reverse")
+		}
+		opts = append(opts, socks5.WithTLS(tlsConf.config))
+		if tlsConf.certs != nil {
+			opts = append(opts, socks5.WithCertReloader(tlsConf.certs))
+		}
+	}
+
+	level, err := parseLevel(logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts = append(opts, socks5.WithLogger(socks5.StdLogger(nil), level))
+
+	if host != "" && stunServers != "" {
+		log.Fatalf("-host and -stun can't be used together")
+	}
+
 	if host != "" {
 		opts = append(opts, socks5.WithAddrProvider(HostAddrProvider(host)))
 	}
 
+	if stunServers != "" {
+		d := stun.New(strings.Split(stunServers, ",")...)
+		d.Logger = levelLogger(socks5.StdLogger(nil), level)
+		go d.Run(context.Background())
+		opts = append(opts, socks5.WithAddrProvider(d.AddrProvider()))
+	}
+
 	if upnp {
-		opts = append(opts, socks5.WithListener(igd.Listen), socks5.WithPacketListener(igd.ListenPacket))
+		portMapping = "upnp"
+	}
+
+	var mapper *portmap.PortMapper
+	switch portMapping {
+	case "":
+	case "upnp", "natpmp", "pcp", "auto":
+		mapper = portmap.New(portMapper(portMapping))
+		opts = append(opts, socks5.WithListener(mapper.Listen), socks5.WithPacketListener(mapper.ListenPacket))
+	default:
+		log.Fatalf("unknown port mapping protocol %q", portMapping)
+	}
+
+	if accessLog != "" {
+		w, err := accessLogWriter(accessLog)
+		if err != nil {
+			log.Fatalf("unable to open the access log: %v", err)
+		}
+		accessLogFile = w
+		format := socks5.JSONLines
+		switch accessLogFormat {
+		case "jsonl":
+		case "cef":
+			format = socks5.CEF
+		default:
+			log.Fatalf("unknown access log format %q", accessLogFormat)
+		}
+		opts = append(opts, socks5.WithAccessLog(w, format))
+	}
+
+	if accountingSpec != "" {
+		a, err := openAccounting(accountingSpec)
+		if err != nil {
+			log.Fatalf("unable to open the accounting: %v", err)
+		}
+		opts = append(opts, socks5.WithAccounting(a))
+	}
+
+	if redactClient != "none" || redactDestination != "none" {
+		policy, err := redactionPolicy(redactClient, redactDestination, redactKeyFile)
+		if err != nil {
+			log.Fatalf("invalid redaction: %v", err)
+		}
+		opts = append(opts, socks5.WithRedaction(policy))
+	}
+
+	if aclDryRun {
+		opts = append(opts, socks5.WithRuleDryRun(true))
+	}
+	if mirrorAddr != "" {
+		opts = append(opts, socks5.WithMirror(mirrorAddr, nil))
+	}
+	if fastOpen {
+		opts = append(opts, socks5.WithTCPFastOpen(true, true))
+	}
+	if dnsIntercept {
+		opts = append(opts, socks5.WithDNSInterception(true))
+	}
+	if nat64Prefix != "" {
+		prefix, err := parseNAT64(nat64Prefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, socks5.WithNAT64Prefix(prefix, false))
+	}
+
+	if dialFailCache > 0 {
+		opts = append(opts, socks5.WithNegativeDialCache(dialFailCache, dialFailCacheEntries))
+	}
+
+	if listenRetries > 0 {
+		opts = append(opts, socks5.WithListenerRecovery(listenRetries, time.Second))
+	}
+
+	if idleExit > 0 {
+		opts = append(opts, socks5.WithIdleShutdown(idleExit))
+	}
+
+	if tarpitHold > 0 {
+		opts = append(opts, socks5.WithTarpit(tarpitHold, tarpitMax))
+	}
+
+	addrs := strings.Split(addr, ",")
+	cmds, err := parseCommands(commands)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := socks5.NewServer(addrs[0], append(opts, socks5.WithCommands(cmds...))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := &reloader{s: s, usersFile: usersFile, insecureUsersFile: insecureUsersFile, aclFile: aclFile, tls: tlsConf.certs != nil}
+	if err := r.load(); err != nil {
+		log.Fatalf("unable to load the configuration: %v", err)
+	}
+	if check {
+		os.Exit(runCheckMode(s, checkConfig{
+			target:   checkTarget,
+			username: user,
+			password: pass,
+			probe:    checkProbe,
+			cmds:     s.Cmds,
+			timeout:  checkTimeout,
+		}))
+	}
+
+	reload := make(chan os.Signal, 1)
+	notifyReload(reload)
+	go r.handle(reload)
+
+	if metricsAddr != "" {
+		if err := checkMetricsAddr(metricsAddr, addrs); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if tproxy && transparentAddr == "" {
+		log.Fatal("-tproxy requires -transparent-addr")
+	}
+
+	//every address is bound before serving so a busy port fails the start, and before the
+	//privileges are dropped so they can be privileged ports
+	var listeners []net.Listener
+	var pacListener, metricsListener, acmeListener, transparentListener net.Listener
+	mdnsAddr := addrs[0]
+	id := identity{user: runAsUser, group: runAsGroup, chroot: chroot}
+	err = bindThenDrop(newDropper(), id, []string{usersFile, aclFile, tf.certFile, tf.keyFile}, func() error {
+		var err error
+		if reverse == "" {
+			if listeners, err = listen(s, addrs); err != nil {
+				return err
+			}
+			mdnsAddr = listeners[0].Addr().String()
+		}
+		if transparentAddr != "" {
+			listen := net.Listen
+			if tproxy {
+				listen = socks5.ListenTProxy
+			}
+			if transparentListener, err = listen("tcp", transparentAddr); err != nil {
+				return fmt.Errorf("unable to accept transparent connections: %v", err)
+			}
+			log.Printf("accepting transparent connections on %s", transparentListener.Addr())
+		}
+		if pacAddr != "" {
+			if pacListener, err = net.Listen("tcp", pacAddr); err != nil {
+				return fmt.Errorf("unable to serve the pac: %v", err)
+			}
+		}
+		if metricsAddr != "" {
+			if metricsListener, err = net.Listen("tcp", metricsAddr); err != nil {
+				return fmt.Errorf("unable to serve metrics: %v", err)
+			}
+		}
+		if tlsConf.acme != nil && tf.acmeHTTPAddr != "" {
+			if acmeListener, err = net.Listen("tcp", tf.acmeHTTPAddr); err != nil {
+				return fmt.Errorf("unable to answer acme challenges: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if pacListener != nil {
+		var direct []string
+		if pacDirect != "" {
+			direct = strings.Split(pacDirect, ",")
+		}
+		h := s.PACHandler(direct...)
+		h.SOCKS4 = pacSOCKS4
+		go func() {
+			log.Fatalf("pac server failed: %v", http.Serve(pacListener, h))
+		}()
+	}
+
+	var metricsServer *http.Server
+	if metricsListener != nil {
+		log.Printf("serving metrics on http://%s/metrics", metricsListener.Addr())
+		metricsServer = &http.Server{Handler: metricsHandler(s, adminToken)}
+		go func() {
+			if err := metricsServer.Serve(metricsListener); err != http.ErrServerClosed {
+				log.Fatalf("metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	if acmeListener != nil {
+		go func() {
+			log.Fatalf("acme http server failed: %v", http.Serve(acmeListener, tlsConf.acme.HTTPHandler(nil)))
+		}()
+	}
+
+	var mdnsDone chan struct{}
+	ctx, cancel := context.WithCancel(context.Background())
+	if mdnsName != "" {
+		r, err := mdnsResponder(mdnsName, mdnsAddr, user != "" || pass != "" || usersFile != "")
+		if err != nil {
+			log.Fatalf("unable to advertise with mdns: %v", err)
+		}
+		mdnsDone = make(chan struct{})
+		go func() {
+			defer close(mdnsDone)
+			if err := r.Run(ctx); err != context.Canceled {
+				log.Printf("mdns advertisement failed: %v", err)
+			}
+		}()
+	}
+
+	if tlsConf.certs != nil && tf.reloadInterval > 0 {
+		go s.WatchTLS(ctx, tf.reloadInterval)
+	}
+
+	if readyFile != "" {
+		go func() {
+			<-s.Ready()
+			if err := writeReadyFile(readyFile, listeners); err != nil {
+				log.Fatalf("unable to write the ready file: %v", err)
+			}
+		}()
 	}
 
-	err = socks5.ListenAndServe(addr, opts...)
+	serve := func(ctx context.Context, force <-chan os.Signal) int {
+		return run(ctx, s, func() error {
+			if transparentListener != nil {
+				go func() {
+					if err := s.ServeTransparent(transparentListener); err != socks5.ErrServerClosed && err != socks5.ErrIdleShutdown {
+						log.Fatalf("transparent listener failed: %v", err)
+					}
+				}()
+			}
+			if reverse != "" {
+				return serveReverse(s, reverse)
+			}
+			return s.ServeAll(listeners...)
+		}, force, drainTimeout)
+	}
+	var code int
+	if asService {
+		code = runService(serviceName, drainTimeout, serve)
+	} else {
+		//the first signal drains the sessions, a second one closes them
+		sig := make(chan os.Signal, 2)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		ctx, stop := context.WithCancel(context.Background())
+		go func() {
+			<-sig
+			stop()
+		}()
+		code = serve(ctx, sig)
+	}
+
+	//the health check reports the drain until the sessions are over
+	if metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		metricsServer.Shutdown(ctx)
+		cancel()
+	}
 
-	log.Fatalf("server failed: %v", err)
+	//remove the mappings left by the sessions and the advertisement so they don't outlive the process
+	if mapper != nil {
+		mapper.Close()
+	}
+	cancel()
+	if mdnsDone != nil {
+		<-mdnsDone
+	}
+	if s.AccessLog != nil {
+		s.AccessLog.Close()
+	}
+	if accessLogFile != nil {
+		accessLogFile.Close()
+	}
+	if s.Accounting != nil {
+		s.Accounting.Close()
+	}
+	if readyFile != "" {
+		os.Remove(readyFile)
+	}
+	if eventLog != nil {
+		eventLog.Close()
+	}
+	os.Exit(code)
+}
+
+//listen binds s to every address of addrs and logs the addresses bound e.g. the port picked for
+//port 0, nothing is bound if one of them fails
+func listen(s *socks5.Server, addrs []string) ([]net.Listener, error) {
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	ls, err := s.ListenAll(addrs...)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range ls {
+		log.Printf("listening on %s", l.Addr())
+	}
+	return ls, nil
+}
+
+//writeReadyFile writes the addresses of ls to path one per line
+func writeReadyFile(path string, ls []net.Listener) error {
+	var b strings.Builder
+	for _, l := range ls {
+		fmt.Fprintln(&b, l.Addr())
+	}
+	return writeFileAtomic(path, []byte(b.String()), 0644)
+}
+
+//writeFileAtomic writes data to a temporary file renamed to path so path is never seen partially
+//written
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+//parseCommands parses the comma separated names of -commands
+func parseCommands(names string) ([]socks5.Command, error) {
+	known := make(map[string]socks5.Command)
+	for _, cmd := range []socks5.Command{socks5.CommandConnect, socks5.CommandBind, socks5.CommandUDPAssociation} {
+		known[cmd.String()] = cmd
+	}
+	var cmds []socks5.Command
+	for _, name := range strings.Split(names, ",") {
+		cmd, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown command %q, expected connect, bind or udp-associate", name)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+//accessLogWriter opens the -access-log file for appending
+func accessLogWriter(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+}
+
+//redactionPolicy returns the policy of the -redact flags
+func redactionPolicy(client, destination, keyFile string) (socks5.RedactionPolicy, error) {
+	var p socks5.RedactionPolicy
+	var err error
+	if p.Client, err = redaction(client); err != nil {
+		return p, err
+	}
+	if p.Destination, err = redaction(destination); err != nil {
+		return p, err
+	}
+	if p.Client == socks5.RedactHash || p.Destination == socks5.RedactHash {
+		if keyFile == "" {
+			return p, fmt.Errorf("the hash redaction requires -redact-key-file")
+		}
+		if p.Key, err = ioutil.ReadFile(keyFile); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+func redaction(name string) (socks5.Redaction, error) {
+	switch name {
+	case "none":
+		return socks5.RedactNone, nil
+	case "drop":
+		return socks5.RedactDrop, nil
+	case "prefix":
+		return socks5.RedactPrefix, nil
+	case "hash":
+		return socks5.RedactHash, nil
+	}
+	return 0, fmt.Errorf("unknown redaction %q", name)
+}
+
+//levelLogger returns a Logger dropping the messages of l below level
+func levelLogger(l socks5.Logger, level socks5.Level) socks5.Logger {
+	return socks5.LoggerFunc(func(lvl socks5.Level, msg string) {
+		if lvl >= level {
+			l.Log(lvl, msg)
+		}
+	})
+}
+
+//parseLevel returns the level of the -log-level flag
+func parseLevel(name string) (socks5.Level, error) {
+	for _, l := range []socks5.Level{socks5.LevelTrace, socks5.LevelDebug, socks5.LevelInfo, socks5.LevelError} {
+		if l.String() == name {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+//portMapper returns the port mapping protocol for the -portmap flag
+func portMapper(name string) portmap.Mapper {
+	switch name {
+	case "natpmp":
+		return new(portmap.NATPMP)
+	case "pcp":
+		return new(portmap.PCP)
+	case "upnp":
+		return new(portmap.UPnP)
+	default:
+		return new(portmap.Auto)
+	}
+}
+
+//mdnsResponder returns a responder advertising the port of addr as instance
+func mdnsResponder(instance, addr string, auth bool) (*mdns.Responder, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p == 0 {
+		return nil, fmt.Errorf("a fixed port is required, got %q", port)
+	}
+	return mdns.New(instance, p, "auth="+strconv.FormatBool(auth), "version=5"), nil
 }
 
 //HostAddrProvider is an adapter for address provider
@@ -55,3 +690,11 @@ func HostAddrProvider(host string) socks5.AddrProvider {
 		return net.JoinHostPort(host, port)
 	}
 }
+
+//serveReverse serves sessions over connections dialed to the rendezvous address
+func serveReverse(s *socks5.Server, rendezvous string) error {
+	var d net.Dialer
+	return s.ServeReverse(context.Background(), func(ctx context.Context) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", rendezvous)
+	}, socks5.WithReversePing(30*time.Second))
+}
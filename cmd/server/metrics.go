@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+//metricsHandler returns the handler of -metrics-addr serving /metrics, /healthz and, if token
+//isn't empty, the admin handler under /admin for requests with an Authorization: Bearer token
+//header
+func metricsHandler(s *socks5.Server, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.Accepting() {
+			http.Error(w, "not accepting", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if token != "" {
+		admin := http.StripPrefix("/admin", s.AdminHandler())
+		mux.Handle("/admin/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			const prefix = "Bearer "
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, prefix) ||
+				subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			admin.ServeHTTP(w, r)
+		}))
+	}
+	return mux
+}
+
+//checkMetricsAddr returns an error if the metrics address is one of the SOCKS addresses
+func checkMetricsAddr(metricsAddr string, addrs []string) error {
+	for _, addr := range addrs {
+		if sameAddr(metricsAddr, addr) {
+			return fmt.Errorf("-metrics-addr %s is the SOCKS address %s", metricsAddr, addr)
+		}
+	}
+	return nil
+}
+
+//sameAddr reports whether a and b are the same port of hosts that overlap, an empty or
+//unspecified host overlaps every host and port 0 is never the same
+func sameAddr(a, b string) bool {
+	ha, pa, errA := net.SplitHostPort(a)
+	hb, pb, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	if pa != pb || pa == "0" {
+		return false
+	}
+	return ha == hb || unspecifiedHost(ha) || unspecifiedHost(hb)
+}
+
+func unspecifiedHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
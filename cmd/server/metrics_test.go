@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5.Server{Cmds: []socks5.Command{socks5.CommandConnect}}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	defer s.Close()
+
+	srv := httptest.NewServer(metricsHandler(s, "token"))
+	defer srv.Close()
+
+	get := func(path, auth string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	//the listener is served once Serve tracks it
+	deadline := time.Now().Add(5 * time.Second)
+	for get("/healthz", "") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the server to be healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tts := []struct {
+		path, auth string
+		status     int
+	}{
+		{"/metrics", "", http.StatusOK},
+		{"/admin/sessions", "", http.StatusUnauthorized},
+		{"/admin/sessions", "Bearer wrong", http.StatusUnauthorized},
+		{"/admin/sessions", "token", http.StatusUnauthorized},
+		{"/admin/sessions", "Bearer token", http.StatusOK},
+		{"/unknown", "", http.StatusNotFound},
+	}
+	for _, tt := range tts {
+		if status := get(tt.path, tt.auth); status != tt.status {
+			t.Errorf("%s %q: expected %d got %d", tt.path, tt.auth, tt.status, status)
+		}
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if status := get("/healthz", ""); status != http.StatusServiceUnavailable {
+		t.Errorf("expected the drain to fail the health check got %d", status)
+	}
+
+	//without a token there's no admin handler
+	noAdmin := httptest.NewServer(metricsHandler(s, ""))
+	defer noAdmin.Close()
+	res, err := http.Get(noAdmin.URL + "/admin/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected no admin handler got %d", res.StatusCode)
+	}
+}
+
+func TestCheckMetricsAddr(t *testing.T) {
+	tts := []struct {
+		metrics string
+		addrs   []string
+		err     bool
+	}{
+		{":9090", []string{":5555"}, false},
+		{":5555", []string{":5555"}, true},
+		{"127.0.0.1:5555", []string{":5555"}, true},
+		{"127.0.0.1:5555", []string{"[::]:5555"}, true},
+		{"127.0.0.1:5555", []string{"10.0.0.1:5555"}, false},
+		{"127.0.0.1:5555", []string{"10.0.0.1:1080", "127.0.0.1:5555"}, true},
+		{"127.0.0.1:0", []string{"127.0.0.1:0"}, false},
+		{":5555", []string{"unix:/run/socks5.sock"}, false},
+	}
+	for _, tt := range tts {
+		err := checkMetricsAddr(tt.metrics, tt.addrs)
+		if (err != nil) != tt.err {
+			t.Errorf("%s %v: expected an error %v got %v", tt.metrics, tt.addrs, tt.err, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), tt.metrics) {
+			t.Errorf("expected the error to name %s got %v", tt.metrics, err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+//nat64DiscoveryTimeout is how long -nat64 auto waits for ipv4only.arpa to resolve
+const nat64DiscoveryTimeout = 5 * time.Second
+
+//parseNAT64 returns the prefix of the -nat64 flag, auto discovers it with ipv4only.arpa
+func parseNAT64(spec string) (*net.IPNet, error) {
+	if spec == "auto" {
+		ctx, cancel := context.WithTimeout(context.Background(), nat64DiscoveryTimeout)
+		defer cancel()
+		prefix, err := socks5.DiscoverNAT64Prefix(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("-nat64 auto: %v", err)
+		}
+		return prefix, nil
+	}
+	_, prefix, err := net.ParseCIDR(spec)
+	if err != nil {
+		return nil, fmt.Errorf("-nat64: %v", err)
+	}
+	if _, err := socks5.SynthesizeNAT64(prefix, net.IPv4zero); err != nil {
+		return nil, fmt.Errorf("-nat64 %s: %v", spec, err)
+	}
+	return prefix, nil
+}
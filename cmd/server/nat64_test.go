@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestParseNAT64(t *testing.T) {
+	tts := []struct {
+		spec   string
+		prefix string
+		err    string
+	}{
+		{"64:ff9b::/96", "64:ff9b::/96", ""},
+		{"2001:db8:122::/48", "2001:db8:122::/48", ""},
+		{"64:ff9b::", "", "-nat64: invalid CIDR address: 64:ff9b::"},
+		{"2001:db8::/33", "", "-nat64 2001:db8::/33: socks5: a NAT64 prefix is an IPv6 prefix of 32, 40, 48, 56, 64 or 96 bits"},
+		{"10.0.0.0/8", "", "-nat64 10.0.0.0/8: socks5: a NAT64 prefix is an IPv6 prefix of 32, 40, 48, 56, 64 or 96 bits"},
+	}
+	for _, tt := range tts {
+		prefix, err := parseNAT64(tt.spec)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: expected %q got %v", tt.spec, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || prefix.String() != tt.prefix {
+			t.Errorf("%s: expected %s got %v %v", tt.spec, tt.prefix, prefix, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+//passwordFlags are the sources of the password of -username
+type passwordFlags struct {
+	password string
+	//onCommandLine is set if -password was an argument rather than from the environment
+	onCommandLine bool
+	file          string
+	stdin         bool
+}
+
+//resolve returns the password of the source set, an error if more than one is. If none is,
+//username isn't empty and prompt isn't nil the password is prompted for
+func (f *passwordFlags) resolve(username string, stdin io.Reader, prompt func() (string, error)) (string, error) {
+	sources := 0
+	for _, set := range []bool{f.password != "", f.file != "", f.stdin} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", errors.New("-password, -password-file and -password-stdin can't be used together")
+	}
+
+	switch {
+	case f.password != "":
+		if f.onCommandLine {
+			log.Printf("warning: -password is deprecated as other users can see it in the process list, use -password-file or -password-stdin")
+		}
+		return f.password, nil
+	case f.file != "":
+		return readPasswordFile(f.file)
+	case f.stdin:
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("-password-stdin: %v", err)
+		}
+		if line = strings.TrimRight(line, "\r\n"); line == "" {
+			return "", errors.New("-password-stdin: no password on stdin")
+		}
+		return line, nil
+	case username != "" && prompt != nil:
+		return prompt()
+	}
+	return "", nil
+}
+
+//readPasswordFile reads the password of path without the trailing newline and warns if everyone
+//can read the file
+func readPasswordFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("-password-file: %v", err)
+	}
+	if fi, err := os.Stat(path); err == nil && readableByEveryone(fi) {
+		log.Printf("warning: -password-file %s is readable by everyone (mode %v)", path, fi.Mode().Perm())
+	}
+	password := strings.TrimRight(string(b), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("-password-file: %s is empty", path)
+	}
+	return password, nil
+}
+
+//terminalPrompt returns a function prompting for a password read from the terminal with the echo
+//disabled, it's nil if stdin isn't a terminal
+func terminalPrompt() func(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil
+	}
+	return func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the password: %v", err)
+		}
+		return string(b), nil
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolvePassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(file, []byte("from-file\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	prompt := func() (string, error) {
+		return "from-prompt", nil
+	}
+	tts := []struct {
+		name     string
+		flags    passwordFlags
+		username string
+		stdin    string
+		prompt   func() (string, error)
+		password string
+		err      string
+		warning  string
+	}{
+		{"none", passwordFlags{}, "", "", prompt, "", "", ""},
+		{"flag", passwordFlags{password: "from-flag", onCommandLine: true}, "alice", "", prompt, "from-flag", "", "-password is deprecated"},
+		{"env", passwordFlags{password: "from-env"}, "alice", "", prompt, "from-env", "", ""},
+		{"file", passwordFlags{file: file}, "alice", "", prompt, "from-file", "", ""},
+		{"missing file", passwordFlags{file: filepath.Join(dir, "missing")}, "alice", "", prompt, "", "-password-file: open", ""},
+		{"empty file", passwordFlags{file: empty}, "alice", "", prompt, "", "is empty", ""},
+		{"stdin", passwordFlags{stdin: true}, "alice", "from-stdin\nignored\n", prompt, "from-stdin", "", ""},
+		{"stdin without newline", passwordFlags{stdin: true}, "alice", "from-stdin", prompt, "from-stdin", "", ""},
+		{"empty stdin", passwordFlags{stdin: true}, "alice", "", prompt, "", "no password on stdin", ""},
+		{"prompt", passwordFlags{}, "alice", "", prompt, "from-prompt", "", ""},
+		{"no terminal", passwordFlags{}, "alice", "", nil, "", "", ""},
+		{"prompt failure", passwordFlags{}, "alice", "", func() (string, error) {
+			return "", errors.New("unable to read the password")
+		}, "", "unable to read the password", ""},
+		{"flag and file", passwordFlags{password: "from-flag", file: file}, "alice", "", prompt, "", "can't be used together", ""},
+		{"file and stdin", passwordFlags{file: file, stdin: true}, "alice", "", prompt, "", "can't be used together", ""},
+		{"flag and stdin", passwordFlags{password: "from-flag", stdin: true}, "alice", "", prompt, "", "can't be used together", ""},
+	}
+	for _, tt := range tts {
+		logs.Reset()
+		password, err := tt.flags.resolve(tt.username, strings.NewReader(tt.stdin), tt.prompt)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected %q got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || password != tt.password {
+			t.Errorf("%s: expected %q got %q %v", tt.name, tt.password, password, err)
+		}
+		if (tt.warning == "") != !strings.Contains(logs.String(), "warning") ||
+			!strings.Contains(logs.String(), tt.warning) {
+			t.Errorf("%s: expected the warning %q got %q", tt.name, tt.warning, logs.String())
+		}
+	}
+}
+
+func TestPasswordFileEnv(t *testing.T) {
+	defer setenv("SOCKS5_PASSWORD_FILE", "/run/secrets/password")()
+	fs := flag.NewFlagSet("socks5-server", flag.ContinueOnError)
+	password := fs.String("password", "", "")
+	file := fs.String("password-file", "", "")
+	if err := setFromEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	//the variable is the one of -password-file rather than the file of -password
+	if *password != "" || *file != "/run/secrets/password" {
+		t.Errorf("expected only -password-file to be set got %q %q", *password, *file)
+	}
+}
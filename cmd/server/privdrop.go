@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+//identity is what the process switches to once the sockets are bound, the zero identity keeps
+//the one the process was started with
+type identity struct {
+	user, group string
+	//chroot is the directory made the root of the file system
+	chroot string
+}
+
+//credential is a resolved identity, uid and gid are -1 if they're kept
+type credential struct {
+	uid, gid int
+	//groups are the supplementary groups set with gid
+	groups []int
+	chroot string
+}
+
+//dropper switches the process to an identity, it's replaced in tests
+type dropper interface {
+	//lookup resolves id before anything is bound so an unknown user fails the start
+	lookup(id identity) (*credential, error)
+	//readable reports whether path can be read once switched to c
+	readable(c *credential, path string) bool
+	//drop switches the process to c and verifies the switch took effect
+	drop(c *credential) error
+}
+
+//bindThenDrop runs bind, which opens every socket needing the privileges of the process, and
+//then switches to id. The files re-read on reload id can't read are warned about
+func bindThenDrop(d dropper, id identity, files []string, bind func() error) error {
+	if id == (identity{}) {
+		return bind()
+	}
+
+	c, err := d.lookup(id)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f != "" && !d.readable(c, f) {
+			log.Printf("warning: %s can't be read once the privileges are dropped, reloading it will fail", f)
+		}
+	}
+
+	if err := bind(); err != nil {
+		return err
+	}
+	if err := d.drop(c); err != nil {
+		return fmt.Errorf("unable to drop privileges: %v", err)
+	}
+	log.Printf("dropped privileges, running as uid %d gid %d", os.Getuid(), os.Getgid())
+	return nil
+}
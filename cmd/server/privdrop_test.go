@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//recordingDropper records the calls made to it
+type recordingDropper struct {
+	calls      []string
+	lookupErr  error
+	dropErr    error
+	unreadable string
+}
+
+func (d *recordingDropper) lookup(id identity) (*credential, error) {
+	d.calls = append(d.calls, "lookup")
+	if d.lookupErr != nil {
+		return nil, d.lookupErr
+	}
+	return &credential{uid: 1000, gid: 1000, groups: []int{1000}}, nil
+}
+
+func (d *recordingDropper) readable(c *credential, path string) bool {
+	d.calls = append(d.calls, "readable "+path)
+	return path != d.unreadable
+}
+
+func (d *recordingDropper) drop(c *credential) error {
+	d.calls = append(d.calls, "drop")
+	return d.dropErr
+}
+
+func TestBindThenDrop(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	errBind := errors.New("bind failed")
+	tts := []struct {
+		name    string
+		id      identity
+		d       *recordingDropper
+		bindErr error
+		calls   []string
+		err     string
+		warning string
+	}{
+		{"no identity", identity{}, &recordingDropper{}, nil, []string{"bind"}, "", ""},
+		{"drop", identity{user: "nobody"}, &recordingDropper{}, nil,
+			[]string{"lookup", "readable users", "bind", "drop"}, "", ""},
+		{"unknown user", identity{user: "nobody"}, &recordingDropper{lookupErr: errors.New("unknown user")}, nil,
+			[]string{"lookup"}, "unknown user", ""},
+		{"bind failure", identity{user: "nobody"}, &recordingDropper{}, errBind,
+			[]string{"lookup", "readable users", "bind"}, "bind failed", ""},
+		{"drop failure", identity{user: "nobody"}, &recordingDropper{dropErr: errors.New("operation not permitted")}, nil,
+			[]string{"lookup", "readable users", "bind", "drop"}, "unable to drop privileges: operation not permitted", ""},
+		{"unreadable file", identity{group: "nogroup"}, &recordingDropper{unreadable: "users"}, nil,
+			[]string{"lookup", "readable users", "bind", "drop"}, "", "warning: users can't be read"},
+	}
+	for _, tt := range tts {
+		logs.Reset()
+		err := bindThenDrop(tt.d, tt.id, []string{"users", ""}, func() error {
+			tt.d.calls = append(tt.d.calls, "bind")
+			return tt.bindErr
+		})
+		if !reflect.DeepEqual(tt.d.calls, tt.calls) {
+			t.Errorf("%s: expected calls %q got %q", tt.name, tt.calls, tt.d.calls)
+		}
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: expected error %q got %v", tt.name, tt.err, err)
+		}
+		if tt.warning != "" && !strings.Contains(logs.String(), tt.warning) {
+			t.Errorf("%s: expected a warning %q in %q", tt.name, tt.warning, logs.String())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+//unixDropper switches the identity with chroot, setgroups, setgid and setuid
+type unixDropper struct{}
+
+func newDropper() dropper {
+	return unixDropper{}
+}
+
+func (unixDropper) lookup(id identity) (*credential, error) {
+	c := &credential{uid: -1, gid: -1, chroot: id.chroot}
+	if id.user != "" {
+		u, err := user.Lookup(id.user)
+		if _, ok := err.(user.UnknownUserError); ok && numeric(id.user) {
+			u, err = user.LookupId(id.user)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("-run-as-user: %v", err)
+		}
+		if c.uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, fmt.Errorf("-run-as-user: uid %q: %v", u.Uid, err)
+		}
+		if c.gid, err = strconv.Atoi(u.Gid); err != nil {
+			return nil, fmt.Errorf("-run-as-user: gid %q: %v", u.Gid, err)
+		}
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("-run-as-user: groups of %s: %v", u.Username, err)
+		}
+		for _, g := range gids {
+			gid, err := strconv.Atoi(g)
+			if err != nil {
+				return nil, fmt.Errorf("-run-as-user: gid %q: %v", g, err)
+			}
+			c.groups = append(c.groups, gid)
+		}
+	}
+	if id.group != "" {
+		g, err := user.LookupGroup(id.group)
+		if _, ok := err.(user.UnknownGroupError); ok && numeric(id.group) {
+			g, err = user.LookupGroupId(id.group)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("-run-as-group: %v", err)
+		}
+		if c.gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("-run-as-group: gid %q: %v", g.Gid, err)
+		}
+	}
+	if c.gid != -1 && !containsInt(c.groups, c.gid) {
+		c.groups = append(c.groups, c.gid)
+	}
+	if c.chroot != "" {
+		fi, err := os.Stat(c.chroot)
+		if err != nil {
+			return nil, fmt.Errorf("-chroot: %v", err)
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("-chroot: %s isn't a directory", c.chroot)
+		}
+	}
+	return c, nil
+}
+
+//readable checks the permissions of path itself, those of its directories aren't
+func (unixDropper) readable(c *credential, path string) bool {
+	if c.chroot != "" {
+		path = filepath.Join(c.chroot, path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+
+	uid, groups := c.uid, c.groups
+	if uid == -1 {
+		uid = os.Getuid()
+	}
+	if c.gid == -1 {
+		groups, _ = os.Getgroups()
+		groups = append(groups, os.Getgid())
+	}
+	return permits(fi.Mode(), int(st.Uid), int(st.Gid), uid, groups)
+}
+
+//permits reports whether the user uid in groups can read a file of mode owned by owner and group
+func permits(mode os.FileMode, owner, group, uid int, groups []int) bool {
+	switch {
+	case uid == 0:
+		return true
+	case uid == owner:
+		return mode&0400 != 0
+	case containsInt(groups, group):
+		return mode&0040 != 0
+	}
+	return mode&0004 != 0
+}
+
+func (unixDropper) drop(c *credential) error {
+	if c.chroot != "" {
+		if err := syscall.Chroot(c.chroot); err != nil {
+			return fmt.Errorf("chroot %s: %v", c.chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir /: %v", err)
+		}
+	}
+	if c.gid != -1 {
+		if err := syscall.Setgroups(c.groups); err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+		if err := syscall.Setgid(c.gid); err != nil {
+			return fmt.Errorf("setgid %d: %v", c.gid, err)
+		}
+	}
+	if c.uid != -1 {
+		if err := syscall.Setuid(c.uid); err != nil {
+			return fmt.Errorf("setuid %d: %v", c.uid, err)
+		}
+	}
+
+	if c.gid != -1 && (os.Getgid() != c.gid || os.Getegid() != c.gid) {
+		return fmt.Errorf("still running as gid %d", os.Getegid())
+	}
+	if c.uid != -1 {
+		if os.Getuid() != c.uid || os.Geteuid() != c.uid {
+			return fmt.Errorf("still running as uid %d", os.Geteuid())
+		}
+		if c.uid != 0 && syscall.Setuid(0) == nil {
+			return errors.New("root can still be regained")
+		}
+	}
+	return nil
+}
+
+//numeric reports whether s is a uid or gid rather than a name
+func numeric(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func containsInt(s []int, v int) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPermits(t *testing.T) {
+	tts := []struct {
+		mode         os.FileMode
+		owner, group int
+		uid          int
+		groups       []int
+		expected     bool
+	}{
+		{0600, 1000, 1000, 1000, []int{1000}, true},
+		{0600, 1000, 1000, 1001, []int{1000}, false},
+		{0640, 1000, 1000, 1001, []int{1000}, true},
+		{0640, 1000, 1000, 1001, []int{1001}, false},
+		{0644, 1000, 1000, 1001, []int{1001}, true},
+		{0044, 1000, 1000, 1000, []int{1000}, false},
+		{0000, 1000, 1000, 0, []int{0}, true},
+	}
+	for _, tt := range tts {
+		if got := permits(tt.mode, tt.owner, tt.group, tt.uid, tt.groups); got != tt.expected {
+			t.Errorf("%v owned by %d:%d for %d %v: expected %v got %v", tt.mode, tt.owner, tt.group, tt.uid, tt.groups, tt.expected, got)
+		}
+	}
+}
+
+func TestDropUnprivileged(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("dropping privileges can only fail gracefully when not running as root")
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+
+	d := newDropper()
+	for _, id := range []identity{{user: "0"}, {group: "0"}, {chroot: os.TempDir()}} {
+		c, err := d.lookup(id)
+		if err != nil {
+			t.Fatalf("%+v: %v", id, err)
+		}
+		err = d.drop(c)
+		if err == nil || !strings.Contains(err.Error(), "operation not permitted") {
+			t.Errorf("%+v: expected a permission error got %v", id, err)
+		}
+		if os.Getuid() != uid || os.Getgid() != gid {
+			t.Fatalf("%+v: the identity changed to %d:%d", id, os.Getuid(), os.Getgid())
+		}
+	}
+}
+
+func TestDropperLookup(t *testing.T) {
+	d := newDropper()
+	if _, err := d.lookup(identity{user: "no-such-user-socks5"}); err == nil || !strings.Contains(err.Error(), "-run-as-user") {
+		t.Errorf("expected an unknown user error got %v", err)
+	}
+	if _, err := d.lookup(identity{chroot: "/no/such/dir"}); err == nil || !strings.Contains(err.Error(), "-chroot") {
+		t.Errorf("expected a chroot error got %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "errors"
+
+//errNoPrivDrop is returned as there's no setuid on Windows, run the server as a service account
+//instead
+var errNoPrivDrop = errors.New("-run-as-user, -run-as-group and -chroot aren't supported on windows")
+
+type windowsDropper struct{}
+
+func newDropper() dropper {
+	return windowsDropper{}
+}
+
+func (windowsDropper) lookup(id identity) (*credential, error) {
+	return nil, errNoPrivDrop
+}
+
+func (windowsDropper) readable(c *credential, path string) bool {
+	return true
+}
+
+func (windowsDropper) drop(c *credential) error {
+	return errNoPrivDrop
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+//reloader reads the configuration files and applies them to the server, it's done at startup
+//and again on every reload signal
+type reloader struct {
+	s *socks5.Server
+
+	//usersFile is the file of the -users-file flag
+	usersFile string
+	//insecureUsersFile allows a users file readable by everyone
+	insecureUsersFile bool
+
+	//aclFile is the file of the -acl flag
+	aclFile string
+	//tls is set if the server serves the certificate of -tls-cert and -tls-key
+	tls bool
+
+	users  socks5.HashedCredentials
+	loaded bool
+}
+
+//load reads the files and applies them, on failure the server keeps its configuration
+func (r *reloader) load() error {
+	var users socks5.HashedCredentials
+	var acl *socks5.ACL
+	var err error
+	if r.usersFile != "" {
+		if users, err = readUsersFile(r.usersFile, r.insecureUsersFile); err != nil {
+			return fmt.Errorf("%s: %v", r.usersFile, err)
+		}
+	}
+	if r.aclFile != "" {
+		if acl, err = readACLFile(r.aclFile); err != nil {
+			return fmt.Errorf("%s: %v", r.aclFile, err)
+		}
+	}
+	if r.tls && r.loaded {
+		if err := r.s.ReloadTLS(); err != nil {
+			return fmt.Errorf("tls certificate: %v", err)
+		}
+	}
+
+	if users != nil {
+		added, removed, changed := diffUsers(r.users, users)
+		r.s.SetAuthenticator(socks5.NewCredentialAuth(users))
+		if r.loaded {
+			log.Printf("reloaded %s: %d users, added %v, removed %v, changed %v",
+				r.usersFile, len(users), added, removed, changed)
+		}
+		r.users = users
+	}
+	if acl != nil {
+		r.s.SetRuleset(acl)
+		if r.loaded {
+			log.Printf("reloaded %s: %d rules", r.aclFile, acl.Len())
+		}
+	}
+	r.loaded = true
+	return nil
+}
+
+//handle reloads the configuration for every signal received on sig
+func (r *reloader) handle(sig <-chan os.Signal) {
+	for range sig {
+		if err := r.load(); err != nil {
+			log.Printf("reload failed, keeping the current configuration: %v", err)
+		}
+	}
+}
+
+//readUsersFile reads a file of username:secret lines, blank lines and lines starting with # are
+//skipped. Unless insecure is set the file is refused if everyone can read it
+func readUsersFile(path string, insecure bool) (socks5.HashedCredentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if !insecure {
+		if err := checkUsersFileMode(f); err != nil {
+			return nil, err
+		}
+	}
+	return parseUsers(f)
+}
+
+//parseUsers parses username:secret lines, the secret is a password or a bcrypt or argon2 hash
+func parseUsers(r io.Reader) (socks5.HashedCredentials, error) {
+	users := make(socks5.HashedCredentials)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: expected username:secret", n)
+		}
+		user, secret := line[:i], line[i+1:]
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("line %d: duplicate username %q", n, user)
+		}
+		if err := socks5.ValidateSecret(secret); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		users[user] = secret
+	}
+	return users, s.Err()
+}
+
+//readACLFile reads the rules of an ACL file as described by socks5.ParseACL
+func readACLFile(path string) (*socks5.ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return socks5.ParseACL(f)
+}
+
+//diffUsers returns the sorted usernames added to, removed from and whose secret changed
+//between old and new
+func diffUsers(old, new socks5.HashedCredentials) (added, removed, changed []string) {
+	for user, pass := range new {
+		p, ok := old[user]
+		switch {
+		case !ok:
+			added = append(added, user)
+		case p != pass:
+			changed = append(changed, user)
+		}
+	}
+	for user := range old {
+		if _, ok := new[user]; !ok {
+			removed = append(removed, user)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func TestParseUsers(t *testing.T) {
+	const (
+		bcryptHash = "$2a$04$Uf8DfB5tr1ury7P6ja1vrer0CffecWOyNfebvQGBd.CdqtEthI.5."
+		argon2Hash = "$argon2id$v=19$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$qhVKebEteqSqfN1q0/VQe+PEtXxh33BCEdTstQ++g6E"
+	)
+	tts := []struct {
+		in       string
+		expected socks5.HashedCredentials
+		err      string
+	}{
+		{"alice:secret\n\n# comment\n  bob:pass:word  \n", socks5.HashedCredentials{"alice": "secret", "bob": "pass:word"}, ""},
+		{"alice:\n", socks5.HashedCredentials{"alice": ""}, ""},
+		{"alice:" + bcryptHash + "\nbob:" + argon2Hash + "\ncarol:plain\n",
+			socks5.HashedCredentials{"alice": bcryptHash, "bob": argon2Hash, "carol": "plain"}, ""},
+		{"alice:secret\nbob\n", nil, "line 2: expected username:secret"},
+		{":secret\n", nil, "line 1: expected username:secret"},
+		{"alice:secret\n# alice\nalice:other\n", nil, `line 3: duplicate username "alice"`},
+		{"alice:secret\nbob:$2a$04$truncated\n", nil, "line 2: socks5: malformed password hash"},
+		{"bob:$argon2id$v=19$m=64$salt$hash\n", nil, "line 1: socks5: malformed password hash"},
+	}
+	for _, tt := range tts {
+		users, err := parseUsers(strings.NewReader(tt.in))
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: expected %q got %v", tt.in, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(users, tt.expected) {
+			t.Errorf("%q: expected %v got %v %v", tt.in, tt.expected, users, err)
+		}
+	}
+}
+
+func TestDiffUsers(t *testing.T) {
+	old := socks5.HashedCredentials{"a": "1", "b": "2", "c": "3"}
+	new := socks5.HashedCredentials{"b": "2", "c": "4", "d": "5"}
+	added, removed, changed := diffUsers(old, new)
+	if !reflect.DeepEqual(added, []string{"d"}) || !reflect.DeepEqual(removed, []string{"a"}) || !reflect.DeepEqual(changed, []string{"c"}) {
+		t.Errorf("unexpected diff %v %v %v", added, removed, changed)
+	}
+}
+
+func TestLoadACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "acl")
+	if err := ioutil.WriteFile(path, []byte("deny cmd bind\ndefault allow\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &socks5.Server{}
+	r := &reloader{s: s, aclFile: path}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	acl, ok := s.Ruleset.(*socks5.ACL)
+	if !ok || acl.Len() != 1 {
+		t.Fatalf("expected the acl to be set got %v", s.Ruleset)
+	}
+
+	//a malformed file leaves the ruleset as it is
+	if err := ioutil.WriteFile(path, []byte("deny cmd bind\nallow dst\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expected := path + ": socks5: acl line 2, column 10: missing the value of \"dst\""
+	if err := r.load(); err == nil || err.Error() != expected {
+		t.Errorf("expected %q got %v", expected, err)
+	}
+	if s.Ruleset != acl {
+		t.Error("expected the ruleset to be kept")
+	}
+}
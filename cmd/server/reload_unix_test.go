@@ -0,0 +1,96 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func TestReloadUsers(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	users := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(users, []byte("old:password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5.Server{Cmds: []socks5.Command{socks5.CommandConnect}}
+	r := &reloader{s: s, usersFile: users}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	sig := make(chan os.Signal)
+	go r.handle(sig)
+	defer close(sig)
+
+	dial := func(user, pass string) error {
+		c, err := socks5.NewClient(l.Addr().String(), socks5.WithClientAuth(user, pass)).Dial("tcp", target.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := dial("old", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	//the second signal is received once the first one is handled
+	reload := func() {
+		sig <- syscall.SIGHUP
+		sig <- syscall.SIGHUP
+	}
+
+	//a file that fails to parse leaves the users as they are
+	if err := ioutil.WriteFile(users, []byte("new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reload()
+	if err := dial("old", "password"); err != nil {
+		t.Errorf("expected the users to be kept got %v", err)
+	}
+
+	//bcrypt hash of secret
+	if err := ioutil.WriteFile(users, []byte("# users\nnew:$2a$04$Yxd94UVnA2mTGYrRG2dw0O6biuDE2WWaNuHydtFYuHYZJUGhv5R1C\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reload()
+	if err := dial("new", "secret"); err != nil {
+		t.Errorf("expected the new user to authenticate got %v", err)
+	}
+	if err := dial("old", "password"); err != socks5.ErrAuthFailed {
+		t.Errorf("expected the removed user to fail got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+//notifyReload does nothing as there's no SIGHUP on Windows, the configuration is only read at
+//startup
+func notifyReload(c chan<- os.Signal) {}
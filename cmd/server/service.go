@@ -0,0 +1,25 @@
+package main
+
+import "strings"
+
+//serviceArgs returns args without the -service flag, they're the arguments the service is
+//installed with
+func serviceArgs(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(out, args[i:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		switch {
+		case name == "service" && strings.HasPrefix(arg, "-"):
+			//the value is the next argument
+			i++
+		case strings.HasPrefix(name, "service=") && strings.HasPrefix(arg, "-"):
+		default:
+			out = append(out, arg)
+		}
+	}
+	return out
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var errNoService = errors.New("-service is only supported on windows")
+
+//inService reports whether the process was started by the Windows service control manager
+func inService() bool {
+	return false
+}
+
+//controlService is only supported on windows
+func controlService(cmd, name, description string, args []string) error {
+	return errNoService
+}
+
+//startEventLog is only supported on windows
+func startEventLog(name string) (io.Closer, error) {
+	return nil, errNoService
+}
+
+//runService is only supported on windows
+func runService(name string, drainTimeout time.Duration, run runFunc) int {
+	panic(errNoService)
+}
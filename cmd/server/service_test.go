@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestServiceArgs(t *testing.T) {
+	tts := []struct {
+		args, expected []string
+	}{
+		{[]string{"-service", "install", "-addr", ":1080"}, []string{"-addr", ":1080"}},
+		{[]string{"-addr", ":1080", "--service=install", "-service-name", "proxy"}, []string{"-addr", ":1080", "-service-name", "proxy"}},
+		{[]string{"-service-description=proxy", "-service", "install"}, []string{"-service-description=proxy"}},
+		{[]string{"-service", "install", "--", "-service"}, []string{"--", "-service"}},
+	}
+	for _, tt := range tts {
+		if got := serviceArgs(tt.args); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q: expected %q got %q", tt.args, tt.expected, got)
+		}
+	}
+}
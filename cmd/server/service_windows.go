@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+//serviceStopTimeout is how long -service stop waits for the service to stop
+const serviceStopTimeout = time.Minute
+
+//inService reports whether the process was started by the Windows service control manager
+func inService() bool {
+	interactive, err := svc.IsAnInteractiveSession()
+	return err == nil && !interactive
+}
+
+//controlService installs, uninstalls, starts or stops the service name, it's installed to run
+//the executable with args
+func controlService(cmd, name, description string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if cmd == "install" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if exe, err = filepath.Abs(exe); err != nil {
+			return err
+		}
+		if s, err := m.OpenService(name); err == nil {
+			s.Close()
+			return fmt.Errorf("service %s already exists", name)
+		}
+		s, err := m.CreateService(name, exe, mgr.Config{
+			DisplayName: name,
+			Description: description,
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return fmt.Errorf("event log source: %v", err)
+		}
+		return nil
+	}
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s: %v", name, err)
+	}
+	defer s.Close()
+	switch cmd {
+	case "uninstall":
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		return eventlog.Remove(name)
+	case "start":
+		return s.Start()
+	case "stop":
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		deadline := time.Now().Add(serviceStopTimeout)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("service %s didn't stop within %v, it may still be draining", name, serviceStopTimeout)
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown -service command %q, expected install, uninstall, start or stop", cmd)
+}
+
+//eventLogWriter writes the lines of the logger to the event log
+type eventLogWriter struct {
+	l *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	if err := w.l.Info(1, strings.TrimRight(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//startEventLog logs to the event log of the service name as well as to the current output
+func startEventLog(name string) (io.Closer, error) {
+	l, err := eventlog.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(io.MultiWriter(log.Writer(), eventLogWriter{l}))
+	return l, nil
+}
+
+//serviceHandler runs the server for the service control manager, Stop and Shutdown drain it
+type serviceHandler struct {
+	run          runFunc
+	drainTimeout time.Duration
+	code         int
+}
+
+func (h *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//a stop requested while draining closes the sessions
+	force := make(chan os.Signal, 1)
+	done := make(chan int, 1)
+	go func() {
+		done <- h.run(ctx, force)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case h.code = <-done:
+			changes <- svc.Status{State: svc.StopPending}
+			return h.code != 0, uint32(h.code)
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				if ctx.Err() != nil {
+					select {
+					case force <- os.Interrupt:
+					default:
+					}
+					continue
+				}
+				changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(h.drainTimeout / time.Millisecond)}
+				cancel()
+			}
+		}
+	}
+}
+
+//runService runs the server as the service name until it's stopped and returns the exit code
+func runService(name string, drainTimeout time.Duration, run runFunc) int {
+	h := &serviceHandler{run: run, drainTimeout: drainTimeout}
+	if err := svc.Run(name, h); err != nil {
+		log.Printf("service failed: %v", err)
+		return 1
+	}
+	return h.code
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+const (
+	//exitDrainForced is the exit code when sessions were closed by -drain-timeout or a second
+	//signal instead of ending on their own
+	exitDrainForced = 2
+
+	//drainProgressInterval is how often the sessions left are logged while draining
+	drainProgressInterval = 5 * time.Second
+)
+
+//drainer is the part of the server the shutdown uses
+type drainer interface {
+	Shutdown(ctx context.Context) error
+	ActiveSessions() int
+}
+
+//shutdown drains s for at most timeout, a signal received on sig meanwhile closes the sessions
+//at once. It returns the exit code of the process
+func shutdown(s drainer, sig <-chan os.Signal, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+
+	log.Printf("waiting for %d active sessions", s.ActiveSessions())
+	ticker := time.NewTicker(drainProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("closed the active sessions: %v", err)
+				return exitDrainForced
+			}
+			log.Printf("all sessions ended")
+			return 0
+		case <-sig:
+			log.Printf("closing the active sessions")
+			cancel()
+		case <-ticker.C:
+			log.Printf("waiting for %d active sessions", s.ActiveSessions())
+		}
+	}
+}
+
+//runFunc serves until ctx is done and drains, a value received on force while draining closes
+//the sessions at once. It returns the exit code of the process
+type runFunc func(ctx context.Context, force <-chan os.Signal) int
+
+//run serves with serve until ctx is done, or until the server shut down for being idle with
+//-idle-exit, and then drains s for at most drainTimeout. It's called by main when running
+//interactively and by the handler of the Windows service
+func run(ctx context.Context, s drainer, serve func() error, force <-chan os.Signal, drainTimeout time.Duration) int {
+	exit := make(chan int, 1)
+	go func() {
+		<-ctx.Done()
+		log.Printf("shutting down, draining for at most %v", drainTimeout)
+		exit <- shutdown(s, force, drainTimeout)
+	}()
+
+	switch err := serve(); err {
+	case socks5.ErrServerClosed:
+		return <-exit
+	case socks5.ErrIdleShutdown:
+		//the clients accepted as the server shut down are drained
+		log.Printf("no session was active for -idle-exit, exiting")
+		return shutdown(s, force, drainTimeout)
+	default:
+		log.Printf("server failed: %v", err)
+		return 1
+	}
+}
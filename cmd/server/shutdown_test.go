@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+//fakeDrainer drains once its sessions end or closes them once the context is done
+type fakeDrainer struct {
+	ended chan struct{}
+}
+
+func (f *fakeDrainer) Shutdown(ctx context.Context) error {
+	select {
+	case <-f.ended:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeDrainer) ActiveSessions() int {
+	select {
+	case <-f.ended:
+		return 0
+	default:
+		return 1
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tts := []struct {
+		name    string
+		timeout time.Duration
+		end     bool
+		signal  bool
+		code    int
+	}{
+		{"drained", time.Minute, true, false, 0},
+		{"deadline", 50 * time.Millisecond, false, false, exitDrainForced},
+		{"second signal", time.Minute, false, true, exitDrainForced},
+	}
+
+	for _, tt := range tts {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeDrainer{ended: make(chan struct{})}
+			sig := make(chan os.Signal, 1)
+			if tt.end {
+				close(f.ended)
+			}
+			if tt.signal {
+				sig <- syscall.SIGTERM
+			}
+
+			code := make(chan int)
+			go func() {
+				code <- shutdown(f, sig, tt.timeout)
+			}()
+			select {
+			case c := <-code:
+				if c != tt.code {
+					t.Errorf("expected exit code %d got %d", tt.code, c)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("shutdown didn't return")
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tts := []struct {
+		name     string
+		end      bool
+		force    bool
+		serveErr error
+		code     int
+	}{
+		{"drained", true, false, nil, 0},
+		{"forced", false, true, nil, exitDrainForced},
+		{"server failure", false, false, errors.New("accept failed"), 1},
+		{"idle", true, false, socks5.ErrIdleShutdown, 0},
+		//a client accepted as the server shut down for being idle is drained
+		{"idle forced", false, true, socks5.ErrIdleShutdown, exitDrainForced},
+	}
+
+	for _, tt := range tts {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeDrainer{ended: make(chan struct{})}
+			if tt.end {
+				close(f.ended)
+			}
+			force := make(chan os.Signal, 1)
+			if tt.force {
+				force <- syscall.SIGTERM
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			//serve returns once the drain started like the server does when shut down
+			serving := make(chan struct{})
+			serve := func() error {
+				close(serving)
+				if tt.serveErr != nil {
+					return tt.serveErr
+				}
+				<-ctx.Done()
+				return socks5.ErrServerClosed
+			}
+
+			code := make(chan int)
+			go func() {
+				code <- run(ctx, f, serve, force, time.Minute)
+			}()
+			<-serving
+			if tt.serveErr == nil {
+				cancel()
+			}
+			select {
+			case c := <-code:
+				if c != tt.code {
+					t.Errorf("expected exit code %d got %d", tt.code, c)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("run didn't return")
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build sqlite
+// +build sqlite
+
+//the pure Go driver keeps cgo out of the build
+
+package main
+
+import _ "modernc.org/sqlite"
+
+func init() {
+	sqliteDriver = "sqlite"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+//tlsFlags are the flags serving the listeners over TLS, either with a certificate from files or
+//one obtained with ACME
+type tlsFlags struct {
+	certFile, keyFile string
+	//reloadInterval is how often the certificate files are checked for changes
+	reloadInterval time.Duration
+	//acmeDomains are the comma separated domains of -acme-domain
+	acmeDomains  string
+	acmeCache    string
+	acmeHTTPAddr string
+}
+
+//validate returns an error if the flags are combined in a way that can't work
+func (f *tlsFlags) validate() error {
+	switch {
+	case (f.certFile == "") != (f.keyFile == ""):
+		return errors.New("-tls-cert and -tls-key must be used together")
+	case f.acmeDomains != "" && f.certFile != "":
+		return errors.New("-acme-domain can't be used with -tls-cert and -tls-key")
+	case f.acmeDomains == "" && f.acmeHTTPAddr != "":
+		return errors.New("-acme-http-addr requires -acme-domain")
+	}
+	return nil
+}
+
+//tlsSetup is what the flags configure, config is nil if TLS isn't used
+type tlsSetup struct {
+	config *tls.Config
+	//certs is set for a certificate from files so it's reloaded with the configuration
+	certs *socks5.CertReloader
+	//acme is set for a certificate obtained and renewed with ACME
+	acme *autocert.Manager
+}
+
+//setup validates the flags and builds the TLS config. ACME challenges are answered with
+//TLS-ALPN-01 on the listeners, which requires one on port 443, and with HTTP-01 on
+//-acme-http-addr if it's set
+func (f *tlsFlags) setup() (*tlsSetup, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	if f.certFile != "" {
+		certs, err := socks5.NewCertReloader(f.certFile, f.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tlsSetup{config: certs.Config(), certs: certs}, nil
+	}
+
+	if f.acmeDomains != "" {
+		var domains []string
+		for _, d := range strings.Split(f.acmeDomains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				domains = append(domains, d)
+			}
+		}
+		if len(domains) == 0 {
+			return nil, errors.New("-acme-domain has no domain")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+		}
+		if f.acmeCache != "" {
+			m.Cache = autocert.DirCache(f.acmeCache)
+		}
+		return &tlsSetup{config: m.TLSConfig(), acme: m}, nil
+	}
+	return &tlsSetup{}, nil
+}
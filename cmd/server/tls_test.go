@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSFlagsValidate(t *testing.T) {
+	tts := []struct {
+		flags tlsFlags
+		err   string
+	}{
+		{tlsFlags{}, ""},
+		{tlsFlags{certFile: "cert.pem", keyFile: "key.pem"}, ""},
+		{tlsFlags{acmeDomains: "proxy.example.com", acmeHTTPAddr: ":80"}, ""},
+		{tlsFlags{certFile: "cert.pem"}, "-tls-cert and -tls-key must be used together"},
+		{tlsFlags{keyFile: "key.pem"}, "-tls-cert and -tls-key must be used together"},
+		{tlsFlags{certFile: "cert.pem", keyFile: "key.pem", acmeDomains: "proxy.example.com"}, "-acme-domain can't be used with -tls-cert and -tls-key"},
+		{tlsFlags{acmeHTTPAddr: ":80"}, "-acme-http-addr requires -acme-domain"},
+	}
+	for _, tt := range tts {
+		err := tt.flags.validate()
+		if (tt.err == "" && err != nil) || (tt.err != "" && (err == nil || err.Error() != tt.err)) {
+			t.Errorf("%+v: expected %q got %v", tt.flags, tt.err, err)
+		}
+	}
+}
+
+func TestTLSSetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeSelfSigned(t, certFile, keyFile)
+
+	setup, err := (&tlsFlags{certFile: certFile, keyFile: keyFile}).setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup.config == nil || setup.certs == nil || setup.acme != nil {
+		t.Fatalf("unexpected setup %+v", setup)
+	}
+	cert, err := setup.config.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.Subject.CommonName != "socks5-server" {
+		t.Errorf("unexpected certificate %v %v", leaf, err)
+	}
+
+	if _, err := (&tlsFlags{certFile: certFile, keyFile: filepath.Join(dir, "missing.pem")}).setup(); err == nil {
+		t.Error("expected a missing key to fail")
+	}
+
+	setup, err = (&tlsFlags{acmeDomains: "proxy.example.com, ", acmeCache: dir}).setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup.config == nil || setup.acme == nil || setup.certs != nil {
+		t.Fatalf("unexpected setup %+v", setup)
+	}
+	alpn := false
+	for _, p := range setup.config.NextProtos {
+		alpn = alpn || p == "acme-tls/1"
+	}
+	if !alpn {
+		t.Errorf("expected the TLS-ALPN-01 protocol got %v", setup.config.NextProtos)
+	}
+
+	if setup, err := (&tlsFlags{}).setup(); err != nil || setup.config != nil {
+		t.Errorf("expected no tls got %+v %v", setup, err)
+	}
+}
+
+//writeSelfSigned writes a self-signed certificate and its key
+func writeSelfSigned(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "socks5-server"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
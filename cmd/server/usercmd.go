@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//usersFileEdit is a users file being edited, its lines are kept as they are so the comments and
+//the order of the entries are preserved
+type usersFileEdit struct {
+	path    string
+	lines   []string
+	perm    os.FileMode
+	modTime time.Time
+	size    int64
+}
+
+//openUsersFile reads the users file path, a missing file is an empty one created with mode 0600
+func openUsersFile(path string) (*usersFileEdit, error) {
+	e := &usersFileEdit{path: path, perm: 0600}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseUsers(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	e.perm, e.modTime, e.size = fi.Mode().Perm(), fi.ModTime(), fi.Size()
+	if len(b) > 0 {
+		e.lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+	return e, nil
+}
+
+//username returns the username of line, it's empty for blank lines and comments
+func (e *usersFileEdit) username(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ""
+	}
+	return line[:strings.IndexByte(line, ':')]
+}
+
+//users returns the usernames in the order of the file
+func (e *usersFileEdit) users() []string {
+	var users []string
+	for _, line := range e.lines {
+		if user := e.username(line); user != "" {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+func (e *usersFileEdit) add(user, secret string) error {
+	for _, u := range e.users() {
+		if u == user {
+			return fmt.Errorf("user %q already exists, delete it first to change the password", user)
+		}
+	}
+	e.lines = append(e.lines, user+":"+secret)
+	return nil
+}
+
+func (e *usersFileEdit) del(user string) error {
+	for i, line := range e.lines {
+		if e.username(line) == user {
+			e.lines = append(e.lines[:i], e.lines[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no user %q", user)
+}
+
+//save writes the file back unless it changed since it was read
+func (e *usersFileEdit) save() error {
+	fi, err := os.Stat(e.path)
+	switch {
+	case os.IsNotExist(err) && e.modTime.IsZero():
+	case err != nil:
+		return err
+	case !fi.ModTime().Equal(e.modTime) || fi.Size() != e.size:
+		return fmt.Errorf("%s changed while it was edited, try again", e.path)
+	}
+	var b strings.Builder
+	for _, line := range e.lines {
+		b.WriteString(line + "\n")
+	}
+	return writeFileAtomic(e.path, []byte(b.String()), e.perm)
+}
+
+//validUsername returns an error if user can't be an entry of the users file or a SOCKS5 username
+func validUsername(user string) error {
+	switch {
+	case user == "":
+		return errors.New("empty username")
+	case len(user) > 255:
+		return errors.New("username longer than 255 bytes")
+	case strings.ContainsAny(user, ":\r\n") || strings.HasPrefix(user, "#") || strings.TrimSpace(user) != user:
+		return fmt.Errorf("invalid username %q", user)
+	}
+	return nil
+}
+
+//addUser adds user to the users file path with a bcrypt hash of password
+func addUser(path, user, password string, cost int) error {
+	if err := validUsername(user); err != nil {
+		return err
+	}
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost %d out of range %d-%d", cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	e, err := openUsersFile(path)
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return err
+	}
+	if err := e.add(user, string(hash)); err != nil {
+		return err
+	}
+	return e.save()
+}
+
+//delUser removes user from the users file path
+func delUser(path, user string) error {
+	e, err := openUsersFile(path)
+	if err != nil {
+		return err
+	}
+	if err := e.del(user); err != nil {
+		return err
+	}
+	return e.save()
+}
+
+//listUsers writes the usernames of the users file path to w one per line
+func listUsers(path string, w io.Writer) error {
+	e, err := openUsersFile(path)
+	if err != nil {
+		return err
+	}
+	for _, user := range e.users() {
+		fmt.Fprintln(w, user)
+	}
+	return nil
+}
+
+//userCommand is socks5-server user add|del|list editing the users file
+type userCommand struct {
+	usersFile string
+	cost      int
+	password  *passwordFlags
+	stdin     io.Reader
+	//ask prompts for a password on the terminal, it's nil if there's no terminal
+	ask func(prompt string) (string, error)
+	out io.Writer
+}
+
+func (c *userCommand) run(args []string) error {
+	if c.usersFile == "" {
+		return errors.New("user: -users-file is required")
+	}
+	switch {
+	case len(args) == 2 && args[0] == "add":
+		password, err := c.password.resolve(args[1], c.stdin, c.confirm(args[1]))
+		if err != nil {
+			return err
+		}
+		if password == "" {
+			return errors.New("user add: no password, use -password-stdin or -password-file without a terminal")
+		}
+		return addUser(c.usersFile, args[1], password, c.cost)
+	case len(args) == 2 && args[0] == "del":
+		return delUser(c.usersFile, args[1])
+	case len(args) == 1 && args[0] == "list":
+		return listUsers(c.usersFile, c.out)
+	}
+	return errors.New("usage: socks5-server -users-file path user add <name> | del <name> | list")
+}
+
+//confirm returns a prompt asking for the password of user twice, it's nil if there's no terminal
+func (c *userCommand) confirm(user string) func() (string, error) {
+	if c.ask == nil {
+		return nil
+	}
+	return func() (string, error) {
+		password, err := c.ask("password for " + user + ": ")
+		if err != nil {
+			return "", err
+		}
+		again, err := c.ask("confirm the password: ")
+		if err != nil {
+			return "", err
+		}
+		if password != again {
+			return "", errors.New("the passwords don't match")
+		}
+		return password, nil
+	}
+}
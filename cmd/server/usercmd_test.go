@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const usersFixture = `# proxy users
+alice:secret
+
+# contractors
+bob:$2a$04$7r8anMrncjbupusPds6nJO5oBFV8AF4ZHxuMKQPfNr2KD0Y/FKKuC
+`
+
+func writeUsersFixture(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "usercmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(path, []byte(usersFixture), 0640); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestAddUser(t *testing.T) {
+	path, cleanup := writeUsersFixture(t)
+	defer cleanup()
+
+	if err := addUser(path, "carol", "hunter2", bcrypt.MinCost); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), usersFixture+"carol:$2a$04$") || !strings.HasSuffix(string(b), "\n") {
+		t.Fatalf("expected the fixture followed by carol got\n%s", b)
+	}
+	users, err := readUsersFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !socks5.CheckSecret(users["carol"], "hunter2") || socks5.CheckSecret(users["carol"], "hunter3") {
+		t.Errorf("the hash %q doesn't verify the password", users["carol"])
+	}
+	if !socks5.CheckSecret(users["bob"], "bobpass") {
+		t.Error("expected the existing entries to be kept")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("expected the mode to be kept got %v %v", fi.Mode(), err)
+	}
+
+	tts := []struct {
+		user string
+		cost int
+		err  string
+	}{
+		{"alice", bcrypt.MinCost, `user "alice" already exists`},
+		{"da:ve", bcrypt.MinCost, "invalid username"},
+		{"#dave", bcrypt.MinCost, "invalid username"},
+		{"", bcrypt.MinCost, "empty username"},
+		{"dave", bcrypt.MaxCost + 1, "bcrypt cost"},
+	}
+	for _, tt := range tts {
+		if err := addUser(path, tt.user, "hunter2", tt.cost); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: expected %q got %v", tt.user, tt.err, err)
+		}
+	}
+}
+
+func TestAddUserNewFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usercmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+
+	if err := addUser(path, "alice", "hunter2", bcrypt.MinCost); err != nil {
+		t.Fatal(err)
+	}
+	users, err := readUsersFile(path, false)
+	if err != nil || len(users) != 1 || !socks5.CheckSecret(users["alice"], "hunter2") {
+		t.Errorf("expected alice got %v %v", users, err)
+	}
+}
+
+func TestDelUser(t *testing.T) {
+	path, cleanup := writeUsersFixture(t)
+	defer cleanup()
+
+	if err := delUser(path, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Replace(usersFixture, "alice:secret\n", "", 1)
+	if string(b) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, b)
+	}
+	if err := delUser(path, "alice"); err == nil || !strings.Contains(err.Error(), `no user "alice"`) {
+		t.Errorf("expected a missing user error got %v", err)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	path, cleanup := writeUsersFixture(t)
+	defer cleanup()
+
+	var out bytes.Buffer
+	if err := listUsers(path, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "alice\nbob\n" {
+		t.Errorf("expected alice and bob got %q", out.String())
+	}
+}
+
+func TestUsersFileConcurrentEdit(t *testing.T) {
+	path, cleanup := writeUsersFixture(t)
+	defer cleanup()
+
+	e, err := openUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.del("bob"); err != nil {
+		t.Fatal(err)
+	}
+	edited := usersFixture + "carol:secret\n"
+	if err := ioutil.WriteFile(path, []byte(edited), 0640); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+
+	if err := e.save(); err == nil || !strings.Contains(err.Error(), "changed while it was edited") {
+		t.Fatalf("expected the concurrent edit to be detected got %v", err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != edited {
+		t.Errorf("expected the concurrent edit to be kept got\n%s", b)
+	}
+}
+
+func TestUserCommand(t *testing.T) {
+	path, cleanup := writeUsersFixture(t)
+	defer cleanup()
+
+	var out bytes.Buffer
+	answers := []string{"hunter2", "hunter2"}
+	c := &userCommand{usersFile: path, cost: bcrypt.MinCost, password: &passwordFlags{}, stdin: strings.NewReader(""),
+		ask: func(prompt string) (string, error) {
+			a := answers[0]
+			answers = answers[1:]
+			return a, nil
+		}, out: &out}
+	if err := c.run([]string{"add", "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	answers = []string{"hunter2", "hunter3"}
+	if err := c.run([]string{"add", "dave"}); err == nil || !strings.Contains(err.Error(), "don't match") {
+		t.Errorf("expected mismatched passwords to fail got %v", err)
+	}
+
+	c.ask, c.password, c.stdin = nil, &passwordFlags{stdin: true}, strings.NewReader("hunter4\n")
+	if err := c.run([]string{"add", "erin"}); err != nil {
+		t.Fatal(err)
+	}
+	c.password = &passwordFlags{}
+	if err := c.run([]string{"add", "frank"}); err == nil || !strings.Contains(err.Error(), "no password") {
+		t.Errorf("expected no password without a terminal got %v", err)
+	}
+
+	if err := c.run([]string{"del", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.run([]string{"list"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "alice\ncarol\nerin\n" {
+		t.Errorf("expected alice, carol and erin got %q", out.String())
+	}
+	if err := c.run([]string{"rename", "alice"}); err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Errorf("expected the usage got %v", err)
+	}
+
+	users, err := readUsersFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !socks5.CheckSecret(users["carol"], "hunter2") || !socks5.CheckSecret(users["erin"], "hunter4") {
+		t.Errorf("unexpected users %v", users)
+	}
+}
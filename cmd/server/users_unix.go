@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+//checkUsersFileMode returns an error if everyone can read f
+func checkUsersFileMode(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if readableByEveryone(fi) {
+		return fmt.Errorf("readable by everyone (mode %v), restrict it or use -users-file-insecure", fi.Mode().Perm())
+	}
+	return nil
+}
+
+//readableByEveryone reports whether the permissions of fi let everyone read it
+func readableByEveryone(fi os.FileInfo) bool {
+	return fi.Mode().Perm()&0004 != 0
+}
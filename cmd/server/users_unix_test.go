@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUsersFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(path, []byte("alice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tts := []struct {
+		mode     os.FileMode
+		insecure bool
+		err      string
+	}{
+		{0600, false, ""},
+		{0640, false, ""},
+		{0644, false, "readable by everyone"},
+		{0644, true, ""},
+	}
+	for _, tt := range tts {
+		if err := os.Chmod(path, tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		users, err := readUsersFile(path, tt.insecure)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: expected %q got %v", tt.mode, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || users["alice"] != "secret" {
+			t.Errorf("%v: unexpected users %v %v", tt.mode, users, err)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+//checkUsersFileMode does nothing as the access to files is controlled by ACLs on Windows
+func checkUsersFileMode(f *os.File) error {
+	return nil
+}
+
+//readableByEveryone is false as the access to files is controlled by ACLs on Windows
+func readableByEveryone(fi os.FileInfo) bool {
+	return false
+}
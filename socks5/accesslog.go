@@ -0,0 +1,266 @@
+package socks5
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//AccessLogBuffer is the number of records an AccessLog holds before dropping new ones
+const AccessLogBuffer = 1024
+
+//AccessRecord describes a session once it's over
+type AccessRecord struct {
+	//Time is when the session started
+	Time time.Time
+	//SessionID identifies the session
+	SessionID string
+	//Client is the address of the client, Client, Destination and ResolvedIP are redacted
+	//by the RedactionPolicy of the server
+	Client string
+	//Username is the username the client authenticated with
+	Username string
+	//Command is the requested command, it's 0 if the handshake didn't get to the request
+	Command Command
+	//Transparent is set for the connections redirected to ServeTransparent, they have no
+	//handshake and no reply
+	Transparent bool
+	//Destination is the requested destination
+	Destination string
+	//ResolvedIP is the IP the request was served with e.g. the one the target was dialed on
+	ResolvedIP string
+	//Reply is the reply sent to the request if Replied
+	Reply   Reply
+	Replied bool
+	//BytesIn and BytesOut are the bytes relayed from and to the client
+	BytesIn, BytesOut int64
+	//Duration is how long the session lasted
+	Duration time.Duration
+	//CloseReason is the side that ended the session or the error it ended with
+	CloseReason string
+}
+
+//AccessLogFormat encodes AccessRecords
+type AccessLogFormat interface {
+	//Encode writes r to w as a single line
+	Encode(w io.Writer, r *AccessRecord) error
+}
+
+var (
+	//JSONLines encodes every record as a JSON object on its own line
+	JSONLines AccessLogFormat = jsonLines{}
+
+	//CEF encodes records in the ArcSight Common Event Format
+	CEF AccessLogFormat = cef{}
+)
+
+//AccessLog writes AccessRecords to a writer from a single goroutine, logging never blocks the
+//sessions, records are dropped and counted once AccessLogBuffer records are pending
+type AccessLog struct {
+	w       io.Writer
+	format  AccessLogFormat
+	records chan *AccessRecord
+	done    chan struct{}
+	dropped uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+//NewAccessLog returns an AccessLog writing records in format to w
+func NewAccessLog(w io.Writer, format AccessLogFormat) *AccessLog {
+	a := &AccessLog{
+		w:       w,
+		format:  format,
+		records: make(chan *AccessRecord, AccessLogBuffer),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AccessLog) run() {
+	defer close(a.done)
+	for r := range a.records {
+		a.format.Encode(a.w, r)
+	}
+}
+
+//Log queues r to be written, it's dropped if the log is full or closed
+func (a *AccessLog) Log(r *AccessRecord) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		atomic.AddUint64(&a.dropped, 1)
+		return
+	}
+	select {
+	case a.records <- r:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+//Dropped returns the number of records dropped
+func (a *AccessLog) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+//Close writes the pending records and stops the log, records logged afterwards are dropped
+func (a *AccessLog) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.records)
+	}
+	a.mu.Unlock()
+	<-a.done
+	return nil
+}
+
+//newAccessRecord returns the record of the session on c redacted by policy which may be nil,
+//req is nil if the handshake failed
+func newAccessRecord(c *conn, req *Request, start time.Time, err error, policy *RedactionPolicy) *AccessRecord {
+	r := &AccessRecord{
+		Time:        start,
+		SessionID:   c.id,
+		Client:      policy.client(c.RemoteAddr()),
+		Username:    c.user,
+		Transparent: c.original != nil,
+		Reply:       c.reply,
+		Replied:     c.replied,
+		BytesIn:     atomic.LoadInt64(&c.in),
+		BytesOut:    atomic.LoadInt64(&c.out),
+		Duration:    time.Since(start),
+	}
+	if req != nil {
+		r.Command = req.Command
+		r.Destination = policy.destination(req.Dest)
+	}
+	r.ResolvedIP = policy.resolved(c.resolved)
+
+	switch {
+	case atomic.LoadInt32(&c.ended) == endedByClient:
+		r.CloseReason = "client closed"
+	case atomic.LoadInt32(&c.ended) == endedByTarget:
+		r.CloseReason = "target closed"
+	case err != nil:
+		r.CloseReason = policy.error(err)
+	default:
+		r.CloseReason = "done"
+	}
+	return r
+}
+
+//newSessionID returns a random identifier for a session
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type jsonLines struct{}
+
+type jsonRecord struct {
+	Time        string `json:"time"`
+	SessionID   string `json:"session_id"`
+	Client      string `json:"client"`
+	Username    string `json:"username,omitempty"`
+	Command     string `json:"command,omitempty"`
+	Transparent bool   `json:"transparent,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	ResolvedIP  string `json:"resolved_ip,omitempty"`
+	Reply       *Reply `json:"reply,omitempty"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	DurationMS  int64  `json:"duration_ms"`
+	CloseReason string `json:"close_reason"`
+}
+
+func (jsonLines) Encode(w io.Writer, r *AccessRecord) error {
+	j := jsonRecord{
+		Time:        r.Time.UTC().Format(time.RFC3339Nano),
+		SessionID:   r.SessionID,
+		Client:      r.Client,
+		Username:    r.Username,
+		Transparent: r.Transparent,
+		Destination: r.Destination,
+		ResolvedIP:  r.ResolvedIP,
+		BytesIn:     r.BytesIn,
+		BytesOut:    r.BytesOut,
+		DurationMS:  int64(r.Duration / time.Millisecond),
+		CloseReason: r.CloseReason,
+	}
+	if r.Command != 0 {
+		j.Command = r.Command.String()
+	}
+	if r.Replied {
+		reply := r.Reply
+		j.Reply = &reply
+	}
+	//Encode ends the object with a newline
+	return json.NewEncoder(w).Encode(j)
+}
+
+type cef struct{}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+func (cef) Encode(w io.Writer, r *AccessRecord) error {
+	severity := 3
+	if r.Replied && r.Reply != ReplySucceeded {
+		severity = 5
+	}
+	signature := "session"
+	if r.Command != 0 {
+		signature = r.Command.String()
+	}
+
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefExtensionEscaper.Replace(value))
+		}
+	}
+	add("rt", strconv.FormatInt(r.Time.UnixNano()/int64(time.Millisecond), 10))
+	add("externalId", r.SessionID)
+	if host, port, err := net.SplitHostPort(r.Client); err == nil {
+		add("src", host)
+		add("spt", port)
+	} else {
+		add("src", r.Client)
+	}
+	add("suser", r.Username)
+	if r.Transparent {
+		add("cs1", "transparent")
+		add("cs1Label", "intake")
+	}
+	if host, port, err := net.SplitHostPort(r.Destination); err == nil {
+		add("dhost", host)
+		add("dpt", port)
+	}
+	add("dst", r.ResolvedIP)
+	if r.Replied {
+		add("outcome", strconv.Itoa(int(r.Reply)))
+	}
+	add("in", strconv.FormatInt(r.BytesIn, 10))
+	add("out", strconv.FormatInt(r.BytesOut, 10))
+	add("cn1", strconv.FormatInt(int64(r.Duration/time.Millisecond), 10))
+	add("cn1Label", "durationMs")
+	add("reason", r.CloseReason)
+
+	_, err := fmt.Fprintf(w, "CEF:0|socks5-server|socks5-server|1|%s|SOCKS5 session|%d|%s\n",
+		cefHeaderEscaper.Replace(signature), severity, strings.Join(ext, " "))
+	return err
+}
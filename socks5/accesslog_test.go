@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//lineWriter passes every write to a channel, the formats write a record at once
+type lineWriter chan string
+
+func (l lineWriter) Write(b []byte) (int, error) {
+	l <- string(b)
+	return len(b), nil
+}
+
+func (l lineWriter) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case line := <-l:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("no access log record")
+		return ""
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	lines := make(lineWriter, 10)
+	s, proxy := newTestServer(t, WithAuth("username", "password"), WithAccessLog(lines, JSONLines))
+	defer s.Close()
+
+	c, err := NewClient(proxy, WithClientAuth("username", "password")).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	client := c.(interface{ LocalAddr() net.Addr }).LocalAddr().String()
+	c.Close()
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines.next(t)), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"client":       client,
+		"username":     "username",
+		"command":      "connect",
+		"destination":  echo.Addr().String(),
+		"resolved_ip":  "127.0.0.1",
+		"reply":        float64(0),
+		"bytes_in":     float64(5),
+		"bytes_out":    float64(5),
+		"close_reason": "client closed",
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Errorf("%s: expected %v got %v", k, v, record[k])
+		}
+	}
+	if id, _ := record["session_id"].(string); len(id) != 16 {
+		t.Errorf("unexpected session id %q", id)
+	}
+	if ts, _ := record["time"].(string); ts == "" {
+		t.Error("expected a timestamp")
+	} else if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+		t.Error(err)
+	}
+
+	//a session failing authentication has no request nor reply
+	_, err = NewClient(proxy, WithClientAuth("username", "wrong")).Dial("tcp", echo.Addr().String())
+	if err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+	record = nil
+	if err := json.Unmarshal([]byte(lines.next(t)), &record); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := record["reply"]; ok || record["command"] != nil || record["close_reason"] != ErrAuthFailed.Error() {
+		t.Errorf("unexpected record %v", record)
+	}
+}
+
+func TestAccessLogCEF(t *testing.T) {
+	r := &AccessRecord{
+		Time:        time.Unix(1600000000, 0),
+		SessionID:   "0123456789abcdef",
+		Client:      "10.0.0.1:5555",
+		Username:    "a=b",
+		Command:     CommandConnect,
+		Destination: "example.com:443",
+		ResolvedIP:  "93.184.216.34",
+		Reply:       ReplyHostUnreachable,
+		Replied:     true,
+		BytesIn:     1,
+		BytesOut:    2,
+		Duration:    1500 * time.Millisecond,
+		CloseReason: "dial tcp: no route\nto host",
+	}
+
+	var b bytes.Buffer
+	if err := CEF.Encode(&b, r); err != nil {
+		t.Fatal(err)
+	}
+	expected := `CEF:0|socks5-server|socks5-server|1|connect|SOCKS5 session|5|rt=1600000000000 externalId=0123456789abcdef ` +
+		`src=10.0.0.1 spt=5555 suser=a\=b dhost=example.com dpt=443 dst=93.184.216.34 outcome=4 in=1 out=2 ` +
+		`cn1=1500 cn1Label=durationMs reason=dial tcp: no route\nto host` + "\n"
+	if b.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, b.String())
+	}
+}
+
+//blockingWriter blocks every write until it's released
+type blockingWriter chan struct{}
+
+func (b blockingWriter) Write(p []byte) (int, error) {
+	<-b
+	return len(p), nil
+}
+
+func TestAccessLogDrop(t *testing.T) {
+	w := make(blockingWriter)
+	a := NewAccessLog(w, JSONLines)
+
+	//one record is held by the blocked writer, the buffer takes the next ones
+	for i := 0; i < AccessLogBuffer+10; i++ {
+		a.Log(&AccessRecord{})
+	}
+	if dropped := a.Dropped(); dropped < 9 || dropped > 10 {
+		t.Errorf("expected 9 or 10 dropped records got %d", dropped)
+	}
+
+	close(w)
+	a.Close()
+	a.Log(&AccessRecord{})
+	if dropped := a.Dropped(); dropped < 10 || dropped > 11 {
+		t.Errorf("expected records logged after close to be dropped got %d", dropped)
+	}
+}
@@ -0,0 +1,186 @@
+package socks5
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//AccountingBuffer is the number of sessions an AccountingQueue holds before dropping new ones
+const AccountingBuffer = 1024
+
+//accountingBatch is the most sessions recorded at once
+const accountingBatch = 128
+
+//SessionStats are the totals of a session once it's over
+type SessionStats struct {
+	//Time is when the session started
+	Time time.Time
+	//SessionID identifies the session
+	SessionID string
+	//Username is the username the client authenticated with
+	Username string
+	//Client and Destination are redacted by the RedactionPolicy of the server
+	Client      string
+	Destination string
+	//BytesIn and BytesOut are the bytes relayed from and to the client
+	BytesIn, BytesOut int64
+	//Duration is how long the session lasted
+	Duration time.Duration
+	//Decision is the decision of the ruleset on the request, one of the Decision constants
+	Decision string
+	//Synthesized is the IPv6 address an IPv4 Destination was dialed on through NAT64, redacted
+	//like it
+	Synthesized string
+}
+
+//Usage are the totals of the sessions of a user
+type Usage struct {
+	Sessions          int64
+	BytesIn, BytesOut int64
+}
+
+//Accounting stores the stats of the sessions e.g. to bill the users
+type Accounting interface {
+	Record(s SessionStats) error
+	//Totals returns the usage of the sessions of user started since then
+	Totals(user string, since time.Time) (Usage, error)
+}
+
+//BatchAccounting is an Accounting which records several sessions at once more efficiently
+type BatchAccounting interface {
+	Accounting
+	RecordBatch(s []SessionStats) error
+}
+
+//AccountingQueue records the sessions with an Accounting from a single goroutine in batches,
+//recording never blocks the sessions, they're dropped and counted once AccountingBuffer
+//sessions are pending
+type AccountingQueue struct {
+	a       Accounting
+	stats   chan SessionStats
+	done    chan struct{}
+	dropped uint64
+	failed  uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+//NewAccountingQueue returns an AccountingQueue recording the sessions with a
+func NewAccountingQueue(a Accounting) *AccountingQueue {
+	q := &AccountingQueue{
+		a:     a,
+		stats: make(chan SessionStats, AccountingBuffer),
+		done:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+//WithAccounting records the stats of every session that got to its request with a
+func WithAccounting(a Accounting) Option {
+	return func(s *Server) {
+		s.Accounting = NewAccountingQueue(a)
+	}
+}
+
+func (q *AccountingQueue) run() {
+	defer close(q.done)
+	batch := make([]SessionStats, 0, accountingBatch)
+	for st := range q.stats {
+		batch = append(batch[:0], st)
+		//the sessions pending meanwhile are recorded together
+	pending:
+		for len(batch) < accountingBatch {
+			select {
+			case st, ok := <-q.stats:
+				if !ok {
+					break pending
+				}
+				batch = append(batch, st)
+			default:
+				break pending
+			}
+		}
+		q.record(batch)
+	}
+}
+
+func (q *AccountingQueue) record(batch []SessionStats) {
+	if ba, ok := q.a.(BatchAccounting); ok {
+		if err := ba.RecordBatch(batch); err != nil {
+			atomic.AddUint64(&q.failed, uint64(len(batch)))
+		}
+		return
+	}
+	for _, st := range batch {
+		if err := q.a.Record(st); err != nil {
+			atomic.AddUint64(&q.failed, 1)
+		}
+	}
+}
+
+//Record queues s to be recorded, it's dropped if the queue is full or closed
+func (q *AccountingQueue) Record(s SessionStats) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		atomic.AddUint64(&q.dropped, 1)
+		return
+	}
+	select {
+	case q.stats <- s:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+//Dropped returns the number of sessions dropped
+func (q *AccountingQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+//Failed returns the number of sessions the Accounting failed to record
+func (q *AccountingQueue) Failed() uint64 {
+	return atomic.LoadUint64(&q.failed)
+}
+
+//Totals returns the usage of user since then, the sessions still queued aren't counted
+func (q *AccountingQueue) Totals(user string, since time.Time) (Usage, error) {
+	return q.a.Totals(user, since)
+}
+
+//Close records the pending sessions and closes the Accounting if it's an io.Closer, sessions
+//recorded afterwards are dropped
+func (q *AccountingQueue) Close() error {
+	q.mu.Lock()
+	first := !q.closed
+	if first {
+		q.closed = true
+		close(q.stats)
+	}
+	q.mu.Unlock()
+	<-q.done
+	if c, ok := q.a.(io.Closer); ok && first {
+		return c.Close()
+	}
+	return nil
+}
+
+//newSessionStats returns the stats of the session on c redacted by policy which may be nil
+func newSessionStats(c *conn, req *Request, start time.Time, policy *RedactionPolicy) SessionStats {
+	return SessionStats{
+		Time:        start,
+		SessionID:   c.id,
+		Username:    c.user,
+		Client:      policy.client(c.RemoteAddr()),
+		Destination: policy.destination(req.Dest),
+		BytesIn:     atomic.LoadInt64(&c.in),
+		BytesOut:    atomic.LoadInt64(&c.out),
+		Duration:    time.Since(start),
+		Decision:    c.decision,
+		Synthesized: policy.resolved(c.nat64),
+	}
+}
@@ -0,0 +1,257 @@
+//Package accounting stores the stats of the sessions of a socks5.Server persistently so the
+//usage of the users survives restarts, in CSV files or in an SQL database
+package accounting
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+//dayLayout is the layout of the days the files are rotated on and the usage is aggregated by
+const dayLayout = "2006-01-02"
+
+var csvHeader = []string{"time", "session_id", "username", "client", "destination", "bytes_in", "bytes_out", "duration_ms", "decision", "synthesized"}
+
+//CSV appends the sessions to a CSV file which is rotated every day and once it grows past a
+//size, the rotated files are named after the file, the day and a sequence number e.g.
+//usage.csv.2006-01-02.1
+type CSV struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+	day  string
+}
+
+var (
+	_ socks5.BatchAccounting = (*CSV)(nil)
+	_ io.Closer              = (*CSV)(nil)
+)
+
+//NewCSV opens the CSV file path to append to, it's rotated once it's over maxSize bytes unless
+//maxSize is 0
+func NewCSV(path string, maxSize int64) (*CSV, error) {
+	c := &CSV{path: path, maxSize: maxSize}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//open opens the file to append to, a file of a previous day is rotated first
+func (c *CSV) open() error {
+	today := time.Now().UTC().Format(dayLayout)
+	if fi, err := os.Stat(c.path); err == nil && fi.ModTime().UTC().Format(dayLayout) != today {
+		if err := c.rename(fi.ModTime().UTC().Format(dayLayout)); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.f, c.w, c.size, c.day = f, bufio.NewWriter(f), fi.Size(), today
+	if c.size == 0 {
+		return c.write(csvHeader)
+	}
+	return nil
+}
+
+//rename moves the file aside as one of day
+func (c *CSV) rename(day string) error {
+	for n := 1; ; n++ {
+		rotated := fmt.Sprintf("%s.%s.%d", c.path, day, n)
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			return os.Rename(c.path, rotated)
+		}
+	}
+}
+
+func (c *CSV) rotate() error {
+	if err := c.closeFile(); err != nil {
+		return err
+	}
+	if err := c.rename(c.day); err != nil {
+		return err
+	}
+	return c.open()
+}
+
+func (c *CSV) write(record []string) error {
+	w := csv.NewWriter(c.w)
+	w.Write(record)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	c.size += c.sizeOf(record)
+	return nil
+}
+
+//sizeOf returns roughly the size of record once written, quotes aside
+func (c *CSV) sizeOf(record []string) int64 {
+	n := len(record)
+	for _, f := range record {
+		n += len(f)
+	}
+	return int64(n)
+}
+
+//Record appends s to the file
+func (c *CSV) Record(s socks5.SessionStats) error {
+	return c.RecordBatch([]socks5.SessionStats{s})
+}
+
+//RecordBatch appends the sessions to the file and flushes it once
+func (c *CSV) RecordBatch(stats []socks5.SessionStats) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return os.ErrClosed
+	}
+	for _, s := range stats {
+		record := []string{
+			s.Time.UTC().Format(time.RFC3339Nano),
+			s.SessionID,
+			s.Username,
+			s.Client,
+			s.Destination,
+			strconv.FormatInt(s.BytesIn, 10),
+			strconv.FormatInt(s.BytesOut, 10),
+			strconv.FormatInt(int64(s.Duration/time.Millisecond), 10),
+			s.Decision,
+			s.Synthesized,
+		}
+		day := time.Now().UTC().Format(dayLayout)
+		if day != c.day || (c.maxSize > 0 && c.size+c.sizeOf(record) > c.maxSize) {
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+			if err := c.rotate(); err != nil {
+				return err
+			}
+		}
+		if err := c.write(record); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+//Totals sums the sessions of user started since then in the file and the rotated ones
+func (c *CSV) Totals(user string, since time.Time) (socks5.Usage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var u socks5.Usage
+	if c.w != nil {
+		if err := c.w.Flush(); err != nil {
+			return u, err
+		}
+	}
+
+	rotated, err := filepath.Glob(c.path + ".*")
+	if err != nil {
+		return u, err
+	}
+	sort.Strings(rotated)
+	sinceDay := since.UTC().Format(dayLayout)
+	for _, path := range append(rotated, c.path) {
+		//the files rotated before since can be skipped by their name
+		if day := strings.SplitN(strings.TrimPrefix(path, c.path+"."), ".", 2)[0]; path != c.path && day < sinceDay {
+			continue
+		}
+		if err := sumCSV(path, user, since, &u); err != nil {
+			return u, err
+		}
+	}
+	return u, nil
+}
+
+//sumCSV adds the sessions of user started since then in the file path to u
+func sumCSV(path, user string, since time.Time, u *socks5.Usage) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	//the files written before the decision and synthesized columns have fewer fields
+	r.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if len(record) > len(csvHeader) || len(record) < len(csvHeader)-2 {
+			return fmt.Errorf("%s:%d: expected %d fields got %d", path, line, len(csvHeader), len(record))
+		}
+		if line == 1 || record[2] != user {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, record[0])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if t.Before(since) {
+			continue
+		}
+		in, err := strconv.ParseInt(record[5], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		out, err := strconv.ParseInt(record[6], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		u.Sessions++
+		u.BytesIn += in
+		u.BytesOut += out
+	}
+}
+
+func (c *CSV) closeFile() error {
+	if err := c.w.Flush(); err != nil {
+		c.f.Close()
+		return err
+	}
+	return c.f.Close()
+}
+
+//Close flushes and closes the file
+func (c *CSV) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.closeFile()
+	c.f, c.w = nil, nil
+	return err
+}
@@ -0,0 +1,169 @@
+package accounting
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func newEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+//session sends payload to the echo server through the proxy as user and reads it back
+func session(t *testing.T, proxy, echo, user string, payload int) {
+	c, err := socks5.NewClient(proxy, socks5.WithClientAuth(user, "password")).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write(make([]byte, payload))
+	if _, err := io.ReadFull(c, make([]byte, payload)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestCSVServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "usage.csv")
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	start := time.Now()
+	for run := 0; run < 2; run++ {
+		store, err := NewCSV(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &socks5.Server{Cmds: []socks5.Command{socks5.CommandConnect},
+			Auth: socks5.NewCredentialAuth(socks5.StaticCredentials{"alice": "password", "bob": "password"})}
+		socks5.WithAccounting(store)(s)
+		go s.Serve(l)
+
+		session(t, l.Addr().String(), echo.Addr().String(), "alice", 100)
+		session(t, l.Addr().String(), echo.Addr().String(), "alice", 50)
+		session(t, l.Addr().String(), echo.Addr().String(), "bob", 10)
+
+		//the sessions are recorded once they're over
+		deadline := time.Now().Add(5 * time.Second)
+		for s.ActiveSessions() != 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		s.Close()
+		if err := s.Accounting.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the totals survive the restarts
+	store, err := NewCSV(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tts := []struct {
+		user  string
+		since time.Time
+		usage socks5.Usage
+	}{
+		{"alice", start, socks5.Usage{Sessions: 4, BytesIn: 300, BytesOut: 300}},
+		{"bob", start, socks5.Usage{Sessions: 2, BytesIn: 20, BytesOut: 20}},
+		{"carol", start, socks5.Usage{}},
+		{"alice", time.Now(), socks5.Usage{}},
+	}
+	for _, tt := range tts {
+		u, err := store.Totals(tt.user, tt.since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != tt.usage {
+			t.Errorf("%s: expected %+v got %+v", tt.user, tt.usage, u)
+		}
+	}
+}
+
+func TestCSVRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "usage.csv")
+
+	//a file of a previous day is rotated on open
+	yesterday := time.Now().Add(-24 * time.Hour)
+	old := "time,session_id,username,client,destination,bytes_in,bytes_out,duration_ms\n" +
+		yesterday.UTC().Format(time.RFC3339Nano) + ",1,alice,127.0.0.1:1,example.com:443,7,9,10\n"
+	if err := ioutil.WriteFile(path, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, yesterday, yesterday)
+
+	store, err := NewCSV(path, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	now := time.Now()
+	var stats []socks5.SessionStats
+	for i := 0; i < 5; i++ {
+		stats = append(stats, socks5.SessionStats{Time: now, SessionID: "s", Username: "alice",
+			Client: "127.0.0.1:2", Destination: "example.com:443", BytesIn: 1, BytesOut: 2})
+	}
+	if err := store.RecordBatch(stats); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) < 2 || filepath.Base(rotated[0]) != "usage.csv."+yesterday.UTC().Format(dayLayout)+".1" {
+		t.Errorf("expected the file of yesterday and files over 200 bytes to be rotated got %v", rotated)
+	}
+	for _, p := range append(rotated, path) {
+		if fi, err := os.Stat(p); err != nil || fi.Size() > 200 {
+			t.Errorf("expected %s to be at most 200 bytes got %v", p, fi.Size())
+		}
+	}
+
+	tts := []struct {
+		since time.Time
+		usage socks5.Usage
+	}{
+		{yesterday.Add(-time.Minute), socks5.Usage{Sessions: 6, BytesIn: 12, BytesOut: 19}},
+		{now, socks5.Usage{Sessions: 5, BytesIn: 5, BytesOut: 10}},
+	}
+	for _, tt := range tts {
+		if u, err := store.Totals("alice", tt.since); err != nil || u != tt.usage {
+			t.Errorf("since %v: expected %+v got %+v %v", tt.since, tt.usage, u, err)
+		}
+	}
+}
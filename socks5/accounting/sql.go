@@ -0,0 +1,113 @@
+package accounting
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+//the schema of SQL, usage_daily aggregates the sessions by user and UTC day
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS sessions (
+		session_id TEXT PRIMARY KEY,
+		time INTEGER NOT NULL,
+		day TEXT NOT NULL,
+		username TEXT NOT NULL,
+		client TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		bytes_in INTEGER NOT NULL,
+		bytes_out INTEGER NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		decision TEXT NOT NULL DEFAULT '',
+		synthesized TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessions_username_time ON sessions (username, time)`,
+	`CREATE TABLE IF NOT EXISTS usage_daily (
+		username TEXT NOT NULL,
+		day TEXT NOT NULL,
+		sessions INTEGER NOT NULL,
+		bytes_in INTEGER NOT NULL,
+		bytes_out INTEGER NOT NULL,
+		PRIMARY KEY (username, day)
+	)`,
+}
+
+const (
+	sqlInsertSession = `INSERT INTO sessions (session_id, time, day, username, client, destination, bytes_in, bytes_out, duration_ms, decision, synthesized)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	sqlAddUsage = `INSERT INTO usage_daily (username, day, sessions, bytes_in, bytes_out) VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT (username, day) DO UPDATE SET sessions = sessions + 1,
+		bytes_in = bytes_in + excluded.bytes_in, bytes_out = bytes_out + excluded.bytes_out`
+	sqlDaysUsage = `SELECT COALESCE(SUM(sessions), 0), COALESCE(SUM(bytes_in), 0), COALESCE(SUM(bytes_out), 0)
+		FROM usage_daily WHERE username = ? AND day > ?`
+	sqlSessionsUsage = `SELECT COUNT(*), COALESCE(SUM(bytes_in), 0), COALESCE(SUM(bytes_out), 0)
+		FROM sessions WHERE username = ? AND day = ? AND time >= ?`
+)
+
+//SQL stores every session in a sessions table and their totals by user and day in a usage_daily
+//table updated in the same transaction. The statements are those of SQLite, e.g. with the pure
+//Go driver modernc.org/sqlite
+type SQL struct {
+	db *sql.DB
+}
+
+var _ socks5.BatchAccounting = (*SQL)(nil)
+
+//NewSQL creates the tables in db if they're missing
+func NewSQL(db *sql.DB) (*SQL, error) {
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &SQL{db: db}, nil
+}
+
+//Record stores s
+func (q *SQL) Record(s socks5.SessionStats) error {
+	return q.RecordBatch([]socks5.SessionStats{s})
+}
+
+//RecordBatch stores the sessions in a single transaction
+func (q *SQL) RecordBatch(stats []socks5.SessionStats) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, s := range stats {
+		day := s.Time.UTC().Format(dayLayout)
+		if _, err := tx.Exec(sqlInsertSession, s.SessionID, s.Time.UnixNano(), day, s.Username, s.Client,
+			s.Destination, s.BytesIn, s.BytesOut, int64(s.Duration/time.Millisecond), s.Decision, s.Synthesized); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlAddUsage, s.Username, day, s.BytesIn, s.BytesOut); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//Totals sums the days after the one of since in usage_daily and the sessions of that day
+//started since then
+func (q *SQL) Totals(user string, since time.Time) (socks5.Usage, error) {
+	var u socks5.Usage
+	day := since.UTC().Format(dayLayout)
+	if err := q.db.QueryRow(sqlDaysUsage, user, day).Scan(&u.Sessions, &u.BytesIn, &u.BytesOut); err != nil {
+		return u, err
+	}
+	var sessions, in, out int64
+	if err := q.db.QueryRow(sqlSessionsUsage, user, day, since.UnixNano()).Scan(&sessions, &in, &out); err != nil {
+		return u, err
+	}
+	u.Sessions += sessions
+	u.BytesIn += in
+	u.BytesOut += out
+	return u, nil
+}
+
+//Close closes the database
+func (q *SQL) Close() error {
+	return q.db.Close()
+}
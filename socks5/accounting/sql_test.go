@@ -0,0 +1,77 @@
+package accounting
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func TestSQL(t *testing.T) {
+	driver := ""
+	for _, d := range sql.Drivers() {
+		if d == "sqlite" || d == "sqlite3" {
+			driver = d
+		}
+	}
+	if driver == "" {
+		t.Skip("no sqlite driver registered")
+	}
+	dir, err := ioutil.TempDir("", "accounting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "usage.db")
+
+	yesterday := time.Now().Add(-24 * time.Hour)
+	now := time.Now()
+	for run, stats := range [][]socks5.SessionStats{
+		{{Time: yesterday, SessionID: "1", Username: "alice", BytesIn: 7, BytesOut: 9}},
+		{
+			{Time: now, SessionID: "2", Username: "alice", BytesIn: 1, BytesOut: 2},
+			{Time: now, SessionID: "3", Username: "bob", BytesIn: 3, BytesOut: 4},
+		},
+	} {
+		db, err := sql.Open(driver, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := NewSQL(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RecordBatch(stats); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		store.Close()
+	}
+
+	db, err := sql.Open(driver, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewSQL(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tts := []struct {
+		user  string
+		since time.Time
+		usage socks5.Usage
+	}{
+		{"alice", yesterday.Add(-time.Minute), socks5.Usage{Sessions: 2, BytesIn: 8, BytesOut: 11}},
+		{"alice", yesterday.Add(time.Minute), socks5.Usage{Sessions: 1, BytesIn: 1, BytesOut: 2}},
+		{"bob", yesterday, socks5.Usage{Sessions: 1, BytesIn: 3, BytesOut: 4}},
+	}
+	for _, tt := range tts {
+		if u, err := store.Totals(tt.user, tt.since); err != nil || u != tt.usage {
+			t.Errorf("%s since %v: expected %+v got %+v %v", tt.user, tt.since, tt.usage, u, err)
+		}
+	}
+}
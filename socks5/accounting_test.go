@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//blockingAccounting blocks every record until it's released, failing those of user fail
+type blockingAccounting struct {
+	release  chan struct{}
+	recorded int32
+	closed   int32
+}
+
+func (a *blockingAccounting) Record(s SessionStats) error {
+	<-a.release
+	if s.Username == "fail" {
+		return errors.New("disk full")
+	}
+	atomic.AddInt32(&a.recorded, 1)
+	return nil
+}
+
+func (a *blockingAccounting) Totals(user string, since time.Time) (Usage, error) {
+	return Usage{Sessions: int64(atomic.LoadInt32(&a.recorded))}, nil
+}
+
+func (a *blockingAccounting) Close() error {
+	atomic.AddInt32(&a.closed, 1)
+	return nil
+}
+
+func TestAccountingQueue(t *testing.T) {
+	a := &blockingAccounting{release: make(chan struct{})}
+	q := NewAccountingQueue(a)
+
+	//one session is held by the blocked store, the buffer takes the next ones
+	q.Record(SessionStats{Username: "fail"})
+	for i := 0; i < AccountingBuffer+9; i++ {
+		q.Record(SessionStats{})
+	}
+	if dropped := q.Dropped(); dropped < 9 || dropped > 10 {
+		t.Errorf("expected 9 or 10 dropped sessions got %d", dropped)
+	}
+
+	close(a.release)
+	q.Close()
+	q.Close()
+	recorded := int(atomic.LoadInt32(&a.recorded))
+	if uint64(recorded)+q.Dropped()+q.Failed() != AccountingBuffer+10 {
+		t.Errorf("expected every session but the dropped ones to be recorded got %d and %d dropped", recorded, q.Dropped())
+	}
+	if q.Failed() != 1 {
+		t.Errorf("expected 1 failed session got %d", q.Failed())
+	}
+	if u, _ := q.Totals("", time.Time{}); u.Sessions != int64(recorded) {
+		t.Errorf("expected the totals of the store got %+v", u)
+	}
+	if n := atomic.LoadInt32(&a.closed); n != 1 {
+		t.Errorf("expected the store to be closed once got %d", n)
+	}
+	q.Record(SessionStats{})
+	if uint64(recorded)+q.Dropped()+q.Failed() != AccountingBuffer+11 {
+		t.Error("expected the sessions recorded after close to be dropped")
+	}
+}
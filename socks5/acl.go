@@ -0,0 +1,530 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//ACL is a Ruleset compiled from a list of rules, the first rule matching a request decides
+//whether it's allowed and the default applies if none does. It's parsed with ParseACL
+type ACL struct {
+	rules []aclRule
+	//deny is set if the requests no rule matches are denied
+	deny bool
+	//defaultRule names the default, defaultDryRun only observes its denials
+	defaultRule   string
+	defaultDryRun bool
+	//dryRun only observes the denials of every rule
+	dryRun bool
+}
+
+var (
+	_ ClientRuleset   = (*ACL)(nil)
+	_ DomainRuleset   = (*ACL)(nil)
+	_ VerdictRuleset  = (*ACL)(nil)
+	_ ResolvedRuleset = (*ACL)(nil)
+)
+
+type aclRule struct {
+	allow bool
+	//dryRun only observes the denials of the rule
+	dryRun bool
+	//name is the rule as written, it identifies the rule in the verdicts
+	name string
+	//the criteria of the rule, a nil one matches every request
+	clients *ipSet
+	dst     *destinationSet
+	ports   []portRange
+	cmds    map[Command]bool
+}
+
+//ACLError is the error of a malformed ACL, Line and Column are 1-based
+type ACLError struct {
+	Line, Column int
+	Msg          string
+}
+
+func (e *ACLError) Error() string {
+	return fmt.Sprintf("socks5: acl line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+//ParseACL parses an ACL of a rule per line, blank lines and everything after a # are skipped.
+//A rule is an action followed by the criteria a request must all match:
+//
+//	allow|deny [dry-run] [client LIST] [dst LIST] [ports LIST] [cmd LIST]
+//	default allow|deny [dry-run]
+//	dry-run
+//
+//LIST is comma separated without spaces. A client is an IP or a CIDR. A dst is an IP, a CIDR or
+//a domain, a domain matches itself and its subdomains while *.example.com matches the
+//subdomains only. IPs and CIDRs match requests for IP addresses and the addresses the domains
+//of requests resolve to once they're dialed or sent datagrams to, a domain resolving into a
+//denied CIDR is refused unless an earlier rule allows it. A port is a number or a range like 8000-8100 and a cmd is connect,
+//bind or udp-associate. The rules are evaluated from the top, requests no rule matches are
+//allowed unless there's a default deny line. The denials of a rule marked dry-run, or of every
+//rule with a dry-run line, are only observed: the requests are allowed and the verdicts tell
+//the rule that would have denied them e.g.
+//
+//	deny client 203.0.113.0/24
+//	deny dst 10.0.0.0/8,192.168.0.0/16
+//	deny cmd bind
+//	allow dst *.example.com ports 443
+//	default deny dry-run
+func ParseACL(r io.Reader) (*ACL, error) {
+	a := &ACL{defaultRule: "default allow"}
+	defaultLine, dryRunLine := 0, 0
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		tokens := tokenize(line)
+		if len(tokens) == 0 {
+			continue
+		}
+		errorf := func(t aclToken, format string, args ...interface{}) error {
+			return &ACLError{Line: n, Column: t.col, Msg: fmt.Sprintf(format, args...)}
+		}
+
+		action := tokens[0]
+		switch action.s {
+		case "allow", "deny":
+		case "default":
+			if len(tokens) < 2 {
+				return nil, errorf(action.end(), "expected allow or deny after default")
+			}
+			if tokens[1].s != "allow" && tokens[1].s != "deny" {
+				return nil, errorf(tokens[1], "expected allow or deny got %q", tokens[1].s)
+			}
+			rest := tokens[2:]
+			dryRun := len(rest) > 0 && rest[0].s == "dry-run"
+			if dryRun {
+				rest = rest[1:]
+			}
+			if len(rest) > 0 {
+				return nil, errorf(rest[0], "unexpected %q", rest[0].s)
+			}
+			if defaultLine != 0 {
+				return nil, errorf(action, "default already set on line %d", defaultLine)
+			}
+			defaultLine = n
+			a.deny, a.defaultDryRun, a.defaultRule = tokens[1].s == "deny", dryRun, "default "+tokens[1].s
+			continue
+		case "dry-run":
+			if len(tokens) > 1 {
+				return nil, errorf(tokens[1], "unexpected %q", tokens[1].s)
+			}
+			if dryRunLine != 0 {
+				return nil, errorf(action, "dry-run already set on line %d", dryRunLine)
+			}
+			dryRunLine = n
+			a.dryRun = true
+			continue
+		default:
+			return nil, errorf(action, "expected allow, deny, default or dry-run got %q", action.s)
+		}
+
+		rule := aclRule{allow: action.s == "allow"}
+		fields := tokens[1:]
+		if len(fields) > 0 && fields[0].s == "dry-run" {
+			rule.dryRun, fields = true, fields[1:]
+		}
+		//the name leaves dry-run out so it's the same once the rule is enforced
+		name := []string{action.s}
+		for _, t := range fields {
+			name = append(name, t.s)
+		}
+		rule.name = strings.Join(name, " ")
+		seen := make(map[string]bool)
+		for i := 0; i < len(fields); i += 2 {
+			field := fields[i]
+			switch field.s {
+			case "client", "dst", "ports", "cmd":
+			default:
+				return nil, errorf(field, "unknown field %q, expected client, dst, ports or cmd", field.s)
+			}
+			if seen[field.s] {
+				return nil, errorf(field, "field %q repeated", field.s)
+			}
+			seen[field.s] = true
+			if i+1 == len(fields) {
+				return nil, errorf(field.end(), "missing the value of %q", field.s)
+			}
+
+			for _, v := range fields[i+1].split() {
+				var err error
+				switch field.s {
+				case "client":
+					if rule.clients == nil {
+						rule.clients = newIPSet()
+					}
+					err = rule.clients.add(v.s)
+				case "dst":
+					if rule.dst == nil {
+						rule.dst = &destinationSet{ips: newIPSet(), domains: newDomainTrie()}
+					}
+					err = rule.dst.add(v.s)
+				case "ports":
+					var pr portRange
+					pr, err = parsePortRange(v.s)
+					rule.ports = append(rule.ports, pr)
+				case "cmd":
+					if rule.cmds == nil {
+						rule.cmds = make(map[Command]bool)
+					}
+					var cmd Command
+					cmd, err = parseCommand(v.s)
+					rule.cmds[cmd] = true
+				}
+				if err != nil {
+					return nil, errorf(v, "%v", err)
+				}
+			}
+		}
+		a.rules = append(a.rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+//Len returns the number of rules of the ACL, the default isn't counted
+func (a *ACL) Len() int {
+	return len(a.rules)
+}
+
+//Allow reports whether the first rule matching the request allows it, the default if none does.
+//The requests denied in dry-run are allowed
+func (a *ACL) Allow(client net.Addr, req *Request) bool {
+	v := a.Verdict(client, req)
+	return v.Allow || v.DryRun
+}
+
+//Verdict returns the verdict of the first rule matching the request, the default if none does
+func (a *ACL) Verdict(client net.Addr, req *Request) Verdict {
+	return a.verdict(addrIP(client), req, nil)
+}
+
+//VerdictResolved returns the verdict of the first rule matching the request whose destination
+//resolved to ip, the IPs and CIDRs of the rules match the destination or ip
+func (a *ACL) VerdictResolved(client net.Addr, req *Request, ip net.IP) Verdict {
+	return a.verdict(addrIP(client), req, ip)
+}
+
+func (a *ACL) verdict(clientIP net.IP, req *Request, resolved net.IP) Verdict {
+	for i := range a.rules {
+		if r := &a.rules[i]; r.matches(clientIP, req, resolved) {
+			return Verdict{Allow: r.allow, Rule: r.name, DryRun: !r.allow && a.observes(r)}
+		}
+	}
+	return Verdict{Allow: !a.deny, Rule: a.defaultRule, DryRun: a.deny && (a.dryRun || a.defaultDryRun)}
+}
+
+//observes reports whether the denials of r are only observed
+func (a *ACL) observes(r *aclRule) bool {
+	return a.dryRun || r.dryRun
+}
+
+//AllowClient reports whether some request of client may be allowed, it's false if the first rule
+//matching client without other criteria denies it before an allow rule could match its requests
+func (a *ACL) AllowClient(client net.Addr) bool {
+	clientIP := addrIP(client)
+	for i := range a.rules {
+		r := &a.rules[i]
+		if r.clients != nil && (clientIP == nil || !r.clients.contains(clientIP)) {
+			continue
+		}
+		if r.allow || (r.dst == nil && r.ports == nil && r.cmds == nil) {
+			return r.allow || a.observes(r)
+		}
+	}
+	return !a.deny || a.dryRun || a.defaultDryRun
+}
+
+//AllowDomain reports whether some request of client for domain may be allowed, it's false if the
+//first rule matching them without port or command criteria denies it before an allow rule could
+//match the requests
+func (a *ACL) AllowDomain(client net.Addr, domain string) bool {
+	clientIP := addrIP(client)
+	dest := &AddrSpec{Type: AddrTypeDomain, Host: domain}
+	for i := range a.rules {
+		r := &a.rules[i]
+		if r.clients != nil && (clientIP == nil || !r.clients.contains(clientIP)) {
+			continue
+		}
+		if r.dst != nil && !r.dst.contains(dest) {
+			continue
+		}
+		if r.allow || (r.ports == nil && r.cmds == nil) {
+			return r.allow || a.observes(r)
+		}
+	}
+	return !a.deny || a.dryRun || a.defaultDryRun
+}
+
+//matches reports whether the request matches r, its destination also matches the IPs and CIDRs
+//of r through resolved unless it's nil
+func (r *aclRule) matches(client net.IP, req *Request, resolved net.IP) bool {
+	if r.clients != nil && (client == nil || !r.clients.contains(client)) {
+		return false
+	}
+	if r.cmds != nil && !r.cmds[req.Command] {
+		return false
+	}
+	if r.ports != nil {
+		var port uint16
+		if req.Dest != nil {
+			port = req.Dest.Port
+		}
+		matched := false
+		for _, pr := range r.ports {
+			if port >= pr.lo && port <= pr.hi {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.dst == nil || (req.Dest != nil && r.dst.contains(req.Dest)) {
+		return true
+	}
+	return resolved != nil && r.dst.ips.contains(resolved)
+}
+
+//aclToken is a word of a line and its 1-based column
+type aclToken struct {
+	s   string
+	col int
+}
+
+//end returns an empty token right after t to report what's missing after it
+func (t aclToken) end() aclToken {
+	return aclToken{col: t.col + len(t.s)}
+}
+
+//split splits a comma separated token keeping the column of every element
+func (t aclToken) split() []aclToken {
+	var tokens []aclToken
+	col := t.col
+	for _, s := range strings.Split(t.s, ",") {
+		tokens = append(tokens, aclToken{s: s, col: col})
+		col += len(s) + 1
+	}
+	return tokens
+}
+
+func tokenize(line string) []aclToken {
+	var tokens []aclToken
+	start := -1
+	for i := 0; i <= len(line); i++ {
+		if i == len(line) || line[i] == ' ' || line[i] == '\t' || line[i] == '\r' {
+			if start != -1 {
+				tokens = append(tokens, aclToken{s: line[start:i], col: start + 1})
+				start = -1
+			}
+		} else if start == -1 {
+			start = i
+		}
+	}
+	return tokens
+}
+
+type portRange struct {
+	lo, hi uint16
+}
+
+func parsePortRange(s string) (portRange, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i != -1 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	l, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || h < l {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	return portRange{uint16(l), uint16(h)}, nil
+}
+
+func parseCommand(s string) (Command, error) {
+	for _, cmd := range []Command{CommandConnect, CommandBind, CommandUDPAssociation} {
+		if s == cmd.String() {
+			return cmd, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown command %q, expected connect, bind or udp-associate", s)
+}
+
+//destinationSet matches the destinations of requests against IPs, CIDRs and domains
+type destinationSet struct {
+	ips     *ipSet
+	domains *domainTrie
+}
+
+func (d *destinationSet) add(s string) error {
+	if d.ips.add(s) == nil {
+		return nil
+	}
+	if err := d.domains.add(s); err != nil {
+		return fmt.Errorf("invalid destination %q, expected an IP, a CIDR or a domain", s)
+	}
+	return nil
+}
+
+func (d *destinationSet) contains(a *AddrSpec) bool {
+	if a.Type != AddrTypeDomain {
+		return d.ips.contains(a.IP)
+	}
+	host := strings.ToLower(strings.TrimSuffix(a.Host, "."))
+	//an IP sent as a domain is checked as an IP so it can't get around the CIDRs
+	if ip := net.ParseIP(host); ip != nil {
+		return d.ips.contains(ip)
+	}
+	return d.domains.contains(host)
+}
+
+//ipSet is a set of CIDRs looked up with a hash per prefix length, the IPs are kept in their 16
+//bytes form so the prefix of an IPv4 CIDR is 96 bits longer
+type ipSet struct {
+	prefixes map[ipPrefixLen]map[string]bool
+	lens     []ipPrefixLen
+}
+
+type ipPrefixLen struct {
+	v4   bool
+	ones int
+}
+
+func newIPSet() *ipSet {
+	return &ipSet{prefixes: make(map[ipPrefixLen]map[string]bool)}
+}
+
+//add adds an IP or a CIDR to the set
+func (s *ipSet) add(cidr string) error {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		if ip = net.ParseIP(cidr); ip == nil {
+			return fmt.Errorf("invalid client %q, expected an IP or a CIDR", cidr)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	ones, bits := ipnet.Mask.Size()
+	l := ipPrefixLen{v4: bits == 8*net.IPv4len, ones: ones}
+	if l.v4 {
+		l.ones += 96
+	}
+	set, ok := s.prefixes[l]
+	if !ok {
+		set = make(map[string]bool)
+		s.prefixes[l] = set
+		s.lens = append(s.lens, l)
+	}
+	set[string(ipnet.IP.To16().Mask(net.CIDRMask(l.ones, 128)))] = true
+	return nil
+}
+
+func (s *ipSet) contains(ip net.IP) bool {
+	v4 := ip.To4() != nil
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	for _, l := range s.lens {
+		if l.v4 != v4 {
+			continue
+		}
+		if s.prefixes[l][string(ip.Mask(net.CIDRMask(l.ones, 128)))] {
+			return true
+		}
+	}
+	return false
+}
+
+//domainTrie is a set of domains stored by label from the top level domain down
+type domainTrie struct {
+	children map[string]*domainTrie
+	//exact matches the domain of the node, subdomains matches the domains under it
+	exact, subdomains bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+//add adds a domain matching itself and its subdomains or a *.domain matching the subdomains
+func (t *domainTrie) add(domain string) error {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	subdomainsOnly := strings.HasPrefix(domain, "*.")
+	if subdomainsOnly {
+		domain = domain[2:]
+	}
+	labels := strings.Split(domain, ".")
+	for _, l := range labels {
+		if l == "" || strings.ContainsAny(l, "*/:") {
+			return fmt.Errorf("invalid domain %q", domain)
+		}
+	}
+	//a numeric top level domain is a mistyped IP
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		next, ok := node.children[labels[i]]
+		if !ok {
+			next = newDomainTrie()
+			node.children[labels[i]] = next
+		}
+		node = next
+	}
+	node.subdomains = true
+	if !subdomainsOnly {
+		node.exact = true
+	}
+	return nil
+}
+
+func (t *domainTrie) contains(domain string) bool {
+	labels := strings.Split(domain, ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		next, ok := node.children[labels[i]]
+		if !ok {
+			return false
+		}
+		node = next
+		if i > 0 && node.subdomains {
+			return true
+		}
+	}
+	return node.exact
+}
+
+//addrIP returns the IP of addr, nil if it has none
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package socks5
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5/socks5test"
+)
+
+func TestParseACLErrors(t *testing.T) {
+	tts := []struct {
+		in           string
+		line, column int
+		msg          string
+	}{
+		{"permit dst 10.0.0.0/8", 1, 1, `expected allow, deny, default or dry-run got "permit"`},
+		{"\n  deny dts 10.0.0.0/8", 2, 8, `unknown field "dts", expected client, dst, ports or cmd`},
+		{"deny dst", 1, 9, `missing the value of "dst"`},
+		{"deny dst 10.0.0.0/33", 1, 10, `invalid destination "10.0.0.0/33", expected an IP, a CIDR or a domain`},
+		{"deny dst example.com,,example.org", 1, 22, `invalid destination "", expected an IP, a CIDR or a domain`},
+		{"deny dst a.example.*", 1, 10, `invalid destination "a.example.*", expected an IP, a CIDR or a domain`},
+		{"deny dst 10.0.0.256", 1, 10, `invalid destination "10.0.0.256", expected an IP, a CIDR or a domain`},
+		{"deny client example.com", 1, 13, `invalid client "example.com", expected an IP or a CIDR`},
+		{"allow dst example.com ports 443,80-22", 1, 33, `invalid port "80-22"`},
+		{"allow ports 65536", 1, 13, `invalid port "65536"`},
+		{"deny cmd connect,listen", 1, 18, `unknown command "listen", expected connect, bind or udp-associate`},
+		{"deny cmd bind cmd connect", 1, 15, `field "cmd" repeated`},
+		{"default", 1, 8, "expected allow or deny after default"},
+		{"default reject", 1, 9, `expected allow or deny got "reject"`},
+		{"default deny # comment\n\tdefault allow", 2, 2, "default already set on line 1"},
+		{"default deny now", 1, 14, `unexpected "now"`},
+		{"default deny dry-run now", 1, 22, `unexpected "now"`},
+		{"dry-run\ndry-run", 2, 1, "dry-run already set on line 1"},
+		{"dry-run now", 1, 9, `unexpected "now"`},
+		{"deny dst example.com dry-run", 1, 22, `unknown field "dry-run", expected client, dst, ports or cmd`},
+	}
+	for _, tt := range tts {
+		_, err := ParseACL(strings.NewReader(tt.in))
+		e, ok := err.(*ACLError)
+		if !ok || e.Line != tt.line || e.Column != tt.column || e.Msg != tt.msg {
+			t.Errorf("%q: expected %d:%d %q got %v", tt.in, tt.line, tt.column, tt.msg, err)
+		}
+	}
+}
+
+func TestACLAllow(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+# blocked clients
+deny client 203.0.113.0/24,2001:db8::1
+deny dst 10.0.0.0/8,192.168.1.1,fd00::/8
+deny cmd bind
+allow dst *.example.com ports 443,8000-8100
+allow dst example.org cmd connect
+deny dst example.org
+allow dst 198.51.100.0/24
+default deny
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.Len() != 7 {
+		t.Errorf("expected 7 rules got %d", acl.Len())
+	}
+
+	client := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	domain := func(host string, port uint16) *AddrSpec {
+		return &AddrSpec{Type: AddrTypeDomain, Host: host, Port: port}
+	}
+	ip := func(host string, port uint16) *AddrSpec {
+		return &AddrSpec{Type: AddrTypeIPv4, IP: net.ParseIP(host), Port: port}
+	}
+	tts := []struct {
+		client  string
+		cmd     Command
+		dest    *AddrSpec
+		allowed bool
+	}{
+		{"", CommandConnect, domain("www.example.com", 443), true},
+		{"", CommandConnect, domain("WWW.Example.COM.", 8080), true},
+		{"", CommandConnect, domain("www.example.com", 80), false},
+		{"", CommandConnect, domain("example.com", 443), false},
+		{"", CommandBind, domain("www.example.com", 443), false},
+		{"", CommandConnect, domain("example.org", 80), true},
+		{"", CommandConnect, domain("mail.example.org", 25), true},
+		{"", CommandUDPAssociation, domain("example.org", 53), false},
+		{"", CommandConnect, domain("notexample.org", 80), false},
+		{"", CommandConnect, ip("10.1.2.3", 443), false},
+		{"", CommandConnect, ip("192.168.1.1", 443), false},
+		{"", CommandConnect, ip("192.168.1.2", 443), false},
+		{"", CommandConnect, ip("198.51.100.7", 80), true},
+		{"", CommandConnect, domain("198.51.100.7", 80), true},
+		{"", CommandConnect, domain("10.0.0.1", 443), false},
+		{"", CommandConnect, &AddrSpec{Type: AddrTypeIPv6, IP: net.ParseIP("fd00::1"), Port: 443}, false},
+		{"203.0.113.9", CommandConnect, ip("198.51.100.7", 80), false},
+		{"2001:db8::1", CommandConnect, ip("198.51.100.7", 80), false},
+		{"2001:db8::2", CommandConnect, ip("198.51.100.7", 80), true},
+	}
+	for _, tt := range tts {
+		c := client
+		if tt.client != "" {
+			c = &net.TCPAddr{IP: net.ParseIP(tt.client), Port: 40000}
+		}
+		if allowed := acl.Allow(c, &Request{Command: tt.cmd, Dest: tt.dest}); allowed != tt.allowed {
+			t.Errorf("%v %v %v: expected %v got %v", c, tt.cmd, tt.dest, tt.allowed, allowed)
+		}
+	}
+
+	acl, err = ParseACL(strings.NewReader("deny dst example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Allow(client, &Request{Command: CommandConnect, Dest: domain("example.net", 80)}) {
+		t.Error("expected the requests no rule matches to be allowed by default")
+	}
+}
+
+func TestACLDenied(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	acl, err := ParseACL(strings.NewReader("deny dst 127.0.0.0/8,::1 ports " + portOf(echo.Addr()) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, proxy := newTestServer(t, WithRuleset(acl))
+	defer s.Close()
+
+	//a domain is refused once it resolves into the denied CIDR
+	for _, addr := range []string{echo.Addr().String(), net.JoinHostPort("localhost", portOf(echo.Addr()))} {
+		d := socks5test.Dial(t, proxy, 5*time.Second)
+		d.Handshake(socks5test.Options{})
+		d.RequestAddr(socks5test.CmdConnect, addr)
+		if r := d.ExpectReply(); r.Code != socks5test.ReplyNotAllowedByRuleset {
+			t.Fatalf("%s: expected reply code %d got %d", addr, socks5test.ReplyNotAllowedByRuleset, r.Code)
+		}
+		d.ExpectClosed()
+		d.Close()
+	}
+}
+
+func TestACLVerdictResolved(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	tts := []struct {
+		acl      string
+		domain   string
+		resolved string
+		allowed  bool
+	}{
+		{"deny dst 10.0.0.0/8", "intranet.example", "10.1.2.3", false},
+		{"deny dst 10.0.0.0/8", "www.example", "198.51.100.1", true},
+		{"deny dst 10.0.0.0/8 ports 22", "intranet.example", "10.1.2.3", true},
+		{"allow dst intranet.example\ndeny dst 10.0.0.0/8", "intranet.example", "10.1.2.3", true},
+		{"allow dst *.example\ndefault deny", "www.example", "198.51.100.1", true},
+		{"allow dst 198.51.100.0/24\ndefault deny", "www.example", "198.51.100.1", true},
+		{"deny dry-run dst 10.0.0.0/8", "intranet.example", "10.1.2.3", true},
+	}
+	for _, tt := range tts {
+		acl, err := ParseACL(strings.NewReader(tt.acl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &Request{Command: CommandConnect, Dest: &AddrSpec{Type: AddrTypeDomain, Host: tt.domain, Port: 443}}
+		v := acl.VerdictResolved(client, req, net.ParseIP(tt.resolved))
+		if allowed := v.Allow || v.DryRun; allowed != tt.allowed {
+			t.Errorf("%q %s resolved to %s: expected %v got %v", tt.acl, tt.domain, tt.resolved, tt.allowed, allowed)
+		}
+	}
+}
+
+func TestACLAllowDomain(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	tts := []struct {
+		acl     string
+		domain  string
+		allowed bool
+	}{
+		{"", "example.com.", true},
+		{"deny dst ads.example", "ads.example.", false},
+		{"deny dst ads.example", "tracker.ads.example", false},
+		{"deny dst ads.example", "example.com", true},
+		{"deny dst ads.example ports 80", "ads.example", true},
+		{"allow dst example.com ports 443\ndefault deny", "example.com", true},
+		{"allow dst example.com ports 443\ndefault deny", "example.org", false},
+		{"deny client 192.0.2.0/24 dst example.com", "example.com", false},
+		{"deny client 198.51.100.0/24 dst example.com", "example.com", true},
+	}
+	for _, tt := range tts {
+		acl, err := ParseACL(strings.NewReader(tt.acl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := acl.AllowDomain(client, tt.domain); allowed != tt.allowed {
+			t.Errorf("%q %s: expected %v got %v", tt.acl, tt.domain, tt.allowed, allowed)
+		}
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
@@ -15,7 +15,11 @@ var ErrInvalidPort = errors.New("socks5: invalid port number")
 //ErrInvalidAddr is returned if the addr is invalid
 var ErrInvalidAddr = errors.New("socks5: invalid address")
 
-var nullIPv4SocksAddr = &socksAddr{Type: AddrTypeIPv4, Addr: "0.0.0.0:0"}
+//ErrEmptyHost is returned if the host of the addr is empty
+var ErrEmptyHost = errors.New("socks5: empty host")
+
+//ErrDomainTooLong is returned if the domain of the addr is longer than 255 bytes
+var ErrDomainTooLong = errors.New("socks5: domain longer than 255 bytes")
 
 //AddrType is the Address type defined in SOCKS5
 type AddrType byte
@@ -35,88 +39,253 @@ var addrTypeString = map[AddrType]string{
 	AddrTypeDomain: "domain",
 }
 
-type socksAddr struct {
+//SocksAddr is an address as encoded in SOCKS5 requests, replies and UDP headers
+type SocksAddr struct {
 	Type AddrType
 	Addr string
 }
 
-var _ net.Addr = (*socksAddr)(nil)
+var _ net.Addr = (*SocksAddr)(nil)
+
+//ParseAddr returns the SocksAddr of the host:port addr, the type is inferred from the host
+func ParseAddr(addr string) (*SocksAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, ErrInvalidAddr
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, ErrInvalidPort
+	}
+	if host == "" {
+		return nil, ErrEmptyHost
+	}
+
+	s := &SocksAddr{Addr: addr, Type: AddrTypeDomain}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if len(host) > 255 {
+			return nil, ErrDomainTooLong
+		}
+		return s, nil
+	}
+
+	if ip.To4() != nil {
+		s.Type = AddrTypeIPv4
+		return s, nil
+	}
+	s.Type = AddrTypeIPv6
+	return s, nil
+}
+
+//UnmarshalFrom reads an address type, an address and a port from r
+func UnmarshalFrom(r io.Reader) (*SocksAddr, error) {
+	a, err := ReadAddrSpec(r)
+	if err != nil {
+		return nil, err
+	}
+	return &SocksAddr{Type: a.Type, Addr: a.String()}, nil
+}
 
-func (s *socksAddr) Network() string {
+//Network returns the name of the address type
+func (s *SocksAddr) Network() string {
 	return addrTypeString[s.Type]
 }
 
-func (s *socksAddr) String() string {
+//String returns the host:port of the address
+func (s *SocksAddr) String() string {
 	return s.Addr
 }
 
-func (s *socksAddr) Marshal(b []byte) (int, error) {
+//MarshaledLen returns the number of bytes Marshal writes for a valid address
+func (s *SocksAddr) MarshaledLen() int {
+	switch s.Type {
+	case AddrTypeIPv4:
+		return 1 + net.IPv4len + 2
+	case AddrTypeIPv6:
+		return 1 + net.IPv6len + 2
+	}
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return 1 + 1 + len(host) + 2
+}
+
+//Marshal writes the address type, the address and the port to b and returns the number of
+//bytes written, io.ErrShortBuffer is returned if b is smaller than MarshaledLen
+func (s *SocksAddr) Marshal(b []byte) (int, error) {
+	//with the capacity capped AppendTo only reallocates if b is too small
+	out, err := s.AppendTo(b[:0:len(b)])
+	if err != nil {
+		return 0, err
+	}
+	if len(out) > len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	return len(out), nil
+}
 
+//AppendTo appends the address type, the address and the port to dst growing it as needed
+func (s *SocksAddr) AppendTo(dst []byte) ([]byte, error) {
 	host, port, err := net.SplitHostPort(s.Addr)
 	if err != nil {
 		log.Printf("socks5:addr invalid address: %v", err)
-		return 0, ErrInvalidAddr
+		return dst, ErrInvalidAddr
+	}
+	if host == "" {
+		return dst, ErrEmptyHost
 	}
 
-	ip := net.ParseIP(host)
-	if ip == nil && (s.Type == AddrTypeIPv4 || s.Type == AddrTypeIPv6) {
-		return 0, ErrInvalidAddr
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		log.Printf("socks5:addr unable to parse port: %v", err)
+		return dst, ErrInvalidPort
 	}
 
-	al := 0
-	switch s.Type {
+	a := &AddrSpec{Type: s.Type, Host: host, IP: net.ParseIP(host), Port: uint16(p)}
+	return a.AppendTo(dst)
+}
+
+//AddrSpec is an address of a request or a reply with the host and the port kept apart, IP is
+//set for the IP address types and Host for domains
+type AddrSpec struct {
+	Type AddrType
+	Host string
+	IP   net.IP
+	Port uint16
+}
+
+var _ net.Addr = (*AddrSpec)(nil)
+
+var nullAddrSpec = &AddrSpec{Type: AddrTypeIPv4, IP: net.IPv4zero}
+
+//ReadAddrSpec reads an address type, an address and a port from r
+func ReadAddrSpec(r io.Reader) (*AddrSpec, error) {
+	var buf [1 + 255 + 2]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, err
+	}
+
+	a := &AddrSpec{Type: AddrType(buf[0])}
+	l := 0
+	switch a.Type {
 	case AddrTypeIPv4:
-		al = net.IPv4len
+		l = net.IPv4len
 	case AddrTypeIPv6:
-		al = net.IPv6len
+		l = net.IPv6len
 	case AddrTypeDomain:
-		al = 1 + len(host)
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return nil, err
+		}
+		if l = int(buf[0]); l == 0 {
+			return nil, ErrEmptyHost
+		}
+	default:
+		return nil, ErrAddressTypeNotSupported
 	}
 
-	if b == nil || len(b) < al+3 {
-		return 0, io.ErrShortBuffer
+	if _, err := io.ReadFull(r, buf[:l+2]); err != nil {
+		return nil, err
 	}
 
-	b[0] = byte(s.Type)
+	if a.Type == AddrTypeDomain {
+		a.Host = string(buf[:l])
+	} else {
+		a.IP = append(net.IP(nil), buf[:l]...)
+	}
+	a.Port = binary.BigEndian.Uint16(buf[l : l+2])
+	return a, nil
+}
 
-	switch s.Type {
-	case AddrTypeIPv4:
-		copy(b[1:], ip.To4())
-	case AddrTypeIPv6:
-		copy(b[1:], ip.To16())
-	case AddrTypeDomain:
-		b[1] = byte(len(host))
-		copy(b[2:], host)
+//hostAddrSpec returns the AddrSpec of host and port, the type is inferred from the host
+func hostAddrSpec(host string, port uint16) *AddrSpec {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &AddrSpec{Type: AddrTypeDomain, Host: host, Port: port}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &AddrSpec{Type: AddrTypeIPv4, IP: ip4, Port: port}
+	}
+	return &AddrSpec{Type: AddrTypeIPv6, IP: ip, Port: port}
+}
+
+//netAddrSpec returns the AddrSpec of a TCP or UDP address, it's nil for addresses that
+//aren't host:port e.g. unix sockets
+func netAddrSpec(addr net.Addr) *AddrSpec {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *AddrSpec:
+		return a
+	case *net.TCPAddr:
+		return hostAddrSpec(a.IP.String(), uint16(a.Port))
+	case *net.UDPAddr:
+		return hostAddrSpec(a.IP.String(), uint16(a.Port))
 	}
 
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
 	p, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
-		log.Printf("socks5:addr unable to parse port: %v", err)
-		return 0, ErrInvalidPort
+		return nil
 	}
+	return hostAddrSpec(host, uint16(p))
+}
 
-	binary.BigEndian.PutUint16(b[1+al:], uint16(p))
-	return 3 + al, nil
+//Network returns the name of the address type
+func (a *AddrSpec) Network() string {
+	return addrTypeString[a.Type]
 }
 
-func newAddr(addr string) *socksAddr {
-	host, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		log.Printf("socks5:addr invalid address: %v", err)
-		return nil
+//String returns the host:port of the address, it's meant for dialing and logging
+func (a *AddrSpec) String() string {
+	host := a.Host
+	if a.Type != AddrTypeDomain {
+		host = a.IP.String()
 	}
+	return net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
+}
 
-	s := &socksAddr{Addr: addr, Type: AddrTypeDomain}
+//MarshaledLen returns the number of bytes AppendTo appends for a valid address
+func (a *AddrSpec) MarshaledLen() int {
+	switch a.Type {
+	case AddrTypeIPv4:
+		return 1 + net.IPv4len + 2
+	case AddrTypeIPv6:
+		return 1 + net.IPv6len + 2
+	}
+	return 1 + 1 + len(a.Host) + 2
+}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
-		return s
+//AppendTo appends the address type, the address and the port to dst growing it as needed
+func (a *AddrSpec) AppendTo(dst []byte) ([]byte, error) {
+	var ip net.IP
+	switch a.Type {
+	case AddrTypeIPv4:
+		if ip = a.IP.To4(); ip == nil {
+			return dst, ErrInvalidAddr
+		}
+	case AddrTypeIPv6:
+		if ip = a.IP.To16(); ip == nil {
+			return dst, ErrInvalidAddr
+		}
+	case AddrTypeDomain:
+		if a.Host == "" {
+			return dst, ErrEmptyHost
+		}
+		if len(a.Host) > 255 {
+			return dst, ErrDomainTooLong
+		}
+	default:
+		return dst, ErrAddressTypeNotSupported
 	}
 
-	if ip.To4() != nil {
-		s.Type = AddrTypeIPv4
-		return s
+	dst = append(dst, byte(a.Type))
+	if a.Type == AddrTypeDomain {
+		dst = append(dst, byte(len(a.Host)))
+		dst = append(dst, a.Host...)
+	} else {
+		dst = append(dst, ip...)
 	}
-	s.Type = AddrTypeIPv6
-	return s
+	return append(dst, byte(a.Port>>8), byte(a.Port)), nil
 }
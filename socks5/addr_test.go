@@ -2,39 +2,112 @@ package socks5
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/quick"
 )
 
-func TestSocksAddrNew(t *testing.T) {
+func TestParseAddr(t *testing.T) {
 	tts := []struct {
 		addr      string
-		socksAddr *socksAddr
+		socksAddr *SocksAddr
+		err       error
 	}{
-		{"0.0.0.0:0", &socksAddr{Type: AddrTypeIPv4, Addr: "0.0.0.0:0"}},
-		{"1.2.3.4:5", &socksAddr{Type: AddrTypeIPv4, Addr: "1.2.3.4:5"}},
-		{"google.com:80", &socksAddr{Type: AddrTypeDomain, Addr: "google.com:80"}},
-		{"[::]:80", &socksAddr{Type: AddrTypeIPv6, Addr: "[::]:80"}},
-		{"[2001:db8::a:b:c:d]:80", &socksAddr{Type: AddrTypeIPv6, Addr: "[2001:db8::a:b:c:d]:80"}},
+		{"0.0.0.0:0", &SocksAddr{Type: AddrTypeIPv4, Addr: "0.0.0.0:0"}, nil},
+		{"1.2.3.4:5", &SocksAddr{Type: AddrTypeIPv4, Addr: "1.2.3.4:5"}, nil},
+		{"google.com:80", &SocksAddr{Type: AddrTypeDomain, Addr: "google.com:80"}, nil},
+		{"[::]:80", &SocksAddr{Type: AddrTypeIPv6, Addr: "[::]:80"}, nil},
+		{"[2001:db8::a:b:c:d]:80", &SocksAddr{Type: AddrTypeIPv6, Addr: "[2001:db8::a:b:c:d]:80"}, nil},
+		{"google.com", nil, ErrInvalidAddr},
+		{"/tmp/socks.sock", nil, ErrInvalidAddr},
+		{"google.com:http", nil, ErrInvalidPort},
+		{"google.com:65536", nil, ErrInvalidPort},
+		{":80", nil, ErrEmptyHost},
+		{strings.Repeat("a", 256) + ":80", nil, ErrDomainTooLong},
 	}
 
 	for _, tt := range tts {
-		s := newAddr(tt.addr)
-		if s == nil || s.Addr != tt.socksAddr.Addr || s.Type != tt.socksAddr.Type {
-			t.Fail()
+		s, err := ParseAddr(tt.addr)
+		if err != tt.err {
+			t.Errorf("%s: expected error %v got %v", tt.addr, tt.err, err)
+			continue
+		}
+		if tt.socksAddr != nil && (s.Addr != tt.socksAddr.Addr || s.Type != tt.socksAddr.Type) {
+			t.Errorf("%s: expected %v got %v", tt.addr, tt.socksAddr, s)
+		}
+	}
+}
+
+func TestSocksAddrRoundTrip(t *testing.T) {
+	tts := []string{
+		"0.0.0.0:0",
+		"1.2.3.4:65535",
+		"[::1]:80",
+		"[2001:db8::a:b:c:d]:443",
+		"a:1",
+		"google.com:80",
+		strings.Repeat("a", 255) + ":8080",
+	}
+
+	for _, tt := range tts {
+		addr, err := ParseAddr(tt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, addr.MarshaledLen()+1)
+		n, err := addr.Marshal(b)
+		if err != nil {
+			t.Fatalf("%s: %v", tt, err)
+		}
+		if n != addr.MarshaledLen() {
+			t.Errorf("%s: marshaled %d bytes expected %d", tt, n, addr.MarshaledLen())
+		}
+		if _, err := addr.Marshal(b[:n-1]); err != io.ErrShortBuffer {
+			t.Errorf("%s: expected %v got %v", tt, io.ErrShortBuffer, err)
+		}
+
+		r := bytes.NewReader(b[:n])
+		got, err := UnmarshalFrom(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tt, err)
+		}
+		if *got != *addr || r.Len() != 0 {
+			t.Errorf("%s: expected %v got %v with %d bytes left", tt, addr, got, r.Len())
 		}
+
+		//every truncation of the encoding is an error
+		for i := 0; i < n; i++ {
+			if _, err := UnmarshalFrom(bytes.NewReader(b[:i])); err == nil {
+				t.Errorf("%s: expected an error for %d bytes", tt, i)
+			}
+		}
+	}
+}
+
+func TestUnmarshalFromAddrType(t *testing.T) {
+	if _, err := UnmarshalFrom(bytes.NewReader([]byte{5, 1, 2, 3, 4, 0, 80})); err != ErrAddressTypeNotSupported {
+		t.Errorf("expected %v got %v", ErrAddressTypeNotSupported, err)
 	}
 }
 
 func TestSocksAddrMarshal(t *testing.T) {
 	tts := []struct {
-		addr   *socksAddr
+		addr   *SocksAddr
 		result []byte
 	}{
-		{&socksAddr{Type: AddrTypeIPv4, Addr: "0.0.0.0:0"}, []byte{1, 0, 0, 0, 0, 0, 0}},
-		{&socksAddr{Type: AddrTypeIPv4, Addr: "1.2.3.4:5"}, []byte{1, 1, 2, 3, 4, 0, 5}},
-		{&socksAddr{Type: AddrTypeDomain, Addr: "google.com:80"}, []byte{3, 10, 103, 111, 111, 103, 108, 101, 46, 99, 111, 109, 0, 80}},
-		{&socksAddr{Type: AddrTypeIPv6, Addr: "[::]:80"}, []byte{4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 80}},
-		{&socksAddr{Type: AddrTypeIPv6, Addr: "[2001:db8::a:b:c:d]:80"}, []byte{4, 32, 1, 13, 184, 0, 0, 0, 0, 0, 10, 0, 11, 0, 12, 0, 13, 0, 80}},
+		{&SocksAddr{Type: AddrTypeIPv4, Addr: "0.0.0.0:0"}, []byte{1, 0, 0, 0, 0, 0, 0}},
+		{&SocksAddr{Type: AddrTypeIPv4, Addr: "1.2.3.4:5"}, []byte{1, 1, 2, 3, 4, 0, 5}},
+		{&SocksAddr{Type: AddrTypeDomain, Addr: "google.com:80"}, []byte{3, 10, 103, 111, 111, 103, 108, 101, 46, 99, 111, 109, 0, 80}},
+		{&SocksAddr{Type: AddrTypeIPv6, Addr: "[::]:80"}, []byte{4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 80}},
+		{&SocksAddr{Type: AddrTypeIPv6, Addr: "[2001:db8::a:b:c:d]:80"}, []byte{4, 32, 1, 13, 184, 0, 0, 0, 0, 0, 10, 0, 11, 0, 12, 0, 13, 0, 80}},
 	}
 
 	for _, tt := range tts {
@@ -52,20 +125,161 @@ func TestSocksAddrMarshal(t *testing.T) {
 
 func TestSocksAddrMarshalErrors(t *testing.T) {
 	tts := []struct {
-		addr *socksAddr
+		addr *SocksAddr
 		size int
+		err  error
 	}{
-		{&socksAddr{Type: AddrTypeIPv4, Addr: "0.0.0.0:0"}, 5},
-		{&socksAddr{Type: AddrTypeDomain, Addr: "1.2.3.4:a"}, 256},
-		{&socksAddr{Type: AddrTypeIPv4, Addr: "google.com:80"}, 256},
-		{&socksAddr{Type: AddrTypeIPv4, Addr: "google.com"}, 256},
+		{&SocksAddr{Type: AddrTypeIPv4, Addr: "0.0.0.0:0"}, 5, io.ErrShortBuffer},
+		{&SocksAddr{Type: AddrTypeDomain, Addr: "1.2.3.4:a"}, 256, ErrInvalidPort},
+		{&SocksAddr{Type: AddrTypeIPv4, Addr: "google.com:80"}, 256, ErrInvalidAddr},
+		{&SocksAddr{Type: AddrTypeIPv4, Addr: "google.com"}, 256, ErrInvalidAddr},
+		{&SocksAddr{Type: AddrTypeIPv4, Addr: "[::1]:80"}, 256, ErrInvalidAddr},
+		{&SocksAddr{Type: AddrTypeDomain, Addr: ":80"}, 256, ErrEmptyHost},
+		{&SocksAddr{Type: AddrTypeDomain, Addr: strings.Repeat("a", 256) + ":80"}, 512, ErrDomainTooLong},
+		{&SocksAddr{Type: 0x05, Addr: "1.2.3.4:80"}, 256, ErrAddressTypeNotSupported},
 	}
 
 	for _, tt := range tts {
 		b := make([]byte, tt.size)
 		n, err := tt.addr.Marshal(b)
-		if err == nil || n > 0 {
-			t.Error(err, n, tt.addr)
+		if err != tt.err || n > 0 {
+			t.Errorf("%v: expected %v got %v, %d", tt.addr, tt.err, err, n)
+		}
+	}
+}
+
+func TestSocksAddrAppendTo(t *testing.T) {
+	addr := &SocksAddr{Type: AddrTypeDomain, Addr: strings.Repeat("a", 255) + ":80"}
+	b, err := addr.AppendTo([]byte{5, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 3+addr.MarshaledLen() || !bytes.Equal(b[:5], []byte{5, 0, 0, 3, 255}) {
+		t.Errorf("unexpected encoding % x", b[:5])
+	}
+
+	b, err = (&SocksAddr{Type: AddrTypeDomain, Addr: ":80"}).AppendTo([]byte{5})
+	if err != ErrEmptyHost || !bytes.Equal(b, []byte{5}) {
+		t.Errorf("expected %v and dst untouched got %v, % x", ErrEmptyHost, err, b)
+	}
+}
+
+//anything that marshals parses back to an equivalent address
+func TestSocksAddrMarshalProperty(t *testing.T) {
+	hosts := []func(r *rand.Rand) string{
+		func(r *rand.Rand) string { return net.IP(randBytes(r, net.IPv4len)).String() },
+		func(r *rand.Rand) string { return net.IP(randBytes(r, net.IPv6len)).String() },
+		func(r *rand.Rand) string { return string(randBytes(r, r.Intn(300))) },
+		func(r *rand.Rand) string { return strings.Repeat("a", 250+r.Intn(10)) },
+	}
+
+	f := func(typ, host uint8, port uint16, seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		addr := &SocksAddr{
+			Type: []AddrType{AddrTypeIPv4, AddrTypeDomain, AddrTypeIPv6, AddrType(typ)}[typ%4],
+			Addr: net.JoinHostPort(hosts[int(host)%len(hosts)](r), strconv.Itoa(int(port))),
+		}
+
+		b, err := addr.AppendTo(nil)
+		if err != nil {
+			return true
+		}
+		got, err := UnmarshalFrom(bytes.NewReader(b))
+		if err != nil {
+			t.Logf("%v: %v", addr, err)
+			return false
+		}
+
+		wantHost, wantPort, _ := net.SplitHostPort(addr.Addr)
+		gotHost, gotPort, _ := net.SplitHostPort(got.Addr)
+		if got.Type == AddrTypeDomain {
+			return got.Type == addr.Type && gotHost == wantHost && gotPort == wantPort
+		}
+		return got.Type == addr.Type && net.ParseIP(gotHost).Equal(net.ParseIP(wantHost)) && gotPort == wantPort
+	}
+
+	//most random hosts are rejected and logged
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func randBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func TestAddrSpec(t *testing.T) {
+	tts := []struct {
+		encoded []byte
+		spec    *AddrSpec
+		str     string
+	}{
+		{[]byte{1, 1, 2, 3, 4, 0, 80}, &AddrSpec{Type: AddrTypeIPv4, IP: net.IP{1, 2, 3, 4}, Port: 80}, "1.2.3.4:80"},
+		{[]byte{4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90}, &AddrSpec{Type: AddrTypeIPv6, IP: net.IPv6loopback, Port: 8080}, "[::1]:8080"},
+		{[]byte{3, 10, 103, 111, 111, 103, 108, 101, 46, 99, 111, 109, 1, 187}, &AddrSpec{Type: AddrTypeDomain, Host: "google.com", Port: 443}, "google.com:443"},
+		//a domain with colons is kept as is, brackets only appear in the joined form
+		{[]byte{3, 5, 'a', ':', 'b', ':', 'c', 0, 80}, &AddrSpec{Type: AddrTypeDomain, Host: "a:b:c", Port: 80}, "[a:b:c]:80"},
+	}
+
+	for _, tt := range tts {
+		spec, err := ReadAddrSpec(bytes.NewReader(tt.encoded))
+		if err != nil {
+			t.Fatal(err)
 		}
+		if spec.Type != tt.spec.Type || spec.Host != tt.spec.Host || !spec.IP.Equal(tt.spec.IP) || spec.Port != tt.spec.Port {
+			t.Errorf("expected %+v got %+v", tt.spec, spec)
+		}
+		if spec.String() != tt.str {
+			t.Errorf("expected %s got %s", tt.str, spec.String())
+		}
+
+		b, err := spec.AppendTo(nil)
+		if err != nil || !bytes.Equal(b, tt.encoded) || len(b) != spec.MarshaledLen() {
+			t.Errorf("%s: expected % x got % x, %v", tt.str, tt.encoded, b, err)
+		}
+	}
+}
+
+func TestNetAddrSpec(t *testing.T) {
+	tts := []struct {
+		addr net.Addr
+		spec *AddrSpec
+	}{
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}, &AddrSpec{Type: AddrTypeIPv4, IP: net.IP{10, 0, 0, 1}, Port: 1080}},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, &AddrSpec{Type: AddrTypeIPv6, IP: net.ParseIP("2001:db8::1"), Port: 53}},
+		{&SocksAddr{Type: AddrTypeDomain, Addr: "example.com:80"}, &AddrSpec{Type: AddrTypeDomain, Host: "example.com", Port: 80}},
+		{&net.UnixAddr{Name: "/run/socks5.sock", Net: "unix"}, nil},
+	}
+
+	for _, tt := range tts {
+		spec := netAddrSpec(tt.addr)
+		if tt.spec == nil {
+			if spec != nil {
+				t.Errorf("%v: expected nil got %+v", tt.addr, spec)
+			}
+			continue
+		}
+		if spec == nil || spec.Type != tt.spec.Type || spec.Host != tt.spec.Host || !spec.IP.Equal(tt.spec.IP) || spec.Port != tt.spec.Port {
+			t.Errorf("%v: expected %+v got %+v", tt.addr, tt.spec, spec)
+		}
+	}
+}
+
+func TestReadCommandRequest(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go b.Write([]byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80})
+	cmd, addr, err := newConn(a).ReadCommandRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != CommandConnect || addr.Type != AddrTypeIPv6 || !addr.IP.Equal(net.ParseIP("2001:db8::1")) || addr.Port != 80 || addr.Host != "" {
+		t.Errorf("unexpected request %d %+v", cmd, addr)
 	}
 }
@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//AdminHandler returns a handler to inspect and act on the server, it's meant to be mounted
+//behind authentication:
+//
+//	GET  /sessions                           the active sessions and whether the server drains
+//	                                         or is paused
+//	POST /pause                              stops admitting new sessions
+//	POST /resume                             admits new sessions again
+//	GET  /destinations?n=10                  the top destinations of WithDestinationStats
+//	POST /ban?ip=IP&duration=1h&reason=text  bans a client
+//	POST /unban?ip=IP                        lifts the ban of a client
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, struct {
+			Active   int  `json:"active"`
+			Draining bool `json:"draining"`
+			Paused   bool `json:"paused"`
+		}{s.ActiveSessions(), s.Draining(), s.Paused()})
+	})
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodPost) {
+			return
+		}
+		s.Pause()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodPost) {
+			return
+		}
+		s.Resume()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/destinations", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodGet) {
+			return
+		}
+		n := 0
+		if v := r.FormValue("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		dests := s.TopDestinations(n)
+		if dests == nil {
+			dests = []DestStat{}
+		}
+		writeJSON(w, dests)
+	})
+	mux.HandleFunc("/ban", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodPost) {
+			return
+		}
+		ip := net.ParseIP(r.FormValue("ip"))
+		d, err := time.ParseDuration(r.FormValue("duration"))
+		if ip == nil || err != nil || d <= 0 {
+			http.Error(w, "expected an ip and a positive duration", http.StatusBadRequest)
+			return
+		}
+		s.Ban(ip, d, r.FormValue("reason"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/unban", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodPost) {
+			return
+		}
+		ip := net.ParseIP(r.FormValue("ip"))
+		if ip == nil {
+			http.Error(w, "expected an ip", http.StatusBadRequest)
+			return
+		}
+		s.Unban(ip)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+//adminMethod answers requests whose method isn't method, it reports whether r is to be served
+func adminMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
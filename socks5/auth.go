@@ -1,6 +1,7 @@
 package socks5
 
 import (
+	"crypto/subtle"
 	"errors"
 	"io"
 	"net"
@@ -45,8 +46,55 @@ type usernamePasswordAuth struct {
 
 func (r usernamePasswordAuth) AuthMethod() AuthMethod { return userPassAuth }
 
-func (r usernamePasswordAuth) Authenticate(cn net.Conn) (err error) {
-	c, _ := cn.(*conn)
+func (r usernamePasswordAuth) Authenticate(cn net.Conn) error {
+	return authenticateUserPass(cn, func(user, pass string) bool {
+		return user == r.Username && pass == r.Password
+	})
+}
+
+//NewUserPassAuth creates a new username/password based authenticator
+func NewUserPassAuth(username, password string) Authenticator {
+	return &usernamePasswordAuth{Username: username, Password: password}
+}
+
+//CredentialStore checks the credentials of clients authenticating with a username and password
+type CredentialStore interface {
+	Valid(username, password string) bool
+}
+
+//StaticCredentials is a CredentialStore of usernames and their passwords
+type StaticCredentials map[string]string
+
+//Valid reports whether password is the password of username
+func (s StaticCredentials) Valid(username, password string) bool {
+	p, ok := s[username]
+	return ok && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+}
+
+type credentialAuth struct {
+	store CredentialStore
+}
+
+var _ Authenticator = (*credentialAuth)(nil)
+
+//NewCredentialAuth creates a username/password based authenticator checking the credentials
+//with store
+func NewCredentialAuth(store CredentialStore) Authenticator {
+	return &credentialAuth{store: store}
+}
+
+func (r credentialAuth) AuthMethod() AuthMethod { return userPassAuth }
+
+func (r credentialAuth) Authenticate(c net.Conn) error {
+	return authenticateUserPass(c, r.store.Valid)
+}
+
+//authenticateUserPass performs the RFC1929 negotiation on cn checking the credentials with valid
+func authenticateUserPass(cn net.Conn, valid func(user, pass string) bool) (err error) {
+	c, ok := cn.(*conn)
+	if !ok {
+		c = newConn(cn)
+	}
 
 	if _, err = io.ReadFull(c, c.buf[0:2]); err != nil {
 		return
@@ -70,9 +118,11 @@ func (r usernamePasswordAuth) Authenticate(cn net.Conn) (err error) {
 
 	c.buf[0] = subNegotiationVer
 	c.buf[1] = 0x00
-	if user != r.Username || pass != r.Password {
+	if !valid(user, pass) {
 		c.buf[1] = 0xED
 		err = ErrAuthFailed
+	} else {
+		c.user = user
 	}
 
 	if _, err := c.Write(c.buf[:2]); err != nil {
@@ -80,8 +130,3 @@ func (r usernamePasswordAuth) Authenticate(cn net.Conn) (err error) {
 	}
 	return
 }
-
-//NewUserPassAuth creates a new username/password based authenticator
-func NewUserPassAuth(username, password string) Authenticator {
-	return &usernamePasswordAuth{Username: username, Password: password}
-}
@@ -0,0 +1,60 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+//ErrBanned is returned by ServeConn for connections of banned clients
+var ErrBanned = errors.New("socks5: client banned")
+
+//bans are the banned client IPs and when their bans are over
+type bans struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+//Ban closes the connections of ip without a handshake for d, an EventClientBanned is sent to the
+//notifiers. Banning an IP again replaces its ban
+func (s *Server) Ban(ip net.IP, d time.Duration, reason string) {
+	now := time.Now()
+	until := now.Add(d)
+	s.bans.mu.Lock()
+	if s.bans.until == nil {
+		s.bans.until = make(map[string]time.Time)
+	}
+	for k, u := range s.bans.until {
+		if now.After(u) {
+			delete(s.bans.until, k)
+		}
+	}
+	s.bans.until[ip.String()] = until
+	s.bans.mu.Unlock()
+
+	client := s.Redaction.client(&net.IPAddr{IP: ip})
+	s.logf(LevelInfo, "banned %s until %s: %s", client, until.Format(time.RFC3339), reason)
+	s.Notify(Event{Type: EventClientBanned, Data: &ClientBan{Client: client, Until: until, Reason: reason}})
+}
+
+//Unban lifts the ban of ip
+func (s *Server) Unban(ip net.IP) {
+	s.bans.mu.Lock()
+	delete(s.bans.until, ip.String())
+	s.bans.mu.Unlock()
+}
+
+//Banned reports whether ip is banned
+func (s *Server) Banned(ip net.IP) bool {
+	s.bans.mu.Lock()
+	defer s.bans.mu.Unlock()
+	until, ok := s.bans.until[ip.String()]
+	return ok && time.Now().Before(until)
+}
+
+//bannedAddr reports whether the client at addr is banned
+func (s *Server) bannedAddr(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip != nil && s.Banned(ip)
+}
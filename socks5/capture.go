@@ -0,0 +1,252 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//CaptureMaxBytes is the default number of relayed bytes captured of a session
+const CaptureMaxBytes = 16 << 20
+
+//SessionInfo describes a session whose request was read
+type SessionInfo struct {
+	//ID identifies the session
+	ID string
+	//Client is the address of the client
+	Client net.Addr
+	//Username is the username the client authenticated with
+	Username string
+	//Command is the requested command
+	Command Command
+	//Dest is the requested destination
+	Dest *AddrSpec
+}
+
+//WithCapture writes the bytes relayed by the sessions filter matches to a pcap file per session
+//in dir, named after the session ID. The bytes are wrapped in synthesized IP and TCP headers so
+//Wireshark shows a TCP stream between the client and the target. If filter is nil every session
+//is captured. The files hold raw addresses and payloads, it's meant for debugging
+func WithCapture(dir string, filter func(SessionInfo) bool) Option {
+	return func(s *Server) {
+		s.capture = &capture{s: s, dir: dir, filter: filter}
+	}
+}
+
+//WithCaptureLimit sets the number of relayed bytes captured of a session, the rest isn't. It's
+//CaptureMaxBytes by default
+func WithCaptureLimit(maxBytes int64) Option {
+	return func(s *Server) {
+		s.captureLimit = maxBytes
+	}
+}
+
+type capture struct {
+	s      *Server
+	dir    string
+	filter func(SessionInfo) bool
+}
+
+//matches reports whether the session is captured
+func (c *capture) matches(info SessionInfo) bool {
+	return c.filter == nil || c.filter(info)
+}
+
+//open creates the capture file of the session relaying between client and target
+func (c *capture) open(id string, client, target net.Addr) (*sessionCapture, error) {
+	f, err := os.OpenFile(filepath.Join(c.dir, "session-"+id+".pcap"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		c.s.logf(LevelError, "session %s: unable to capture: %v", id, err)
+		return nil, err
+	}
+	max := c.s.captureLimit
+	if max <= 0 {
+		max = CaptureMaxBytes
+	}
+	sc := &sessionCapture{f: f, w: bufio.NewWriter(f), max: max}
+	sc.ip[0], sc.port[0] = tcpEndpoint(client)
+	sc.ip[1], sc.port[1] = tcpEndpoint(target)
+	if sc.ip[0].To4() == nil || sc.ip[1].To4() == nil {
+		sc.ip[0], sc.ip[1] = sc.ip[0].To16(), sc.ip[1].To16()
+	} else {
+		sc.ip[0], sc.ip[1] = sc.ip[0].To4(), sc.ip[1].To4()
+	}
+
+	//the global header of a pcap file of raw IP packets
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	sc.w.Write(hdr)
+
+	sc.packet(fromClient, tcpSYN, nil)
+	sc.packet(fromTarget, tcpSYN|tcpACK, nil)
+	sc.packet(fromClient, tcpACK, nil)
+	return sc, nil
+}
+
+//tcpEndpoint returns the IP and port of addr, 0.0.0.0:0 if it isn't a TCP address
+func tcpEndpoint(addr net.Addr) (net.IP, uint16) {
+	if a, ok := addr.(*net.TCPAddr); ok && a.IP != nil {
+		return a.IP, uint16(a.Port)
+	}
+	return net.IPv4zero, 0
+}
+
+const (
+	linkTypeRaw = 101
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	//captureSegment is the largest payload of a captured packet
+	captureSegment = 16 << 10
+
+	fromClient = 0
+	fromTarget = 1
+)
+
+//sessionCapture writes the packets of a session, index 0 of the arrays is the client and 1 the
+//target
+type sessionCapture struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	ip      [2]net.IP
+	port    [2]uint16
+	seq     [2]uint32
+	written int64
+	max     int64
+}
+
+//writer returns the writer of the bytes sent by side
+func (sc *sessionCapture) writer(side int) io.Writer {
+	return captureWriter{sc, side}
+}
+
+type captureWriter struct {
+	sc   *sessionCapture
+	side int
+}
+
+//Write captures b, it never fails so the relay isn't affected
+func (w captureWriter) Write(b []byte) (int, error) {
+	w.sc.mu.Lock()
+	defer w.sc.mu.Unlock()
+	p := b
+	if left := w.sc.max - w.sc.written; int64(len(p)) > left {
+		p = p[:left]
+	}
+	w.sc.written += int64(len(p))
+	for len(p) > 0 {
+		n := len(p)
+		if n > captureSegment {
+			n = captureSegment
+		}
+		w.sc.packetLocked(w.side, tcpPSH|tcpACK, p[:n])
+		p = p[n:]
+	}
+	return len(b), nil
+}
+
+func (sc *sessionCapture) packet(side int, flags byte, payload []byte) {
+	sc.mu.Lock()
+	sc.packetLocked(side, flags, payload)
+	sc.mu.Unlock()
+}
+
+func (sc *sessionCapture) packetLocked(side int, flags byte, payload []byte) {
+	src, dst := side, 1-side
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], sc.port[src])
+	binary.BigEndian.PutUint16(tcp[2:], sc.port[dst])
+	binary.BigEndian.PutUint32(tcp[4:], sc.seq[src])
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], sc.seq[dst])
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	sc.seq[src] += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		sc.seq[src]++
+	}
+
+	var ip []byte
+	var pseudo []byte
+	if len(sc.ip[src]) == net.IPv4len {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[6] = 0x40
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], sc.ip[src])
+		copy(ip[16:], sc.ip[dst])
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		pseudo = append(append(append([]byte{}, ip[12:20]...), 0, 6), byte(len(tcp)>>8), byte(len(tcp)))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], sc.ip[src])
+		copy(ip[24:], sc.ip[dst])
+		pseudo = append(append([]byte{}, ip[8:40]...), 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+	now := time.Now()
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(ip)+len(tcp)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(ip)+len(tcp)))
+	sc.w.Write(rec)
+	sc.w.Write(ip)
+	sc.w.Write(tcp)
+}
+
+//checksum returns the internet checksum of the concatenation of bs, all of them but the last
+//are of even length
+func checksum(bs ...[]byte) uint16 {
+	var s uint32
+	for _, b := range bs {
+		for i := 0; i+1 < len(b); i += 2 {
+			s += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			s += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return ^uint16(s)
+}
+
+//Close ends the stream of both sides and closes the file
+func (sc *sessionCapture) Close() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.packetLocked(fromClient, tcpFIN|tcpACK, nil)
+	sc.packetLocked(fromTarget, tcpFIN|tcpACK, nil)
+	sc.packetLocked(fromClient, tcpACK, nil)
+	if err := sc.w.Flush(); err != nil {
+		sc.f.Close()
+		return err
+	}
+	return sc.f.Close()
+}
@@ -0,0 +1,154 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type capturedPacket struct {
+	src, dst          string
+	flags             byte
+	payload           []byte
+	ipValid, tcpValid bool
+}
+
+//readCapture parses the records of a pcap file of raw IPv4 packets
+func readCapture(t *testing.T, path string) []capturedPacket {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(b[20:]) != linkTypeRaw {
+		t.Fatalf("unexpected header % x", b[:24])
+	}
+	b = b[24:]
+
+	var packets []capturedPacket
+	for len(b) > 0 {
+		if len(b) < 16 {
+			t.Fatalf("truncated record header % x", b)
+		}
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		if len(b) < 16+n || n != int(binary.LittleEndian.Uint32(b[12:])) {
+			t.Fatalf("truncated record of %d bytes", n)
+		}
+		p, ip := b[16:16+n], b[16:36]
+		b = b[16+n:]
+		if ip[0] != 0x45 || ip[9] != 6 || int(binary.BigEndian.Uint16(ip[2:])) != n {
+			t.Fatalf("unexpected IP header % x", ip)
+		}
+		tcp := p[20:]
+		pseudo := append(append([]byte{}, ip[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		packets = append(packets, capturedPacket{
+			src:      (&net.TCPAddr{IP: net.IP(ip[12:16]), Port: int(binary.BigEndian.Uint16(tcp))}).String(),
+			dst:      (&net.TCPAddr{IP: net.IP(ip[16:20]), Port: int(binary.BigEndian.Uint16(tcp[2:]))}).String(),
+			flags:    tcp[13],
+			payload:  tcp[20:],
+			ipValid:  checksum(ip) == 0,
+			tcpValid: checksum(pseudo, tcp) == 0,
+		})
+	}
+	return packets
+}
+
+func TestCapture(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var sessions []SessionInfo
+	filter := func(info SessionInfo) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		sessions = append(sessions, info)
+		return info.Dest.Port != 1
+	}
+	s, proxy := newTestServer(t, WithCapture(dir, filter), WithCaptureLimit(8))
+	defer s.Close()
+
+	c, err := NewClient(proxy).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := c.(interface{ LocalAddr() net.Addr }).LocalAddr().String()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	//the relay goes on past the limit of the capture
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	//a session the filter doesn't match isn't captured
+	if _, err := NewClient(proxy).Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+
+	//the file is written once the session is over
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ActiveSessions() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the sessions didn't end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sessions) != 2 || len(files) != 1 || files[0] != filepath.Join(dir, "session-"+sessions[0].ID+".pcap") {
+		t.Fatalf("expected a capture of the first session got %v", files)
+	}
+
+	target := echo.Addr().String()
+	out := []struct {
+		fromClient bool
+		flags      byte
+		payload    string
+	}{
+		{true, tcpSYN, ""},
+		{false, tcpSYN | tcpACK, ""},
+		{true, tcpACK, ""},
+		{true, tcpPSH | tcpACK, "hello"},
+		{false, tcpPSH | tcpACK, "hel"},
+		{true, tcpFIN | tcpACK, ""},
+		{false, tcpFIN | tcpACK, ""},
+		{true, tcpACK, ""},
+	}
+	packets := readCapture(t, files[0])
+	if len(packets) != len(out) {
+		t.Fatalf("expected %d packets got %d", len(out), len(packets))
+	}
+	for i, p := range packets {
+		src, dst := client, target
+		if !out[i].fromClient {
+			src, dst = target, client
+		}
+		if p.src != src || p.dst != dst || p.flags != out[i].flags || string(p.payload) != out[i].payload {
+			t.Errorf("packet %d: expected %s > %s %02x %q got %s > %s %02x %q", i,
+				src, dst, out[i].flags, out[i].payload, p.src, p.dst, p.flags, p.payload)
+		}
+		if !p.ipValid || !p.tcpValid {
+			t.Errorf("packet %d: invalid checksum", i)
+		}
+	}
+}
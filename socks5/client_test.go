@@ -0,0 +1,492 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, opts ...Option) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Cmds: []Command{CommandConnect}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	go s.Serve(l)
+	return s, l.Addr().String()
+}
+
+func TestClientDial(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	//a port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	s, proxy := newTestServer(t, WithAuth("username", "password"))
+	defer s.Close()
+
+	tts := []struct {
+		name string
+		opts []ClientOption
+		addr string
+		err  error
+	}{
+		{"ip", []ClientOption{WithClientAuth("username", "password")}, echo.Addr().String(), nil},
+		{"remote resolve", []ClientOption{WithClientAuth("username", "password")}, net.JoinHostPort("localhost", echoPort), nil},
+		{"local resolve", []ClientOption{WithClientAuth("username", "password"), WithLocalResolve(true)}, net.JoinHostPort("localhost", echoPort), nil},
+		{"bad credentials", []ClientOption{WithClientAuth("username", "wrong")}, echo.Addr().String(), ErrAuthFailed},
+		{"no credentials", nil, echo.Addr().String(), ErrNoAcceptableMethod},
+		{"denied destination", []ClientOption{WithClientAuth("username", "password")}, closedAddr, ErrHostUnreachable},
+	}
+
+	for _, tt := range tts {
+		c, err := NewClient(proxy, tt.opts...).Dial("tcp", tt.addr)
+		if err != tt.err {
+			t.Errorf("%s: expected %v got %v", tt.name, tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write([]byte(testString)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		b := make([]byte, len(testString))
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(b) != testString {
+			t.Errorf("%s: expected %q got %q", tt.name, testString, b)
+		}
+		c.Close()
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	s, proxy := newTestServer(t, WithAuth("username", "password"))
+	defer s.Close()
+
+	tts := []struct {
+		name     string
+		password string
+		stages   []string
+	}{
+		{"connected", "password", []string{"connected", "authenticated"}},
+		{"bad credentials", "wrong", []string{"connected"}},
+	}
+	for _, tt := range tts {
+		var stages []string
+		trace := &ClientTrace{
+			ProxyConnected: func() { stages = append(stages, "connected") },
+			Authenticated:  func() { stages = append(stages, "authenticated") },
+		}
+		c, err := NewClient(proxy, WithClientAuth("username", tt.password), WithClientTrace(trace)).Dial("tcp", echo.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		if !reflect.DeepEqual(stages, tt.stages) {
+			t.Errorf("%s: expected %v got %v", tt.name, tt.stages, stages)
+		}
+	}
+}
+
+func TestClientDialContext(t *testing.T) {
+	//a proxy that never answers the greeting
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = NewClient(l.Addr().String()).DialContext(ctx, "tcp", "example.com:80")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("DialContext didn't honor the context")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err = NewClient(l.Addr().String()).DialContext(ctx, "tcp", "example.com:80")
+	if err != context.Canceled {
+		t.Errorf("expected %v got %v", context.Canceled, err)
+	}
+}
+
+func TestClientDestination(t *testing.T) {
+	c := NewClient("127.0.0.1:1080")
+	tts := []struct {
+		addr string
+		typ  AddrType
+		err  error
+	}{
+		{"127.0.0.1:80", AddrTypeIPv4, nil},
+		{"[::1]:80", AddrTypeIPv6, nil},
+		{"example.com:80", AddrTypeDomain, nil},
+		{"example.com:0", 0, ErrInvalidPort},
+		{"example.com:http", 0, ErrInvalidPort},
+		{strings.Repeat("a", 256) + ":80", 0, ErrInvalidAddr},
+	}
+
+	for _, tt := range tts {
+		addr, err := c.destination(context.Background(), "tcp", tt.addr)
+		if err != tt.err {
+			t.Errorf("%s: expected %v got %v", tt.addr, tt.err, err)
+			continue
+		}
+		if err == nil && addr.Type != tt.typ {
+			t.Errorf("%s: expected type %v got %v", tt.addr, tt.typ, addr.Type)
+		}
+	}
+}
+
+func TestClientBindFTP(t *testing.T) {
+	s, proxy := newTestServer(t, WithCommands(CommandConnect, CommandBind))
+	defer s.Close()
+
+	//the ftp server reads PORT commands from the control connection and sends the file over a
+	//data connection it dials to the given address
+	const file = "ftp file contents"
+	ftp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ftp.Close()
+	dataSrc := make(chan net.Addr, 1)
+	go func() {
+		ctrl, err := ftp.Accept()
+		if err != nil {
+			return
+		}
+		defer ctrl.Close()
+		b := make([]byte, 256)
+		n, err := ctrl.Read(b)
+		if err != nil || !strings.HasPrefix(string(b[:n]), "PORT ") {
+			return
+		}
+		data, err := net.Dial("tcp", strings.TrimSpace(string(b[5:n])))
+		if err != nil {
+			return
+		}
+		dataSrc <- data.LocalAddr()
+		data.Write([]byte(file))
+		data.Close()
+	}()
+
+	client := NewClient(proxy)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctrl, err := client.DialContext(ctx, "tcp", ftp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+
+	l, err := client.Bind(ctx, ftp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if addr := l.Addr().(*SocksAddr); addr.Type != AddrTypeIPv4 || strings.HasPrefix(addr.Addr, "0.0.0.0:") {
+		t.Errorf("expected a reachable advertised address got %v", addr)
+	}
+	if _, err := ctrl.Write([]byte("PORT " + l.Addr().String() + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := l.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != file {
+		t.Errorf("expected %q got %q", file, b)
+	}
+	if src := <-dataSrc; data.RemoteAddr().String() != src.String() {
+		t.Errorf("expected peer %v got %v", src, data.RemoteAddr())
+	}
+
+	if _, err := l.Accept(ctx); err != ErrBindAccepted {
+		t.Errorf("expected %v got %v", ErrBindAccepted, err)
+	}
+}
+
+//fakeProxy accepts a single connection and answers the greeting and the request with the
+//given replies, it closes the connection afterwards
+func fakeProxy(t *testing.T, replies ...[]byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		b := make([]byte, 512)
+		c.Read(b)
+		c.Write([]byte{socksVer5, byte(noAuth)})
+		c.Read(b)
+		for _, r := range replies {
+			if r == nil {
+				//hold the connection open
+				time.Sleep(time.Second)
+				continue
+			}
+			c.Write(r)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClientBindErrors(t *testing.T) {
+	ok := []byte{socksVer5, byte(ReplySucceeded), reserve, byte(AddrTypeIPv4), 127, 0, 0, 1, 0x10, 0x00}
+	failed := []byte{socksVer5, byte(ReplyGeneralFailure), reserve, byte(AddrTypeIPv4), 0, 0, 0, 0, 0, 0}
+	unsupported := []byte{socksVer5, byte(ReplyCommandNotSupported), reserve, byte(AddrTypeIPv4), 0, 0, 0, 0, 0, 0}
+
+	tts := []struct {
+		name      string
+		replies   [][]byte
+		bindErr   error
+		acceptErr error
+	}{
+		{"first reply error", [][]byte{unsupported}, ErrCommandNotSupported, nil},
+		{"second reply error", [][]byte{ok, failed}, nil, ErrGeneralFailure},
+		{"control connection closed", [][]byte{ok}, nil, ErrProxyClosed},
+		{"timeout", [][]byte{ok, nil}, nil, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tts {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		l, err := NewClient(fakeProxy(t, tt.replies...)).Bind(ctx, "")
+		if err != tt.bindErr {
+			t.Errorf("%s: expected %v got %v", tt.name, tt.bindErr, err)
+		}
+		if err == nil {
+			if l.Addr().String() != "127.0.0.1:4096" {
+				t.Errorf("%s: unexpected advertised address %v", tt.name, l.Addr())
+			}
+			if _, err := l.Accept(ctx); err != tt.acceptErr {
+				t.Errorf("%s: expected %v got %v", tt.name, tt.acceptErr, err)
+			}
+			l.Close()
+		}
+		cancel()
+	}
+}
+
+func TestBindControlClosed(t *testing.T) {
+	s, proxy := newTestServer(t, WithCommands(CommandConnect, CommandBind))
+	defer s.Close()
+
+	l, err := NewClient(proxy).Bind(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	//the server stops listening once the control connection is gone
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("the bind listener outlived the control connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//recordingDialer returns a Dialer recording the addresses it connects to
+func recordingDialer() (*net.Dialer, func() []string) {
+	var mu sync.Mutex
+	var dialed []string
+	d := &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, address)
+		return nil
+	}}
+	return d, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, dialed...)
+	}
+}
+
+func TestChain(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	d1, dialed1 := recordingDialer()
+	s1, proxy1 := newTestServer(t, WithAuth("first", "secret1"), WithDialer(d1))
+	defer s1.Close()
+	d2, dialed2 := recordingDialer()
+	s2, proxy2 := newTestServer(t, WithAuth("second", "secret2"), WithDialer(d2))
+	defer s2.Close()
+
+	c, err := Chain("socks5://first:secret1@"+proxy1+"?timeout=5s", "socks5://second:secret2@"+proxy2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := c.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte(testString)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(testString))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if string(b) != testString {
+		t.Errorf("expected %q got %q", testString, b)
+	}
+
+	if d := dialed1(); len(d) != 1 || d[0] != proxy2 {
+		t.Errorf("expected the first hop to dial only %s got %v", proxy2, d)
+	}
+	if d := dialed2(); len(d) != 1 || d[0] != echo.Addr().String() {
+		t.Errorf("expected the second hop to dial only %s got %v", echo.Addr(), d)
+	}
+
+	//a port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tts := []struct {
+		name    string
+		proxies []string
+		hop     int
+		err     error
+	}{
+		{"bad credentials of the second hop", []string{"first:secret1@" + proxy1, "socks5://second:wrong@" + proxy2}, 2, ErrAuthFailed},
+		{"bad credentials of the first hop", []string{"socks5://first:wrong@" + proxy1, "socks5://second:secret2@" + proxy2}, 1, ErrAuthFailed},
+		{"second hop down", []string{"socks5://first:secret1@" + proxy1, "socks5://" + closedAddr}, 1, ErrHostUnreachable},
+	}
+	for _, tt := range tts {
+		c, err := Chain(tt.proxies...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.DialContext(ctx, "tcp", echo.Addr().String())
+		he, ok := err.(*HopError)
+		if !ok || he.Hop != tt.hop || he.Err != tt.err {
+			t.Errorf("%s: expected hop %d to fail with %v got %v", tt.name, tt.hop, tt.err, err)
+		}
+	}
+
+	if _, err := Chain(); err != ErrNoProxies {
+		t.Errorf("expected %v got %v", ErrNoProxies, err)
+	}
+	if _, err := Chain("http://" + proxy1); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
+
+func TestChainHopTimeout(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	//the first hop takes longer to reach the second one than the timeout of the second hop
+	slow := &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	}}
+	s1, proxy1 := newTestServer(t, WithDialer(slow))
+	defer s1.Close()
+	s2, proxy2 := newTestServer(t)
+	defer s2.Close()
+
+	c, err := Chain("socks5://"+proxy1, "socks5://"+proxy2+"?timeout=150ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := c.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("expected the timeout of the second hop not to bound the first one: %v", err)
+	}
+	conn.Close()
+}
+
+func TestParseProxyURL(t *testing.T) {
+	tests := []struct {
+		proxy string
+		local bool
+	}{
+		{"socks5://127.0.0.1:1080", true},
+		{"socks5h://127.0.0.1:1080", false},
+		{"127.0.0.1:1080", false},
+	}
+	for _, tt := range tests {
+		c, err := parseProxyURL(tt.proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.LocalResolve != tt.local {
+			t.Errorf("%s: expected LocalResolve %v got %v", tt.proxy, tt.local, c.LocalResolve)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+//ErrChainedUDP is returned by ListenPacket for a chained client, the datagrams can't go through
+//the proxies before the last one
+var ErrChainedUDP = errors.New("socks5: udp associations aren't supported through a chain")
+
+//maxUDPHeader is the longest header of a relayed datagram, the one of a domain of 255 bytes
+const maxUDPHeader = 3 + 1 + 1 + 255 + 2
+
+//ListenPacket asks the proxy for a udp association, the returned net.PacketConn sends the
+//datagrams written to it through the proxy and reads the ones relayed back with their source.
+//The destinations may be domains the proxy resolves. The association lasts until it's closed
+//or the proxy closes the control connection, ctx bounds the handshake
+func (c *Client) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if c.via != nil {
+		return nil, ErrChainedUDP
+	}
+	ctrl, addr, err := c.connect(ctx, CommandUDPAssociation, &SocksAddr{Type: AddrTypeIPv4, Addr: "0.0.0.0:0"})
+	if err != nil {
+		return nil, err
+	}
+	relay, err := net.ResolveUDPAddr("udp", advertisedBindAddr(addr, ctrl.RemoteAddr()).String())
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	//the proxy accepts the datagrams from the IP of the control connection
+	var local *net.UDPAddr
+	if la, ok := ctrl.LocalAddr().(*net.TCPAddr); ok {
+		local = &net.UDPAddr{IP: la.IP, Zone: la.Zone}
+	}
+	pc, err := net.ListenUDP("udp", local)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	u := &udpAssociation{pc: pc, ctrl: ctrl, relay: relay}
+	go u.watch()
+	return u, nil
+}
+
+//udpAssociation is a udp association of a client, the datagrams are sent to and read from the
+//relay of the proxy
+type udpAssociation struct {
+	pc    *net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+//watch closes the association once the proxy closes the control connection
+func (u *udpAssociation) watch() {
+	io.Copy(ioutil.Discard, u.ctrl)
+	u.pc.Close()
+}
+
+//ReadFrom reads a datagram relayed by the proxy, the datagrams from elsewhere and the malformed
+//ones are skipped
+func (u *udpAssociation) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUDPHeader+len(b))
+	for {
+		n, from, err := u.pc.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(u.relay.IP) || from.Port != u.relay.Port {
+			continue
+		}
+		src, payload, err := parseUDPDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		var addr net.Addr = src
+		if src.Type != AddrTypeDomain {
+			addr = &net.UDPAddr{IP: src.IP, Port: int(src.Port)}
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+//WriteTo sends b to addr through the proxy, addr is a host:port whose host may be a domain
+func (u *udpAssociation) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, err := ParseAddr(addr.String())
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: err}
+	}
+	d, err := dst.AppendTo(append(make([]byte, 0, maxUDPHeader+len(b)), reserve, reserve, 0))
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: err}
+	}
+	if _, err := u.pc.WriteToUDP(append(d, b...), u.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+//Close ends the association
+func (u *udpAssociation) Close() error {
+	u.ctrl.Close()
+	return u.pc.Close()
+}
+
+//LocalAddr returns the address the datagrams are sent to the relay from
+func (u *udpAssociation) LocalAddr() net.Addr {
+	return u.pc.LocalAddr()
+}
+
+func (u *udpAssociation) SetDeadline(t time.Time) error {
+	return u.pc.SetDeadline(t)
+}
+
+func (u *udpAssociation) SetReadDeadline(t time.Time) error {
+	return u.pc.SetReadDeadline(t)
+}
+
+func (u *udpAssociation) SetWriteDeadline(t time.Time) error {
+	return u.pc.SetWriteDeadline(t)
+}
@@ -0,0 +1,48 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+
+	"github.com/abdullah2993/socks5-server/socks5/socks5test"
+)
+
+//listenAndServe runs ListenAndServe on port 0 and returns the server once it accepts connections
+func listenAndServe(t *testing.T, opts ...Option) *Server {
+	s := &Server{Addr: "127.0.0.1:0", Cmds: []Command{CommandConnect}, Dialer: new(net.Dialer)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	select {
+	case <-s.Ready():
+	case err := <-done:
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	tts := []struct {
+		name string
+		opts []Option
+		conf socks5test.Options
+	}{
+		{"connect", nil, socks5test.Options{}},
+		{"all commands", []Option{WithCommands(CommandConnect, CommandBind, CommandUDPAssociation)},
+			socks5test.Options{Bind: true, UDP: true}},
+		{"auth", []Option{WithAuth("username", "password"), WithCommands(CommandConnect, CommandBind, CommandUDPAssociation)},
+			socks5test.Options{Username: "username", Password: "password", Bind: true, UDP: true}},
+	}
+
+	for _, tt := range tts {
+		t.Run(tt.name, func(t *testing.T) {
+			s := listenAndServe(t, tt.opts...)
+			defer s.Close()
+			socks5test.Run(t, s.ListenAddr().String(), tt.conf)
+		})
+	}
+}
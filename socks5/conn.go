@@ -2,11 +2,11 @@ package socks5
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
-	"strconv"
+	"sync/atomic"
 )
 
 const (
@@ -27,18 +27,41 @@ const (
 	CommandUDPAssociation Command = 0x03
 )
 
-type responseType byte
+//String returns the name of the command
+func (c Command) String() string {
+	switch c {
+	case CommandConnect:
+		return "connect"
+	case CommandBind:
+		return "bind"
+	case CommandUDPAssociation:
+		return "udp-associate"
+	}
+	return fmt.Sprintf("0x%02x", byte(c))
+}
+
+//Reply is the reply code sent to a request
+type Reply byte
 
 const (
-	responseSuccess             responseType = 0x00
-	responseGeneralFailure      responseType = 0x01
-	responseNotAllowedByRuleset responseType = 0x02
-	responseNetworkUnreachable  responseType = 0x03
-	responseHostUnreachable     responseType = 0x04
-	responseConnectionRefused   responseType = 0x05
-	responseTTLExpired          responseType = 0x06
-	responseCommandNotSupported responseType = 0x07
-	responseAddressNotSupported responseType = 0x08
+	//ReplySucceeded the request succeeded
+	ReplySucceeded Reply = 0x00
+	//ReplyGeneralFailure general SOCKS server failure
+	ReplyGeneralFailure Reply = 0x01
+	//ReplyNotAllowedByRuleset connection not allowed by ruleset
+	ReplyNotAllowedByRuleset Reply = 0x02
+	//ReplyNetworkUnreachable network unreachable
+	ReplyNetworkUnreachable Reply = 0x03
+	//ReplyHostUnreachable host unreachable
+	ReplyHostUnreachable Reply = 0x04
+	//ReplyConnectionRefused connection refused
+	ReplyConnectionRefused Reply = 0x05
+	//ReplyTTLExpired TTL expired
+	ReplyTTLExpired Reply = 0x06
+	//ReplyCommandNotSupported command not supported
+	ReplyCommandNotSupported Reply = 0x07
+	//ReplyAddressNotSupported address type not supported
+	ReplyAddressNotSupported Reply = 0x08
 )
 
 //ErrInvalidSocksVer is returned if the SOCKS version in not 5
@@ -51,10 +74,52 @@ var ErrNoAcceptableMethod = errors.New("socks4: no accaptable method")
 var ErrAddressTypeNotSupported = errors.New("socks5: address type not supported")
 
 type conn struct {
+	//in and out are the bytes relayed from and to the client, first for 64-bit alignment
+	in, out int64
+
 	net.Conn
 	buf []byte
+
+	//id identifies the session on the connection
+	id string
+	//user is the username the client authenticated with
+	user string
+	//negotiated is set once the client negotiated an authentication method
+	negotiated bool
+	//original is the destination of a connection accepted by ServeTransparent, there's no
+	//handshake and no reply on it
+	original *AddrSpec
+	//reply is the reply sent to the request if replied
+	reply   Reply
+	replied bool
+	//decision is the decision of the ruleset on the request, one of the Decision constants
+	decision string
+	//ruleset is the ruleset the request was checked against, the addresses the session reaches
+	//are checked against it as well
+	ruleset Ruleset
+	//resolved is the address the request was served with e.g. the IP the target was dialed on
+	resolved net.IP
+	//nat64 is the address synthesized for the IPv4 destination if it was dialed through NAT64
+	nat64 net.IP
+	//ended is the side that ended the relay
+	ended int32
+	//relayed is closed once the relay from the target is over
+	relayed chan struct{}
+	//capture if set captures the relayed bytes to captured
+	capture  *capture
+	captured *sessionCapture
+	//mirror if set mirrors the relayed bytes to mirrored
+	mirror   *mirror
+	mirrored *sessionMirror
+	//wrap if set wraps the streams of the relay, it's set by WithStreamWrapper
+	wrap func(d Direction, rw io.ReadWriter) io.ReadWriter
 }
 
+const (
+	endedByClient int32 = iota + 1
+	endedByTarget
+)
+
 func newConn(c net.Conn) *conn {
 	return &conn{
 		Conn: c,
@@ -62,40 +127,47 @@ func newConn(c net.Conn) *conn {
 	}
 }
 
-func (c *conn) Negoatiate(auth AuthMethod) error {
-	accept := byte(noAcceptable)
+//Negotiate selects the first of auths whose method is offered by the client
+func (c *conn) Negotiate(auths []Authenticator) (Authenticator, error) {
 	if _, err := io.ReadFull(c, c.buf[:2]); err != nil {
-		return err
+		return nil, err
 	}
 
 	if c.buf[0] != socksVer5 {
-		return ErrInvalidSocksVer
+		return nil, ErrInvalidSocksVer
 	}
 	methodCount := c.buf[1]
 
 	if _, err := io.ReadFull(c, c.buf[:methodCount]); err != nil {
-		return err
+		return nil, err
 	}
 
-	if i := bytes.IndexByte(c.buf[:methodCount], byte(auth)); i != -1 {
-		accept = c.buf[i]
+	var accepted Authenticator
+	for _, auth := range auths {
+		if bytes.IndexByte(c.buf[:methodCount], byte(auth.AuthMethod())) != -1 {
+			accepted = auth
+			break
+		}
 	}
 
 	c.buf[0] = socksVer5
-	c.buf[1] = accept
+	c.buf[1] = byte(noAcceptable)
+	if accepted != nil {
+		c.buf[1] = byte(accepted.AuthMethod())
+	}
 	if _, err := c.Write(c.buf[:2]); err != nil {
-		return err
+		return nil, err
 	}
 
-	if accept == byte(noAcceptable) {
-		return ErrNoAcceptableMethod
+	if accepted == nil {
+		return nil, ErrNoAcceptableMethod
 	}
-	return nil
+	return accepted, nil
 }
 
-func (c *conn) ReadCommandRequest() (method Command, addr *socksAddr, err error) {
+func (c *conn) ReadCommandRequest() (method Command, addr *AddrSpec, err error) {
 
-	if _, err = io.ReadFull(c, c.buf[:5]); err != nil {
+	if _, err = io.ReadFull(c, c.buf[:3]); err != nil {
 		return
 	}
 
@@ -106,76 +178,92 @@ func (c *conn) ReadCommandRequest() (method Command, addr *socksAddr, err error)
 
 	method = Command(c.buf[1])
 
-	addrLength := 0
-	domain := false
-	offset := 1
-	addrType := AddrType(c.buf[3])
-	switch addrType { //buf[2] is reserve
-	case AddrTypeIPv4:
-		addrLength = net.IPv4len
-	case AddrTypeIPv6:
-		addrLength = net.IPv6len
-	case AddrTypeDomain:
-		addrLength = int(c.buf[4])
-		domain = true
-		offset = 0
-	default:
-		err = ErrAddressTypeNotSupported
-		return
-	}
-
-	c.buf[0] = c.buf[4]
-
-	if _, err = io.ReadFull(c, c.buf[offset:addrLength+2]); err != nil {
-		return
-	}
-
-	addrBytes := c.buf[:addrLength]
-
-	port := int(binary.BigEndian.Uint16(c.buf[addrLength : addrLength+2]))
-
-	targetHost := string(addrBytes)
-
-	if !domain {
-		ip := net.IP(addrBytes)
-		targetHost = ip.String()
-	}
-
-	addr = &socksAddr{Type: addrType, Addr: net.JoinHostPort(targetHost, strconv.Itoa(port))}
+	//buf[2] is reserve
+	addr, err = ReadAddrSpec(c)
 	return
 }
 
-func (c *conn) WriteCommandResponse(res responseType, addr string) error {
-	c.buf[0] = socksVer5
-	c.buf[1] = byte(res)
-	c.buf[2] = reserve
-
-	saddr := newAddr(addr)
-	if saddr == nil {
-		return ErrInvalidAddr
+//WriteCommandResponse writes a reply with addr, the null address is sent if addr is nil
+func (c *conn) WriteCommandResponse(res Reply, addr *AddrSpec) error {
+	if c.original != nil {
+		return nil
+	}
+	if addr == nil {
+		addr = nullAddrSpec
 	}
 
-	addrLen, err := saddr.Marshal(c.buf[3:])
+	b, err := addr.AppendTo(append(c.buf[:0], socksVer5, byte(res), reserve))
 	if err != nil {
 		return err
 	}
-	_, err = c.Write(c.buf[:3+addrLen])
+	c.reply, c.replied = res, true
+	c.tracePhase(traceReply, 0)
+	_, err = c.Write(b)
+	c.untrace()
 	return err
 }
 
-func (c *conn) WriteError(res responseType) error {
-	errRes := []byte{socksVer5, 0x01, reserve, byte(AddrTypeIPv4), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	copy(errRes, c.buf) //why? why not?
-	c.buf[1] = byte(res)
-	_, err := c.Write(c.buf[:10])
+func (c *conn) WriteError(res Reply) error {
+	if c.original != nil {
+		return nil
+	}
+	errRes := []byte{socksVer5, byte(res), reserve, byte(AddrTypeIPv4), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	c.reply, c.replied = res, true
+	c.tracePhase(traceReply, 0)
+	_, err := c.Write(errRes)
+	c.untrace()
 	return err
 }
 
 // Relay should fail silently and just return
 func (c *conn) Relay(tconn net.Conn) {
+	var from, to io.Reader = tconn, c.Conn
+	if c.capture != nil {
+		if sc, err := c.capture.open(c.id, c.RemoteAddr(), tconn.RemoteAddr()); err == nil {
+			c.captured = sc
+			from, to = io.TeeReader(tconn, sc.writer(fromTarget)), io.TeeReader(c.Conn, sc.writer(fromClient))
+		}
+	}
+	if c.mirror != nil {
+		c.mirrored = c.mirror.open(c.id)
+		from, to = io.TeeReader(from, c.mirrored.writer(DirectionTargetToClient)), io.TeeReader(to, c.mirrored.writer(DirectionClientToTarget))
+	}
+
+	c.relayed = make(chan struct{})
 	go func() {
+		defer close(c.relayed)
 		defer tconn.Close()
-		io.Copy(c, tconn)
+		n, _ := c.copy(DirectionTargetToClient, c, from)
+		atomic.AddInt64(&c.out, n)
+		atomic.CompareAndSwapInt32(&c.ended, 0, endedByTarget)
+		//let the client see the end of the stream while it may still be sending
+		closeWrite(c.Conn)
 	}()
-	io.Copy(tconn, c)
+	n, _ := c.copy(DirectionClientToTarget, tconn, to)
+	atomic.AddInt64(&c.in, n)
+	atomic.CompareAndSwapInt32(&c.ended, 0, endedByClient)
+	tconn.Close()
+}
+
+//Close closes the connection and waits for the relay from the target to finish
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	if c.relayed != nil {
+		<-c.relayed
+	}
+	if c.captured != nil {
+		c.captured.Close()
+	}
+	if c.mirrored != nil {
+		c.mirrored.Close()
+	}
+	return err
+}
+
+//closeWrite shuts down the writing side of c if it supports half closing, it's closed otherwise
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
 }
@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//DestStat is the traffic of the sessions to a destination host
+type DestStat struct {
+	//Host is the normalized domain or the IP of the destination, redacted by the
+	//RedactionPolicy of the server
+	Host string
+	//Sessions is the number of sessions to the host
+	Sessions int64
+	//BytesIn and BytesOut are the bytes relayed from and to the client
+	BytesIn, BytesOut int64
+	//Error is the most bytes the counts may be short of, the host took the place of an
+	//evicted one whose bytes it's ranked with
+	Error int64
+}
+
+//bytes is the weight the host is ranked with
+func (d *DestStat) bytes() int64 {
+	return d.BytesIn + d.BytesOut + d.Error
+}
+
+//destStats aggregates the traffic of destination hosts keeping at most max of them, once it's
+//full the host with the least bytes is evicted for a new one (space-saving) so heavy hosts are
+//kept while the light ones come and go
+type destStats struct {
+	mu    sync.Mutex
+	max   int
+	hosts map[string]*destEntry
+	heap  destHeap
+}
+
+type destEntry struct {
+	DestStat
+	index int
+}
+
+func newDestStats(max int) *destStats {
+	if max < 1 {
+		max = 1
+	}
+	return &destStats{max: max, hosts: make(map[string]*destEntry, max)}
+}
+
+//add counts a session of in and out bytes to host
+func (d *destStats) add(host string, in, out int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.hosts[host]
+	switch {
+	case ok:
+	case len(d.heap) < d.max:
+		e = &destEntry{DestStat: DestStat{Host: host}}
+		d.hosts[host] = e
+		heap.Push(&d.heap, e)
+	default:
+		e = d.heap[0]
+		delete(d.hosts, e.Host)
+		e.DestStat = DestStat{Host: host, Error: e.bytes()}
+		d.hosts[host] = e
+	}
+	e.Sessions++
+	e.BytesIn += in
+	e.BytesOut += out
+	heap.Fix(&d.heap, e.index)
+}
+
+//top returns the n hosts with the most bytes, all of them if n is less than 1
+func (d *destStats) top(n int) []DestStat {
+	d.mu.Lock()
+	stats := make([]DestStat, len(d.heap))
+	for i, e := range d.heap {
+		stats[i] = e.DestStat
+	}
+	d.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].bytes() != stats[j].bytes() {
+			return stats[i].bytes() > stats[j].bytes()
+		}
+		return stats[i].Host < stats[j].Host
+	})
+	if n > 0 && n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+//destHeap is a min-heap of the hosts by bytes
+type destHeap []*destEntry
+
+func (h destHeap) Len() int           { return len(h) }
+func (h destHeap) Less(i, j int) bool { return h[i].bytes() < h[j].bytes() }
+func (h destHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *destHeap) Push(x interface{}) {
+	e := x.(*destEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *destHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+//destHost returns the host the destination is aggregated under, the lower case domain without
+//the trailing dot or the IP
+func destHost(a *AddrSpec) string {
+	if a.Type == AddrTypeDomain {
+		return strings.ToLower(strings.TrimSuffix(a.Host, "."))
+	}
+	return a.IP.String()
+}
+
+//TopDestinations returns the n destination hosts with the most bytes relayed, all of them if n
+//is less than 1. It's nil unless WithDestinationStats is set
+func (s *Server) TopDestinations(n int) []DestStat {
+	if s.destStats == nil {
+		return nil
+	}
+	return s.destStats.top(n)
+}
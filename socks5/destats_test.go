@@ -0,0 +1,112 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopDestinations(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	s, proxy := newTestServer(t, WithDestinationStats(10))
+	defer s.Close()
+
+	sessions := []struct {
+		host    string
+		payload int
+	}{
+		{"localhost", 5},
+		{"127.0.0.1", 100},
+		{"LocalHost", 10},
+	}
+	for _, session := range sessions {
+		c, err := NewClient(proxy).Dial("tcp", net.JoinHostPort(session.host, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write([]byte(strings.Repeat("a", session.payload))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, make([]byte, session.payload)); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	expected := []DestStat{
+		{Host: "127.0.0.1", Sessions: 1, BytesIn: 100, BytesOut: 100},
+		{Host: "localhost", Sessions: 2, BytesIn: 15, BytesOut: 15},
+	}
+	//the sessions are counted once the server is done with them
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		top := s.TopDestinations(0)
+		if reflect.DeepEqual(top, expected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %+v got %+v", expected, top)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if top := s.TopDestinations(1); !reflect.DeepEqual(top, expected[:1]) {
+		t.Errorf("expected %+v got %+v", expected[:1], top)
+	}
+	if top := (&Server{}).TopDestinations(1); top != nil {
+		t.Errorf("expected no stats got %+v", top)
+	}
+}
+
+func TestDestStatsEviction(t *testing.T) {
+	d := newDestStats(2)
+	d.add("a.example", 100, 100)
+	d.add("b.example", 10, 0)
+	d.add("b.example", 0, 10)
+	//c takes the place of b, the lightest host, and is ranked with its bytes
+	d.add("c.example", 1, 0)
+	d.add("a.example", 0, 50)
+
+	expected := []DestStat{
+		{Host: "a.example", Sessions: 2, BytesIn: 100, BytesOut: 150},
+		{Host: "c.example", Sessions: 1, BytesIn: 1, Error: 20},
+	}
+	if top := d.top(0); !reflect.DeepEqual(top, expected) {
+		t.Errorf("expected %+v got %+v", expected, top)
+	}
+
+	//a host lighter than the evicted one still makes it in
+	d.add("d.example", 0, 0)
+	expected = []DestStat{
+		{Host: "a.example", Sessions: 2, BytesIn: 100, BytesOut: 150},
+		{Host: "d.example", Sessions: 1, Error: 21},
+	}
+	if top := d.top(0); !reflect.DeepEqual(top, expected) {
+		t.Errorf("expected %+v got %+v", expected, top)
+	}
+}
+
+func TestDestinationHostRedaction(t *testing.T) {
+	tts := []struct {
+		policy   *RedactionPolicy
+		dest     *AddrSpec
+		expected string
+	}{
+		{nil, hostAddrSpec("WWW.Example.COM.", 443), "www.example.com"},
+		{nil, hostAddrSpec("10.1.2.3", 80), "10.1.2.3"},
+		{&RedactionPolicy{Destination: RedactPrefix}, hostAddrSpec("www.example.com", 443), "example.com"},
+		{&RedactionPolicy{Destination: RedactPrefix}, hostAddrSpec("10.1.2.3", 80), "10.1.2.0"},
+		{&RedactionPolicy{Destination: RedactDrop}, hostAddrSpec("www.example.com", 443), ""},
+	}
+	for _, tt := range tts {
+		if host := tt.policy.destinationHost(tt.dest); host != tt.expected {
+			t.Errorf("%v: expected %q got %q", tt.dest, tt.expected, host)
+		}
+	}
+}
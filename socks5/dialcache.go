@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//ErrDialCached is returned for a request whose destination failed to be dialed within the ttl
+//of WithNegativeDialCache, it's replied the same failure without dialing it again
+var ErrDialCached = errors.New("socks5: destination failed to be dialed recently")
+
+//dialCache remembers the destinations that failed to be dialed for ttl, keeping at most max of
+//them, once it's full the least recently used one is evicted
+type dialCache struct {
+	ttl time.Duration
+	max int
+	//timeouts caches the dials that timed out as well
+	timeouts bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	hits    int64
+}
+
+type dialCacheEntry struct {
+	dest    string
+	reply   Reply
+	expires time.Time
+}
+
+//WithNegativeDialCache replies the failure of the last dial to the requests for a destination
+//that was refused or unreachable within ttl without dialing it again, so clients retrying a
+//dead destination fail fast. Destinations are keyed by the host:port handed to the Dialer, the
+//synthesized address when WithNAT64Prefix forces it. The Dialer resolves the domains so a domain
+//is keyed by its name and port rather than by the addresses it resolved to, and its entry is the
+//failure of dialing all of them. At most maxEntries destinations are kept and the least recently
+//used one is evicted for a new one. A successful dial forgets the destination. Dials that time out aren't cached unless
+//WithNegativeDialCacheTimeouts
+func WithNegativeDialCache(ttl time.Duration, maxEntries int) Option {
+	return func(s *Server) {
+		timeouts := s.dialCache != nil && s.dialCache.timeouts
+		s.dialCache = &dialCache{ttl: ttl, max: maxEntries, timeouts: timeouts, entries: make(map[string]*list.Element)}
+		s.validate(func() string {
+			if ttl <= 0 || maxEntries < 1 {
+				return fmt.Sprintf("WithNegativeDialCache needs a positive ttl and entries, got %v and %d", ttl, maxEntries)
+			}
+			return ""
+		})
+	}
+}
+
+//WithNegativeDialCacheTimeouts caches the dials of WithNegativeDialCache that timed out as well
+//as the refused and unreachable ones, it has no effect without WithNegativeDialCache
+func WithNegativeDialCacheTimeouts(timeouts bool) Option {
+	return func(s *Server) {
+		if s.dialCache == nil {
+			s.dialCache = &dialCache{entries: make(map[string]*list.Element)}
+		}
+		s.dialCache.timeouts = timeouts
+	}
+}
+
+//lookup returns the reply of the failed dial to dest if it's cached and hasn't expired
+func (d *dialCache) lookup(dest string) (Reply, bool) {
+	if d == nil || d.ttl <= 0 {
+		return 0, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.entries[dest]
+	if !ok {
+		return 0, false
+	}
+	entry := e.Value.(*dialCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		d.remove(e)
+		return 0, false
+	}
+	d.lru.MoveToFront(e)
+	d.hits++
+	return entry.reply, true
+}
+
+//failed caches the reply to the dial to dest that failed with err if the failure is a definitive one
+func (d *dialCache) failed(dest string, reply Reply, err error) {
+	if d == nil || d.ttl <= 0 || !d.cacheable(err) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	expires := time.Now().Add(d.ttl)
+	if e, ok := d.entries[dest]; ok {
+		entry := e.Value.(*dialCacheEntry)
+		entry.reply, entry.expires = reply, expires
+		d.lru.MoveToFront(e)
+		return
+	}
+	for d.lru.Len() >= d.max {
+		d.remove(d.lru.Back())
+	}
+	d.entries[dest] = d.lru.PushFront(&dialCacheEntry{dest: dest, reply: reply, expires: expires})
+}
+
+//succeeded forgets dest once it's been dialed
+func (d *dialCache) succeeded(dest string) {
+	if d == nil || d.ttl <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.entries[dest]; ok {
+		d.remove(e)
+	}
+}
+
+func (d *dialCache) remove(e *list.Element) {
+	delete(d.entries, e.Value.(*dialCacheEntry).dest)
+	d.lru.Remove(e)
+}
+
+//stats returns the hits and the destinations cached
+func (d *dialCache) stats() (hits int64, entries int) {
+	if d == nil {
+		return 0, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.hits, d.lru.Len()
+}
+
+//cacheable reports whether err is a definitive failure a dial again would fail with as well,
+//running out of file descriptors is a failure of the server and isn't
+func (d *dialCache) cacheable(err error) bool {
+	if fdExhausted(err) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return true
+	}
+	var netErr net.Error
+	return d.timeouts && errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,142 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNegativeDialCache(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	const ttl = 500 * time.Millisecond
+	var dials int32
+	dialer := &net.Dialer{Control: func(string, string, syscall.RawConn) error {
+		atomic.AddInt32(&dials, 1)
+		return nil
+	}}
+	s, proxy := newTestServer(t, WithDialer(dialer), WithNegativeDialCache(ttl, 10))
+	defer s.Close()
+
+	if _, err := NewClient(proxy).Dial("tcp", dead); err != ErrHostUnreachable {
+		t.Fatalf("expected the dead destination unreachable got %v", err)
+	}
+	//the second request is replied the same failure without dialing
+	start := time.Now()
+	if _, err := NewClient(proxy).Dial("tcp", dead); err != ErrHostUnreachable {
+		t.Errorf("expected the cached failure got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > ttl/2 {
+		t.Errorf("expected the cached failure to be fast got %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("expected a single dial got %d", n)
+	}
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{"socks5_dial_cache_hits_total 1\n", "socks5_dial_cache_entries 1\n"} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("expected %q in\n%s", line, rec.Body.String())
+		}
+	}
+
+	//once the ttl is over the destination which is listening again is dialed
+	l, err = net.Listen("tcp", dead)
+	if err != nil {
+		t.Skipf("the port was taken meanwhile: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	if _, err := NewClient(proxy).Dial("tcp", dead); err != ErrHostUnreachable {
+		t.Errorf("expected the failure cached until the ttl is over got %v", err)
+	}
+	time.Sleep(ttl)
+	c, err := NewClient(proxy).Dial("tcp", dead)
+	if err != nil {
+		t.Fatalf("expected the destination dialed once the ttl is over got %v", err)
+	}
+	c.Close()
+	if _, entries := s.dialCache.stats(); entries != 0 {
+		t.Errorf("expected the destination forgotten once dialed got %d entries", entries)
+	}
+}
+
+func TestDialCache(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}
+	tts := []struct {
+		err              error
+		cached, timeouts bool
+	}{
+		{refused, true, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}, true, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ENETUNREACH}, true, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, true, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.EMFILE}, false, true},
+		{timeout, false, false},
+		{timeout, true, true},
+		{errors.New("socks5: unknown"), false, true},
+	}
+	for _, tt := range tts {
+		d := &dialCache{timeouts: tt.timeouts}
+		if cached := d.cacheable(tt.err); cached != tt.cached {
+			t.Errorf("%v timeouts %v: expected cached %v got %v", tt.err, tt.timeouts, tt.cached, cached)
+		}
+	}
+
+	//the least recently used destination is evicted for a new one
+	s := &Server{}
+	WithNegativeDialCache(time.Minute, 2)(s)
+	d := s.dialCache
+	d.failed("a:1", ReplyHostUnreachable, refused)
+	d.failed("b:1", ReplyGeneralFailure, refused)
+	d.lookup("a:1")
+	d.failed("c:1", ReplyHostUnreachable, refused)
+	if _, ok := d.lookup("b:1"); ok {
+		t.Error("expected the least recently used destination evicted")
+	}
+	if reply, ok := d.lookup("a:1"); !ok || reply != ReplyHostUnreachable {
+		t.Errorf("expected a:1 cached got %v %v", reply, ok)
+	}
+	d.succeeded("a:1")
+	if _, ok := d.lookup("a:1"); ok {
+		t.Error("expected the destination forgotten once dialed")
+	}
+
+	//the timeouts are cached whichever option comes first
+	s = &Server{Cmds: []Command{CommandConnect}}
+	WithNegativeDialCacheTimeouts(true)(s)
+	WithNegativeDialCache(time.Minute, 2)(s)
+	s.dialCache.failed("a:1", ReplyHostUnreachable, timeout)
+	if _, ok := s.dialCache.lookup("a:1"); !ok {
+		t.Error("expected the timeout cached")
+	}
+	if err := s.Validate(); err != nil {
+		t.Error(err)
+	}
+	WithNegativeDialCache(0, 2)(s)
+	if err := s.Validate(); err == nil {
+		t.Error("expected a zero ttl to be invalid")
+	}
+}
@@ -0,0 +1,139 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	//dnsPort is the destination port of the datagrams intercepted as DNS queries
+	dnsPort = 53
+	//dnsTimeout bounds the resolution of an intercepted query
+	dnsTimeout = 5 * time.Second
+	//dnsTTL is the TTL of the synthesized answers
+	dnsTTL = 60
+)
+
+//Resolver looks up the IPs of domains, *net.Resolver is one
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+//WithResolver sets the resolver the intercepted DNS queries are answered with
+func WithResolver(r Resolver) Option {
+	return func(s *Server) {
+		s.Resolver = r
+	}
+}
+
+//DomainRuleset is a Ruleset which can tell the domains it denies every request for, with DNS
+//interception the queries for those are refused
+type DomainRuleset interface {
+	Ruleset
+	AllowDomain(client net.Addr, domain string) bool
+}
+
+//WithDNSInterception answers the A and AAAA queries clients send to port 53 through UDP
+//associations with the Resolver instead of relaying them, the queries for domains the
+//DomainRuleset denies are refused. Other queries and malformed ones are relayed as usual
+func WithDNSInterception(enabled bool) Option {
+	return func(s *Server) {
+		s.dnsInterception = enabled
+	}
+}
+
+//dnsInterceptor answers the DNS queries of the client of an association
+type dnsInterceptor struct {
+	resolver Resolver
+	ruleset  Ruleset
+	client   net.Addr
+}
+
+//dnsInterceptor returns the interceptor of the association of c, it's nil without interception
+func (s *Server) dnsInterceptor(c *conn) *dnsInterceptor {
+	if !s.dnsInterception {
+		return nil
+	}
+	_, ruleset := s.config()
+	//the domains denied in dry-run are resolved as the requests for them are served
+	if s.ruleDryRun {
+		ruleset = nil
+	}
+	d := &dnsInterceptor{resolver: s.Resolver, ruleset: ruleset, client: c.RemoteAddr()}
+	if d.resolver == nil {
+		d.resolver = net.DefaultResolver
+	}
+	return d
+}
+
+//query parses payload sent to dst and returns its question if it's to be answered, the
+//datagrams that aren't A or AAAA queries to port 53 are relayed
+func (d *dnsInterceptor) query(dst *AddrSpec, payload []byte) (dnsmessage.Header, dnsmessage.Question, bool) {
+	var h dnsmessage.Header
+	var q dnsmessage.Question
+	if d == nil || dst.Port != dnsPort {
+		return h, q, false
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(payload)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return h, q, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil || len(questions) != 1 {
+		return h, q, false
+	}
+	q = questions[0]
+	if q.Class != dnsmessage.ClassINET || (q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) {
+		return h, q, false
+	}
+	return h, q, true
+}
+
+//answer resolves q and returns the response to the query of header h
+func (d *dnsInterceptor) answer(h dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	domain := q.Name.String()
+	if dr, ok := d.ruleset.(DomainRuleset); ok && !dr.AllowDomain(d.client, domain) {
+		msg.Header.RCode = dnsmessage.RCodeRefused
+		return msg.Pack()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	addrs, err := d.resolver.LookupIPAddr(ctx, domain)
+	if err != nil {
+		msg.Header.RCode = dnsmessage.RCodeServerFailure
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			msg.Header.RCode = dnsmessage.RCodeNameError
+		}
+		return msg.Pack()
+	}
+
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+	for _, a := range addrs {
+		ip4 := a.IP.To4()
+		switch {
+		case q.Type == dnsmessage.TypeA && ip4 != nil:
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: rh, Body: r})
+		case q.Type == dnsmessage.TypeAAAA && ip4 == nil && len(a.IP) == net.IPv6len:
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], a.IP)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: rh, Body: r})
+		}
+	}
+	return msg.Pack()
+}
@@ -0,0 +1,175 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5/socks5test"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type resolverFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+func (f resolverFunc) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return f(ctx, host)
+}
+
+//associate sends a UDP ASSOCIATE to the proxy and returns the control connection and a socket
+//connected to the relay
+func associate(t *testing.T, proxy string) (*socks5test.Driver, net.Conn) {
+	d := socks5test.Dial(t, proxy, 5*time.Second)
+	d.Handshake(socks5test.Options{})
+	d.RequestAddr(byte(CommandUDPAssociation), "0.0.0.0:0")
+	reply := d.Read(10)
+	if reply[1] != byte(ReplySucceeded) {
+		t.Fatalf("unexpected reply % x", reply)
+	}
+	u, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(reply[8])<<8|int(reply[9]))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SetDeadline(time.Now().Add(5 * time.Second))
+	return d, u
+}
+
+func TestDNSInterception(t *testing.T) {
+	resolver := resolverFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "example.com.":
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+		case "missing.example.":
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, errors.New("resolver unavailable")
+	})
+	acl, err := ParseACL(strings.NewReader("deny dst ads.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, proxy := newTestServer(t, WithCommands(CommandUDPAssociation), WithDNSInterception(true),
+		WithResolver(resolver), WithRuleset(acl))
+	defer s.Close()
+
+	d, u := associate(t, proxy)
+	defer d.Close()
+	defer u.Close()
+
+	tts := []struct {
+		name    string
+		typ     dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers []string
+	}{
+		{"example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.0.2.1"}},
+		{"example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"2001:db8::1"}},
+		{"missing.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"broken.example.", dnsmessage.TypeA, dnsmessage.RCodeServerFailure, nil},
+		{"ads.example.", dnsmessage.TypeA, dnsmessage.RCodeRefused, nil},
+	}
+	//the resolver the client had configured isn't reachable, the answers come from the proxy
+	header := []byte{0, 0, 0, 1, 192, 0, 2, 53, 0, 53}
+	for i, tt := range tts {
+		q := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(i + 100), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(tt.name), Type: tt.typ, Class: dnsmessage.ClassINET}},
+		}
+		b, err := q.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := u.Write(append(header, b...)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, err := u.Read(buf)
+		if err != nil {
+			t.Fatalf("%s %v: %v", tt.name, tt.typ, err)
+		}
+		if !bytes.HasPrefix(buf[:n], header) {
+			t.Fatalf("%s %v: expected the answer from the resolver got % x", tt.name, tt.typ, buf[:n])
+		}
+		var res dnsmessage.Message
+		if err := res.Unpack(buf[len(header):n]); err != nil {
+			t.Fatal(err)
+		}
+		if res.Header.ID != q.Header.ID || !res.Header.Response || res.Header.RCode != tt.rcode {
+			t.Errorf("%s %v: unexpected header %+v", tt.name, tt.typ, res.Header)
+		}
+		if len(res.Questions) != 1 || res.Questions[0] != q.Questions[0] {
+			t.Errorf("%s %v: expected the question echoed got %v", tt.name, tt.typ, res.Questions)
+		}
+		var answers []string
+		for _, a := range res.Answers {
+			switch r := a.Body.(type) {
+			case *dnsmessage.AResource:
+				answers = append(answers, net.IP(r.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				answers = append(answers, net.IP(r.AAAA[:]).String())
+			}
+		}
+		if strings.Join(answers, ",") != strings.Join(tt.answers, ",") {
+			t.Errorf("%s %v: expected %v got %v", tt.name, tt.typ, tt.answers, answers)
+		}
+	}
+
+	//the datagrams to other ports are relayed
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		n, from, err := echo.ReadFrom(buf)
+		if err == nil {
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+	port := echo.LocalAddr().(*net.UDPAddr).Port
+	if _, err := u.Write([]byte{0, 0, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port), 'h', 'i'}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	if n, err := u.Read(buf); err != nil || string(buf[n-2:n]) != "hi" {
+		t.Errorf("expected the datagram to be relayed got % x %v", buf[:n], err)
+	}
+}
+
+func TestDNSInterceptorQuery(t *testing.T) {
+	d := &dnsInterceptor{}
+	query := func(typ dnsmessage.Type, response bool) []byte {
+		b, _ := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: response},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com."), Type: typ, Class: dnsmessage.ClassINET}},
+		}).Pack()
+		return b
+	}
+	dns := &AddrSpec{Type: AddrTypeIPv4, IP: net.IPv4(192, 0, 2, 53), Port: 53}
+	tts := []struct {
+		name        string
+		dst         *AddrSpec
+		payload     []byte
+		intercepted bool
+	}{
+		{"A", dns, query(dnsmessage.TypeA, false), true},
+		{"AAAA", dns, query(dnsmessage.TypeAAAA, false), true},
+		{"MX", dns, query(dnsmessage.TypeMX, false), false},
+		{"response", dns, query(dnsmessage.TypeA, true), false},
+		{"malformed", dns, []byte{1, 2, 3}, false},
+		{"other port", &AddrSpec{Type: AddrTypeIPv4, IP: net.IPv4(192, 0, 2, 53), Port: 5353}, query(dnsmessage.TypeA, false), false},
+	}
+	for _, tt := range tts {
+		if _, _, ok := d.query(tt.dst, tt.payload); ok != tt.intercepted {
+			t.Errorf("%s: expected %v got %v", tt.name, tt.intercepted, ok)
+		}
+	}
+	if _, _, ok := (*dnsInterceptor)(nil).query(dns, query(dnsmessage.TypeA, false)); ok {
+		t.Error("expected nothing to be intercepted without interception")
+	}
+}
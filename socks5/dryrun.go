@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+//the decisions on the requests recorded in SessionStats
+const (
+	DecisionAllowed = "allowed"
+	DecisionDenied  = "denied"
+	//DecisionDryRunDeny is the decision on the requests the ruleset denied in dry-run
+	DecisionDryRunDeny = "allowed (dry-run deny)"
+)
+
+//WithRuleDryRun only observes the denials of the ruleset if dryRun is set: the requests are
+//still checked but the denied ones are served, logged, counted by rule in
+//socks5_would_deny_total and notified with an EventWouldDeny. The rulesets which are
+//VerdictRulesets, e.g. ACLs with dry-run rules, can observe some rules and enforce the others
+func WithRuleDryRun(dryRun bool) Option {
+	return func(s *Server) {
+		s.ruleDryRun = dryRun
+	}
+}
+
+//wouldDeny records a request denied in dry-run by rule
+func (s *Server) wouldDeny(c *conn, req *Request, rule string) {
+	s.metrics.wouldDeny(rule)
+	s.logKeyed(LevelInfo, "dry-run "+rule, "session %s: %s: dry-run deny of %v %s by %q",
+		c.id, s.Redaction.client(c.RemoteAddr()), req.Command, s.Redaction.destination(req.Dest), rule)
+	s.Notify(Event{Type: EventWouldDeny, Data: &WouldDeny{
+		Rule:        rule,
+		SessionID:   c.id,
+		Client:      s.Redaction.client(c.RemoteAddr()),
+		Username:    c.user,
+		Command:     req.Command.String(),
+		Destination: s.Redaction.destination(req.Dest),
+	}})
+}
+
+//wouldDeny counts a request denied in dry-run by rule
+func (m *metrics) wouldDeny(rule string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.wouldDenyByRule == nil {
+		m.wouldDenyByRule = make(map[string]int64)
+	}
+	m.wouldDenyByRule[rule]++
+}
+
+//labelEscaper escapes the values of labels in the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//writeWouldDeny writes socks5_would_deny_total with a sample per rule
+func (m *metrics) writeWouldDeny(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rules := make([]string, 0, len(m.wouldDenyByRule))
+	for rule := range m.wouldDenyByRule {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	fmt.Fprint(w, "# HELP socks5_would_deny_total Requests denied in dry-run by rule, they were served.\n# TYPE socks5_would_deny_total counter\n")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "socks5_would_deny_total{rule=\"%s\"} %d\n", labelEscaper.Replace(rule), m.wouldDenyByRule[rule])
+	}
+}
@@ -0,0 +1,148 @@
+package socks5
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACLDryRun(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	req := func(host string, port uint16) *Request {
+		return &Request{Command: CommandConnect, Dest: &AddrSpec{Type: AddrTypeDomain, Host: host, Port: port}}
+	}
+	tts := []struct {
+		acl     string
+		req     *Request
+		verdict Verdict
+		allowed bool
+	}{
+		{"deny dry-run dst example.com", req("example.com", 80), Verdict{Rule: "deny dst example.com", DryRun: true}, true},
+		{"deny dry-run dst example.com\ndeny dst example.org", req("example.org", 80), Verdict{Rule: "deny dst example.org"}, false},
+		{"allow dst example.com\ndefault deny dry-run", req("example.org", 80), Verdict{Rule: "default deny", DryRun: true}, true},
+		{"allow dst example.com\ndefault deny dry-run", req("example.com", 80), Verdict{Allow: true, Rule: "allow dst example.com"}, true},
+		{"dry-run\ndeny dst example.com\ndefault deny", req("example.com", 80), Verdict{Rule: "deny dst example.com", DryRun: true}, true},
+		{"dry-run\ndeny dst example.com\ndefault deny", req("example.org", 80), Verdict{Rule: "default deny", DryRun: true}, true},
+		{"", req("example.com", 80), Verdict{Allow: true, Rule: "default allow"}, true},
+	}
+	for _, tt := range tts {
+		acl, err := ParseACL(strings.NewReader(tt.acl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := acl.Verdict(client, tt.req); v != tt.verdict {
+			t.Errorf("%q %v: expected %+v got %+v", tt.acl, tt.req.Dest, tt.verdict, v)
+		}
+		if allowed := acl.Allow(client, tt.req); allowed != tt.allowed {
+			t.Errorf("%q %v: expected allowed %v got %v", tt.acl, tt.req.Dest, tt.allowed, allowed)
+		}
+		//the clients and domains denied in dry-run aren't tarpitted or refused
+		if allowed := acl.AllowDomain(client, tt.req.Dest.Host); allowed != tt.allowed {
+			t.Errorf("%q %v: expected the domain allowed %v got %v", tt.acl, tt.req.Dest, tt.allowed, allowed)
+		}
+	}
+
+	acl, err := ParseACL(strings.NewReader("deny dry-run client 192.0.2.0/24\ndeny client 198.51.100.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acl.AllowClient(client) || acl.AllowClient(&net.TCPAddr{IP: net.ParseIP("198.51.100.1")}) {
+		t.Error("expected only the client denied in dry-run to be allowed")
+	}
+}
+
+//decisions records the decisions of the sessions
+type decisions chan string
+
+func (d decisions) Record(s SessionStats) error {
+	d <- s.Decision
+	return nil
+}
+
+func (d decisions) Totals(string, time.Time) (Usage, error) {
+	return Usage{}, nil
+}
+
+func TestRuleDryRun(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	acl, err := ParseACL(strings.NewReader("deny dry-run dst 127.0.0.0/8 ports " + portOf(echo.Addr()) + "\ndeny dst 127.0.0.0/8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 10)
+	recorded := make(decisions, 10)
+	s, proxy := newTestServer(t, WithRuleset(acl), WithNotifier(func(e Event) { events <- e }), WithAccounting(recorded))
+	defer s.Close()
+
+	//the traffic flows despite the matching deny rule
+	c, err := NewClient(proxy).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := c.Read(b); err != nil || string(b) != "ping" {
+		t.Errorf("expected the echo got %q %v", b, err)
+	}
+	c.Close()
+
+	rule := "deny dst 127.0.0.0/8 ports " + portOf(echo.Addr())
+	select {
+	case e := <-events:
+		wd, ok := e.Data.(*WouldDeny)
+		if e.Type != EventWouldDeny || !ok || wd.Rule != rule || wd.Command != "connect" || wd.Destination != echo.Addr().String() {
+			t.Errorf("unexpected event %v %+v", e.Type, e.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	select {
+	case d := <-recorded:
+		if d != DecisionDryRunDeny {
+			t.Errorf("expected %q got %q", DecisionDryRunDeny, d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session wasn't recorded")
+	}
+
+	//the rules which aren't in dry-run are enforced
+	if _, err := NewClient(proxy).Dial("tcp", "127.0.0.1:1"); err != ErrNotAllowedByRuleset {
+		t.Errorf("expected the request to be denied got %v", err)
+	}
+	if d := <-recorded; d != DecisionDenied {
+		t.Errorf("expected %q got %q", DecisionDenied, d)
+	}
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if sample := `socks5_would_deny_total{rule="` + rule + `"} 1`; !strings.Contains(rec.Body.String(), sample) {
+		t.Errorf("expected %s in\n%s", sample, rec.Body.String())
+	}
+
+	//every denial is observed with WithRuleDryRun
+	s, proxy = newTestServer(t, WithRuleset(acl), WithRuleDryRun(true), WithAccounting(recorded))
+	defer s.Close()
+	c, err = NewClient(proxy).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := NewClient(proxy).Dial("tcp", "127.0.0.1:1"); err != ErrHostUnreachable {
+		t.Errorf("expected the request to be served got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if d := <-recorded; d != DecisionDryRunDeny {
+			t.Errorf("expected %q got %q", DecisionDryRunDeny, d)
+		}
+	}
+	rec = httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if sample := `socks5_would_deny_total{rule="deny dst 127.0.0.0/8"} 1`; !strings.Contains(rec.Body.String(), sample) {
+		t.Errorf("expected %s in\n%s", sample, rec.Body.String())
+	}
+}
@@ -0,0 +1,214 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+//Strategy is the order a FailoverClient tries its proxies in
+type Strategy int
+
+const (
+	//StrategyFailover tries the proxies in the given order
+	StrategyFailover Strategy = iota
+
+	//StrategyRoundRobin starts every dial at the proxy after the one the previous dial started at
+	StrategyRoundRobin
+)
+
+//FailoverClient dials through the first proxy that works out of several, a proxy failing
+//MaxFailures consecutive dials is skipped until its Cooldown is over. Replies of a proxy
+//about the destination e.g. ErrHostUnreachable are returned without trying the next one
+type FailoverClient struct {
+	//Clients are the proxies
+	Clients []*Client
+
+	//Strategy is the order the proxies are tried in
+	Strategy Strategy
+
+	//MaxFailures is the number of consecutive failures after which a proxy is marked down
+	MaxFailures int
+
+	//Cooldown is how long a proxy is marked down for
+	Cooldown time.Duration
+
+	//AttemptTimeout bounds a dial through a single proxy, if 0 only the context does
+	AttemptTimeout time.Duration
+
+	//OnDial if set is called after every attempt with the address of the proxy and its error
+	OnDial func(proxy string, err error)
+
+	//Notify if set gets an EventUpstreamDown once the last healthy proxy is marked down, it
+	//may be the Notify of a Server
+	Notify func(Event)
+
+	mu     sync.Mutex
+	health map[*Client]*proxyHealth
+	next   int
+}
+
+type proxyHealth struct {
+	failures  int
+	downUntil time.Time
+}
+
+//NewFailoverClient returns a FailoverClient for proxies which are URLs like the ones of Chain
+func NewFailoverClient(strategy Strategy, proxies ...string) (*FailoverClient, error) {
+	if len(proxies) == 0 {
+		return nil, ErrNoProxies
+	}
+
+	f := &FailoverClient{Strategy: strategy, MaxFailures: 3, Cooldown: 30 * time.Second}
+	for _, proxy := range proxies {
+		c, err := parseProxyURL(proxy)
+		if err != nil {
+			return nil, err
+		}
+		f.Clients = append(f.Clients, c)
+	}
+	return f, nil
+}
+
+//Dial connects to addr through one of the proxies
+func (f *FailoverClient) Dial(network, addr string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, addr)
+}
+
+//DialContext connects to addr through the first proxy that works, the proxies marked down
+//are tried last. The error of the last attempt is returned if none works
+func (f *FailoverClient) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(f.Clients) == 0 {
+		return nil, ErrNoProxies
+	}
+
+	err := error(ErrNoProxies)
+	for _, c := range f.order() {
+		var conn net.Conn
+		conn, err = f.attempt(ctx, c, network, addr)
+		if f.OnDial != nil {
+			f.OnDial(c.ProxyAddr, err)
+		}
+		if err == nil {
+			f.report(c, true)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if isDestinationError(err) {
+			//the proxy works, the destination doesn't
+			f.report(c, true)
+			return nil, err
+		}
+		f.report(c, false)
+	}
+	return nil, err
+}
+
+func (f *FailoverClient) attempt(ctx context.Context, c *Client, network, addr string) (net.Conn, error) {
+	if f.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.AttemptTimeout)
+		defer cancel()
+	}
+	return c.DialContext(ctx, network, addr)
+}
+
+//order returns the proxies to try, the ones marked down come last
+func (f *FailoverClient) order() []*Client {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	start := 0
+	if f.Strategy == StrategyRoundRobin {
+		start = f.next
+		f.next = (f.next + 1) % len(f.Clients)
+	}
+
+	now := time.Now()
+	var up, down []*Client
+	for i := range f.Clients {
+		c := f.Clients[(start+i)%len(f.Clients)]
+		if h := f.health[c]; h != nil && now.Before(h.downUntil) {
+			down = append(down, c)
+			continue
+		}
+		up = append(up, c)
+	}
+	return append(up, down...)
+}
+
+//report updates the health of c after an attempt
+func (f *FailoverClient) report(c *Client, ok bool) {
+	if down := f.updateHealth(c, ok); down != nil && f.Notify != nil {
+		f.Notify(Event{Type: EventUpstreamDown, Time: time.Now(), Data: &UpstreamDown{Proxies: down}})
+	}
+}
+
+//updateHealth updates the health of c, it returns the proxies if c was the last healthy one
+func (f *FailoverClient) updateHealth(c *Client, ok bool) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.health == nil {
+		f.health = make(map[*Client]*proxyHealth)
+	}
+	h := f.health[c]
+	if h == nil {
+		h = new(proxyHealth)
+		f.health[c] = h
+	}
+
+	if ok {
+		h.failures, h.downUntil = 0, time.Time{}
+		return nil
+	}
+
+	h.failures++
+	max := f.MaxFailures
+	if max <= 0 {
+		max = 1
+	}
+	if h.failures < max {
+		return nil
+	}
+	now := time.Now()
+	wasDown := now.Before(h.downUntil)
+	h.downUntil = now.Add(f.Cooldown)
+	if wasDown {
+		return nil
+	}
+
+	down := make([]string, 0, len(f.Clients))
+	for _, c := range f.Clients {
+		if h := f.health[c]; h == nil || !now.Before(h.downUntil) {
+			return nil
+		}
+		down = append(down, c.ProxyAddr)
+	}
+	return down
+}
+
+//Down reports whether the proxy at addr is marked down
+func (f *FailoverClient) Down(addr string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c, h := range f.health {
+		if c.ProxyAddr == addr && time.Now().Before(h.downUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+//isDestinationError reports whether err is a reply of the proxy about the destination
+func isDestinationError(err error) bool {
+	switch err {
+	case ErrNotAllowedByRuleset, ErrNetworkUnreachable, ErrHostUnreachable,
+		ErrConnectionRefusedByProxy, ErrTTLExpired, ErrAddressTypeNotSupported:
+		return true
+	}
+	return false
+}
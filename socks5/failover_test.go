@@ -0,0 +1,147 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFailoverClient(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	s1, proxy1 := newTestServer(t)
+	s2, proxy2 := newTestServer(t)
+	defer s2.Close()
+
+	f, err := NewFailoverClient(StrategyFailover, proxy1, proxy2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.MaxFailures = 1
+	f.Cooldown = 300 * time.Millisecond
+	f.AttemptTimeout = time.Second
+
+	var mu sync.Mutex
+	var attempts []string
+	f.OnDial = func(proxy string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			proxy += " failed"
+		}
+		attempts = append(attempts, proxy)
+	}
+	dial := func() []string {
+		mu.Lock()
+		attempts = nil
+		mu.Unlock()
+
+		c, err := f.DialContext(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts
+	}
+
+	if a := dial(); len(a) != 1 || a[0] != proxy1 {
+		t.Errorf("expected the first proxy to be used got %v", a)
+	}
+
+	s1.Close()
+	if a := dial(); len(a) != 2 || a[0] != proxy1+" failed" || a[1] != proxy2 {
+		t.Errorf("expected a failover to the second proxy got %v", a)
+	}
+	if !f.Down(proxy1) {
+		t.Error("expected the first proxy to be marked down")
+	}
+	if a := dial(); len(a) != 1 || a[0] != proxy2 {
+		t.Errorf("expected the proxy marked down to be skipped got %v", a)
+	}
+
+	//the first proxy recovers and is used again once its cooldown is over
+	l, err := net.Listen("tcp", proxy1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1 = new(Server)
+	go s1.Serve(l)
+	defer s1.Close()
+
+	time.Sleep(f.Cooldown)
+	if a := dial(); len(a) != 1 || a[0] != proxy1 {
+		t.Errorf("expected the recovered proxy to be used got %v", a)
+	}
+	if f.Down(proxy1) {
+		t.Error("expected the recovered proxy not to be marked down")
+	}
+}
+
+func TestFailoverClientRoundRobin(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	s1, proxy1 := newTestServer(t)
+	defer s1.Close()
+	s2, proxy2 := newTestServer(t)
+	defer s2.Close()
+
+	f, err := NewFailoverClient(StrategyRoundRobin, proxy1, proxy2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var used []string
+	f.OnDial = func(proxy string, err error) {
+		used = append(used, proxy)
+	}
+
+	for i := 0; i < 4; i++ {
+		c, err := f.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	expected := []string{proxy1, proxy2, proxy1, proxy2}
+	for i := range expected {
+		if used[i] != expected[i] {
+			t.Fatalf("expected %v got %v", expected, used)
+		}
+	}
+}
+
+func TestFailoverClientDestinationError(t *testing.T) {
+	s1, proxy1 := newTestServer(t)
+	defer s1.Close()
+	s2, proxy2 := newTestServer(t)
+	defer s2.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	f, err := NewFailoverClient(StrategyFailover, proxy1, proxy2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempts := 0
+	f.OnDial = func(proxy string, err error) {
+		attempts++
+	}
+
+	if _, err := f.Dial("tcp", closed.Addr().String()); err != ErrHostUnreachable {
+		t.Errorf("expected %v got %v", ErrHostUnreachable, err)
+	}
+	if attempts != 1 || f.Down(proxy1) {
+		t.Errorf("expected a destination error not to fail over, got %d attempts", attempts)
+	}
+}
@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+//DefaultTCPFastOpenQueue is the most pending TCP Fast Open requests a listener of
+//WithTCPFastOpen has unless WithTCPFastOpenQueue is set
+const DefaultTCPFastOpenQueue = 256
+
+//fastOpenDataSize is the most bytes the client sent along its request that are read to be sent in
+//the SYN to the target, more than a SYN carries is sent once the connection is established
+const fastOpenDataSize = 1460
+
+//fastOpen is the TCP Fast Open of the listeners and of the connections to the targets
+type fastOpen struct {
+	inbound, outbound bool
+	queue             int
+	//notice logs once that TCP Fast Open isn't supported on the platform
+	notice sync.Once
+}
+
+//WithTCPFastOpen enables TCP Fast Open on the listeners if inbound, so the clients which have a
+//cookie send their handshake in the SYN, and on the connections to the targets if outbound.
+//The bytes a client sent along its connect request without waiting for the reply are then sent
+//in the SYN to the target, saving a round trip. It falls back to a plain connect when the kernel
+//doesn't allow it or has no cookie for the target. It's only supported on linux, elsewhere it's
+//logged and ignored
+func WithTCPFastOpen(inbound, outbound bool) Option {
+	return func(s *Server) {
+		s.fastOpenConfig().inbound, s.fastOpenConfig().outbound = inbound, outbound
+	}
+}
+
+//WithTCPFastOpenQueue sets the most pending TCP Fast Open requests a listener of WithTCPFastOpen
+//has, the others get a plain handshake. It's DefaultTCPFastOpenQueue by default
+func WithTCPFastOpenQueue(n int) Option {
+	return func(s *Server) {
+		s.fastOpenConfig().queue = n
+		s.validate(func() string {
+			if n < 1 {
+				return fmt.Sprintf("WithTCPFastOpenQueue %d isn't positive", n)
+			}
+			return ""
+		})
+	}
+}
+
+func (s *Server) fastOpenConfig() *fastOpen {
+	if s.fastOpen == nil {
+		s.fastOpen = &fastOpen{queue: DefaultTCPFastOpenQueue}
+	}
+	return s.fastOpen
+}
+
+//checkFastOpen logs once that WithTCPFastOpen is ignored if the platform doesn't support it
+func (s *Server) checkFastOpen() {
+	f := s.fastOpen
+	if f == nil || fastOpenSupported || !f.inbound && !f.outbound {
+		return
+	}
+	f.notice.Do(func() {
+		s.logf(LevelInfo, "TCP Fast Open isn't supported on this platform, WithTCPFastOpen is ignored")
+	})
+}
+
+//listenControl returns the control of the TCP listeners, it enables TCP Fast Open with a
+//queue of WithTCPFastOpenQueue if inbound. It's nil if there's nothing to set
+func (s *Server) listenControl() func(network, address string, c syscall.RawConn) error {
+	if s.fastOpen == nil || !s.fastOpen.inbound || !fastOpenSupported {
+		return nil
+	}
+	queue := s.fastOpen.queue
+	return func(network, address string, c syscall.RawConn) error {
+		if err := setFastOpenQueue(c, queue); err != nil {
+			s.logKeyed(LevelError, "fastopen", "enabling TCP Fast Open on %s failed, listening without it: %v", address, err)
+		}
+		return nil
+	}
+}
+
+//dial dials address for req with the Dialer of the server, with WithTCPFastOpen early is sent in
+//the SYN if the target has a cookie and right after the handshake if it doesn't
+func (s *Server) dial(ctx context.Context, req *Request, address string, early []byte) (net.Conn, error) {
+	d := s.dialer(req)
+	if len(early) == 0 {
+		return d.DialContext(ctx, "tcp", address)
+	}
+	return dialFastOpen(ctx, d, address, early)
+}
+
+//earlyData returns the bytes the client sent along its request if they're to be sent in the
+//SYN to the target of c with WithTCPFastOpen. The wrapped, captured and mirrored streams are
+//relayed as usual, as are the ones of the connections that aren't plain TCP ones
+func (s *Server) earlyData(c *conn) []byte {
+	if s.fastOpen == nil || !s.fastOpen.outbound || !fastOpenSupported || c.wrap != nil || c.capture != nil || c.mirror != nil {
+		return nil
+	}
+	tc, ok := c.Conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return readEarlyData(tc)
+}
@@ -0,0 +1,255 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const fastOpenSupported = true
+
+//fastOpenSendto sends b in the SYN of a connection to sa, it's replaced by the tests to
+//simulate a kernel without TCP Fast Open
+var fastOpenSendto = func(fd int, b []byte, sa unix.Sockaddr) (int, error) {
+	return unix.SendmsgN(fd, b, nil, sa, unix.MSG_FASTOPEN)
+}
+
+//errFastOpenUnsupported is returned by fastOpenConnect if the kernel doesn't allow TCP Fast Open
+//on the connections it opens
+var errFastOpenUnsupported = errors.New("socks5: TCP Fast Open isn't supported")
+
+func setFastOpenQueue(c syscall.RawConn, queue int) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, queue)
+	}); cerr != nil {
+		return cerr
+	}
+	return os.NewSyscallError("setsockopt", err)
+}
+
+//readEarlyData reads what the client already sent on c without waiting for more
+func readEarlyData(c *net.TCPConn) []byte {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	b := make([]byte, fastOpenDataSize)
+	n := 0
+	raw.Read(func(fd uintptr) bool {
+		n, _ = unix.Read(int(fd), b)
+		return true
+	})
+	if n <= 0 {
+		return nil
+	}
+	return b[:n]
+}
+
+//dialFastOpen connects to address sending b in the SYN, the rest of b if it doesn't fit or all
+//of it if the kernel has no cookie for the target is written once the connection is
+//established. If the kernel doesn't allow TCP Fast Open it's a plain dial writing b
+func dialFastOpen(ctx context.Context, d *net.Dialer, address string, b []byte) (net.Conn, error) {
+	raddr, err := resolveTCPAddr(ctx, d, address)
+	if err != nil {
+		return nil, err
+	}
+	c, err := fastOpenConnect(ctx, d, raddr, b)
+	if err != errFastOpenUnsupported {
+		return c, err
+	}
+	if c, err = d.DialContext(ctx, "tcp", address); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(b); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//resolveTCPAddr resolves address with the Resolver of d, preferring an IPv4 address like net.Dial
+func resolveTCPAddr(ctx context.Context, d *net.Dialer, address string) (*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, &net.AddrError{Err: "invalid port", Addr: address}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	ia := addrs[0]
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			ia = a
+			break
+		}
+	}
+	return &net.TCPAddr{IP: ia.IP, Port: port, Zone: ia.Zone}, nil
+}
+
+//fdRawConn is the syscall.RawConn of a socket that isn't a net.Conn yet, for the Control of a
+//Dialer
+type fdRawConn int
+
+func (fd fdRawConn) Control(f func(fd uintptr)) error {
+	f(uintptr(fd))
+	return nil
+}
+
+func (fd fdRawConn) Read(func(fd uintptr) bool) error {
+	return syscall.EINVAL
+}
+
+func (fd fdRawConn) Write(func(fd uintptr) bool) error {
+	return syscall.EINVAL
+}
+
+//fastOpenConnect connects to raddr sending b with sendto and MSG_FASTOPEN, it returns
+//errFastOpenUnsupported if the kernel doesn't allow it
+func fastOpenConnect(ctx context.Context, d *net.Dialer, raddr *net.TCPAddr, b []byte) (net.Conn, error) {
+	network, family := "tcp4", unix.AF_INET
+	var sa unix.Sockaddr
+	if ip4 := raddr.IP.To4(); ip4 != nil {
+		sa4 := &unix.SockaddrInet4{Port: raddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &unix.SockaddrInet6{Port: raddr.Port}
+		copy(sa6.Addr[:], raddr.IP.To16())
+		if ifi, err := net.InterfaceByName(raddr.Zone); err == nil {
+			sa6.ZoneId = uint32(ifi.Index)
+		}
+		network, family, sa = "tcp6", unix.AF_INET6, sa6
+	}
+	opErr := func(op string, err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: os.NewSyscallError(op, err)}
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP)
+	if err != nil {
+		return nil, opErr("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), "")
+	defer f.Close()
+	if la, ok := d.LocalAddr.(*net.TCPAddr); ok && la != nil {
+		var lsa unix.Sockaddr
+		if family == unix.AF_INET {
+			lsa4 := &unix.SockaddrInet4{Port: la.Port}
+			copy(lsa4.Addr[:], la.IP.To4())
+			lsa = lsa4
+		} else {
+			lsa6 := &unix.SockaddrInet6{Port: la.Port}
+			copy(lsa6.Addr[:], la.IP.To16())
+			lsa = lsa6
+		}
+		if err := unix.Bind(fd, lsa); err != nil {
+			return nil, opErr("bind", err)
+		}
+	}
+	if d.Control != nil {
+		if err := d.Control(network, raddr.String(), fdRawConn(fd)); err != nil {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: err}
+		}
+	}
+
+	n, err := fastOpenSendto(fd, b, sa)
+	switch err {
+	case nil:
+	case unix.EINPROGRESS:
+		//there's no cookie for the target, the SYN asked for one
+		n = 0
+	case unix.EOPNOTSUPP, unix.ENOPROTOOPT:
+		return nil, errFastOpenUnsupported
+	default:
+		return nil, opErr("sendto", err)
+	}
+
+	if err := waitConnected(ctx, d, f); err != nil {
+		if _, ok := err.(syscall.Errno); ok {
+			err = os.NewSyscallError("connect", err)
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: err}
+	}
+	//the addresses of the connection are known once it's established
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	if n < len(b) {
+		if _, err := c.Write(b[n:]); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//waitConnected waits for the socket of f to be connected with the deadline of ctx and d
+func waitConnected(ctx context.Context, d *net.Dialer, f *os.File) error {
+	c, err := net.FileConn(f)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	deadline, _ := ctx.Deadline()
+	if d.Timeout > 0 && (deadline.IsZero() || time.Now().Add(d.Timeout).Before(deadline)) {
+		deadline = time.Now().Add(d.Timeout)
+	}
+	if !d.Deadline.IsZero() && (deadline.IsZero() || d.Deadline.Before(deadline)) {
+		deadline = d.Deadline
+	}
+	c.SetWriteDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetWriteDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	raw, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var connErr error
+	if err := raw.Write(func(fd uintptr) bool {
+		errno, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		switch {
+		case err != nil:
+			connErr = err
+		case errno != 0:
+			connErr = syscall.Errno(errno)
+		default:
+			//it's still connecting until it has a peer
+			_, err := unix.Getpeername(int(fd))
+			return err == nil
+		}
+		return true
+	}); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return connErr
+}
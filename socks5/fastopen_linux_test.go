@@ -0,0 +1,130 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTCPFastOpen(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	var mu sync.Mutex
+	var sent [][]byte
+	unsupported := false
+	defer func(sendto func(int, []byte, unix.Sockaddr) (int, error)) { fastOpenSendto = sendto }(fastOpenSendto)
+	sendto := fastOpenSendto
+	fastOpenSendto = func(fd int, b []byte, sa unix.Sockaddr) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, append([]byte(nil), b...))
+		if unsupported {
+			return 0, unix.EOPNOTSUPP
+		}
+		return sendto(fd, b, sa)
+	}
+
+	s := &Server{Cmds: []Command{CommandConnect}}
+	WithTCPFastOpen(true, true)(s)
+	WithTCPFastOpenQueue(16)(s)
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	raw, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := 0
+	raw.Control(func(fd uintptr) {
+		queue, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN)
+	})
+	if err != nil || queue != 16 {
+		t.Errorf("expected a TCP Fast Open queue of 16 on the listener got %d %v", queue, err)
+	}
+
+	//pipelined sends the handshake, the request and the payload without waiting for the replies
+	pipelined := func(dst *net.TCPAddr, payload string) (Reply, string) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		b := []byte{socksVer5, 1, byte(noAuth), socksVer5, byte(CommandConnect), reserve, byte(AddrTypeIPv4)}
+		b = append(b, dst.IP.To4()...)
+		b = append(b, byte(dst.Port>>8), byte(dst.Port))
+		c.Write(append(b, payload...))
+		reply := make([]byte, 2+10)
+		if _, err := io.ReadFull(c, reply); err != nil {
+			t.Fatal(err)
+		}
+		echoed := make([]byte, len(payload))
+		if reply[3] == byte(ReplySucceeded) {
+			io.ReadFull(c, echoed)
+		}
+		return Reply(reply[3]), string(echoed)
+	}
+
+	tts := []struct {
+		name        string
+		unsupported bool
+	}{
+		{"tcp fast open", false},
+		//the kernel refusing MSG_FASTOPEN e.g. if net.ipv4.tcp_fastopen is 0
+		{"fallback", true},
+	}
+	for _, tt := range tts {
+		mu.Lock()
+		unsupported, sent = tt.unsupported, nil
+		mu.Unlock()
+		if reply, echoed := pipelined(echo.Addr().(*net.TCPAddr), "ping"); reply != ReplySucceeded || echoed != "ping" {
+			t.Errorf("%s: expected the payload echoed got %v %q", tt.name, reply, echoed)
+		}
+		mu.Lock()
+		if len(sent) != 1 || !bytes.Equal(sent[0], []byte("ping")) {
+			t.Errorf("%s: expected the payload sent in the SYN got %q", tt.name, sent)
+		}
+		mu.Unlock()
+	}
+
+	mu.Lock()
+	unsupported, sent = false, nil
+	mu.Unlock()
+	if reply, _ := pipelined(dead, "ping"); reply != ReplyHostUnreachable {
+		t.Errorf("expected a dead destination unreachable got %v", reply)
+	}
+
+	//a client waiting for the replies has nothing to send in the SYN
+	c, err := NewClient(l.Addr().String()).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("pong"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "pong" {
+		t.Errorf("expected the echo got %q %v", b, err)
+	}
+	c.Close()
+	mu.Lock()
+	if len(sent) != 1 {
+		t.Errorf("expected only the pipelined request to use TCP Fast Open got %q", sent)
+	}
+	mu.Unlock()
+}
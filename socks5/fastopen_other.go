@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+const fastOpenSupported = false
+
+//setFastOpenQueue isn't supported outside of linux
+func setFastOpenQueue(syscall.RawConn, int) error {
+	return nil
+}
+
+//readEarlyData isn't supported outside of linux
+func readEarlyData(*net.TCPConn) []byte {
+	return nil
+}
+
+//dialFastOpen is a plain dial writing b outside of linux
+func dialFastOpen(ctx context.Context, d *net.Dialer, address string, b []byte) (net.Conn, error) {
+	c, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(b); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
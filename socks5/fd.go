@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	//minFDBackoff and maxFDBackoff bound how long accepting waits once the process is out of
+	//file descriptors, the wait doubles until a connection is accepted
+	minFDBackoff = 5 * time.Millisecond
+	maxFDBackoff = time.Second
+)
+
+//fdExhausted reports whether err is EMFILE or ENFILE, the process or the system is out of file
+//descriptors
+func fdExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+//fdReserve is a file kept open so the descriptor can be given up once the process is out of
+//them, letting a connection waiting to be accepted be answered instead of retrying it forever
+type fdReserve struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+//acquire opens the reserved file unless it's open, it reports whether it is
+func (r *fdReserve) acquire() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		r.f, _ = os.Open(os.DevNull)
+	}
+	return r.f != nil
+}
+
+//release closes the reserved file
+func (r *fdReserve) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+//acceptFailed handles Accept failing with err, once the process is out of file descriptors
+//the new sessions are refused until it has some again, the reserved descriptor is given up for
+//a connection to be refused with and accepting waits for delay, which is returned doubled
+func (s *Server) acceptFailed(l net.Listener, err error, delay time.Duration) time.Duration {
+	atomic.AddInt64(&s.metrics.acceptFDExhausted, 1)
+	s.setPaused(pausedByFDs, true)
+	s.logKeyed(LevelError, "fd", "accepting on %v failed, out of file descriptors, refusing new sessions: %v", l.Addr(), err)
+	s.fds.release()
+
+	if delay < minFDBackoff {
+		delay = minFDBackoff
+	}
+	select {
+	case <-time.After(delay):
+	case <-s.getDoneChan():
+	}
+	if delay *= 2; delay > maxFDBackoff {
+		delay = maxFDBackoff
+	}
+	return delay
+}
+
+//accepted is called for every accepted connection, the server admits sessions again once the
+//reserved descriptor can be opened
+func (s *Server) accepted() {
+	if s.fds.acquire() && s.setPaused(pausedByFDs, false) {
+		s.logf(LevelInfo, "file descriptors available again, admitting new sessions")
+	}
+}
+
+//dialFailed replies to req for the dial that failed with err, running out of file descriptors
+//is a general failure of the server rather than an unreachable host. It returns the reply
+func (s *Server) dialFailed(req *Request, err error) Reply {
+	if !fdExhausted(err) {
+		req.Fail(ReplyHostUnreachable)
+		return ReplyHostUnreachable
+	}
+	atomic.AddInt64(&s.metrics.dialFDExhausted, 1)
+	s.logKeyed(LevelError, "fd", "session %s: dialing %s failed, out of file descriptors: %v",
+		req.conn.id, s.Redaction.destination(req.Dest), err)
+	req.Fail(ReplyGeneralFailure)
+	return ReplyGeneralFailure
+}
@@ -0,0 +1,22 @@
+package socks5
+
+import (
+	"os"
+	"syscall"
+)
+
+//fdUsage returns the open file descriptors of the process from /proc and the most it can open
+func fdUsage() (open, max int, ok bool) {
+	d, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, 0, false
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	var rl syscall.Rlimit
+	if err != nil || syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl) != nil {
+		return 0, 0, false
+	}
+	//the descriptor of the directory being read isn't counted
+	return len(names) - 1, int(rl.Cur), true
+}
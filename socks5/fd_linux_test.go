@@ -0,0 +1,129 @@
+package socks5
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//fdChildEnv is set for the child process of TestFDExhaustion serving with few descriptors
+const fdChildEnv = "SOCKS5_FD_CHILD"
+
+//serveWithFewFDs serves until stdin is closed with the limit of descriptors just above the ones
+//open, it writes the address of the server and then its metrics on every line read
+func serveWithFewFDs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Cmds: []Command{CommandConnect}}
+	go s.Serve(l)
+	open, _, ok := fdUsage()
+	if !ok {
+		t.Fatal("no descriptor usage")
+	}
+	lim := &syscall.Rlimit{Cur: uint64(open + 12), Max: uint64(open + 12)}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, lim); err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout.WriteString(l.Addr().String() + "\n")
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		rec := httptest.NewRecorder()
+		s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, "socks5_") {
+				os.Stdout.WriteString(line + " ")
+			}
+		}
+		os.Stdout.WriteString("\n")
+	}
+	s.Close()
+}
+
+func TestFDExhaustion(t *testing.T) {
+	if os.Getenv(fdChildEnv) == "1" {
+		serveWithFewFDs(t)
+		return
+	}
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFDExhaustion$")
+	cmd.Env = append(os.Environ(), fdChildEnv+"=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+	out := bufio.NewScanner(stdout)
+	if !out.Scan() {
+		t.Fatal("the child didn't start")
+	}
+	proxy := out.Text()
+	metrics := func() string {
+		stdin.Write([]byte("\n"))
+		if !out.Scan() {
+			t.Fatal("the child exited")
+		}
+		return out.Text()
+	}
+
+	//the sessions are held until the server runs out of descriptors, it refuses the next ones
+	//with a general failure rather than hanging or blaming the destination
+	dial := func() (net.Conn, error) {
+		return NewClient(proxy, WithClientTimeout(5*time.Second)).Dial("tcp", echo.Addr().String())
+	}
+	var held []net.Conn
+	for len(held) < 50 {
+		c, err := dial()
+		if err != nil {
+			if err != ErrGeneralFailure {
+				t.Fatalf("expected %v once out of descriptors got %v", ErrGeneralFailure, err)
+			}
+			break
+		}
+		held = append(held, c)
+	}
+	if len(held) == 0 || len(held) == 50 {
+		t.Fatalf("expected the descriptors to run out got %d sessions", len(held))
+	}
+	if m := metrics(); strings.Contains(m, "socks5_accept_fd_exhausted_total 0 ") && strings.Contains(m, "socks5_dial_fd_exhausted_total 0 ") {
+		t.Errorf("expected the exhaustion counted in %s", m)
+	}
+
+	//once the sessions are over the server admits new ones again
+	for _, c := range held {
+		c.Close()
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c, err := dial()
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the server to recover got %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if m := metrics(); !strings.Contains(m, "socks5_paused 0 ") {
+		t.Errorf("expected the server admitting sessions in %s", m)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+//fdUsage isn't supported outside of linux
+func fdUsage() (open, max int, ok bool) {
+	return 0, 0, false
+}
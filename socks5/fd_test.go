@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFDExhausted(t *testing.T) {
+	tts := []struct {
+		err       error
+		exhausted bool
+	}{
+		{&net.OpError{Op: "accept", Err: os.NewSyscallError("accept4", syscall.EMFILE)}, true},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("socket", syscall.ENFILE)}, true},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{errors.New("too many open files"), false},
+	}
+	for _, tt := range tts {
+		if exhausted := fdExhausted(tt.err); exhausted != tt.exhausted {
+			t.Errorf("%v: expected %v got %v", tt.err, tt.exhausted, exhausted)
+		}
+	}
+}
+
+//acquired reports whether the reserved file is open
+func (r *fdReserve) acquired() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f != nil
+}
+
+func TestFDReserveReleased(t *testing.T) {
+	for _, shutdown := range []bool{false, true} {
+		s := &Server{Cmds: []Command{CommandConnect}}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Serve(l)
+		}()
+		<-s.Ready()
+		deadline := time.Now().Add(5 * time.Second)
+		for !s.fds.acquired() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if !s.fds.acquired() {
+			t.Fatal("expected the descriptor reserved while accepting")
+		}
+
+		if shutdown {
+			s.Shutdown(context.Background())
+		} else {
+			s.Close()
+		}
+		<-done
+		if s.fds.acquired() {
+			t.Errorf("shutdown %v: expected the reserved descriptor released once the server stopped", shutdown)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"net"
+)
+
+//Request is the request of a client that completed the handshake, it's answered with Success
+//or Fail and relaying the connection afterwards is up to the caller
+type Request struct {
+	//Command is the requested command
+	Command Command
+
+	//Dest is the destination of the request
+	Dest *AddrSpec
+
+	conn *conn
+}
+
+//Handshake negotiates an authentication method with the client on c, authenticates it and
+//reads its request. The method of the first of auths the client offers is selected, if auths
+//is empty no authentication is required. A request with an unknown address type is answered
+//before ErrAddressTypeNotSupported is returned
+func Handshake(c net.Conn, auths []Authenticator) (*Request, error) {
+	if len(auths) == 0 {
+		auths = []Authenticator{NoAuth}
+	}
+	return handshake(newConn(c), auths)
+}
+
+func handshake(c *conn, auths []Authenticator) (*Request, error) {
+	auth, err := c.Negotiate(auths)
+	if err != nil {
+		return nil, err
+	}
+	c.negotiated = true
+
+	c.tracePhase(traceAuth, auth.AuthMethod())
+	if err := auth.Authenticate(c); err != nil {
+		return nil, err
+	}
+
+	c.tracePhase(traceRequest, 0)
+
+	cmd, addr, err := c.ReadCommandRequest()
+	if err != nil {
+		switch err {
+		case ErrInvalidSocksVer:
+			c.WriteError(ReplyGeneralFailure)
+		case ErrAddressTypeNotSupported:
+			c.WriteError(ReplyAddressNotSupported)
+		}
+		return nil, err
+	}
+	return &Request{Command: cmd, Dest: addr, conn: c}, nil
+}
+
+//Success replies to the request with the bound address, the null address is sent if bound
+//is nil or isn't a host:port address
+func (r *Request) Success(bound net.Addr) error {
+	return r.conn.WriteCommandResponse(ReplySucceeded, netAddrSpec(bound))
+}
+
+//Fail replies to the request with the reply code
+func (r *Request) Fail(reply Reply) error {
+	return r.conn.WriteError(reply)
+}
+
+//Relay copies data between the client and target until either side is done, target is closed
+func (r *Request) Relay(target net.Conn) {
+	r.conn.Relay(target)
+}
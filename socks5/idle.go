@@ -0,0 +1,130 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+//ErrIdleShutdown is returned by Serve and ListenAndServe once the server shut down with
+//WithIdleShutdown
+var ErrIdleShutdown = errors.New("socks5: idle shutdown")
+
+//maxIdlePollInterval is the longest between two checks of WithIdleShutdown
+const maxIdlePollInterval = time.Second
+
+//WithIdleShutdown shuts the server down once no session was active for d, its listeners are
+//closed and Serve returns ErrIdleShutdown. It's meant for servers started on demand e.g. by
+//socket activation, disabled if d is 0
+func WithIdleShutdown(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+//idleState is when the server became idle and the connections accepted that are being served,
+//it's guarded by the mutex of the server so a connection is admitted by the accept loop either
+//before the server shuts down, resetting the timer, or after it did and is then drained
+type idleState struct {
+	since    time.Time
+	admitted int
+	watching bool
+	shutdown bool
+}
+
+//admit counts a connection as accepted, it's called by the accept loop before the next Accept so
+//the server doesn't shut down for being idle while it's counted. A connection accepted as the
+//server shut down is counted as well, it's served and drained like the active sessions
+func (s *Server) admit() {
+	if s.idleTimeout <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.idle.admitted++
+	s.idle.since = time.Now()
+	s.mu.Unlock()
+}
+
+//release counts a connection admitted by admit as over
+func (s *Server) release() {
+	if s.idleTimeout <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.idle.admitted--
+	s.idle.since = time.Now()
+	s.mu.Unlock()
+}
+
+//serveAdmitted serves c admitted by admit with serveConn
+func (s *Server) serveAdmitted(c net.Conn, serveConn func(net.Conn) error) {
+	defer s.release()
+	serveConn(c)
+}
+
+//pendingSessions returns the number of connections being served including the ones admitted
+//whose session isn't tracked yet
+func (s *Server) pendingSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle.admitted > len(s.conns) {
+		return s.idle.admitted
+	}
+	return len(s.conns)
+}
+
+//idleShutdown reports whether the server shut down for being idle
+func (s *Server) idleShutdown() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.idle.shutdown
+}
+
+//watchIdle starts checking for the server to be idle unless it's already checked or
+//WithIdleShutdown isn't used
+func (s *Server) watchIdle() {
+	if s.idleTimeout <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle.watching || s.idle.shutdown {
+		return
+	}
+	s.idle.watching, s.idle.since = true, time.Now()
+	go s.checkIdle(s.getDoneChanLocked())
+}
+
+//checkIdle closes the listeners once no session was active for the idle timeout or the server
+//is closed
+func (s *Server) checkIdle(done <-chan struct{}) {
+	interval := s.idleTimeout / 4
+	if interval > maxIdlePollInterval {
+		interval = maxIdlePollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			s.mu.Lock()
+			s.idle.watching = false
+			s.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if s.idle.admitted > 0 || len(s.conns) > 0 || time.Since(s.idle.since) < s.idleTimeout {
+			s.mu.Unlock()
+			continue
+		}
+		s.idle.shutdown, s.idle.watching = true, false
+		atomic.StoreInt32(&s.draining, 1)
+		s.closeListenerLocked()
+		s.mu.Unlock()
+		s.logf(LevelInfo, "no session for %v, shutting down", s.idleTimeout)
+		return
+	}
+}
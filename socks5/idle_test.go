@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleShutdown(t *testing.T) {
+	const idle = 300 * time.Millisecond
+	echo := newEchoServer(t)
+	defer echo.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Cmds: []Command{CommandConnect}}
+	WithIdleShutdown(idle)(s)
+	defer s.Close()
+	served := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	//a session outlasting the timeout defers the shutdown until it's over
+	c, err := NewClient(l.Addr().String()).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("expected the server to serve while a session is active got %v", err)
+	case <-time.After(2 * idle):
+	}
+	c.Write([]byte("ping"))
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	closed := time.Now()
+
+	select {
+	case err := <-served:
+		if err != ErrIdleShutdown {
+			t.Errorf("expected %v got %v", ErrIdleShutdown, err)
+		}
+		if since := time.Since(closed); since < idle {
+			t.Errorf("expected the shutdown %v after the last session got %v", idle, since)
+		}
+		if since := time.Since(start); since < 3*idle {
+			t.Errorf("expected the session to defer the shutdown got %v", since)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server didn't shut down")
+	}
+	if s.Accepting() {
+		t.Error("expected the server not to accept once it shut down")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("expected the listener closed")
+	}
+}
+
+func TestIdleShutdownAdmission(t *testing.T) {
+	s := &Server{}
+	WithIdleShutdown(time.Millisecond)(s)
+
+	//a connection admitted before the check keeps the server up past the timeout
+	s.admit()
+	s.watchIdle()
+	time.Sleep(50 * time.Millisecond)
+	if s.idleShutdown() {
+		t.Fatal("expected the admitted connection to keep the server up")
+	}
+	s.release()
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.idleShutdown() {
+		if time.Now().After(deadline) {
+			t.Fatal("the server didn't shut down")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	//and one accepted as it shut down is drained rather than closed
+	s.admit()
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected Shutdown to wait for the admitted connection got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.release()
+	if err := <-done; err != nil {
+		t.Errorf("expected the admitted connection drained got %v", err)
+	}
+}
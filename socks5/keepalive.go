@@ -0,0 +1,39 @@
+package socks5
+
+import "net"
+
+//WithKeepAliveConfig sets the TCP keep-alives of the inbound and outbound connections, the idle
+//time before the first probe, the interval between the probes and how many are sent before the
+//connection is dropped. The inbound connections get them before the handshake so a client that
+//vanished is reaped even while it's stalled. It takes precedence over KeepAlive, before go1.23
+//only the idle time is set
+func WithKeepAliveConfig(cfg KeepAliveConfig) Option {
+	return func(s *Server) {
+		s.keepAliveConfig = &cfg
+	}
+}
+
+//setKeepAlive sets the keep-alives of WithKeepAliveConfig, or of KeepAlive unless outbound, on
+//c if it's a TCP connection
+func (s *Server) setKeepAlive(c net.Conn, outbound bool) {
+	tc, ok := c.(*net.TCPConn)
+	switch {
+	case !ok:
+	case s.keepAliveConfig != nil:
+		if err := setKeepAliveConfig(tc, *s.keepAliveConfig); err != nil {
+			s.logKeyed(LevelError, "keepalive", "setting the keep-alives of %s failed: %s", s.redactedPeer(tc, outbound), s.Redaction.error(err))
+		}
+	case s.KeepAlive > 0 && !outbound:
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(s.KeepAlive)
+	}
+}
+
+//redactedPeer returns the remote address of c as it may be logged, the one of an outbound
+//connection is a destination and the one of an inbound connection a client
+func (s *Server) redactedPeer(c net.Conn, outbound bool) string {
+	if outbound {
+		return s.Redaction.destination(netAddrSpec(c.RemoteAddr()))
+	}
+	return s.Redaction.client(c.RemoteAddr())
+}
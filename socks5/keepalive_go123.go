@@ -0,0 +1,13 @@
+//go:build go1.23
+// +build go1.23
+
+package socks5
+
+import "net"
+
+//KeepAliveConfig is the net.KeepAliveConfig of the keep-alives of WithKeepAliveConfig
+type KeepAliveConfig = net.KeepAliveConfig
+
+func setKeepAliveConfig(tc *net.TCPConn, cfg KeepAliveConfig) error {
+	return tc.SetKeepAliveConfig(cfg)
+}
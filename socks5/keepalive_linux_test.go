@@ -0,0 +1,127 @@
+//go:build linux && go1.23
+// +build linux,go1.23
+
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+//acceptRecorder records the connections accepted by the listener
+type acceptRecorder struct {
+	net.Listener
+	accepted chan net.Conn
+}
+
+func (l *acceptRecorder) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted <- c
+	}
+	return c, err
+}
+
+//keepAliveOpts returns SO_KEEPALIVE, TCP_KEEPIDLE, TCP_KEEPINTVL and TCP_KEEPCNT of c
+func keepAliveOpts(t *testing.T, c net.Conn) [4]int {
+	t.Helper()
+	rc, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts [4]int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		for i, opt := range [][2]int{
+			{unix.SOL_SOCKET, unix.SO_KEEPALIVE},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPIDLE},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPINTVL},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPCNT},
+		} {
+			if opts[i], serr = unix.GetsockoptInt(int(fd), opt[0], opt[1]); serr != nil {
+				return
+			}
+		}
+	})
+	if err != nil || serr != nil {
+		t.Fatal(err, serr)
+	}
+	return opts
+}
+
+func TestKeepAliveConfig(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &acceptRecorder{Listener: l, accepted: make(chan net.Conn, 1)}
+	s := &Server{Cmds: []Command{CommandConnect}}
+	WithKeepAlive(time.Minute)(s)
+	WithKeepAliveConfig(KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 5 * time.Second, Count: 3})(s)
+	go s.Serve(rec)
+	defer s.Close()
+
+	//the client never sends its greeting
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := <-rec.accepted
+
+	expected := [4]int{1, 30, 5, 3}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		opts := keepAliveOpts(t, sc)
+		if opts == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected keep-alives, idle, interval and count %v got %v", expected, opts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReversePing(t *testing.T) {
+	rendezvous, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rendezvous.Close()
+	s := new(Server)
+	defer s.Close()
+
+	//the reverse connection is wrapped in TLS, the TCP connection under it is probed
+	opts := make(chan [4]int, 1)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		c, err := net.Dial("tcp", rendezvous.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return tls.Client(c, &tls.Config{InsecureSkipVerify: true}), nil
+	}
+	handler := func(c net.Conn) error {
+		select {
+		case opts <- keepAliveOpts(t, c.(*tls.Conn).NetConn()):
+		default:
+		}
+		return c.Close()
+	}
+	go s.ServeReverse(context.Background(), dial, WithReversePing(20*time.Second), WithReverseHandler(handler))
+
+	select {
+	case got := <-opts:
+		if expected := [4]int{1, 20, 20, reversePingProbes}; got != expected {
+			t.Errorf("expected keep-alives, idle, interval and count %v got %v", expected, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reverse connection wasn't dialed")
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !go1.23
+// +build !go1.23
+
+package socks5
+
+import (
+	"net"
+	"time"
+)
+
+//KeepAliveConfig is the keep-alives of WithKeepAliveConfig, it's net.KeepAliveConfig from go1.23
+//on. Before that only the idle time is set, as the period of SetKeepAlivePeriod
+type KeepAliveConfig struct {
+	//Enable enables the keep-alives
+	Enable bool
+	//Idle is the time without traffic before the first probe
+	Idle time.Duration
+	//Interval is the time between the probes
+	Interval time.Duration
+	//Count is the probes left unanswered before the connection is dropped
+	Count int
+}
+
+func setKeepAliveConfig(tc *net.TCPConn, cfg KeepAliveConfig) error {
+	if err := tc.SetKeepAlive(cfg.Enable); err != nil || !cfg.Enable || cfg.Idle <= 0 {
+		return err
+	}
+	return tc.SetKeepAlivePeriod(cfg.Idle)
+}
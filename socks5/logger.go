@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"fmt"
+	"log"
+)
+
+//Level is the severity of a log message
+type Level int
+
+const (
+	//LevelTrace dumps the bytes of handshakes
+	LevelTrace Level = iota - 2
+	//LevelDebug describes every session
+	LevelDebug
+	//LevelInfo is for events worth noting, it's the default level
+	LevelInfo
+	//LevelError is for failures
+	LevelError
+)
+
+//String returns the name of the level
+func (l Level) String() string {
+	switch l {
+	case LevelTrace:
+		return "trace"
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+//Logger receives the messages logged by the server
+type Logger interface {
+	Log(level Level, msg string)
+}
+
+//LoggerFunc is an adapter to use functions as Logger
+type LoggerFunc func(level Level, msg string)
+
+//Log calls f(level, msg)
+func (f LoggerFunc) Log(level Level, msg string) {
+	f(level, msg)
+}
+
+//StdLogger returns a Logger writing to l with the level as a prefix, the standard logger of
+//the log package is used if l is nil
+func StdLogger(l *log.Logger) Logger {
+	return LoggerFunc(func(level Level, msg string) {
+		if l == nil {
+			log.Printf("socks5: %s: %s", level, msg)
+			return
+		}
+		l.Printf("socks5: %s: %s", level, msg)
+	})
+}
+
+var defaultLogger = StdLogger(nil)
+
+//logEnabled reports whether messages of level are logged
+func (s *Server) logEnabled(level Level) bool {
+	return level >= s.LogLevel
+}
+
+func (s *Server) logf(level Level, format string, args ...interface{}) {
+	s.logKeyed(level, format, format, args...)
+}
+
+//logKeyed logs a message which is rate limited with the other messages of key
+func (s *Server) logKeyed(level Level, key, format string, args ...interface{}) {
+	if !s.logEnabled(level) {
+		return
+	}
+	if s.logLimiter != nil && !s.logLimiter.allow(s, level, key) {
+		return
+	}
+	s.logger().Log(level, fmt.Sprintf(format, args...))
+}
+
+func (s *Server) logger() Logger {
+	if s.Logger == nil {
+		return defaultLogger
+	}
+	return s.Logger
+}
@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//LogLimitKeys is the number of distinct messages a rate limited logger tracks in an interval,
+//messages past it are limited together
+const LogLimitKeys = 1024
+
+//logLimiter lets at most burst messages of a kind through every interval, the ones it holds
+//back are summed up in a line once the interval is over
+type logLimiter struct {
+	burst        int
+	interval     time.Duration
+	bypassErrors bool
+
+	mu         sync.Mutex
+	start      time.Time
+	counts     map[string]int
+	suppressed int
+	level      Level
+	flushing   bool
+}
+
+func newLogLimiter(burst int, interval time.Duration, bypassErrors bool) *logLimiter {
+	return &logLimiter{
+		burst:        burst,
+		interval:     interval,
+		bypassErrors: bypassErrors,
+		counts:       make(map[string]int),
+	}
+}
+
+//allow reports whether a message of key is logged, the summary of the messages held back is
+//written to s once the interval is over
+func (l *logLimiter) allow(s *Server, level Level, key string) bool {
+	if l.bypassErrors && level >= LevelError {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.start) >= l.interval {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+	if _, ok := l.counts[key]; !ok && len(l.counts) >= LogLimitKeys {
+		key = ""
+	}
+	l.counts[key]++
+	if l.counts[key] <= l.burst {
+		return true
+	}
+
+	if l.suppressed == 0 || level > l.level {
+		l.level = level
+	}
+	l.suppressed++
+	if !l.flushing {
+		l.flushing = true
+		time.AfterFunc(l.start.Add(l.interval).Sub(now), func() { l.flush(s) })
+	}
+	return false
+}
+
+//flush writes the summary of the messages held back
+func (l *logLimiter) flush(s *Server) {
+	l.mu.Lock()
+	n, level := l.suppressed, l.level
+	l.suppressed, l.flushing = 0, false
+	l.mu.Unlock()
+
+	if n > 0 {
+		s.logger().Log(level, fmt.Sprintf("suppressed %d similar messages in the last %v", n, l.interval))
+	}
+}
+
+//errorKey returns the key session errors are limited by, the kind of err and the /24 or /48 of
+//the client so a single scanner doesn't drown the rest
+func errorKey(err error, client net.Addr) string {
+	var kind string
+loop:
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case *net.DNSError:
+			kind = "lookup: " + e.Err
+			break loop
+		case *net.AddrError:
+			kind = e.Err
+			break loop
+		default:
+			kind = err.Error()
+			break loop
+		}
+	}
+
+	host, _, splitErr := net.SplitHostPort(client.String())
+	if splitErr != nil {
+		host = client.String()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ipPrefix(ip)
+	}
+	return kind + " " + host
+}
@@ -0,0 +1,131 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//messageLogger keeps every message logged
+type messageLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (m *messageLogger) Log(level Level, msg string) {
+	m.mu.Lock()
+	m.messages = append(m.messages, level.String()+": "+msg)
+	m.mu.Unlock()
+}
+
+func (m *messageLogger) count(prefix string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, msg := range m.messages {
+		if strings.HasPrefix(msg, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLogRateLimit(t *testing.T) {
+	tts := []struct {
+		name              string
+		level             Level
+		bypassErrors      bool
+		logged, summaries int
+	}{
+		{"info", LevelInfo, false, 3, 1},
+		{"error", LevelError, false, 3, 1},
+		{"bypassed error", LevelError, true, 100, 0},
+	}
+
+	scanner := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	for _, tt := range tts {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := new(messageLogger)
+			s := &Server{}
+			for _, opt := range []Option{WithLogger(logger, LevelInfo), WithLogRateLimit(3, time.Minute, tt.bypassErrors)} {
+				opt(s)
+			}
+
+			for i := 0; i < 100; i++ {
+				//the port changes with every connection of the scanner, the /24 doesn't
+				scanner.Port++
+				scanner.IP[15] = byte(i)
+				s.logKeyed(tt.level, errorKey(ErrInvalidSocksVer, scanner), "flood %d", i)
+			}
+			other := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1234}
+			s.logKeyed(tt.level, errorKey(ErrInvalidSocksVer, other), "other")
+
+			prefix := tt.level.String() + ": "
+			if n := logger.count(prefix + "flood"); n != tt.logged {
+				t.Errorf("expected %d messages got %d", tt.logged, n)
+			}
+			if n := logger.count(prefix + "other"); n != 1 {
+				t.Errorf("expected the other client to be logged got %d", n)
+			}
+
+			s.logLimiter.flush(s)
+			summary := prefix + "suppressed 97 similar messages in the last 1m0s"
+			if n := logger.count(summary); n != tt.summaries {
+				t.Errorf("expected %d summaries got %d in %v", tt.summaries, n, logger.messages)
+			}
+			//nothing more was held back
+			s.logLimiter.flush(s)
+			if n := logger.count(prefix + "suppressed"); n != tt.summaries {
+				t.Errorf("expected %d summaries got %d", tt.summaries, n)
+			}
+		})
+	}
+}
+
+func TestLogRateLimitInterval(t *testing.T) {
+	logger := new(messageLogger)
+	s := &Server{}
+	WithLogger(logger, LevelInfo)(s)
+	WithLogRateLimit(1, 50*time.Millisecond, false)(s)
+
+	s.logf(LevelInfo, "first")
+	s.logf(LevelInfo, "first")
+	//the summary is written once the interval is over and the limit starts over
+	deadline := time.Now().Add(5 * time.Second)
+	for logger.count("info: suppressed 1 similar messages") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no summary in %v", logger.messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.logf(LevelInfo, "first")
+	if n := logger.count("info: first"); n != 2 {
+		t.Errorf("expected 2 messages got %d", n)
+	}
+}
+
+func TestErrorKey(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5555}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2::1"), Port: 5555}
+	tts := []struct {
+		err      error
+		client   net.Addr
+		expected string
+	}{
+		{io.EOF, client, "EOF 10.1.2.0"},
+		{errors.New("some error"), client6, "some error 2001:db8:1::"},
+		{&net.OpError{Op: "read", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "a.example"}}, client, "lookup: no such host 10.1.2.0"},
+		{&net.OpError{Op: "read", Net: "tcp", Source: client, Err: syscall.ECONNRESET}, client, syscall.ECONNRESET.Error() + " 10.1.2.0"},
+		{io.EOF, &net.UnixAddr{Name: "@", Net: "unix"}, "EOF @"},
+	}
+	for _, tt := range tts {
+		if key := errorKey(tt.err, tt.client); key != tt.expected {
+			t.Errorf("%v: expected %q got %q", tt.err, tt.expected, key)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+//Package mdns advertises the server on the local network as a DNS-SD service (RFC 6763) over
+//multicast DNS (RFC 6762). The responder is minimal, it announces the service and answers
+//PTR, SRV, TXT, A and AAAA queries for its own names only
+package mdns
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	//Port is the mDNS port
+	Port = 5353
+
+	//DefaultService is the DNS-SD service type of SOCKS5 proxies
+	DefaultService = "_socks5._tcp"
+
+	//DefaultDomain is the mDNS domain
+	DefaultDomain = "local."
+)
+
+//cacheFlush is set in the class of the records owned exclusively by the responder
+const cacheFlush dnsmessage.Class = 1 << 15
+
+//legacyTTL is the maximum TTL of records sent to legacy unicast resolvers
+const legacyTTL = 10 * time.Second
+
+//ErrNoInterfaces is returned if none of the interfaces supports multicast
+var ErrNoInterfaces = errors.New("mdns: no multicast interfaces")
+
+//Responder advertises a service instance and answers queries for it
+type Responder struct {
+	//Instance is the instance name of the service, dots are replaced by dashes
+	Instance string
+
+	//Service is the service type, if empty DefaultService is used
+	Service string
+
+	//Domain is the domain of the service, if empty DefaultDomain is used
+	Domain string
+
+	//Host is the host name the service points to, if empty the name of the machine is used
+	Host string
+
+	//Port is the port the service listens on
+	Port int
+
+	//Text are the key=value pairs of the TXT record
+	Text []string
+
+	//TTL is the TTL of the records
+	TTL time.Duration
+
+	//Interfaces are the interfaces the service is advertised on, if nil every multicast
+	//interface is used
+	Interfaces []net.Interface
+
+	//Interval is the interval at which the addresses of the interfaces are checked, the
+	//service is announced again if they change
+	Interval time.Duration
+
+	mu    sync.RWMutex
+	addrs map[int][]net.IP
+}
+
+//New returns a Responder advertising instance on port with sane defaults
+func New(instance string, port int, text ...string) *Responder {
+	return &Responder{
+		Instance: instance,
+		Service:  DefaultService,
+		Domain:   DefaultDomain,
+		Port:     port,
+		Text:     text,
+		TTL:      2 * time.Minute,
+		Interval: 10 * time.Second,
+	}
+}
+
+//Run advertises the service until ctx is done, the advertisement is withdrawn before it returns
+func (r *Responder) Run(ctx context.Context) error {
+	conns := listenMulticast(r.Interfaces)
+	if len(conns) == 0 {
+		return ErrNoInterfaces
+	}
+
+	r.setAddrs(r.interfaceAddrs())
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c transport) {
+			defer wg.Done()
+			r.serve(c)
+		}(c)
+	}
+
+	r.announce(conns)
+
+	interval := r.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if r.setAddrs(r.interfaceAddrs()) {
+				log.Printf("mdns: addresses changed, announcing %s again", r.instanceName())
+				r.announce(conns)
+			}
+		case <-ctx.Done():
+			r.goodbye(conns)
+			for _, c := range conns {
+				c.Close()
+			}
+			wg.Wait()
+			return ctx.Err()
+		}
+	}
+}
+
+//announce sends the records twice, a second apart, on every interface
+func (r *Responder) announce(conns []transport) {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		r.broadcast(conns, r.ttl())
+	}
+}
+
+//goodbye withdraws the advertisement by sending the records with a zero TTL
+func (r *Responder) goodbye(conns []transport) {
+	r.broadcast(conns, 0)
+}
+
+func (r *Responder) broadcast(conns []transport, ttl time.Duration) {
+	for _, c := range conns {
+		for ifIndex, addrs := range r.addresses() {
+			b, err := r.announcement(addrs, ttl)
+			if err != nil {
+				log.Printf("mdns: unable to build announcement: %v", err)
+				return
+			}
+			if _, err := c.WriteTo(b, ifIndex, nil); err != nil {
+				log.Printf("mdns: unable to announce on interface %d: %v", ifIndex, err)
+			}
+		}
+	}
+}
+
+func (r *Responder) serve(c transport) {
+	b := make([]byte, 9000)
+	for {
+		n, ifIndex, src, err := c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		res, unicast, err := r.handle(b[:n], r.interfaceAddrsOf(ifIndex), src)
+		if err != nil || res == nil {
+			continue
+		}
+
+		var dst net.Addr
+		if unicast {
+			dst = src
+		}
+		if _, err := c.WriteTo(res, ifIndex, dst); err != nil {
+			log.Printf("mdns: unable to respond to %v: %v", src, err)
+		}
+	}
+}
+
+//handle returns the response to query or nil if it has no questions about our names, unicast
+//reports whether the response must be sent to src instead of the multicast group
+func (r *Responder) handle(query []byte, addrs []net.IP, src net.Addr) (res []byte, unicast bool, err error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, false, err
+	}
+	if h.Response || h.OpCode != 0 {
+		return nil, false, nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false, err
+	}
+
+	//queries not sent from the mDNS port come from legacy resolvers expecting a regular response
+	legacy := false
+	if udp, ok := src.(*net.UDPAddr); ok && udp.Port != Port {
+		legacy = true
+	}
+
+	ttl := r.ttl()
+	if legacy && ttl > legacyTTL {
+		ttl = legacyTTL
+	}
+	rs := r.records(addrs, ttl, !legacy)
+
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	if legacy {
+		msg.Header.ID = h.ID
+	}
+
+	unicast = legacy
+	for _, q := range questions {
+		answers, additionals := rs.answer(q)
+		if len(answers) == 0 {
+			continue
+		}
+		if q.Class&cacheFlush != 0 {
+			unicast = true
+		}
+		if legacy {
+			msg.Questions = append(msg.Questions, q)
+		}
+		msg.Answers = appendUnique(msg.Answers, answers...)
+		msg.Additionals = appendUnique(msg.Additionals, additionals...)
+	}
+	if len(msg.Answers) == 0 {
+		return nil, false, nil
+	}
+
+	//records already in the answers aren't repeated in the additional section
+	additionals := msg.Additionals[:0]
+	for _, a := range msg.Additionals {
+		if !containsResource(msg.Answers, a) {
+			additionals = append(additionals, a)
+		}
+	}
+	msg.Additionals = additionals
+
+	res, err = msg.Pack()
+	return res, unicast, err
+}
+
+//announcement returns an unsolicited response with every record
+func (r *Responder) announcement(addrs []net.IP, ttl time.Duration) ([]byte, error) {
+	rs := r.records(addrs, ttl, true)
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	msg.Answers = append(msg.Answers, rs.ptr, rs.srv, rs.txt)
+	msg.Answers = append(msg.Answers, rs.addrs...)
+	return msg.Pack()
+}
+
+type records struct {
+	service, instance, host string
+
+	ptr, srv, txt dnsmessage.Resource
+	addrs         []dnsmessage.Resource
+}
+
+//answer returns the records answering q and the additional records the resolver will need
+func (rs *records) answer(q dnsmessage.Question) (answers, additionals []dnsmessage.Resource) {
+	name := strings.ToLower(q.Name.String())
+	typ := q.Type
+
+	switch name {
+	case rs.service:
+		if typ == dnsmessage.TypePTR || typ == dnsmessage.TypeALL {
+			answers = append(answers, rs.ptr)
+			additionals = append(additionals, rs.srv, rs.txt)
+			additionals = append(additionals, rs.addrs...)
+		}
+	case rs.instance:
+		if typ == dnsmessage.TypeSRV || typ == dnsmessage.TypeALL {
+			answers = append(answers, rs.srv)
+			additionals = append(additionals, rs.addrs...)
+		}
+		if typ == dnsmessage.TypeTXT || typ == dnsmessage.TypeALL {
+			answers = append(answers, rs.txt)
+		}
+	case rs.host:
+		for _, a := range rs.addrs {
+			if typ == a.Header.Type || typ == dnsmessage.TypeALL {
+				answers = append(answers, a)
+			}
+		}
+	}
+	return answers, additionals
+}
+
+func (r *Responder) records(addrs []net.IP, ttl time.Duration, flush bool) *records {
+	rs := &records{
+		service:  strings.ToLower(r.serviceName()),
+		instance: strings.ToLower(r.instanceName()),
+		host:     strings.ToLower(r.hostName()),
+	}
+
+	//the cache flush bit marks the records that are unique to this responder
+	unique := dnsmessage.ClassINET
+	if flush {
+		unique |= cacheFlush
+	}
+	header := func(name string, typ dnsmessage.Type, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typ,
+			Class: class,
+			TTL:   uint32(ttl / time.Second),
+		}
+	}
+
+	rs.ptr = dnsmessage.Resource{
+		Header: header(r.serviceName(), dnsmessage.TypePTR, dnsmessage.ClassINET),
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(r.instanceName())},
+	}
+	rs.srv = dnsmessage.Resource{
+		Header: header(r.instanceName(), dnsmessage.TypeSRV, unique),
+		Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(r.hostName()), Port: uint16(r.Port)},
+	}
+
+	//a TXT record must contain at least one string
+	text := r.Text
+	if len(text) == 0 {
+		text = []string{""}
+	}
+	rs.txt = dnsmessage.Resource{
+		Header: header(r.instanceName(), dnsmessage.TypeTXT, unique),
+		Body:   &dnsmessage.TXTResource{TXT: text},
+	}
+
+	for _, ip := range addrs {
+		if ip4 := ip.To4(); ip4 != nil {
+			a := &dnsmessage.AResource{}
+			copy(a.A[:], ip4)
+			rs.addrs = append(rs.addrs, dnsmessage.Resource{Header: header(r.hostName(), dnsmessage.TypeA, unique), Body: a})
+		} else if len(ip) == net.IPv6len {
+			aaaa := &dnsmessage.AAAAResource{}
+			copy(aaaa.AAAA[:], ip)
+			rs.addrs = append(rs.addrs, dnsmessage.Resource{Header: header(r.hostName(), dnsmessage.TypeAAAA, unique), Body: aaaa})
+		}
+	}
+	return rs
+}
+
+func (r *Responder) ttl() time.Duration {
+	if r.TTL <= 0 {
+		return 2 * time.Minute
+	}
+	return r.TTL
+}
+
+func (r *Responder) domain() string {
+	domain := r.Domain
+	if domain == "" {
+		domain = DefaultDomain
+	}
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	return domain
+}
+
+func (r *Responder) serviceName() string {
+	service := r.Service
+	if service == "" {
+		service = DefaultService
+	}
+	return service + "." + r.domain()
+}
+
+func (r *Responder) instanceName() string {
+	return strings.Replace(r.Instance, ".", "-", -1) + "." + r.serviceName()
+}
+
+func (r *Responder) hostName() string {
+	host := r.Host
+	if host == "" {
+		host, _ = os.Hostname()
+		if host == "" {
+			host = "localhost"
+		}
+	}
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		host = host[:i]
+	}
+	return host + "." + r.domain()
+}
+
+//setAddrs replaces the addresses of the interfaces and reports whether they changed
+func (r *Responder) setAddrs(addrs map[int][]net.IP) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := len(addrs) != len(r.addrs)
+	for ifIndex, ips := range addrs {
+		old, ok := r.addrs[ifIndex]
+		if !ok || !equalIPs(old, ips) {
+			changed = true
+		}
+	}
+	r.addrs = addrs
+	return changed
+}
+
+func (r *Responder) addresses() map[int][]net.IP {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.addrs
+}
+
+//interfaceAddrsOf returns the addresses of the interface a query arrived on, or every address
+//if the interface is unknown
+func (r *Responder) interfaceAddrsOf(ifIndex int) []net.IP {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if addrs, ok := r.addrs[ifIndex]; ok {
+		return addrs
+	}
+
+	var all []net.IP
+	for _, addrs := range r.addrs {
+		all = append(all, addrs...)
+	}
+	return all
+}
+
+func (r *Responder) interfaceAddrs() map[int][]net.IP {
+	addrs := make(map[int][]net.IP)
+	for _, ifi := range multicastInterfaces(r.Interfaces) {
+		ifAddrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifAddrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() {
+				continue
+			}
+			addrs[ifi.Index] = append(addrs[ifi.Index], ipnet.IP)
+		}
+	}
+	return addrs
+}
+
+func equalIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func appendUnique(rs []dnsmessage.Resource, add ...dnsmessage.Resource) []dnsmessage.Resource {
+	for _, r := range add {
+		if !containsResource(rs, r) {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+func containsResource(rs []dnsmessage.Resource, r dnsmessage.Resource) bool {
+	for _, x := range rs {
+		if x.Header == r.Header && x.Body.GoString() == r.Body.GoString() {
+			return true
+		}
+	}
+	return false
+}
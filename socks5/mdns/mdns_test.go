@@ -0,0 +1,260 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testAddrs = []net.IP{net.IPv4(192, 168, 1, 10), net.ParseIP("fe80::1")}
+
+func newTestResponder() *Responder {
+	r := New("Home.Proxy", 1080, "auth=true", "version=5")
+	r.Host = "gateway.example"
+	r.setAddrs(map[int][]net.IP{1: testAddrs})
+	return r
+}
+
+func query(t *testing.T, id uint16, name string, typ dnsmessage.Type, class dnsmessage.Class) []byte {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: class}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHandle(t *testing.T) {
+	mdnsSrc := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: Port}
+	legacySrc := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 40000}
+
+	tts := []struct {
+		name        string
+		query       []byte
+		src         net.Addr
+		answers     []dnsmessage.Type
+		additionals []dnsmessage.Type
+		unicast     bool
+	}{
+		{"browse", query(t, 0, "_socks5._tcp.local.", dnsmessage.TypePTR, dnsmessage.ClassINET), mdnsSrc,
+			[]dnsmessage.Type{dnsmessage.TypePTR}, []dnsmessage.Type{dnsmessage.TypeSRV, dnsmessage.TypeTXT, dnsmessage.TypeA, dnsmessage.TypeAAAA}, false},
+		{"resolve", query(t, 0, "Home-Proxy._socks5._tcp.local.", dnsmessage.TypeSRV, dnsmessage.ClassINET), mdnsSrc,
+			[]dnsmessage.Type{dnsmessage.TypeSRV}, []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}, false},
+		{"text", query(t, 0, "home-proxy._socks5._tcp.local.", dnsmessage.TypeTXT, dnsmessage.ClassINET), mdnsSrc,
+			[]dnsmessage.Type{dnsmessage.TypeTXT}, nil, false},
+		{"ipv4", query(t, 0, "gateway.local.", dnsmessage.TypeA, dnsmessage.ClassINET), mdnsSrc,
+			[]dnsmessage.Type{dnsmessage.TypeA}, nil, false},
+		{"ipv6", query(t, 0, "gateway.local.", dnsmessage.TypeAAAA, dnsmessage.ClassINET), mdnsSrc,
+			[]dnsmessage.Type{dnsmessage.TypeAAAA}, nil, false},
+		{"unicast response", query(t, 0, "gateway.local.", dnsmessage.TypeA, dnsmessage.ClassINET|cacheFlush), mdnsSrc,
+			[]dnsmessage.Type{dnsmessage.TypeA}, nil, true},
+		{"legacy", query(t, 42, "gateway.local.", dnsmessage.TypeA, dnsmessage.ClassINET), legacySrc,
+			[]dnsmessage.Type{dnsmessage.TypeA}, nil, true},
+		{"other name", query(t, 0, "printer.local.", dnsmessage.TypeA, dnsmessage.ClassINET), mdnsSrc, nil, nil, false},
+		{"other service", query(t, 0, "_http._tcp.local.", dnsmessage.TypePTR, dnsmessage.ClassINET), mdnsSrc, nil, nil, false},
+	}
+
+	r := newTestResponder()
+	for _, tt := range tts {
+		res, unicast, err := r.handle(tt.query, testAddrs, tt.src)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.answers == nil {
+			if res != nil {
+				t.Errorf("%s: expected no response", tt.name)
+			}
+			continue
+		}
+		if unicast != tt.unicast {
+			t.Errorf("%s: expected unicast %v got %v", tt.name, tt.unicast, unicast)
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(res); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !msg.Header.Response || !msg.Header.Authoritative {
+			t.Errorf("%s: expected an authoritative response", tt.name)
+		}
+		if got := types(msg.Answers); !equalTypes(got, tt.answers) {
+			t.Errorf("%s: expected answers %v got %v", tt.name, tt.answers, got)
+		}
+		if got := types(msg.Additionals); !equalTypes(got, tt.additionals) {
+			t.Errorf("%s: expected additionals %v got %v", tt.name, tt.additionals, got)
+		}
+	}
+}
+
+func TestHandleLegacy(t *testing.T) {
+	r := newTestResponder()
+	res, _, err := r.handle(query(t, 42, "Home-Proxy._socks5._tcp.local.", dnsmessage.TypeSRV, dnsmessage.ClassINET), testAddrs, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 40000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(res); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 42 || len(msg.Questions) != 1 {
+		t.Errorf("expected the id and question to be echoed got %+v", msg.Header)
+	}
+
+	srv := msg.Answers[0]
+	if srv.Header.TTL != uint32(legacyTTL/time.Second) || srv.Header.Class != dnsmessage.ClassINET {
+		t.Errorf("unexpected legacy record header %+v", srv.Header)
+	}
+	body := srv.Body.(*dnsmessage.SRVResource)
+	if body.Port != 1080 || body.Target.String() != "gateway.local." {
+		t.Errorf("unexpected SRV record %+v", body)
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	r := newTestResponder()
+	for _, ttl := range []time.Duration{r.TTL, 0} {
+		b, err := r.announcement(testAddrs, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		expected := []dnsmessage.Type{dnsmessage.TypePTR, dnsmessage.TypeSRV, dnsmessage.TypeTXT, dnsmessage.TypeA, dnsmessage.TypeAAAA}
+		if got := types(msg.Answers); !equalTypes(got, expected) {
+			t.Errorf("expected %v got %v", expected, got)
+		}
+		for _, a := range msg.Answers {
+			if a.Header.TTL != uint32(ttl/time.Second) {
+				t.Errorf("expected ttl %v got %d", ttl, a.Header.TTL)
+			}
+		}
+
+		txt := msg.Answers[2].Body.(*dnsmessage.TXTResource)
+		if len(txt.TXT) != 2 || txt.TXT[0] != "auth=true" || txt.TXT[1] != "version=5" {
+			t.Errorf("unexpected TXT record %v", txt.TXT)
+		}
+	}
+}
+
+func TestSetAddrs(t *testing.T) {
+	r := newTestResponder()
+	if r.setAddrs(map[int][]net.IP{1: testAddrs}) {
+		t.Error("expected the same addresses not to be a change")
+	}
+	if !r.setAddrs(map[int][]net.IP{1: testAddrs[:1]}) {
+		t.Error("expected a removed address to be a change")
+	}
+	if !r.setAddrs(map[int][]net.IP{1: testAddrs[:1], 2: testAddrs[1:]}) {
+		t.Error("expected a new interface to be a change")
+	}
+	if addrs := r.interfaceAddrsOf(2); !equalIPs(addrs, testAddrs[1:]) {
+		t.Errorf("expected %v got %v", testAddrs[1:], addrs)
+	}
+	if addrs := r.interfaceAddrsOf(0); len(addrs) != 2 {
+		t.Errorf("expected every address for an unknown interface got %v", addrs)
+	}
+}
+
+//loopback is a transport over a unicast socket, messages for the multicast group are sent to peer
+type loopback struct {
+	net.PacketConn
+	peer net.Addr
+}
+
+func (l *loopback) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	n, src, err := l.PacketConn.ReadFrom(b)
+	return n, 1, src, err
+}
+
+func (l *loopback) WriteTo(b []byte, ifIndex int, dst net.Addr) (int, error) {
+	if dst == nil {
+		dst = l.peer
+	}
+	return l.PacketConn.WriteTo(b, dst)
+}
+
+func TestServe(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tr := &loopback{PacketConn: server, peer: client.LocalAddr()}
+	r := newTestResponder()
+	done := make(chan struct{})
+	go func() {
+		r.serve(tr)
+		close(done)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 9000)
+
+	//unrelated queries are ignored and the next one is answered
+	client.WriteTo(query(t, 1, "printer.local.", dnsmessage.TypeA, dnsmessage.ClassINET), server.LocalAddr())
+	client.WriteTo(query(t, 2, "_socks5._tcp.local.", dnsmessage.TypePTR, dnsmessage.ClassINET), server.LocalAddr())
+	n, _, err := client.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 2 || len(msg.Answers) != 1 {
+		t.Fatalf("unexpected response %v", msg.GoString())
+	}
+	if ptr := msg.Answers[0].Body.(*dnsmessage.PTRResource); ptr.PTR.String() != "Home-Proxy._socks5._tcp.local." {
+		t.Errorf("unexpected PTR record %v", ptr.PTR)
+	}
+
+	//the goodbye is sent to the group
+	r.goodbye([]transport{tr})
+	n, _, err = client.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Unpack(b[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) == 0 || msg.Answers[0].Header.TTL != 0 {
+		t.Errorf("expected a goodbye got %v", msg.GoString())
+	}
+
+	server.Close()
+	<-done
+}
+
+func types(rs []dnsmessage.Resource) []dnsmessage.Type {
+	var res []dnsmessage.Type
+	for _, r := range rs {
+		res = append(res, r.Header.Type)
+	}
+	return res
+}
+
+func equalTypes(a, b []dnsmessage.Type) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+package mdns
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	groupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: Port}
+	groupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: Port}
+)
+
+//transport sends and receives mDNS messages, a nil dst is the multicast group of ifIndex
+type transport interface {
+	ReadFrom(b []byte) (n int, ifIndex int, src net.Addr, err error)
+	WriteTo(b []byte, ifIndex int, dst net.Addr) (int, error)
+	Close() error
+}
+
+//listenMulticast joins the mDNS groups on every interface, a family which can't be used is skipped
+func listenMulticast(ifis []net.Interface) []transport {
+	ifis = multicastInterfaces(ifis)
+	var conns []transport
+
+	if c, err := net.ListenMulticastUDP("udp4", nil, groupIPv4); err != nil {
+		log.Printf("mdns: unable to listen on %v: %v", groupIPv4, err)
+	} else {
+		p := ipv4.NewPacketConn(c)
+		joined := false
+		for i := range ifis {
+			if err := p.JoinGroup(&ifis[i], groupIPv4); err == nil {
+				joined = true
+			}
+		}
+		p.SetControlMessage(ipv4.FlagInterface, true)
+		p.SetMulticastTTL(255)
+		if joined {
+			conns = append(conns, &ipv4Transport{p: p, ifis: ifis})
+		} else {
+			c.Close()
+		}
+	}
+
+	if c, err := net.ListenMulticastUDP("udp6", nil, groupIPv6); err != nil {
+		log.Printf("mdns: unable to listen on %v: %v", groupIPv6, err)
+	} else {
+		p := ipv6.NewPacketConn(c)
+		joined := false
+		for i := range ifis {
+			if err := p.JoinGroup(&ifis[i], groupIPv6); err == nil {
+				joined = true
+			}
+		}
+		p.SetControlMessage(ipv6.FlagInterface, true)
+		p.SetMulticastHopLimit(255)
+		if joined {
+			conns = append(conns, &ipv6Transport{p: p, ifis: ifis})
+		} else {
+			c.Close()
+		}
+	}
+
+	return conns
+}
+
+//multicastInterfaces returns the interfaces that are up and support multicast, all of them if ifis is nil
+func multicastInterfaces(ifis []net.Interface) []net.Interface {
+	if ifis == nil {
+		var err error
+		if ifis, err = net.Interfaces(); err != nil {
+			return nil
+		}
+	}
+
+	var res []net.Interface
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			res = append(res, ifi)
+		}
+	}
+	return res
+}
+
+func findInterface(ifis []net.Interface, index int) *net.Interface {
+	for i := range ifis {
+		if ifis[i].Index == index {
+			return &ifis[i]
+		}
+	}
+	return nil
+}
+
+type ipv4Transport struct {
+	p    *ipv4.PacketConn
+	ifis []net.Interface
+
+	//mu guards the multicast interface which is set before every multicast write
+	mu sync.Mutex
+}
+
+func (t *ipv4Transport) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := t.p.ReadFrom(b)
+	ifIndex := 0
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return n, ifIndex, src, err
+}
+
+func (t *ipv4Transport) WriteTo(b []byte, ifIndex int, dst net.Addr) (int, error) {
+	if dst != nil {
+		return t.p.WriteTo(b, nil, dst)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ifi := findInterface(t.ifis, ifIndex); ifi != nil {
+		if err := t.p.SetMulticastInterface(ifi); err != nil {
+			return 0, err
+		}
+	}
+	return t.p.WriteTo(b, nil, groupIPv4)
+}
+
+func (t *ipv4Transport) Close() error {
+	return t.p.Close()
+}
+
+type ipv6Transport struct {
+	p    *ipv6.PacketConn
+	ifis []net.Interface
+
+	//mu guards the multicast interface which is set before every multicast write
+	mu sync.Mutex
+}
+
+func (t *ipv6Transport) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := t.p.ReadFrom(b)
+	ifIndex := 0
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return n, ifIndex, src, err
+}
+
+func (t *ipv6Transport) WriteTo(b []byte, ifIndex int, dst net.Addr) (int, error) {
+	if dst != nil {
+		return t.p.WriteTo(b, nil, dst)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ifi := findInterface(t.ifis, ifIndex); ifi != nil {
+		if err := t.p.SetMulticastInterface(ifi); err != nil {
+			return 0, err
+		}
+	}
+	return t.p.WriteTo(b, nil, groupIPv6)
+}
+
+func (t *ipv6Transport) Close() error {
+	return t.p.Close()
+}
@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+//MetricsContentType is the content type of the Prometheus text format served by MetricsHandler
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//metrics are the counters of the server since it was created
+type metrics struct {
+	sessions, failed, authFailures, denied int64
+	//transparent are the sessions accepted by ServeTransparent
+	transparent int64
+	//routeFailures are the connections of RouteTLS that failed the handshake or had no route
+	routeFailures int64
+	//acceptFDExhausted and dialFDExhausted are the accepts and dials that failed as the process
+	//was out of file descriptors
+	acceptFDExhausted, dialFDExhausted int64
+	//bytesIn and bytesOut are the bytes relayed from and to the clients
+	bytesIn, bytesOut int64
+
+	mu sync.Mutex
+	//wouldDenyByRule counts the requests denied in dry-run by rule
+	wouldDenyByRule map[string]int64
+}
+
+//count adds a session that's over to the counters
+func (m *metrics) count(c *conn, err error) {
+	atomic.AddInt64(&m.sessions, 1)
+	if c.original != nil {
+		atomic.AddInt64(&m.transparent, 1)
+	}
+	atomic.AddInt64(&m.bytesIn, atomic.LoadInt64(&c.in))
+	atomic.AddInt64(&m.bytesOut, atomic.LoadInt64(&c.out))
+	switch err {
+	case nil:
+		return
+	case ErrAuthFailed:
+		atomic.AddInt64(&m.authFailures, 1)
+	case ErrNotAllowedByRuleset:
+		atomic.AddInt64(&m.denied, 1)
+	}
+	atomic.AddInt64(&m.failed, 1)
+}
+
+//MetricsHandler returns a handler serving the metrics of the server in the Prometheus text
+//format, the counters are of the sessions that are over
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		draining, paused := 0, 0
+		dialCacheHits, dialCacheEntries := s.dialCache.stats()
+		if s.Draining() {
+			draining = 1
+		}
+		if s.Paused() {
+			paused = 1
+		}
+
+		var b bytes.Buffer
+		for _, m := range []struct {
+			name, kind, help string
+			value            interface{}
+		}{
+			{"socks5_sessions_total", "counter", "Sessions served.", atomic.LoadInt64(&s.metrics.sessions)},
+			{"socks5_transparent_sessions_total", "counter", "Sessions of connections redirected to ServeTransparent.", atomic.LoadInt64(&s.metrics.transparent)},
+			{"socks5_sessions_failed_total", "counter", "Sessions that ended with an error.", atomic.LoadInt64(&s.metrics.failed)},
+			{"socks5_auth_failures_total", "counter", "Sessions whose client failed to authenticate.", atomic.LoadInt64(&s.metrics.authFailures)},
+			{"socks5_requests_denied_total", "counter", "Requests denied by the ruleset.", atomic.LoadInt64(&s.metrics.denied)},
+			{"socks5_received_bytes_total", "counter", "Bytes relayed from the clients.", atomic.LoadInt64(&s.metrics.bytesIn)},
+			{"socks5_sent_bytes_total", "counter", "Bytes relayed to the clients.", atomic.LoadInt64(&s.metrics.bytesOut)},
+			{"socks5_dropped_events_total", "counter", "Events dropped as the notifier was behind.", s.DroppedEvents()},
+			{"socks5_tls_route_failures_total", "counter", "Connections of RouteTLS that failed the handshake or had no route.", atomic.LoadInt64(&s.metrics.routeFailures)},
+			{"socks5_accept_fd_exhausted_total", "counter", "Accepts that failed as the process was out of file descriptors.", atomic.LoadInt64(&s.metrics.acceptFDExhausted)},
+			{"socks5_dial_fd_exhausted_total", "counter", "Dials that failed as the process was out of file descriptors.", atomic.LoadInt64(&s.metrics.dialFDExhausted)},
+			{"socks5_dial_cache_hits_total", "counter", "Requests replied the failure of a recent dial to their destination by WithNegativeDialCache.", dialCacheHits},
+			{"socks5_active_sessions", "gauge", "Sessions being served.", s.ActiveSessions()},
+			{"socks5_tarpitted_connections", "gauge", "Connections held by the tarpit.", s.Tarpitted()},
+			{"socks5_dial_cache_entries", "gauge", "Destinations whose failed dial is cached by WithNegativeDialCache.", dialCacheEntries},
+			{"socks5_draining", "gauge", "Whether the server is draining its sessions.", draining},
+			{"socks5_paused", "gauge", "Whether the server is paused, refusing new sessions.", paused},
+		} {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+		}
+		if open, max, ok := fdUsage(); ok {
+			fmt.Fprintf(&b, "# HELP socks5_open_fds Open file descriptors of the process.\n# TYPE socks5_open_fds gauge\nsocks5_open_fds %d\n", open)
+			fmt.Fprintf(&b, "# HELP socks5_max_fds Most file descriptors the process can open.\n# TYPE socks5_max_fds gauge\nsocks5_max_fds %d\n", max)
+		}
+		if s.certs != nil {
+			const name = "socks5_tls_cert_not_after_seconds"
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name,
+				"When the TLS certificate being served expires, in seconds since the epoch.", name, name, s.certs.NotAfter().Unix())
+		}
+		if m := s.mirror; m != nil {
+			for _, mm := range []struct {
+				name, help string
+				value      int64
+			}{
+				{"socks5_mirror_frames_sent_total", "Frames sent to the mirror collector.", atomic.LoadInt64(&m.sent)},
+				{"socks5_mirror_frames_dropped_total", "Frames not mirrored as the queue of their session was full or the collector was unavailable.", atomic.LoadInt64(&m.dropped)},
+				{"socks5_mirror_sessions_disabled_total", "Sessions no longer mirrored as the collector stalled.", atomic.LoadInt64(&m.disabled)},
+			} {
+				fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", mm.name, mm.help, mm.name, mm.name, mm.value)
+			}
+		}
+		s.metrics.writeWouldDeny(&b)
+
+		w.Header().Set("Content-Type", MetricsContentType)
+		w.Write(b.Bytes())
+	})
+}
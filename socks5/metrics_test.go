@@ -0,0 +1,119 @@
+package socks5
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	s, proxy := newTestServer(t, WithAuth("username", "password"))
+	defer s.Close()
+
+	c, err := NewClient(proxy, WithClientAuth("username", "password")).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello"))
+	c.Read(make([]byte, 5))
+	c.Close()
+	if _, err := NewClient(proxy, WithClientAuth("username", "wrong")).Dial("tcp", echo.Addr().String()); err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ActiveSessions() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the sessions didn't end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != MetricsContentType {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE socks5_sessions_total counter",
+		"socks5_sessions_total 2",
+		"socks5_sessions_failed_total 1",
+		"socks5_auth_failures_total 1",
+		"socks5_received_bytes_total 5",
+		"socks5_sent_bytes_total 5",
+		"socks5_active_sessions 0",
+		"socks5_transparent_sessions_total 0",
+		"socks5_tls_route_failures_total 0",
+		"socks5_accept_fd_exhausted_total 0",
+		"socks5_dial_fd_exhausted_total 0",
+		"socks5_dial_cache_hits_total 0",
+		"socks5_dial_cache_entries 0",
+		"socks5_tarpitted_connections 0",
+		"socks5_draining 0",
+		"socks5_paused 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	s := &Server{}
+	WithDestinationStats(10)(s)
+	srv := httptest.NewServer(s.AdminHandler())
+	defer srv.Close()
+
+	tts := []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{http.MethodGet, "/sessions", http.StatusOK, `{"active":0,"draining":false,"paused":false}`},
+		{http.MethodPost, "/sessions", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/destinations?n=5", http.StatusOK, `[]`},
+		{http.MethodGet, "/destinations?n=five", http.StatusBadRequest, ""},
+		{http.MethodPost, "/ban?ip=192.0.2.1&duration=1h&reason=scanning", http.StatusNoContent, ""},
+		{http.MethodPost, "/ban?ip=192.0.2.1", http.StatusBadRequest, ""},
+		{http.MethodGet, "/ban?ip=192.0.2.1&duration=1h", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tts {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.status {
+			t.Errorf("%s %s: expected %d got %d", tt.method, tt.path, tt.status, res.StatusCode)
+		}
+		if tt.body != "" {
+			var got interface{}
+			json.Unmarshal(b, &got)
+			if b, _ := json.Marshal(got); string(b) != tt.body {
+				t.Errorf("%s %s: expected %s got %s", tt.method, tt.path, tt.body, b)
+			}
+		}
+	}
+	if !s.Banned(net.ParseIP("192.0.2.1")) {
+		t.Error("expected the client to be banned")
+	}
+
+	res, err := http.Post(srv.URL+"/unban?ip=192.0.2.1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent || s.Banned(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected the ban to be lifted got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,273 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//mirrorQueue is the most frames of a session waiting to be sent to the collector, the
+	//others are dropped
+	mirrorQueue = 64
+	//mirrorStall is how long a frame may take to be written before the collector is considered
+	//stalled, the session is no longer mirrored then and the collector is reconnected to
+	mirrorStall = 5 * time.Second
+	//mirrorMaxBackoff is the longest wait before reconnecting to the collector
+	mirrorMaxBackoff = 30 * time.Second
+	//mirrorMaxFrame is the largest frame ReadMirrorFrame accepts
+	mirrorMaxFrame = 1 << 20
+
+	mirrorFlagEnd byte = 0x01
+)
+
+var (
+	//ErrMirrorFrame is returned by ReadMirrorFrame for a frame that isn't well formed
+	ErrMirrorFrame = errors.New("socks5: malformed mirror frame")
+	//errMirrorDown is returned while the collector is waited for before reconnecting
+	errMirrorDown = errors.New("socks5: mirror collector unavailable")
+)
+
+//MirrorFrame is a chunk of a stream mirrored by WithMirror. On the wire it's a big-endian
+//uint32 length of what follows, the direction byte, a flags byte whose bit 0 marks the end of
+//the stream, the big-endian int64 time in nanoseconds since the epoch, a byte of the length of
+//the session ID, the session ID and the data
+type MirrorFrame struct {
+	//Session is the ID of the session
+	Session string
+	//Direction is the direction the data was relayed in
+	Direction Direction
+	//Time is when the data was relayed
+	Time time.Time
+	//End is set on the last frame of the direction, it has no data
+	End bool
+	//Data is the relayed bytes
+	Data []byte
+}
+
+//ReadMirrorFrame reads a frame written by WithMirror from r, it returns io.EOF once r ends
+//between frames
+func ReadMirrorFrame(r io.Reader) (*MirrorFrame, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < 11 || n > mirrorMaxFrame {
+		return nil, ErrMirrorFrame
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	idLen := int(b[10])
+	if 11+idLen > len(b) {
+		return nil, ErrMirrorFrame
+	}
+	return &MirrorFrame{
+		Direction: Direction(b[0]),
+		End:       b[1]&mirrorFlagEnd != 0,
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(b[2:]))),
+		Session:   string(b[11 : 11+idLen]),
+		Data:      b[11+idLen:],
+	}, nil
+}
+
+//appendMirrorFrame appends the frame of data relayed in d by the session id to b
+func appendMirrorFrame(b []byte, id string, d Direction, flags byte, t time.Time, data []byte) []byte {
+	if len(id) > 255 {
+		id = id[:255]
+	}
+	var hdr [15]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(11+len(id)+len(data)))
+	hdr[4], hdr[5] = byte(d), flags
+	binary.BigEndian.PutUint64(hdr[6:], uint64(t.UnixNano()))
+	hdr[14] = byte(len(id))
+	b = append(b, hdr[:]...)
+	b = append(b, id...)
+	return append(b, data...)
+}
+
+//WithMirror streams both directions of the sessions filter matches to the collector listening
+//on target, host:port or unix:/path/to/socket, as they're relayed. The chunks are framed as
+//described by MirrorFrame, ReadMirrorFrame decodes them. The relay never waits for the
+//collector, the frames of a session that don't fit its queue are dropped and a session is no
+//longer mirrored once the collector stalls. The collector is dialed again with a backoff once
+//its connection fails. If filter is nil every session is mirrored
+func WithMirror(target string, filter func(SessionInfo) bool) Option {
+	return func(s *Server) {
+		network, address := splitAddr(target)
+		m := &mirror{s: s, network: network, address: address, filter: filter, queue: mirrorQueue, stall: mirrorStall}
+		s.mirror = m
+		s.onShutdown = append(s.onShutdown, m.close)
+		s.validate(func() string {
+			if address == "" {
+				return "WithMirror needs the address of a collector"
+			}
+			return ""
+		})
+	}
+}
+
+//mirror is the connection to the collector of WithMirror shared by the mirrored sessions
+type mirror struct {
+	s                *Server
+	network, address string
+	filter           func(SessionInfo) bool
+	queue            int
+	stall            time.Duration
+
+	//sent, dropped and disabled are the frames sent and dropped and the sessions no longer
+	//mirrored as the collector stalled
+	sent, dropped, disabled int64
+
+	mu      sync.Mutex
+	c       net.Conn
+	closed  bool
+	backoff time.Duration
+	retry   time.Time
+}
+
+//matches reports whether the session is mirrored
+func (m *mirror) matches(info SessionInfo) bool {
+	return m.filter == nil || m.filter(info)
+}
+
+//write writes a frame to the collector, dialing it if it isn't connected and the backoff is
+//over. The connection is closed if the write fails so the collector doesn't see half a frame
+func (m *mirror) write(frame []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errMirrorDown
+	}
+	if m.c == nil {
+		if time.Now().Before(m.retry) {
+			return errMirrorDown
+		}
+		c, err := net.DialTimeout(m.network, m.address, m.stall)
+		if err != nil {
+			m.failed("dialing the mirror collector %s failed: %v", err)
+			return err
+		}
+		m.c, m.backoff = c, 0
+	}
+	m.c.SetWriteDeadline(time.Now().Add(m.stall))
+	if _, err := m.c.Write(frame); err != nil {
+		m.c.Close()
+		m.c = nil
+		m.failed("writing to the mirror collector %s failed: %v", err)
+		return err
+	}
+	atomic.AddInt64(&m.sent, 1)
+	return nil
+}
+
+//failed logs the failure and sets when the collector is dialed again, the delay doubling
+//after each failure
+func (m *mirror) failed(format string, err error) {
+	m.s.logKeyed(LevelError, "mirror", format, m.address, err)
+	switch {
+	case m.backoff == 0:
+		m.backoff = 100 * time.Millisecond
+	case m.backoff < mirrorMaxBackoff:
+		m.backoff *= 2
+		if m.backoff > mirrorMaxBackoff {
+			m.backoff = mirrorMaxBackoff
+		}
+	}
+	m.retry = time.Now().Add(m.backoff)
+}
+
+func (m *mirror) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.c != nil {
+		m.c.Close()
+		m.c = nil
+	}
+}
+
+//open starts mirroring the session id
+func (m *mirror) open(id string) *sessionMirror {
+	sm := &sessionMirror{m: m, id: id, frames: make(chan []byte, m.queue), done: make(chan struct{})}
+	go sm.send()
+	return sm
+}
+
+//sessionMirror queues the frames of a session for the collector
+type sessionMirror struct {
+	m        *mirror
+	id       string
+	frames   chan []byte
+	done     chan struct{}
+	disabled int32
+}
+
+//send writes the queued frames to the collector until the session is over, the session is
+//disabled if the collector stalls
+func (sm *sessionMirror) send() {
+	defer close(sm.done)
+	for frame := range sm.frames {
+		if atomic.LoadInt32(&sm.disabled) != 0 {
+			atomic.AddInt64(&sm.m.dropped, 1)
+			continue
+		}
+		err := sm.m.write(frame)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			atomic.StoreInt32(&sm.disabled, 1)
+			atomic.AddInt64(&sm.m.disabled, 1)
+			sm.m.s.logKeyed(LevelError, "mirror", "session %s: the mirror collector stalled, no longer mirroring the session", sm.id)
+		}
+		if err != nil {
+			atomic.AddInt64(&sm.m.dropped, 1)
+		}
+	}
+}
+
+//queue queues a frame without waiting, it's dropped if the queue is full
+func (sm *sessionMirror) queue(d Direction, flags byte, data []byte) {
+	if atomic.LoadInt32(&sm.disabled) != 0 {
+		atomic.AddInt64(&sm.m.dropped, 1)
+		return
+	}
+	select {
+	case sm.frames <- appendMirrorFrame(nil, sm.id, d, flags, time.Now(), data):
+	default:
+		atomic.AddInt64(&sm.m.dropped, 1)
+	}
+}
+
+//writer returns the writer of the bytes relayed in d
+func (sm *sessionMirror) writer(d Direction) io.Writer {
+	return mirrorWriter{sm, d}
+}
+
+type mirrorWriter struct {
+	sm *sessionMirror
+	d  Direction
+}
+
+//Write queues b, it never fails nor waits so the relay isn't affected
+func (w mirrorWriter) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		w.sm.queue(w.d, 0, b)
+	}
+	return len(b), nil
+}
+
+//Close ends both streams, the queued frames are sent in the background
+func (sm *sessionMirror) Close() error {
+	sm.queue(DirectionClientToTarget, mirrorFlagEnd, nil)
+	sm.queue(DirectionTargetToClient, mirrorFlagEnd, nil)
+	close(sm.frames)
+	return nil
+}
@@ -0,0 +1,199 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadMirrorFrame(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+	var b []byte
+	b = appendMirrorFrame(b, "abc", DirectionTargetToClient, 0, now, []byte("payload"))
+	b = appendMirrorFrame(b, "abc", DirectionClientToTarget, mirrorFlagEnd, now, nil)
+	r := bytes.NewReader(b)
+	tts := []MirrorFrame{
+		{Session: "abc", Direction: DirectionTargetToClient, Time: now, Data: []byte("payload")},
+		{Session: "abc", Direction: DirectionClientToTarget, Time: now, End: true, Data: []byte{}},
+	}
+	for _, tt := range tts {
+		f, err := ReadMirrorFrame(r)
+		if err != nil || f.Session != tt.Session || f.Direction != tt.Direction || !f.Time.Equal(tt.Time) || f.End != tt.End || !bytes.Equal(f.Data, tt.Data) {
+			t.Errorf("expected %+v got %+v %v", tt, f, err)
+		}
+	}
+	if _, err := ReadMirrorFrame(r); err != io.EOF {
+		t.Errorf("expected io.EOF got %v", err)
+	}
+
+	for _, b := range [][]byte{
+		{0, 0, 0, 2, 0, 0},
+		//the session ID is longer than the frame
+		{0, 0, 0, 11, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 9},
+	} {
+		if _, err := ReadMirrorFrame(bytes.NewReader(b)); err != ErrMirrorFrame {
+			t.Errorf("% x: expected ErrMirrorFrame got %v", b, err)
+		}
+	}
+	if _, err := ReadMirrorFrame(bytes.NewReader(b[:20])); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for a truncated frame got %v", err)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	frames := make(chan *MirrorFrame, 1000)
+	go func() {
+		c, err := collector.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			f, err := ReadMirrorFrame(c)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	s, proxy := newTestServer(t, WithMirror(collector.Addr().String(), func(info SessionInfo) bool {
+		return info.Dest.Port == uint16(echo.Addr().(*net.TCPAddr).Port)
+	}))
+	defer s.Close()
+
+	payload := bytes.Repeat([]byte("mirrored payload "), 1000)
+	c, err := NewClient(proxy).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		for p := payload; len(p) > 0; p = p[1000:] {
+			c.Write(p[:1000])
+		}
+	}()
+	if _, err := io.ReadFull(c, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	//the streams are reassembled from the frames of the session until both ended
+	streams := make(map[Direction][]byte)
+	ended, session := 0, ""
+	for ended < 2 {
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				t.Fatal("the collector's connection ended")
+			}
+			if session == "" {
+				session = f.Session
+			}
+			if f.Session != session || time.Since(f.Time) > time.Minute {
+				t.Errorf("unexpected frame %+v", f)
+			}
+			if f.End {
+				ended++
+			}
+			streams[f.Direction] = append(streams[f.Direction], f.Data...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the frames weren't mirrored, got %d and %d bytes", len(streams[DirectionClientToTarget]), len(streams[DirectionTargetToClient]))
+		}
+	}
+	for _, d := range []Direction{DirectionClientToTarget, DirectionTargetToClient} {
+		if !bytes.Equal(streams[d], payload) {
+			t.Errorf("%v: expected the payload reassembled got %d bytes", d, len(streams[d]))
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{"socks5_mirror_frames_dropped_total 0\n", "socks5_mirror_sessions_disabled_total 0\n"} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("expected %q in\n%s", line, rec.Body.String())
+		}
+	}
+
+	//the sessions the filter doesn't match aren't mirrored
+	c, err = NewClient(proxy).Dial("tcp", collector.Addr().String())
+	if err == nil {
+		c.Close()
+	}
+	select {
+	case f := <-frames:
+		t.Errorf("unexpected frame %+v", f)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorStalled(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "collector.sock")
+	collector, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	//the collector accepts the connection and never reads from it
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		c, err := collector.Accept()
+		if err == nil {
+			stalled <- c
+		}
+	}()
+
+	s, proxy := newTestServer(t, WithMirror(UnixScheme+path, nil))
+	defer s.Close()
+	s.mirror.stall = 200 * time.Millisecond
+
+	//the relay isn't slowed down by the collector
+	payload := make([]byte, 16<<20)
+	c, err := NewClient(proxy).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	go c.Write(payload)
+	if _, err := io.ReadFull(c, make([]byte, len(payload))); err != nil {
+		t.Fatalf("expected the payload relayed despite the stalled collector got %v", err)
+	}
+	c.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&s.mirror.disabled) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if disabled, dropped := atomic.LoadInt64(&s.mirror.disabled), atomic.LoadInt64(&s.mirror.dropped); disabled != 1 || dropped == 0 {
+		t.Errorf("expected the session disabled and frames dropped got %d and %d", disabled, dropped)
+	}
+	select {
+	case c := <-stalled:
+		c.Close()
+	default:
+		t.Error("the collector wasn't dialed")
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/abdullah2993/socks5-server/socks5/mux
+
+go 1.15
+
+require (
+	github.com/abdullah2993/socks5-server v0.0.0
+	github.com/hashicorp/yamux v0.1.1
+)
+
+replace github.com/abdullah2993/socks5-server => ../../
@@ -0,0 +1,330 @@
+//Package mux multiplexes SOCKS5 sessions over a single reverse connection using yamux, the
+//rendezvous point opens a stream per client and the server serves every stream as a session.
+//It lives in its own module to keep the yamux dependency out of the socks5 package.
+package mux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+	"github.com/hashicorp/yamux"
+)
+
+//ErrClosed is returned by Rendezvous.Open once the Rendezvous is closed
+var ErrClosed = errors.New("mux: rendezvous closed")
+
+//Option is a multiplexing option shared by both halves
+type Option func(*config)
+
+type config struct {
+	yamux      *yamux.Config
+	maxStreams int
+	reverse    []socks5.ReverseOption
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{yamux: yamux.DefaultConfig()}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+//WithStreamWindow sets the maximum flow control window of a stream, it must be at least 256KB
+func WithStreamWindow(size uint32) Option {
+	return func(c *config) {
+		c.yamux.MaxStreamWindowSize = size
+	}
+}
+
+//WithAcceptBacklog sets the number of streams that can be waiting to be accepted
+func WithAcceptBacklog(n int) Option {
+	return func(c *config) {
+		c.yamux.AcceptBacklog = n
+	}
+}
+
+//WithKeepAliveInterval sets the interval of pings used to detect a dead connection
+func WithKeepAliveInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.yamux.KeepAliveInterval = interval
+	}
+}
+
+//WithMaxStreams limits the number of sessions served concurrently, new streams aren't accepted
+//until a session is over. 0 means unlimited
+func WithMaxStreams(n int) Option {
+	return func(c *config) {
+		c.maxStreams = n
+	}
+}
+
+//WithReverseOptions sets the options used for dialing the reverse connection
+func WithReverseOptions(opts ...socks5.ReverseOption) Option {
+	return func(c *config) {
+		c.reverse = append(c.reverse, opts...)
+	}
+}
+
+//ServeReverseMux works like Server.ServeReverse but serves every stream multiplexed over the
+//outbound connection as a separate session
+func ServeReverseMux(ctx context.Context, s *socks5.Server, dial func(ctx context.Context) (net.Conn, error), opts ...Option) error {
+	cfg := newConfig(opts)
+	if err := yamux.VerifyConfig(cfg.yamux); err != nil {
+		return err
+	}
+
+	handler := func(c net.Conn) error {
+		return serveMux(c, s, cfg)
+	}
+	return s.ServeReverse(ctx, dial, append(cfg.reverse, socks5.WithReverseHandler(handler))...)
+}
+
+func serveMux(c net.Conn, s *socks5.Server, cfg *config) error {
+	sess, err := yamux.Server(c, cfg.yamux)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	defer sess.Close()
+
+	var sem chan struct{}
+	if cfg.maxStreams > 0 {
+		sem = make(chan struct{}, cfg.maxStreams)
+	}
+
+	served := false
+	for {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-sess.CloseChan():
+				return nil
+			}
+		}
+
+		st, err := sess.AcceptStream()
+		if err != nil {
+			//a connection that served sessions isn't a failure, the backoff is reset
+			if served {
+				return nil
+			}
+			return err
+		}
+		served = true
+
+		go func() {
+			s.ServeConn(st)
+			if sem != nil {
+				<-sem
+			}
+		}()
+	}
+}
+
+//Rendezvous accepts reverse connections from servers using ServeReverseMux and opens
+//streams to them on behalf of the clients with Open, Accept or Serve
+type Rendezvous struct {
+	l   net.Listener
+	cfg *config
+
+	mu       sync.Mutex
+	sessions []*yamux.Session
+	next     int
+	ready    chan struct{}
+	done     chan struct{}
+
+	//idle is held by the stream returned by Accept until it's used
+	idle chan struct{}
+}
+
+var _ net.Listener = (*Rendezvous)(nil)
+
+//ListenReverse listens on addr for reverse connections, Open or Accept of the returned
+//Rendezvous opens a stream to a SOCKS5 server and Serve forwards the clients of a listener over
+//such streams
+func ListenReverse(addr string, opts ...Option) (*Rendezvous, error) {
+	cfg := newConfig(opts)
+	if err := yamux.VerifyConfig(cfg.yamux); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rendezvous{l: l, cfg: cfg, ready: make(chan struct{}), done: make(chan struct{}), idle: make(chan struct{}, 1)}
+	go r.acceptReverse()
+	return r, nil
+}
+
+func (r *Rendezvous) acceptReverse() {
+	for {
+		c, err := r.l.Accept()
+		if err != nil {
+			return
+		}
+
+		sess, err := yamux.Client(c, r.cfg.yamux)
+		if err != nil {
+			c.Close()
+			continue
+		}
+
+		r.mu.Lock()
+		r.sessions = append(r.sessions, sess)
+		select {
+		case <-r.ready:
+		default:
+			close(r.ready)
+		}
+		r.mu.Unlock()
+
+		go func() {
+			<-sess.CloseChan()
+			r.removeSession(sess)
+		}()
+	}
+}
+
+func (r *Rendezvous) removeSession(sess *yamux.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, s := range r.sessions {
+		if s == sess {
+			r.sessions = append(r.sessions[:i], r.sessions[i+1:]...)
+			break
+		}
+	}
+	if len(r.sessions) == 0 {
+		r.ready = make(chan struct{})
+	}
+}
+
+//Open opens a stream to one of the connected servers, it waits until a server is connected
+//or ctx is done
+func (r *Rendezvous) Open(ctx context.Context) (net.Conn, error) {
+	for {
+		r.mu.Lock()
+		ready := r.ready
+		var sess *yamux.Session
+		if len(r.sessions) > 0 {
+			r.next = (r.next + 1) % len(r.sessions)
+			sess = r.sessions[r.next]
+		}
+		r.mu.Unlock()
+
+		if sess != nil {
+			st, err := sess.OpenStream()
+			if err == nil {
+				return st, nil
+			}
+			sess.Close()
+			r.removeSession(sess)
+			continue
+		}
+
+		select {
+		case <-ready:
+		case <-r.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//Accept opens a stream to one of the connected servers like Open, it waits until the stream
+//returned by the previous call was written to or closed so a loop calling Accept holds at most
+//one stream no client is using. It returns ErrClosed once the Rendezvous is closed
+func (r *Rendezvous) Accept() (net.Conn, error) {
+	select {
+	case r.idle <- struct{}{}:
+	case <-r.done:
+		return nil, ErrClosed
+	}
+
+	st, err := r.Open(context.Background())
+	if err != nil {
+		<-r.idle
+		return nil, err
+	}
+	return &acceptedStream{Conn: st, idle: r.idle}, nil
+}
+
+//acceptedStream is a stream returned by Accept, it releases Accept once it's used
+type acceptedStream struct {
+	net.Conn
+	once sync.Once
+	idle chan struct{}
+}
+
+func (a *acceptedStream) used() {
+	a.once.Do(func() { <-a.idle })
+}
+
+func (a *acceptedStream) Write(b []byte) (int, error) {
+	a.used()
+	return a.Conn.Write(b)
+}
+
+func (a *acceptedStream) Close() error {
+	a.used()
+	return a.Conn.Close()
+}
+
+//Serve accepts clients from l and forwards each of them over a new stream
+func (r *Rendezvous) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.forward(c)
+	}
+}
+
+func (r *Rendezvous) forward(c net.Conn) {
+	defer c.Close()
+	st, err := r.Open(context.Background())
+	if err != nil {
+		return
+	}
+	defer st.Close()
+
+	go func() {
+		io.Copy(st, c)
+		st.Close()
+	}()
+	io.Copy(c, st)
+}
+
+//Addr returns the address reverse connections are accepted on
+func (r *Rendezvous) Addr() net.Addr {
+	return r.l.Addr()
+}
+
+//Close stops accepting reverse connections and closes the established ones
+func (r *Rendezvous) Close() error {
+	r.mu.Lock()
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	sessions := r.sessions
+	r.sessions = nil
+	r.mu.Unlock()
+
+	for _, s := range sessions {
+		s.Close()
+	}
+	return r.l.Close()
+}
@@ -0,0 +1,216 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+func TestServeReverseMux(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	r, err := ListenReverse("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := new(socks5.Server)
+	defer s.Close()
+
+	var dials int32
+	go ServeReverseMux(context.Background(), s, func(ctx context.Context) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", r.Addr().String())
+	}, WithMaxStreams(4), WithStreamWindow(512*1024))
+
+	clients, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.Serve(clients)
+
+	const sessions = 8
+	errs := make(chan error, sessions)
+	for i := 0; i < sessions; i++ {
+		go func(i int) {
+			c, err := net.Dial("tcp", clients.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			errs <- connectAndEcho(c, echo.Addr().(*net.TCPAddr), fmt.Sprintf("session %d", i))
+		}(i)
+	}
+
+	for i := 0; i < sessions; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("expected a single reverse connection got %d", n)
+	}
+
+	//a stream opened directly works as well
+	c, err := r.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := connectAndEcho(c, echo.Addr().(*net.TCPAddr), "direct"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRendezvousClose(t *testing.T) {
+	r, err := ListenReverse("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.Open(context.Background())
+		errs <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-errs:
+		if err != ErrClosed {
+			t.Errorf("expected %v got %v", ErrClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Open didn't return after Close")
+	}
+}
+
+func TestRendezvousAccept(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	r, err := ListenReverse("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(socks5.Server)
+	defer s.Close()
+	go ServeReverseMux(context.Background(), s, func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", r.Addr().String())
+	})
+
+	var l net.Listener = r
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("expected Accept to wait until the previous stream is used")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := connectAndEcho(c, echo.Addr().(*net.TCPAddr), "accepted"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept didn't return once the previous stream was used")
+	}
+
+	r.Close()
+	if _, err := l.Accept(); err != ErrClosed {
+		t.Errorf("expected %v got %v", ErrClosed, err)
+	}
+}
+
+func connectAndEcho(rw io.ReadWriter, addr *net.TCPAddr, payload string) error {
+	if _, err := rw.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(rw, b[:2]); err != nil {
+		return err
+	}
+
+	req := append([]byte{5, 1, 0, 1}, addr.IP.To4()...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[8:], uint16(addr.Port))
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, b); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		return fmt.Errorf("connect failed with %d", b[1])
+	}
+
+	if _, err := rw.Write([]byte(payload)); err != nil {
+		return err
+	}
+	res := make([]byte, len(payload))
+	if _, err := io.ReadFull(rw, res); err != nil {
+		return err
+	}
+	if string(res) != payload {
+		return fmt.Errorf("expected %q got %q", payload, res)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+//DefaultNAT64Prefix is the well-known prefix of RFC 6052, used by WithNAT64Prefix if it's given
+//none
+const DefaultNAT64Prefix = "64:ff9b::/96"
+
+var (
+	//ErrNAT64Prefix is returned for a prefix RFC 6052 doesn't allow for NAT64
+	ErrNAT64Prefix = errors.New("socks5: a NAT64 prefix is an IPv6 prefix of 32, 40, 48, 56, 64 or 96 bits")
+	//ErrNoNAT64 is returned by DiscoverNAT64Prefix if ipv4only.arpa has no synthesized address
+	ErrNoNAT64 = errors.New("socks5: no NAT64 prefix discovered")
+)
+
+//ipv4OnlyAddrs are the addresses of ipv4only.arpa of RFC 7050
+var ipv4OnlyAddrs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+//nat64 synthesizes the IPv6 addresses the IPv4 destinations are reached on through NAT64
+type nat64 struct {
+	prefix *net.IPNet
+	//force synthesizes the addresses even if there's a route to the IPv4 ones
+	force bool
+}
+
+//WithNAT64Prefix reaches the IPv4 destinations of the requests on the IPv6 addresses synthesized
+//from them with prefix as RFC 6052 describes, for servers on IPv6-only hosts behind NAT64. If
+//prefix is nil DefaultNAT64Prefix is used. Unless force the synthesized address is only dialed
+//if the host has no route to the IPv4 one. The datagrams of the udp associations to IPv4
+//destinations are sent the same way and their replies relayed as if they came from them
+func WithNAT64Prefix(prefix *net.IPNet, force bool) Option {
+	return func(s *Server) {
+		if prefix == nil {
+			_, prefix, _ = net.ParseCIDR(DefaultNAT64Prefix)
+		}
+		s.nat64 = &nat64{prefix: prefix, force: force}
+		s.validate(func() string {
+			if !validNAT64Prefix(prefix) {
+				return fmt.Sprintf("WithNAT64Prefix %v isn't an IPv6 prefix of 32, 40, 48, 56, 64 or 96 bits", prefix)
+			}
+			return ""
+		})
+	}
+}
+
+func validNAT64Prefix(prefix *net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len || prefix.IP.To4() != nil {
+		return false
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+//nat64Octets returns the offsets of the octets of the IPv4 address in an address synthesized
+//with a prefix of ones bits, the octet 8 is skipped as RFC 6052 reserves it
+func nat64Octets(ones int) [4]int {
+	var octets [4]int
+	for i, o := 0, ones/8; i < len(octets); o++ {
+		if o == 8 {
+			continue
+		}
+		octets[i] = o
+		i++
+	}
+	return octets
+}
+
+//SynthesizeNAT64 returns the IPv6 address ip is reached on through NAT64 with prefix as
+//described by RFC 6052
+func SynthesizeNAT64(prefix *net.IPNet, ip net.IP) (net.IP, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, ErrInvalidAddr
+	}
+	if !validNAT64Prefix(prefix) {
+		return nil, ErrNAT64Prefix
+	}
+	ones, _ := prefix.Mask.Size()
+	synthesized := make(net.IP, net.IPv6len)
+	copy(synthesized, prefix.IP.Mask(prefix.Mask))
+	for i, o := range nat64Octets(ones) {
+		synthesized[o] = ip4[i]
+	}
+	return synthesized, nil
+}
+
+//extractNAT64 returns the IPv4 address ip was synthesized from with prefix, it's nil if ip isn't
+//one of the prefix
+func extractNAT64(prefix *net.IPNet, ip net.IP) net.IP {
+	if len(ip) != net.IPv6len || ip.To4() != nil || !prefix.Contains(ip) || !validNAT64Prefix(prefix) {
+		return nil
+	}
+	ones, _ := prefix.Mask.Size()
+	ip4 := make(net.IP, net.IPv4len)
+	for i, o := range nat64Octets(ones) {
+		ip4[i] = ip[o]
+	}
+	return ip4
+}
+
+//DiscoverNAT64Prefix discovers the NAT64 prefix of the network from the IPv6 addresses DNS64
+//synthesizes for ipv4only.arpa as described by RFC 7050. If r is nil net.DefaultResolver is used
+func DiscoverNAT64Prefix(ctx context.Context, r Resolver) (*net.IPNet, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	addrs, err := r.LookupIPAddr(ctx, "ipv4only.arpa")
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		for _, ones := range []int{96, 64, 56, 48, 40, 32} {
+			prefix := &net.IPNet{IP: addr.IP.Mask(net.CIDRMask(ones, 128)), Mask: net.CIDRMask(ones, 128)}
+			ip4 := extractNAT64(prefix, addr.IP)
+			for _, known := range ipv4OnlyAddrs {
+				if ip4 != nil && ip4.Equal(known) {
+					return prefix, nil
+				}
+			}
+		}
+	}
+	return nil, ErrNoNAT64
+}
+
+//synthesize returns the address ip is reached on, it's nil if ip is reached directly
+func (n *nat64) synthesize(ip net.IP) net.IP {
+	if n == nil || ip.To4() == nil {
+		return nil
+	}
+	synthesized, err := SynthesizeNAT64(n.prefix, ip)
+	if err != nil {
+		return nil
+	}
+	return synthesized
+}
+
+//forUDP returns n if the datagrams of a new association to IPv4 destinations are to be sent
+//through NAT64, i.e. if it's forced or there's no route to IPv4 addresses
+func (n *nat64) forUDP() *nat64 {
+	if n == nil || n.force {
+		return n
+	}
+	//connecting a UDP socket sends nothing, it fails if there's no route
+	c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ipv4OnlyAddrs[0], Port: 9})
+	if err != nil {
+		return n
+	}
+	c.Close()
+	return nil
+}
+
+//noIPv4Route reports whether the dial failed with err as the host has no route to IPv4
+//addresses
+func noIPv4Route(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EAFNOSUPPORT)
+}
+
+//dialTCP dials the destination of req, through NAT64 if it's an IPv4 address that can't be
+//reached directly. early is sent to it as the first bytes, in the SYN with WithTCPFastOpen
+func (s *Server) dialTCP(ctx context.Context, req *Request, early []byte) (net.Conn, error) {
+	synthesized := s.nat64Addr(req)
+	if synthesized == nil || !s.nat64.force {
+		t, err := s.dial(ctx, req, req.Dest.String(), early)
+		if synthesized == nil || err == nil || !noIPv4Route(err) {
+			return t, err
+		}
+	}
+	req.conn.nat64 = synthesized
+	s.logf(LevelDebug, "session %s: dialing %s through nat64 on %s", req.conn.id,
+		s.Redaction.destination(req.Dest), s.Redaction.resolved(synthesized))
+	return s.dial(ctx, req, net.JoinHostPort(synthesized.String(), fmt.Sprint(req.Dest.Port)), early)
+}
+
+//nat64Addr returns the address the IPv4 destination of req is synthesized to with
+//WithNAT64Prefix, nil if there's none
+func (s *Server) nat64Addr(req *Request) net.IP {
+	if req.Dest.Type != AddrTypeIPv4 {
+		return nil
+	}
+	return s.nat64.synthesize(req.Dest.IP)
+}
+
+//dialAddr returns the host:port dialTCP hands to the Dialer first for req, the NAT64 address
+//when WithNAT64Prefix forces it and the destination otherwise. A domain is resolved by the Dialer
+//so it's the domain and port
+func (s *Server) dialAddr(req *Request) string {
+	if synthesized := s.nat64Addr(req); synthesized != nil && s.nat64.force {
+		return net.JoinHostPort(synthesized.String(), fmt.Sprint(req.Dest.Port))
+	}
+	return req.Dest.String()
+}
@@ -0,0 +1,197 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSynthesizeNAT64(t *testing.T) {
+	//the examples of RFC 6052 section 2.4
+	ip := net.ParseIP("192.0.2.33")
+	tts := []struct {
+		prefix      string
+		synthesized string
+		err         error
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::", nil},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::", nil},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::", nil},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::", nil},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0", nil},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221", nil},
+		{DefaultNAT64Prefix, "64:ff9b::c000:221", nil},
+		{"2001:db8::/33", "", ErrNAT64Prefix},
+		{"::ffff:0:0/96", "", ErrNAT64Prefix},
+	}
+	for _, tt := range tts {
+		_, prefix, err := net.ParseCIDR(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		synthesized, err := SynthesizeNAT64(prefix, ip)
+		if err != tt.err {
+			t.Errorf("%s: expected %v got %v", tt.prefix, tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !synthesized.Equal(net.ParseIP(tt.synthesized)) {
+			t.Errorf("%s: expected %s got %s", tt.prefix, tt.synthesized, synthesized)
+		}
+		if extracted := extractNAT64(prefix, synthesized); !extracted.Equal(ip) {
+			t.Errorf("%s: expected %s extracted from %s got %s", tt.prefix, ip, synthesized, extracted)
+		}
+	}
+	_, prefix, _ := net.ParseCIDR(DefaultNAT64Prefix)
+	if extracted := extractNAT64(prefix, net.ParseIP("2001:db8::1")); extracted != nil {
+		t.Errorf("expected nothing extracted from an address out of the prefix got %s", extracted)
+	}
+}
+
+//statsRecorder records the stats of the sessions
+type statsRecorder chan SessionStats
+
+func (r statsRecorder) Record(s SessionStats) error {
+	r <- s
+	return nil
+}
+
+func (r statsRecorder) Totals(string, time.Time) (Usage, error) {
+	return Usage{}, nil
+}
+
+func TestNAT64Connect(t *testing.T) {
+	tts := []struct {
+		name   string
+		opts   []Option
+		dialed []string
+		//key is the address the failure is cached under by WithNegativeDialCache
+		key string
+	}{
+		{"without nat64", nil, []string{"tcp4 192.0.2.33:80"}, "192.0.2.33:80"},
+		{"no ipv4 route", []Option{WithNAT64Prefix(nil, false)}, []string{"tcp4 192.0.2.33:80", "tcp6 [64:ff9b::c000:221]:80"}, "192.0.2.33:80"},
+		{"forced", []Option{WithNAT64Prefix(nil, true)}, []string{"tcp6 [64:ff9b::c000:221]:80"}, "[64:ff9b::c000:221]:80"},
+	}
+	for _, tt := range tts {
+		//the host has no IPv4 route and nothing listens on the synthesized address
+		var dialed []string
+		d := &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+			dialed = append(dialed, network+" "+address)
+			if network == "tcp4" {
+				return syscall.ENETUNREACH
+			}
+			return syscall.ECONNREFUSED
+		}}
+		recorded := make(statsRecorder, 1)
+		s, proxy := newTestServer(t, append(tt.opts, WithDialer(d), WithAccounting(recorded))...)
+
+		if _, err := NewClient(proxy).Dial("tcp", "192.0.2.33:80"); err != ErrHostUnreachable {
+			t.Errorf("%s: expected %v got %v", tt.name, ErrHostUnreachable, err)
+		}
+		stats := <-recorded
+		s.Close()
+		if key := s.dialAddr(&Request{Dest: hostAddrSpec("192.0.2.33", 80)}); key != tt.key {
+			t.Errorf("%s: expected the dial address %s got %s", tt.name, tt.key, key)
+		}
+		if len(dialed) != len(tt.dialed) {
+			t.Errorf("%s: expected the dials %q got %q", tt.name, tt.dialed, dialed)
+			continue
+		}
+		for i := range dialed {
+			if dialed[i] != tt.dialed[i] {
+				t.Errorf("%s: expected the dials %q got %q", tt.name, tt.dialed, dialed)
+			}
+		}
+		synthesized := ""
+		if len(tt.opts) > 0 {
+			synthesized = "64:ff9b::c000:221"
+		}
+		if stats.Destination != "192.0.2.33:80" || stats.Synthesized != synthesized {
+			t.Errorf("%s: expected %s synthesized as %q got %+v", tt.name, "192.0.2.33:80", synthesized, stats)
+		}
+	}
+}
+
+func TestNAT64UDP(t *testing.T) {
+	//with the prefix ::/96 the address synthesized for 0.0.0.1 is ::1
+	dst, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer dst.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	l, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, prefix, _ := net.ParseCIDR("::/96")
+	c := &conn{}
+	go relayUDP(l, client.LocalAddr().(*net.UDPAddr), c, newUDPRoutes(nil, &nat64{prefix: prefix, force: true}), nil, 1)
+
+	requested := &net.UDPAddr{IP: net.IPv4(0, 0, 0, 1), Port: dst.LocalAddr().(*net.UDPAddr).Port}
+	hdr, _ := appendUDPHeader(nil, requested)
+	relay := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: l.LocalAddr().(*net.UDPAddr).Port}
+	if _, err := client.WriteTo(append(hdr, "ping"...), relay); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2048)
+	dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := dst.ReadFrom(b)
+	if err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("expected the datagram on the synthesized address got %q %v", b[:n], err)
+	}
+
+	//the reply comes from the requested IPv4 address
+	if _, err := dst.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = client.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, payload, err := parseUDPDatagram(b[:n])
+	if err != nil || src.String() != requested.String() || !bytes.Equal(payload, []byte("pong")) {
+		t.Errorf("expected the reply from %v got %v %q %v", requested, src, payload, err)
+	}
+}
+
+func TestDiscoverNAT64Prefix(t *testing.T) {
+	tts := []struct {
+		addrs  []string
+		prefix string
+		err    error
+	}{
+		{[]string{"192.0.0.170", "192.0.0.171"}, "", ErrNoNAT64},
+		{[]string{"192.0.0.170", "64:ff9b::c000:aa", "64:ff9b::c000:ab"}, "64:ff9b::/96", nil},
+		{[]string{"2001:db8:122:344:c0:0:aa00:0"}, "2001:db8:122:344::/64", nil},
+		{[]string{"2001:db8:c000:ab::"}, "2001:db8::/32", nil},
+		{[]string{"2001:db8::1"}, "", ErrNoNAT64},
+	}
+	for _, tt := range tts {
+		r := resolverFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			if host != "ipv4only.arpa" {
+				t.Errorf("unexpected lookup of %s", host)
+			}
+			var addrs []net.IPAddr
+			for _, a := range tt.addrs {
+				addrs = append(addrs, net.IPAddr{IP: net.ParseIP(a)})
+			}
+			return addrs, nil
+		})
+		prefix, err := DiscoverNAT64Prefix(context.Background(), r)
+		if err != tt.err || (err == nil && prefix.String() != tt.prefix) {
+			t.Errorf("%v: expected %s %v got %v %v", tt.addrs, tt.prefix, tt.err, prefix, err)
+		}
+	}
+}
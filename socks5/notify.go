@@ -0,0 +1,225 @@
+package socks5
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//EventBuffer is the number of events a server holds for its notifiers before dropping new ones
+const EventBuffer = 256
+
+//EventType is the kind of an Event
+type EventType int
+
+const (
+	//EventAuthFailures is sent when the authentication failures in a window cross the threshold
+	//of WithAuthFailureAlert, its Data is an *AuthFailures
+	EventAuthFailures EventType = iota + 1
+
+	//EventClientBanned is sent when a client is banned, its Data is a *ClientBan
+	EventClientBanned
+
+	//EventUpstreamDown is sent by a FailoverClient when its last healthy proxy is marked down,
+	//its Data is an *UpstreamDown
+	EventUpstreamDown
+
+	//EventDrainStarted is sent when Shutdown starts draining the sessions, its Data is a *Drain
+	EventDrainStarted
+
+	//EventDrainFinished is sent once the drain is over, its Data is a *Drain
+	EventDrainFinished
+
+	//EventWouldDeny is sent when a request denied in dry-run is served, its Data is a *WouldDeny
+	EventWouldDeny
+)
+
+//String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case EventAuthFailures:
+		return "auth_failures"
+	case EventClientBanned:
+		return "client_banned"
+	case EventUpstreamDown:
+		return "upstream_down"
+	case EventDrainStarted:
+		return "drain_started"
+	case EventDrainFinished:
+		return "drain_finished"
+	case EventWouldDeny:
+		return "would_deny"
+	}
+	return fmt.Sprintf("event(%d)", int(t))
+}
+
+//MarshalText encodes the event type as its name
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+//Event is an operational event worth alerting on
+type Event struct {
+	Type EventType
+	Time time.Time
+	//Data is the payload of the event, its type is given by Type
+	Data interface{}
+}
+
+//MarshalJSON encodes the event as an object with type, time and data
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type EventType   `json:"type"`
+		Time string      `json:"time"`
+		Data interface{} `json:"data,omitempty"`
+	}{e.Type, e.Time.UTC().Format(time.RFC3339Nano), e.Data})
+}
+
+//AuthFailures is the payload of EventAuthFailures
+type AuthFailures struct {
+	//Failures is the number of failures in the window
+	Failures int `json:"failures"`
+	//Window is the window the failures are counted in
+	Window time.Duration `json:"window_ns"`
+}
+
+//ClientBan is the payload of EventClientBanned
+type ClientBan struct {
+	//Client is the banned address redacted by the RedactionPolicy of the server
+	Client string `json:"client"`
+	//Until is when the ban is over
+	Until time.Time `json:"until"`
+	//Reason is why the client was banned
+	Reason string `json:"reason,omitempty"`
+}
+
+//UpstreamDown is the payload of EventUpstreamDown
+type UpstreamDown struct {
+	//Proxies are the addresses of the proxies marked down
+	Proxies []string `json:"proxies"`
+}
+
+//Drain is the payload of EventDrainStarted and EventDrainFinished
+type Drain struct {
+	//Sessions is the number of active sessions when the drain started or those closed when
+	//it was cut short
+	Sessions int `json:"sessions"`
+	//Forced reports whether the deadline of the drain forced the sessions closed
+	Forced bool `json:"forced,omitempty"`
+}
+
+//WouldDeny is the payload of EventWouldDeny
+type WouldDeny struct {
+	//Rule identifies the rule that would have denied the request
+	Rule      string `json:"rule,omitempty"`
+	SessionID string `json:"session_id"`
+	//Client and Destination are redacted by the RedactionPolicy of the server
+	Client   string `json:"client"`
+	Username string `json:"username,omitempty"`
+	//Command is the name of the requested command e.g. connect
+	Command     string `json:"command"`
+	Destination string `json:"destination"`
+}
+
+//WithNotifier calls notify with every event of the server, notifiers are called in order from a
+//single goroutine so a slow one delays the events but never the sessions
+func WithNotifier(notify func(Event)) Option {
+	return func(s *Server) {
+		if s.events == nil {
+			s.events = newEventBus()
+		}
+		s.events.add(notify)
+	}
+}
+
+//WithAuthFailureAlert sends an EventAuthFailures once threshold authentications failed within
+//window, at most once per window
+func WithAuthFailureAlert(threshold int, window time.Duration) Option {
+	return func(s *Server) {
+		s.authFailures = &failureCounter{threshold: threshold, window: window}
+	}
+}
+
+//Notify queues e for the notifiers of the server, it never blocks and the event is dropped if
+//too many are pending. The Time of e is set if it's zero
+func (s *Server) Notify(e Event) {
+	if s.events == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.events.publish(e)
+}
+
+//DroppedEvents returns the number of events dropped as the notifiers fell behind
+func (s *Server) DroppedEvents() uint64 {
+	if s.events == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.events.dropped)
+}
+
+//eventBus passes events to the notifiers from a single goroutine
+type eventBus struct {
+	dropped uint64
+
+	mu        sync.RWMutex
+	notifiers []func(Event)
+	events    chan Event
+}
+
+func newEventBus() *eventBus {
+	b := &eventBus{events: make(chan Event, EventBuffer)}
+	go b.run()
+	return b
+}
+
+func (b *eventBus) add(notify func(Event)) {
+	b.mu.Lock()
+	b.notifiers = append(b.notifiers, notify)
+	b.mu.Unlock()
+}
+
+func (b *eventBus) publish(e Event) {
+	select {
+	case b.events <- e:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+}
+
+func (b *eventBus) run() {
+	for e := range b.events {
+		b.mu.RLock()
+		notifiers := b.notifiers
+		b.mu.RUnlock()
+		for _, notify := range notifiers {
+			notify(e)
+		}
+	}
+}
+
+//failureCounter counts failures in fixed windows and reports when they cross the threshold
+type failureCounter struct {
+	threshold int
+	window    time.Duration
+
+	mu       sync.Mutex
+	start    time.Time
+	failures int
+}
+
+//fail counts a failure, it returns the failures in the window when they reach the threshold
+func (f *failureCounter) fail() (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if now.Sub(f.start) >= f.window {
+		f.start, f.failures = now, 0
+	}
+	f.failures++
+	return f.failures, f.failures == f.threshold
+}
@@ -0,0 +1,229 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//webhookReceiver checks the signature of the events it receives and passes them to a channel,
+//the first request fails to exercise the retries
+func webhookReceiver(t *testing.T, secret []byte) (*httptest.Server, chan map[string]interface{}) {
+	events := make(chan map[string]interface{}, 10)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %v", r.Method, r.Header)
+		}
+		if sig := r.Header.Get(WebhookSignatureHeader); sig != (&Webhook{Secret: secret}).Sign(body) {
+			t.Errorf("unexpected signature %q", sig)
+		}
+		var e map[string]interface{}
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Errorf("malformed event %s: %v", body, err)
+			return
+		}
+		events <- e
+	}))
+	return srv, events
+}
+
+func nextEvent(t *testing.T, events chan map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	select {
+	case e := <-events:
+		if ts, _ := e["time"].(string); ts == "" {
+			t.Errorf("event without a time %v", e)
+		} else if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+			t.Error(err)
+		}
+		delete(e, "time")
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return nil
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	secret := []byte("secret")
+	receiver, events := webhookReceiver(t, secret)
+	defer receiver.Close()
+
+	hook := NewWebhook(receiver.URL, secret)
+	hook.Backoff = 10 * time.Millisecond
+	hook.OnError = func(e Event, err error) {
+		t.Errorf("%v not delivered: %v", e.Type, err)
+	}
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+	s, proxy := newTestServer(t, WithNotifier(hook.Notify))
+	defer s.Close()
+
+	s.Ban(net.ParseIP("127.0.0.1"), time.Minute, "scanning")
+	e := nextEvent(t, events)
+	data, _ := e["data"].(map[string]interface{})
+	if e["type"] != "client_banned" || data["client"] != "127.0.0.1" || data["reason"] != "scanning" {
+		t.Errorf("unexpected event %v", e)
+	}
+	if _, err := NewClient(proxy).Dial("tcp", echo.Addr().String()); err == nil {
+		t.Error("expected the banned client to be refused")
+	}
+
+	s.Unban(net.ParseIP("127.0.0.1"))
+	c, err := NewClient(proxy).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	expected := map[string]interface{}{"type": "drain_started", "data": map[string]interface{}{"sessions": float64(1)}}
+	if e := nextEvent(t, events); !reflect.DeepEqual(e, expected) {
+		t.Errorf("expected %v got %v", expected, e)
+	}
+	if !s.Draining() {
+		t.Error("expected the server to be draining")
+	}
+	//the session carries on while the server drains
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{"type": "drain_finished", "data": map[string]interface{}{"sessions": float64(0)}}
+	if e := nextEvent(t, events); !reflect.DeepEqual(e, expected) {
+		t.Errorf("expected %v got %v", expected, e)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	events := make(chan Event, 10)
+	s, proxy := newTestServer(t, WithNotifier(func(e Event) { events <- e }))
+
+	c, err := NewClient(proxy).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v got %v", context.DeadlineExceeded, err)
+	}
+	//the session is closed by the deadline
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the session to be closed")
+	}
+
+	for _, expected := range []Event{
+		{Type: EventDrainStarted, Data: &Drain{Sessions: 1}},
+		{Type: EventDrainFinished, Data: &Drain{Sessions: 1, Forced: true}},
+	} {
+		select {
+		case e := <-events:
+			if e.Type != expected.Type || !reflect.DeepEqual(e.Data, expected.Data) {
+				t.Errorf("expected %v %+v got %v %+v", expected.Type, expected.Data, e.Type, e.Data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+	}
+}
+
+func TestAuthFailureAlert(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	events := make(chan Event, 10)
+	s, proxy := newTestServer(t, WithAuth("username", "password"),
+		WithNotifier(func(e Event) { events <- e }), WithAuthFailureAlert(2, time.Minute))
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := NewClient(proxy, WithClientAuth("username", "wrong")).Dial("tcp", echo.Addr().String()); err == nil {
+			t.Fatal("expected authentication to fail")
+		}
+	}
+
+	select {
+	case e := <-events:
+		expected := &AuthFailures{Failures: 2, Window: time.Minute}
+		if e.Type != EventAuthFailures || !reflect.DeepEqual(e.Data, expected) {
+			t.Errorf("unexpected event %v %+v", e.Type, e.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	//the failures are counted once the sessions are over
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case e := <-events:
+		t.Errorf("expected a single event got %v %+v", e.Type, e.Data)
+	default:
+	}
+}
+
+func TestFailoverUpstreamDown(t *testing.T) {
+	//closed listeners refuse the connections to the proxies
+	var proxies []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies = append(proxies, l.Addr().String())
+		l.Close()
+	}
+
+	f, err := NewFailoverClient(StrategyFailover, proxies...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.MaxFailures = 1
+	f.Cooldown = time.Minute
+	var events []Event
+	f.Notify = func(e Event) { events = append(events, e) }
+
+	for i := 0; i < 2; i++ {
+		if _, err := f.Dial("tcp", "127.0.0.1:80"); err == nil {
+			t.Fatal("expected the dial to fail")
+		}
+	}
+	//the event is sent once as the second proxy goes down, not while the proxies stay down
+	if len(events) != 1 {
+		t.Fatalf("expected an event got %+v", events)
+	}
+	expected := &UpstreamDown{Proxies: proxies}
+	if events[0].Type != EventUpstreamDown || !reflect.DeepEqual(events[0].Data, expected) {
+		t.Errorf("unexpected event %v %+v", events[0].Type, events[0].Data)
+	}
+}
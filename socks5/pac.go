@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//PACContentType is the content type of proxy auto-config files
+const PACContentType = "application/x-ns-proxy-autoconfig"
+
+//PACHandler serves a proxy auto-config file pointing browsers at the server on /proxy.pac and
+///wpad.dat, it can be mounted under any prefix
+type PACHandler struct {
+	//Addr returns the address advertised in the PAC, an unspecified host is replaced with
+	//the host the PAC was requested from
+	Addr func() string
+
+	//SOCKS4 adds a SOCKS entry after the SOCKS5 one for browsers that don't support SOCKS5
+	SOCKS4 bool
+
+	mu     sync.RWMutex
+	direct []string
+}
+
+var _ http.Handler = (*PACHandler)(nil)
+
+//PACHandler returns a PACHandler advertising the address of the server returned by the
+//AddrProvider, direct are the exceptions passed to SetDirect
+func (s *Server) PACHandler(direct ...string) *PACHandler {
+	h := &PACHandler{Addr: s.advertisedAddr}
+	h.SetDirect(direct...)
+	return h
+}
+
+//SetDirect replaces the destinations reached without the proxy, they are either CIDRs or
+//domains which match the domain and its subdomains, a leading dot matches subdomains only.
+//It's safe to call while serving so the exceptions can be reloaded
+func (h *PACHandler) SetDirect(direct ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.direct = append([]string{}, direct...)
+}
+
+func (h *PACHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/proxy.pac") && !strings.HasSuffix(r.URL.Path, "/wpad.dat") {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", PACContentType)
+	w.Write(h.generate(h.proxyAddr(r)))
+}
+
+//proxyAddr returns the advertised address with an unspecified host replaced by the host of r
+func (h *PACHandler) proxyAddr(r *http.Request) string {
+	addr := h.Addr()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (h *PACHandler) generate(proxy string) []byte {
+	h.mu.RLock()
+	direct := h.direct
+	h.mu.RUnlock()
+
+	var b bytes.Buffer
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, d := range direct {
+		if cond := pacCondition(d); cond != "" {
+			fmt.Fprintf(&b, "\tif (%s) return \"DIRECT\";\n", cond)
+		}
+	}
+
+	ret := "SOCKS5 " + proxy
+	if h.SOCKS4 {
+		ret += "; SOCKS " + proxy
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", jsString(ret))
+	return b.Bytes()
+}
+
+//pacCondition returns the JavaScript condition matching the exception d
+func pacCondition(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+	if d == "" {
+		return ""
+	}
+
+	if _, ipnet, err := net.ParseCIDR(d); err == nil {
+		if ipnet.IP.To4() != nil {
+			return fmt.Sprintf("isInNet(host, %s, %s)", jsString(ipnet.IP.String()), jsString(net.IP(ipnet.Mask).String()))
+		}
+		//isInNetEx is the IPv6 aware extension supported by most browsers
+		return fmt.Sprintf("typeof isInNetEx == \"function\" && isInNetEx(host, %s)", jsString(ipnet.String()))
+	}
+
+	if strings.HasPrefix(d, ".") {
+		return fmt.Sprintf("dnsDomainIs(host, %s)", jsString(d))
+	}
+	return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", jsString(d), jsString("."+d))
+}
+
+//jsString quotes s as a JavaScript string literal
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+//advertisedAddr returns the address of the first listener as returned by the AddrProvider
+func (s *Server) advertisedAddr() string {
+	addr := s.ListenAddr()
+	s.mu.RLock()
+	provider := s.AddrProvider
+	s.mu.RUnlock()
+
+	if provider == nil {
+		provider = nopAddrProvider
+	}
+	if addr == nil {
+		return s.Addr
+	}
+	return provider(addr)
+}
@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPACHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	s := &Server{AddrProvider: func(addr net.Addr) string {
+		return net.JoinHostPort("proxy.example.com", port)
+	}}
+	go s.Serve(l)
+	defer s.Close()
+	<-s.Ready()
+
+	h := s.PACHandler("intranet.example", ".corp.example", "10.0.0.0/8", "fd00::/8")
+	h.SOCKS4 = true
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	tts := []struct {
+		path     string
+		status   int
+		contains []string
+	}{
+		{"/proxy.pac", http.StatusOK, []string{
+			"function FindProxyForURL(url, host) {",
+			`if (host == "intranet.example" || dnsDomainIs(host, ".intranet.example")) return "DIRECT";`,
+			`if (dnsDomainIs(host, ".corp.example")) return "DIRECT";`,
+			`if (isInNet(host, "10.0.0.0", "255.0.0.0")) return "DIRECT";`,
+			`isInNetEx(host, "fd00::/8")`,
+			`return "SOCKS5 proxy.example.com:` + port + `; SOCKS proxy.example.com:` + port + `";`,
+		}},
+		{"/wpad.dat", http.StatusOK, []string{`return "SOCKS5 proxy.example.com:` + port}},
+		{"/admin/proxy.pac", http.StatusOK, []string{"FindProxyForURL"}},
+		{"/other", http.StatusNotFound, nil},
+	}
+
+	for _, tt := range tts {
+		res, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d got %d", tt.path, tt.status, res.StatusCode)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if ct := res.Header.Get("Content-Type"); ct != PACContentType {
+			t.Errorf("%s: expected content type %s got %s", tt.path, PACContentType, ct)
+		}
+		for _, c := range tt.contains {
+			if !strings.Contains(string(body), c) {
+				t.Errorf("%s: expected %q in\n%s", tt.path, c, body)
+			}
+		}
+	}
+
+	//the exceptions can be replaced while serving
+	h.SetDirect("other.example")
+	res, err := http.Get(ts.URL + "/proxy.pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if strings.Contains(string(body), "intranet.example") || !strings.Contains(string(body), `"other.example"`) {
+		t.Errorf("expected the reloaded exceptions got\n%s", body)
+	}
+}
+
+func TestPACEscaping(t *testing.T) {
+	h := &PACHandler{Addr: func() string { return "0.0.0.0:1080" }}
+	h.SetDirect(`evil.example"); alert("x`, `</script>.example`, "back\\slash.example")
+
+	r := httptest.NewRequest("GET", "http://pac.example:8080/proxy.pac", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	body := w.Body.String()
+
+	for _, c := range []string{
+		`"evil.example\"); alert(\"x"`,
+		`"\u003c/script\u003e.example"`,
+		`"back\\slash.example"`,
+		//the unspecified address is replaced with the host the PAC was requested from
+		`return "SOCKS5 pac.example:1080";`,
+	} {
+		if !strings.Contains(body, c) {
+			t.Errorf("expected %q in\n%s", c, body)
+		}
+	}
+	if strings.Contains(body, `alert("x`) {
+		t.Errorf("unescaped hostname in\n%s", body)
+	}
+}
@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//ErrMalformedHash is returned if a secret looking like a password hash can't be parsed
+var ErrMalformedHash = errors.New("socks5: malformed password hash")
+
+//HashedCredentials is a CredentialStore of usernames and their secrets, a secret is either the
+//password or a hash of it. Hashes are detected by their prefix, bcrypt ($2a$, $2b$ and $2y$)
+//and argon2 in the PHC format ($argon2i$ and $argon2id$) are supported
+type HashedCredentials map[string]string
+
+//Valid reports whether password matches the secret of username
+func (h HashedCredentials) Valid(username, password string) bool {
+	secret, ok := h[username]
+	return ok && CheckSecret(secret, password)
+}
+
+//CheckSecret reports whether password matches secret, a password or a hash of it
+func CheckSecret(secret, password string) bool {
+	switch secretKind(secret) {
+	case "bcrypt":
+		return bcrypt.CompareHashAndPassword([]byte(secret), []byte(password)) == nil
+	case "argon2i", "argon2id":
+		a, err := parseArgon2(secret)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(a.key(password), a.hash) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(password)) == 1
+}
+
+//ValidateSecret returns an error if secret is a hash that can't be parsed
+func ValidateSecret(secret string) error {
+	switch secretKind(secret) {
+	case "bcrypt":
+		if _, err := bcrypt.Cost([]byte(secret)); err != nil {
+			return ErrMalformedHash
+		}
+	case "argon2i", "argon2id":
+		if _, err := parseArgon2(secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//secretKind returns the algorithm of the hash secret is, empty if it's a password
+func secretKind(secret string) string {
+	switch {
+	case strings.HasPrefix(secret, "$2a$"), strings.HasPrefix(secret, "$2b$"), strings.HasPrefix(secret, "$2y$"):
+		return "bcrypt"
+	case strings.HasPrefix(secret, "$argon2id$"):
+		return "argon2id"
+	case strings.HasPrefix(secret, "$argon2i$"):
+		return "argon2i"
+	}
+	return ""
+}
+
+type argon2Hash struct {
+	id           bool
+	memory, time uint32
+	threads      uint8
+	salt, hash   []byte
+}
+
+//parseArgon2 parses $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash> with the salt and hash in
+//unpadded base64
+func parseArgon2(secret string) (*argon2Hash, error) {
+	parts := strings.Split(secret, "$")
+	if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, ErrMalformedHash
+	}
+	a := &argon2Hash{id: parts[1] == "argon2id"}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.memory, &a.time, &a.threads); err != nil {
+		return nil, ErrMalformedHash
+	}
+	var err error
+	if a.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrMalformedHash
+	}
+	if a.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(a.hash) == 0 {
+		return nil, ErrMalformedHash
+	}
+	if a.time == 0 || a.threads == 0 {
+		return nil, ErrMalformedHash
+	}
+	return a, nil
+}
+
+//key derives the key of password with the parameters of a
+func (a *argon2Hash) key(password string) []byte {
+	if a.id {
+		return argon2.IDKey([]byte(password), a.salt, a.time, a.memory, a.threads, uint32(len(a.hash)))
+	}
+	return argon2.Key([]byte(password), a.salt, a.time, a.memory, a.threads, uint32(len(a.hash)))
+}
@@ -0,0 +1,56 @@
+package socks5
+
+import "testing"
+
+const (
+	testBcrypt   = "$2a$04$Uf8DfB5tr1ury7P6ja1vrer0CffecWOyNfebvQGBd.CdqtEthI.5."
+	testArgon2id = "$argon2id$v=19$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$qhVKebEteqSqfN1q0/VQe+PEtXxh33BCEdTstQ++g6E"
+	testArgon2i  = "$argon2i$v=19$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$7eMeY/dDHTtwi/UJ9NvK4nDjEMm+MlW1/j23C4+/+Jc"
+)
+
+func TestCheckSecret(t *testing.T) {
+	tts := []struct {
+		secret, password string
+		valid            bool
+	}{
+		{"plain", "plain", true},
+		{"plain", "Plain", false},
+		{"", "", true},
+		{testBcrypt, "bcrypt-pass", true},
+		{testBcrypt, "wrong", false},
+		{testBcrypt, testBcrypt, false},
+		{testArgon2id, "argon-pass", true},
+		{testArgon2id, "wrong", false},
+		{testArgon2i, "argon-pass", true},
+		{testArgon2i, "wrong", false},
+		{"$argon2id$v=19$m=64,t=1$MDEy$qhVK", "argon-pass", false},
+	}
+	for _, tt := range tts {
+		if valid := CheckSecret(tt.secret, tt.password); valid != tt.valid {
+			t.Errorf("%q %q: expected %v got %v", tt.secret, tt.password, tt.valid, valid)
+		}
+	}
+}
+
+func TestValidateSecret(t *testing.T) {
+	tts := []struct {
+		secret string
+		err    error
+	}{
+		{"plain", nil},
+		{"$1$not-a-supported-hash", nil},
+		{testBcrypt, nil},
+		{testArgon2id, nil},
+		{testArgon2i, nil},
+		{"$2a$04$short", ErrMalformedHash},
+		{"$argon2id$v=16$m=64,t=1,p=1$MDEy$qhVK", ErrMalformedHash},
+		{"$argon2id$v=19$m=64,t=1$MDEy$qhVK", ErrMalformedHash},
+		{"$argon2id$v=19$m=64,t=0,p=1$MDEy$qhVK", ErrMalformedHash},
+		{"$argon2i$v=19$m=64,t=1,p=1$!!$qhVK", ErrMalformedHash},
+	}
+	for _, tt := range tts {
+		if err := ValidateSecret(tt.secret); err != tt.err {
+			t.Errorf("%q: expected %v got %v", tt.secret, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+//ErrPaused is returned for the sessions refused while the server is paused
+var ErrPaused = errors.New("socks5: server paused")
+
+//PauseMode is how the connections accepted while the server is paused are refused
+type PauseMode int
+
+const (
+	//PauseRefuse completes the handshake and answers the request with ReplyGeneralFailure so
+	//the clients fail fast with a SOCKS error
+	PauseRefuse PauseMode = iota
+	//PauseClose closes the connections before the handshake
+	PauseClose
+)
+
+//WithPauseMode sets how the connections are refused while the server is paused, it's
+//PauseRefuse by default
+func WithPauseMode(mode PauseMode) Option {
+	return func(s *Server) {
+		s.pauseMode = mode
+	}
+}
+
+const (
+	//pausedByUser is set by Pause
+	pausedByUser int32 = 1 << iota
+	//pausedByFDs is set while the process is out of file descriptors
+	pausedByFDs
+)
+
+//Pause stops admitting new sessions while the active ones go on, the connections accepted
+//meanwhile are refused as set by WithPauseMode and Accepting reports false. Pausing a paused
+//server does nothing
+func (s *Server) Pause() {
+	if s.setPaused(pausedByUser, true) {
+		s.logf(LevelInfo, "paused, new sessions are refused")
+	}
+}
+
+//Resume admits new sessions again after Pause, resuming a server that isn't paused does nothing
+func (s *Server) Resume() {
+	if s.setPaused(pausedByUser, false) {
+		s.logf(LevelInfo, "resumed")
+	}
+}
+
+//Paused reports whether the server is paused, by Pause or while it's out of file descriptors
+func (s *Server) Paused() bool {
+	return atomic.LoadInt32(&s.paused) != 0
+}
+
+//setPaused sets or clears the reason the server is paused for, it reports whether it changed
+func (s *Server) setPaused(reason int32, paused bool) bool {
+	for {
+		old := atomic.LoadInt32(&s.paused)
+		new := old &^ reason
+		if paused {
+			new = old | reason
+		}
+		if new == old {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.paused, old, new) {
+			return true
+		}
+	}
+}
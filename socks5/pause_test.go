@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPause(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	s, proxy := newTestServer(t)
+	defer s.Close()
+	admin := s.AdminHandler()
+	post := func(path string) {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: expected %d got %d", path, http.StatusNoContent, rec.Code)
+		}
+	}
+
+	c, err := NewClient(proxy).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	echoes := func() {
+		t.Helper()
+		b := make([]byte, 4)
+		c.Write([]byte("ping"))
+		if _, err := c.Read(b); err != nil || string(b) != "ping" {
+			t.Errorf("expected the echo got %q %v", b, err)
+		}
+	}
+
+	//pausing twice is the same as pausing once
+	post("/pause")
+	s.Pause()
+	if !s.Paused() || s.Accepting() {
+		t.Error("expected the server paused and not accepting")
+	}
+	if _, err := NewClient(proxy).Dial("tcp", echo.Addr().String()); err != ErrGeneralFailure {
+		t.Errorf("expected the request refused got %v", err)
+	}
+	echoes()
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"active":1,"draining":false,"paused":true}` {
+		t.Errorf("unexpected sessions %s", body)
+	}
+	rec = httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "socks5_paused 1") {
+		t.Errorf("expected socks5_paused 1 in\n%s", rec.Body.String())
+	}
+
+	post("/resume")
+	s.Resume()
+	if s.Paused() || !s.Accepting() {
+		t.Error("expected the server resumed and accepting")
+	}
+	c2, err := NewClient(proxy).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("expected the request admitted got %v", err)
+	}
+	c2.Close()
+	echoes()
+}
+
+func TestPauseClose(t *testing.T) {
+	s, proxy := newTestServer(t, WithPauseMode(PauseClose))
+	defer s.Close()
+	s.Pause()
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte{socksVer5, 1, 0})
+	if n, err := c.Read(make([]byte, 2)); n != 0 || err == nil {
+		t.Errorf("expected the connection closed before the handshake got %d %v", n, err)
+	}
+}
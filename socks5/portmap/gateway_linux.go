@@ -0,0 +1,45 @@
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+//DefaultGateway returns the gateway of the default IPv4 route read from /proc/net/route, on the
+//other platforms it returns ErrGatewayUnsupported
+func DefaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRoutes(f)
+}
+
+func parseRoutes(r io.Reader) (net.IP, error) {
+	s := bufio.NewScanner(r)
+	s.Scan() //header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		//Iface Destination Gateway Flags ...
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != net.IPv4len {
+			continue
+		}
+		//the addresses are in host byte order which is little endian on supported platforms
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+		if !ip.IsUnspecified() {
+			return ip, nil
+		}
+	}
+	return nil, ErrNoGateway
+}
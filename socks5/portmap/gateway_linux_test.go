@@ -0,0 +1,25 @@
+package portmap
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+`
+	ip, err := parseRoutes(strings.NewReader(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("expected 192.168.1.1 got %v", ip)
+	}
+
+	if _, err := parseRoutes(strings.NewReader(strings.SplitN(routes, "\n", 3)[0])); err != ErrNoGateway {
+		t.Errorf("expected %v got %v", ErrNoGateway, err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package portmap
+
+import "net"
+
+//DefaultGateway isn't supported on this platform, it returns ErrGatewayUnsupported and the Gateway
+//of NATPMP, PCP and Auto has to be set explicitly
+func DefaultGateway() (net.IP, error) {
+	return nil, ErrGatewayUnsupported
+}
@@ -0,0 +1,308 @@
+package portmap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Port is the port NAT-PMP and PCP servers listen on
+const Port = 5351
+
+//ErrInvalidResponse is returned if the gateway sends a malformed response
+var ErrInvalidResponse = errors.New("portmap: invalid response")
+
+//ErrUnsupportedVersion is returned if the gateway doesn't support the protocol version
+var ErrUnsupportedVersion = errors.New("portmap: unsupported protocol version")
+
+//ResultError is returned if the gateway refuses a request
+type ResultError struct {
+	Protocol string
+	Code     int
+}
+
+func (r *ResultError) Error() string {
+	return fmt.Sprintf("portmap: %s request failed with result code %d", r.Protocol, r.Code)
+}
+
+const (
+	natpmpVersion   byte = 0
+	natpmpOpAddress byte = 0
+	natpmpOpUDP     byte = 1
+	natpmpOpTCP     byte = 2
+)
+
+//NATPMP is a NAT-PMP (RFC 6886) client
+type NATPMP struct {
+	//Gateway is the host:port of the NAT-PMP server, if empty the default gateway is used which
+	//is only looked up on linux
+	Gateway string
+}
+
+var _ Mapper = (*NATPMP)(nil)
+
+//ExternalIP returns the external address of the gateway
+func (n *NATPMP) ExternalIP(ctx context.Context) (net.IP, error) {
+	res, err := n.request(ctx, []byte{natpmpVersion, natpmpOpAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(res[8:12]), nil
+}
+
+//AddMapping maps internalPort on the gateway
+func (n *NATPMP) AddMapping(ctx context.Context, protocol string, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	res, err := n.mapping(ctx, protocol, internalPort, externalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mapping{
+		Protocol:     protocol,
+		InternalPort: int(binary.BigEndian.Uint16(res[8:])),
+		ExternalPort: int(binary.BigEndian.Uint16(res[10:])),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(res[12:])) * time.Second,
+	}
+
+	//the external address isn't part of the mapping response
+	if ip, err := n.ExternalIP(ctx); err == nil {
+		m.ExternalIP = ip
+	}
+	return m, nil
+}
+
+//DeleteMapping removes the mapping of internalPort
+func (n *NATPMP) DeleteMapping(ctx context.Context, protocol string, internalPort int) error {
+	_, err := n.mapping(ctx, protocol, internalPort, 0, 0)
+	return err
+}
+
+func (n *NATPMP) mapping(ctx context.Context, protocol string, internalPort, externalPort int, lifetime time.Duration) ([]byte, error) {
+	op := natpmpOpTCP
+	if protocol == "udp" {
+		op = natpmpOpUDP
+	}
+
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	return n.request(ctx, req, 16)
+}
+
+func (n *NATPMP) request(ctx context.Context, req []byte, resLen int) ([]byte, error) {
+	res, err := transact(ctx, n.Gateway, req, func(res []byte) bool {
+		return len(res) >= 2 && res[1] == req[1]|0x80
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) < resLen || res[0] != natpmpVersion {
+		return nil, ErrInvalidResponse
+	}
+	if code := binary.BigEndian.Uint16(res[2:]); code != 0 {
+		return nil, &ResultError{Protocol: "nat-pmp", Code: int(code)}
+	}
+	return res, nil
+}
+
+const (
+	pcpVersion   byte = 2
+	pcpOpMap     byte = 1
+	pcpHeaderLen      = 24
+	pcpMapLen         = 36
+)
+
+//PCP is a Port Control Protocol (RFC 6887) client
+type PCP struct {
+	//Gateway is the host:port of the PCP server, if empty the default gateway is used which is
+	//only looked up on linux
+	Gateway string
+}
+
+var _ Mapper = (*PCP)(nil)
+
+//AddMapping maps internalPort on the gateway using the MAP opcode
+func (p *PCP) AddMapping(ctx context.Context, protocol string, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	res, err := p.mapping(ctx, protocol, internalPort, externalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	body := res[pcpHeaderLen:]
+	ip := net.IP(append([]byte{}, body[20:36]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return &Mapping{
+		Protocol:     protocol,
+		InternalPort: int(binary.BigEndian.Uint16(body[16:])),
+		ExternalPort: int(binary.BigEndian.Uint16(body[18:])),
+		ExternalIP:   ip,
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(res[4:])) * time.Second,
+	}, nil
+}
+
+//DeleteMapping removes the mapping of internalPort
+func (p *PCP) DeleteMapping(ctx context.Context, protocol string, internalPort int) error {
+	_, err := p.mapping(ctx, protocol, internalPort, 0, 0)
+	return err
+}
+
+func (p *PCP) mapping(ctx context.Context, protocol string, internalPort, externalPort int, lifetime time.Duration) ([]byte, error) {
+	proto := byte(6)
+	if protocol == "udp" {
+		proto = 17
+	}
+
+	req := make([]byte, pcpHeaderLen+pcpMapLen)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	//req[8:24] is the client address, it's filled in by transact
+
+	body := req[pcpHeaderLen:]
+	if _, err := rand.Read(body[:12]); err != nil {
+		return nil, err
+	}
+	body[12] = proto
+	binary.BigEndian.PutUint16(body[16:], uint16(internalPort))
+	binary.BigEndian.PutUint16(body[18:], uint16(externalPort))
+	copy(body[20:], net.IPv6zero)
+
+	//NAT-PMP only gateways answer with a version 0 response which must not be waited out
+	res, err := transact(ctx, p.Gateway, req, func(res []byte) bool {
+		return len(res) >= 4 && res[1]&0x80 != 0
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res[0] != pcpVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	if res[3] != 0 {
+		return nil, &ResultError{Protocol: "pcp", Code: int(res[3])}
+	}
+	if len(res) < pcpHeaderLen+pcpMapLen || res[1] != pcpOpMap|0x80 ||
+		string(res[pcpHeaderLen:pcpHeaderLen+12]) != string(body[:12]) {
+		return nil, ErrInvalidResponse
+	}
+	return res, nil
+}
+
+//Auto uses PCP if the gateway supports it and falls back to NAT-PMP otherwise
+type Auto struct {
+	//Gateway is the host:port of the gateway, if empty the default gateway is used which is only
+	//looked up on linux
+	Gateway string
+
+	mu     sync.Mutex
+	mapper Mapper
+}
+
+var _ Mapper = (*Auto)(nil)
+
+//AddMapping maps internalPort with the protocol supported by the gateway
+func (a *Auto) AddMapping(ctx context.Context, protocol string, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	a.mu.Lock()
+	mapper := a.mapper
+	a.mu.Unlock()
+	if mapper != nil {
+		return mapper.AddMapping(ctx, protocol, internalPort, externalPort, lifetime)
+	}
+
+	for _, mapper := range []Mapper{&PCP{Gateway: a.Gateway}, &NATPMP{Gateway: a.Gateway}} {
+		m, err := mapper.AddMapping(ctx, protocol, internalPort, externalPort, lifetime)
+		if err == nil {
+			a.mu.Lock()
+			a.mapper = mapper
+			a.mu.Unlock()
+			return m, nil
+		}
+		if err != ErrUnsupportedVersion {
+			return nil, err
+		}
+	}
+	return nil, ErrUnsupportedVersion
+}
+
+//DeleteMapping removes the mapping of internalPort
+func (a *Auto) DeleteMapping(ctx context.Context, protocol string, internalPort int) error {
+	a.mu.Lock()
+	mapper := a.mapper
+	a.mu.Unlock()
+	if mapper == nil {
+		return ErrUnsupportedVersion
+	}
+	return mapper.DeleteMapping(ctx, protocol, internalPort)
+}
+
+//transact sends req to the gateway retransmitting it with exponential backoff starting at 250ms
+//until a response accepted by match is received or ctx is done. PCP requests have the client
+//address filled in from the local address of the socket
+func transact(ctx context.Context, gateway string, req []byte, match func([]byte) bool) ([]byte, error) {
+	if gateway == "" {
+		ip, err := DefaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		gateway = net.JoinHostPort(ip.String(), strconv.Itoa(Port))
+	}
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if req[0] == pcpVersion {
+		local := c.LocalAddr().(*net.UDPAddr)
+		copy(req[8:24], local.IP.To16())
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	res := make([]byte, 1100)
+	for wait := 250 * time.Millisecond; ; wait *= 2 {
+		if _, err := c.Write(req); err != nil {
+			return nil, err
+		}
+
+		c.SetReadDeadline(time.Now().Add(wait))
+		for {
+			n, err := c.Read(res)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if match(res[:n]) {
+				return res[:n], nil
+			}
+		}
+	}
+}
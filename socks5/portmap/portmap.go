@@ -0,0 +1,364 @@
+//Package portmap maps the listening ports on the gateway using UPnP, NAT-PMP (RFC 6886) or
+//PCP (RFC 6887) so the server is reachable from outside the NAT, the mappings are renewed
+//for as long as the listeners are open and removed once they are closed
+package portmap
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//ErrNoGateway is returned if the default gateway can't be determined
+var ErrNoGateway = errors.New("portmap: no default gateway")
+
+//ErrGatewayUnsupported is returned by DefaultGateway on the platforms other than linux
+var ErrGatewayUnsupported = errors.New("portmap: the default gateway can only be looked up on linux")
+
+//DefaultLifetime is the lifetime requested for mappings, they are renewed at half their lifetime
+const DefaultLifetime = 2 * time.Hour
+
+//Mapping is a port mapped on the gateway
+type Mapping struct {
+	//Protocol is either tcp or udp
+	Protocol     string
+	InternalPort int
+	ExternalPort int
+	ExternalIP   net.IP
+	//Lifetime is the lifetime granted by the gateway
+	Lifetime time.Duration
+}
+
+//Mapper is implemented by the port mapping protocols
+type Mapper interface {
+	//AddMapping maps internalPort, externalPort is a suggestion which may be 0
+	AddMapping(ctx context.Context, protocol string, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error)
+
+	//DeleteMapping removes the mapping of internalPort
+	DeleteMapping(ctx context.Context, protocol string, internalPort int) error
+}
+
+//PortMapper creates listeners whose ports are mapped on the gateway and keeps the
+//mappings alive until the listeners are closed
+type PortMapper struct {
+	//Mapper is the protocol used to map the ports
+	Mapper Mapper
+
+	//Lifetime is the requested lifetime of the mappings, if 0 DefaultLifetime is used
+	Lifetime time.Duration
+
+	//Timeout bounds every request sent to the gateway
+	Timeout time.Duration
+
+	//MinBackoff and MaxBackoff bound the delay between retries of a failed renewal
+	MinBackoff, MaxBackoff time.Duration
+
+	//OnError is called if a mapping can't be created or renewed, local is the address of the
+	//listener. Failed renewals are retried until the listener is closed
+	OnError func(local net.Addr, err error)
+
+	//OnChange is called if the gateway changed the external address of a mapping, e.g. after
+	//a reboot or a change of the external IP
+	OnChange func(local net.Addr, m *Mapping)
+
+	mu     sync.Mutex
+	mapped map[*mapped]struct{}
+}
+
+//New returns a PortMapper using m
+func New(m Mapper) *PortMapper {
+	return &PortMapper{
+		Mapper:     m,
+		Lifetime:   DefaultLifetime,
+		Timeout:    10 * time.Second,
+		MinBackoff: time.Second,
+		MaxBackoff: 5 * time.Minute,
+	}
+}
+
+//Listen works like net.Listen but maps the port on the gateway, the Addr() method of the
+//returned Listener returns the external address. If the port can't be mapped the error is
+//logged and the plain listener is returned
+func (p *PortMapper) Listen(network, address string) (net.Listener, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := p.mapAddr("tcp", l.Addr())
+	if err != nil {
+		p.error(l.Addr(), err)
+		return l, nil
+	}
+	return &mappedListener{Listener: l, m: m}, nil
+}
+
+//ListenPacket works like net.ListenPacket but maps the port on the gateway, the LocalAddr()
+//method of the returned PacketConn returns the external address. If the port can't be mapped
+//the error is logged and the plain PacketConn is returned
+func (p *PortMapper) ListenPacket(network, address string) (net.PacketConn, error) {
+	c, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := p.mapAddr("udp", c.LocalAddr())
+	if err != nil {
+		p.error(c.LocalAddr(), err)
+		return c, nil
+	}
+	return &mappedPacketConn{PacketConn: c, m: m}, nil
+}
+
+//Close removes all the mappings created by the PortMapper, it returns once they are removed
+//even if they are concurrently removed by closing their listeners
+func (p *PortMapper) Close() error {
+	p.mu.Lock()
+	mappings := make([]*mapped, 0, len(p.mapped))
+	for m := range p.mapped {
+		mappings = append(mappings, m)
+	}
+	p.mu.Unlock()
+
+	var err error
+	for _, m := range mappings {
+		if e := m.close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (p *PortMapper) mapAddr(protocol string, addr net.Addr) (*mapped, error) {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	internal, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mapped{p: p, protocol: protocol, internal: internal, local: addr, done: make(chan struct{})}
+	if _, err := m.renew(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.mapped == nil {
+		p.mapped = make(map[*mapped]struct{})
+	}
+	p.mapped[m] = struct{}{}
+	p.mu.Unlock()
+
+	go m.keepAlive()
+	return m, nil
+}
+
+func (p *PortMapper) lifetime() time.Duration {
+	if p.Lifetime <= 0 {
+		return DefaultLifetime
+	}
+	return p.Lifetime
+}
+
+func (p *PortMapper) backoff() (min, max time.Duration) {
+	min, max = p.MinBackoff, p.MaxBackoff
+	if min <= 0 {
+		min = time.Second
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+func (p *PortMapper) error(local net.Addr, err error) {
+	log.Printf("portmap: unable to map %v: %v", local, err)
+	if p.OnError != nil {
+		p.OnError(local, err)
+	}
+}
+
+func (p *PortMapper) context() (context.Context, context.CancelFunc) {
+	if p.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.Timeout)
+}
+
+//mapped is a single mapping kept alive by renewing it at half its lifetime
+type mapped struct {
+	p        *PortMapper
+	protocol string
+	internal int
+	local    net.Addr
+
+	mu      sync.RWMutex
+	mapping *Mapping
+
+	//op serializes requests to the gateway so a renewal can't recreate a deleted mapping
+	op     sync.Mutex
+	closed bool
+
+	once sync.Once
+	done chan struct{}
+}
+
+//renew requests the mapping again and reports whether its external address changed
+func (m *mapped) renew() (changed bool, err error) {
+	m.op.Lock()
+	defer m.op.Unlock()
+	if m.closed {
+		return false, nil
+	}
+
+	external := 0
+	m.mu.RLock()
+	old := m.mapping
+	m.mu.RUnlock()
+	if old != nil {
+		external = old.ExternalPort
+	}
+
+	ctx, cancel := m.p.context()
+	defer cancel()
+	mapping, err := m.p.Mapper.AddMapping(ctx, m.protocol, m.internal, external, m.p.lifetime())
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	m.mapping = mapping
+	m.mu.Unlock()
+
+	return old != nil && (old.ExternalPort != mapping.ExternalPort || !old.ExternalIP.Equal(mapping.ExternalIP)), nil
+}
+
+func (m *mapped) keepAlive() {
+	min, max := m.p.backoff()
+	backoff := min
+	for {
+		m.mu.RLock()
+		wait := m.mapping.Lifetime / 2
+		m.mu.RUnlock()
+		if wait < min {
+			wait = min
+		}
+
+		//failed renewals are retried with exponential backoff, even past the expiry of the
+		//mapping so it's re-established once the gateway is reachable again
+		for {
+			select {
+			case <-time.After(wait):
+			case <-m.done:
+				return
+			}
+
+			changed, err := m.renew()
+			if err == nil {
+				backoff = min
+				if changed {
+					m.changed()
+				}
+				break
+			}
+
+			m.p.error(m.local, err)
+			wait = backoff
+			if backoff *= 2; backoff > max {
+				backoff = max
+			}
+		}
+	}
+}
+
+func (m *mapped) changed() {
+	m.mu.RLock()
+	mapping := *m.mapping
+	m.mu.RUnlock()
+
+	log.Printf("portmap: mapping of %v changed to %v", m.local, m.addr())
+	if m.p.OnChange != nil {
+		m.p.OnChange(m.local, &mapping)
+	}
+}
+
+//addr returns the external address or the local one if the gateway didn't report the external IP
+func (m *mapped) addr() net.Addr {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.mapping.ExternalIP == nil {
+		return m.local
+	}
+	return &addr{network: m.local.Network(), address: net.JoinHostPort(m.mapping.ExternalIP.String(), strconv.Itoa(m.mapping.ExternalPort))}
+}
+
+func (m *mapped) close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+
+		m.op.Lock()
+		m.closed = true
+		ctx, cancel := m.p.context()
+		err = m.p.Mapper.DeleteMapping(ctx, m.protocol, m.internal)
+		cancel()
+		m.op.Unlock()
+
+		m.p.mu.Lock()
+		delete(m.p.mapped, m)
+		m.p.mu.Unlock()
+	})
+	return err
+}
+
+type addr struct {
+	network, address string
+}
+
+var _ net.Addr = (*addr)(nil)
+
+func (a *addr) Network() string {
+	return a.network
+}
+
+func (a *addr) String() string {
+	return a.address
+}
+
+type mappedListener struct {
+	net.Listener
+	m *mapped
+}
+
+var _ net.Listener = (*mappedListener)(nil)
+
+func (l *mappedListener) Addr() net.Addr {
+	return l.m.addr()
+}
+
+func (l *mappedListener) Close() error {
+	defer l.m.close()
+	return l.Listener.Close()
+}
+
+type mappedPacketConn struct {
+	net.PacketConn
+	m *mapped
+}
+
+var _ net.PacketConn = (*mappedPacketConn)(nil)
+
+func (c *mappedPacketConn) LocalAddr() net.Addr {
+	return c.m.addr()
+}
+
+func (c *mappedPacketConn) Close() error {
+	defer c.m.close()
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,352 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var externalIP = net.IPv4(203, 0, 113, 1).To4()
+
+//gateway is a fake NAT-PMP/PCP server, if pcp is false version 2 requests are refused like
+//NAT-PMP only gateways do
+type gateway struct {
+	c        net.PacketConn
+	pcp      bool
+	lifetime uint32
+
+	mu       sync.Mutex
+	requests map[int]int
+	mapped   map[int]int
+}
+
+func newGateway(t *testing.T, pcp bool, lifetime uint32) *gateway {
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gateway{c: c, pcp: pcp, lifetime: lifetime, requests: make(map[int]int), mapped: make(map[int]int)}
+	go g.serve()
+	return g
+}
+
+func (g *gateway) addr() string {
+	return g.c.LocalAddr().String()
+}
+
+func (g *gateway) state(port int) (requests int, mapped bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, mapped = g.mapped[port]
+	return g.requests[port], mapped
+}
+
+func (g *gateway) serve() {
+	b := make([]byte, 1100)
+	for {
+		n, addr, err := g.c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if res := g.handle(b[:n]); res != nil {
+			g.c.WriteTo(res, addr)
+		}
+	}
+}
+
+func (g *gateway) record(internal, lifetime int) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests[internal]++
+	if lifetime == 0 {
+		delete(g.mapped, internal)
+		return 0
+	}
+	g.mapped[internal] = externalPort(internal)
+	return externalPort(internal)
+}
+
+func externalPort(internal int) int {
+	return (internal + 30000) % 65536
+}
+
+func (g *gateway) handle(req []byte) []byte {
+	switch {
+	case req[0] == natpmpVersion && req[1] == natpmpOpAddress:
+		res := make([]byte, 12)
+		res[1] = 0x80
+		copy(res[8:], externalIP)
+		return res
+	case req[0] == natpmpVersion && len(req) == 12:
+		internal := int(binary.BigEndian.Uint16(req[4:]))
+		lifetime := int(binary.BigEndian.Uint32(req[8:]))
+		external := g.record(internal, lifetime)
+		res := make([]byte, 16)
+		res[1] = req[1] | 0x80
+		copy(res[8:10], req[4:6])
+		binary.BigEndian.PutUint16(res[10:], uint16(external))
+		if lifetime > 0 {
+			binary.BigEndian.PutUint32(res[12:], g.lifetime)
+		}
+		return res
+	case req[0] == pcpVersion && !g.pcp:
+		return []byte{natpmpVersion, req[1] | 0x80, 0, 1, 0, 0, 0, 0}
+	case req[0] == pcpVersion && len(req) == pcpHeaderLen+pcpMapLen:
+		body := req[pcpHeaderLen:]
+		internal := int(binary.BigEndian.Uint16(body[16:]))
+		lifetime := int(binary.BigEndian.Uint32(req[4:]))
+		external := g.record(internal, lifetime)
+		res := make([]byte, pcpHeaderLen+pcpMapLen)
+		res[0] = pcpVersion
+		res[1] = pcpOpMap | 0x80
+		if lifetime > 0 {
+			binary.BigEndian.PutUint32(res[4:], g.lifetime)
+		}
+		copy(res[pcpHeaderLen:], body[:20])
+		binary.BigEndian.PutUint16(res[pcpHeaderLen+18:], uint16(external))
+		copy(res[pcpHeaderLen+20:], externalIP.To16())
+		return res
+	}
+	return nil
+}
+
+func TestMappers(t *testing.T) {
+	tts := []struct {
+		name   string
+		pcp    bool
+		mapper func(gw string) Mapper
+	}{
+		{"nat-pmp", false, func(gw string) Mapper { return &NATPMP{Gateway: gw} }},
+		{"pcp", true, func(gw string) Mapper { return &PCP{Gateway: gw} }},
+		{"auto pcp", true, func(gw string) Mapper { return &Auto{Gateway: gw} }},
+		{"auto nat-pmp", false, func(gw string) Mapper { return &Auto{Gateway: gw} }},
+	}
+
+	for _, tt := range tts {
+		g := newGateway(t, tt.pcp, 3600)
+		m := tt.mapper(g.addr())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		mapping, err := m.AddMapping(ctx, "tcp", 5555, 0, time.Hour)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if mapping.InternalPort != 5555 || mapping.ExternalPort != 35555 || !mapping.ExternalIP.Equal(externalIP) || mapping.Lifetime != time.Hour {
+			t.Errorf("%s: unexpected mapping %+v", tt.name, mapping)
+		}
+
+		if err := m.DeleteMapping(ctx, "tcp", 5555); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if _, mapped := g.state(5555); mapped {
+			t.Errorf("%s: expected mapping to be deleted", tt.name)
+		}
+
+		cancel()
+		g.c.Close()
+	}
+}
+
+func TestPCPUnsupported(t *testing.T) {
+	g := newGateway(t, false, 3600)
+	defer g.c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := (&PCP{Gateway: g.addr()}).AddMapping(ctx, "tcp", 5555, 0, time.Hour); err != ErrUnsupportedVersion {
+		t.Errorf("expected %v got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestPortMapperListen(t *testing.T) {
+	g := newGateway(t, true, 2)
+	defer g.c.Close()
+
+	p := New(&PCP{Gateway: g.addr()})
+	l, err := p.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.(*mappedListener).Listener.Addr().String())
+	internal, _ := strconv.Atoi(port)
+
+	expected := net.JoinHostPort(externalIP.String(), strconv.Itoa(externalPort(internal)))
+	if l.Addr().String() != expected {
+		t.Errorf("expected %s got %s", expected, l.Addr())
+	}
+
+	//the 2s lifetime is renewed after a second
+	time.Sleep(1500 * time.Millisecond)
+	if requests, mapped := g.state(internal); requests < 2 || !mapped {
+		t.Errorf("expected the mapping to be renewed got %d requests", requests)
+	}
+
+	l.Close()
+	if _, mapped := g.state(internal); mapped {
+		t.Error("expected the mapping to be deleted on Close")
+	}
+}
+
+func TestPortMapperFallback(t *testing.T) {
+	//nothing answers on the gateway address
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	p := New(&NATPMP{Gateway: c.LocalAddr().String()})
+	p.Timeout = 300 * time.Millisecond
+	l, err := p.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, ok := l.(*net.TCPListener); !ok {
+		t.Errorf("expected an unmapped listener got %T", l)
+	}
+}
+
+//fakeMapper records the requests of a PortMapper, failures makes the next requests fail
+type fakeMapper struct {
+	mu         sync.Mutex
+	ops        []string
+	failures   int
+	externalIP net.IP
+	lifetime   time.Duration
+	onDelete   func(internal int)
+}
+
+func (f *fakeMapper) AddMapping(ctx context.Context, protocol string, internalPort, _ int, lifetime time.Duration) (*Mapping, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		f.ops = append(f.ops, "fail")
+		return nil, errors.New("gateway unreachable")
+	}
+	f.ops = append(f.ops, "add")
+	return &Mapping{Protocol: protocol, InternalPort: internalPort, ExternalPort: externalPort(internalPort), ExternalIP: f.externalIP, Lifetime: f.lifetime}, nil
+}
+
+func (f *fakeMapper) DeleteMapping(ctx context.Context, protocol string, internalPort int) error {
+	if f.onDelete != nil {
+		f.onDelete(internalPort)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops = append(f.ops, "delete")
+	return nil
+}
+
+func (f *fakeMapper) set(failures int, ip net.IP) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = failures
+	f.externalIP = ip
+}
+
+func (f *fakeMapper) history() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.ops...)
+}
+
+func newFakePortMapper(f *fakeMapper) *PortMapper {
+	p := New(f)
+	p.Lifetime = f.lifetime
+	p.MinBackoff = 10 * time.Millisecond
+	p.MaxBackoff = 40 * time.Millisecond
+	return p
+}
+
+func TestPortMapperRenewal(t *testing.T) {
+	f := &fakeMapper{externalIP: externalIP, lifetime: 100 * time.Millisecond}
+	p := newFakePortMapper(f)
+
+	errs := make(chan error, 10)
+	p.OnError = func(local net.Addr, err error) {
+		errs <- err
+	}
+	changes := make(chan *Mapping, 1)
+	p.OnChange = func(local net.Addr, m *Mapping) {
+		changes <- m
+	}
+
+	l, err := p.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	//the gateway reboots with a new external address, the renewals fail until it's back
+	newIP := net.IPv4(203, 0, 113, 2).To4()
+	f.set(3, newIP)
+
+	select {
+	case m := <-changes:
+		if !m.ExternalIP.Equal(newIP) {
+			t.Errorf("expected external address %v got %v", newIP, m.ExternalIP)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mapping wasn't re-established")
+	}
+
+	if len(errs) != 3 {
+		t.Errorf("expected 3 failed renewals got %d", len(errs))
+	}
+
+	_, port, _ := net.SplitHostPort(l.(*mappedListener).Listener.Addr().String())
+	internal, _ := strconv.Atoi(port)
+	expected := net.JoinHostPort(newIP.String(), strconv.Itoa(externalPort(internal)))
+	if l.Addr().String() != expected {
+		t.Errorf("expected %s got %s", expected, l.Addr())
+	}
+}
+
+func TestPortMapperTeardown(t *testing.T) {
+	f := &fakeMapper{externalIP: externalIP, lifetime: 20 * time.Millisecond}
+	p := newFakePortMapper(f)
+
+	l, err := p.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := l.(*mappedListener).Listener.Addr().String()
+
+	var listening bool
+	f.onDelete = func(internal int) {
+		if c, err := net.Dial("tcp", local); err == nil {
+			listening = true
+			c.Close()
+		}
+	}
+
+	//let a few renewals race with the teardown
+	time.Sleep(50 * time.Millisecond)
+	l.Close()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if listening {
+		t.Error("expected the listener to be closed before the mapping is deleted")
+	}
+
+	ops := f.history()
+	if len(ops) < 2 || ops[len(ops)-1] != "delete" {
+		t.Fatalf("expected the mapping to be deleted last got %v", ops)
+	}
+	for _, op := range ops[:len(ops)-1] {
+		if op == "delete" {
+			t.Fatalf("expected a single delete got %v", ops)
+		}
+	}
+}
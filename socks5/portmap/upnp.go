@@ -0,0 +1,108 @@
+package portmap
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	upnp "github.com/NebulousLabs/go-upnp"
+	igd "github.com/abdullah2993/go-fwdlistener"
+)
+
+//UPnP maps ports on a UPnP internet gateway device using go-fwdlistener. The gateway maps the
+//same external port for both tcp and udp without a lease, renewing the mapping forwards the
+//port again if the gateway lost it e.g. after a reboot
+type UPnP struct{}
+
+var _ Mapper = (*UPnP)(nil)
+
+//AddMapping maps internalPort to the same external port, externalPort is ignored
+func (u *UPnP) AddMapping(ctx context.Context, protocol string, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	type result struct {
+		addr net.Addr
+		err  error
+	}
+	//go-fwdlistener discovers the gateway without a context
+	done := make(chan result, 1)
+	go func() {
+		addr, err := forward(protocol, internalPort)
+		done <- result{addr, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	host, port, err := net.SplitHostPort(r.addr.String())
+	if err != nil {
+		return nil, err
+	}
+	external, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{Protocol: protocol, InternalPort: internalPort, ExternalPort: external, ExternalIP: net.ParseIP(host), Lifetime: lifetime}, nil
+}
+
+//DeleteMapping removes the mapping of internalPort. go-fwdlistener only removes a mapping when its
+//listener is closed which recurses without end, the gateway is asked directly instead
+func (u *UPnP) DeleteMapping(ctx context.Context, protocol string, internalPort int) error {
+	d, err := upnp.DiscoverCtx(ctx)
+	if err != nil {
+		return err
+	}
+	return d.Clear(uint16(internalPort))
+}
+
+//forward forwards port with go-fwdlistener and returns the external address, as it forwards the
+//port of a listener it's handed a placeholder with the port as its address
+func forward(protocol string, port int) (net.Addr, error) {
+	if protocol == "udp" {
+		c, err := igd.FwdPacketListener(&portPacketConn{addr: &net.UDPAddr{Port: port}})
+		if err != nil {
+			return nil, err
+		}
+		return c.LocalAddr(), nil
+	}
+
+	l, err := igd.FwdListener(&portListener{addr: &net.TCPAddr{Port: port}})
+	if err != nil {
+		return nil, err
+	}
+	return l.Addr(), nil
+}
+
+//portListener is a placeholder net.Listener only reporting its address
+type portListener struct {
+	net.Listener
+	addr net.Addr
+}
+
+func (l *portListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *portListener) Close() error {
+	return nil
+}
+
+//portPacketConn is a placeholder net.PacketConn only reporting its address
+type portPacketConn struct {
+	net.PacketConn
+	addr net.Addr
+}
+
+func (c *portPacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *portPacketConn) Close() error {
+	return nil
+}
@@ -0,0 +1,255 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ProxyProtocolMode defines whether a PROXY protocol header is expected on inbound connections
+type ProxyProtocolMode int
+
+const (
+	//ProxyProtocolOptional accepts connections with or without a PROXY protocol header
+	ProxyProtocolOptional ProxyProtocolMode = iota
+	//ProxyProtocolRequired closes connections without a PROXY protocol header
+	ProxyProtocolRequired
+	//ProxyProtocolRejected closes connections with a PROXY protocol header
+	ProxyProtocolRejected
+)
+
+//ProxyProtocolPolicy controls how the PROXY protocol header is handled
+type ProxyProtocolPolicy struct {
+	//Mode defines whether the header is required, optional or rejected
+	Mode ProxyProtocolMode
+
+	//Allowed are the networks of the load balancers that are allowed to send the header,
+	//if empty any source is allowed to send it
+	Allowed []*net.IPNet
+
+	//HeaderTimeout bounds reading the header, or the first byte of the greeting if there's
+	//none, the connection is closed once it's over. DefaultProxyHeaderTimeout if 0
+	HeaderTimeout time.Duration
+}
+
+//DefaultProxyHeaderTimeout is how long the PROXY protocol header is waited for unless the
+//HeaderTimeout of the policy is set
+const DefaultProxyHeaderTimeout = 10 * time.Second
+
+//ErrInvalidProxyHeader is returned if the PROXY protocol header is malformed
+var ErrInvalidProxyHeader = errors.New("socks5: invalid proxy protocol header")
+
+//ErrProxyHeaderRequired is returned if the PROXY protocol header is required but missing
+var ErrProxyHeaderRequired = errors.New("socks5: proxy protocol header required")
+
+//ErrProxyHeaderNotAllowed is returned if the PROXY protocol header is sent by a source that isn't allowed to
+var ErrProxyHeaderNotAllowed = errors.New("socks5: proxy protocol header not allowed")
+
+const (
+	//v1 header is at most 107 bytes including the CRLF
+	proxyV1MaxLen = 107
+	proxyV2HdrLen = 16
+)
+
+var (
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+//proxyConn is a net.Conn with the remote address advertised in the PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+var _ net.Conn = (*proxyConn)(nil)
+
+func (p *proxyConn) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+func (p *proxyConn) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+//readProxyHeader reads the optional PROXY protocol header from c according to the policy
+//and returns a net.Conn reporting the advertised client address as its RemoteAddr
+func readProxyHeader(c net.Conn, policy *ProxyProtocolPolicy) (net.Conn, error) {
+	r := bufio.NewReaderSize(c, 256)
+	pc := &proxyConn{Conn: c, r: r, remote: c.RemoteAddr()}
+
+	timeout := policy.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	//SOCKS5 greeting starts with 0x05 so a single byte tells whether a header is present
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	present := b[0] == proxyV1Sig[0] || b[0] == proxyV2Sig[0]
+	switch {
+	case !present && policy.Mode == ProxyProtocolRequired:
+		return nil, ErrProxyHeaderRequired
+	case !present:
+		return pc, c.SetReadDeadline(time.Time{})
+	case policy.Mode == ProxyProtocolRejected || !policy.allowed(c.RemoteAddr()):
+		return nil, ErrProxyHeaderNotAllowed
+	}
+
+	var addr net.Addr
+	if b[0] == proxyV1Sig[0] {
+		addr, err = readProxyV1(r)
+	} else {
+		addr, err = readProxyV2(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addr != nil {
+		pc.remote = addr
+	}
+	return pc, c.SetReadDeadline(time.Time{})
+}
+
+func (p *ProxyProtocolPolicy) allowed(addr net.Addr) bool {
+	if len(p.Allowed) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range p.Allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//readProxyV1 parses the human readable header e.g. "PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n",
+//a nil addr is returned for UNKNOWN connections
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	tcp4 := fields[1] == "TCP4"
+	ip := net.ParseIP(fields[2])
+	if !proxyV1Family(ip, fields[2], tcp4) || !proxyV1Family(net.ParseIP(fields[3]), fields[3], tcp4) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//proxyV1Family reports whether the address field parsed as ip is of the family of the header,
+//dotted IPv4 for TCP4 and IPv6 for TCP6 where an IPv4-mapped address is IPv6 as written
+func proxyV1Family(ip net.IP, field string, tcp4 bool) bool {
+	if ip == nil {
+		return false
+	}
+	if tcp4 {
+		return ip.To4() != nil && !strings.Contains(field, ":")
+	}
+	return strings.Contains(field, ":")
+}
+
+//readProxyV2 parses the binary header, a nil addr is returned for LOCAL connections
+//and address families other than TCP over IPv4/IPv6
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, proxyV2HdrLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	if !bytes.Equal(hdr[:12], proxyV2Sig) || hdr[12]>>4 != 0x02 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	cmd := hdr[12] & 0x0F
+	if cmd > 0x01 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	length := int64(binary.BigEndian.Uint16(hdr[14:16]))
+
+	addrLen := 0
+	switch hdr[13] {
+	case 0x11: //TCP over IPv4
+		addrLen = 2*net.IPv4len + 4
+	case 0x21: //TCP over IPv6
+		addrLen = 2*net.IPv6len + 4
+	}
+
+	if cmd == 0x00 || addrLen == 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, length); err != nil {
+			return nil, ErrInvalidProxyHeader
+		}
+		return nil, nil
+	}
+
+	if length < int64(addrLen) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	b := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	//skip the TLVs
+	if _, err := io.CopyN(ioutil.Discard, r, length-int64(addrLen)); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ipLen := (addrLen - 4) / 2
+	ip := make(net.IP, ipLen)
+	copy(ip, b[:ipLen])
+	port := binary.BigEndian.Uint16(b[2*ipLen:])
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
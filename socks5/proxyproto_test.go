@@ -0,0 +1,157 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var greeting = []byte{socksVer5, 1, byte(noAuth)}
+
+func proxyV2Header(cmd, fam byte, addr []byte) []byte {
+	b := append([]byte{}, proxyV2Sig...)
+	b = append(b, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addr)))
+	return append(b, addr...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2IPv4 := proxyV2Header(0x01, 0x11, []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x04, 0x38})
+	v2IPv6 := proxyV2Header(0x01, 0x21, append(append(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1")...), 0x30, 0x39, 0x04, 0x38))
+	v2TLV := proxyV2Header(0x01, 0x11, []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x04, 0x38, 0x04, 0x00, 0x01, 0xFF})
+
+	tts := []struct {
+		name   string
+		mode   ProxyProtocolMode
+		header []byte
+		remote string
+		err    error
+	}{
+		{"v1 ipv4", ProxyProtocolOptional, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 1080\r\n"), "203.0.113.7:12345", nil},
+		{"v1 ipv6", ProxyProtocolRequired, []byte("PROXY TCP6 2001:db8::7 2001:db8::1 12345 1080\r\n"), "[2001:db8::7]:12345", nil},
+		{"v1 unknown", ProxyProtocolRequired, []byte("PROXY UNKNOWN\r\n"), "pipe", nil},
+		{"v2 ipv4", ProxyProtocolRequired, v2IPv4, "203.0.113.7:12345", nil},
+		{"v2 ipv6", ProxyProtocolOptional, v2IPv6, "[2001:db8::7]:12345", nil},
+		{"v2 tlv", ProxyProtocolOptional, v2TLV, "203.0.113.7:12345", nil},
+		{"v2 local", ProxyProtocolRequired, proxyV2Header(0x00, 0x00, nil), "pipe", nil},
+		{"no header", ProxyProtocolOptional, nil, "pipe", nil},
+		{"missing header", ProxyProtocolRequired, nil, "", ErrProxyHeaderRequired},
+		{"rejected header", ProxyProtocolRejected, v2IPv4, "", ErrProxyHeaderNotAllowed},
+		{"v1 family mismatch", ProxyProtocolOptional, []byte("PROXY TCP4 2001:db8::7 10.0.0.1 12345 1080\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 destination family mismatch", ProxyProtocolOptional, []byte("PROXY TCP4 203.0.113.7 2001:db8::1 12345 1080\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 tcp6 with ipv4", ProxyProtocolOptional, []byte("PROXY TCP6 203.0.113.7 10.0.0.1 12345 1080\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 tcp6 destination ipv4", ProxyProtocolOptional, []byte("PROXY TCP6 2001:db8::7 10.0.0.1 12345 1080\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 bad port", ProxyProtocolOptional, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 123456 1080\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 missing fields", ProxyProtocolOptional, []byte("PROXY TCP4 203.0.113.7\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 no crlf", ProxyProtocolOptional, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 1080\n"), "", ErrInvalidProxyHeader},
+		{"v2 bad version", ProxyProtocolOptional, append(append([]byte{}, proxyV2Sig...), 0x11, 0x11, 0, 0), "", ErrInvalidProxyHeader},
+		{"v2 short address", ProxyProtocolOptional, proxyV2Header(0x01, 0x11, []byte{203, 0, 113, 7}), "", ErrInvalidProxyHeader},
+	}
+
+	for _, tt := range tts {
+		c, p := net.Pipe()
+		go func(b []byte) {
+			p.Write(append(b, greeting...))
+		}(tt.header)
+
+		pc, err := readProxyHeader(c, &ProxyProtocolPolicy{Mode: tt.mode})
+		if err != tt.err {
+			t.Errorf("%s: expected error %v got %v", tt.name, tt.err, err)
+		}
+		if err == nil {
+			if pc.RemoteAddr().String() != tt.remote {
+				t.Errorf("%s: expected remote %s got %s", tt.name, tt.remote, pc.RemoteAddr())
+			}
+			b := make([]byte, len(greeting))
+			if _, err := io.ReadFull(pc, b); err != nil || !bytes.Equal(b, greeting) {
+				t.Errorf("%s: greeting not preserved %v %v", tt.name, b, err)
+			}
+		}
+		c.Close()
+		p.Close()
+	}
+}
+
+func TestReadProxyHeaderTimeout(t *testing.T) {
+	//the peer sends nothing, or only part of a header
+	for _, b := range [][]byte{nil, []byte("PROXY TCP4 203.0.113.7")} {
+		c, p := net.Pipe()
+		go p.Write(b)
+		start := time.Now()
+		_, err := readProxyHeader(c, &ProxyProtocolPolicy{HeaderTimeout: 50 * time.Millisecond})
+		if err == nil || time.Since(start) > 5*time.Second {
+			t.Errorf("%q: expected the header read to time out got %v", b, err)
+		}
+		c.Close()
+		p.Close()
+	}
+
+	//the deadline is cleared once the header is read
+	c, p := net.Pipe()
+	defer c.Close()
+	defer p.Close()
+	go p.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 1080\r\n"))
+	pc, err := readProxyHeader(c, &ProxyProtocolPolicy{HeaderTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		p.Write(greeting)
+	}()
+	if _, err := io.ReadFull(pc, make([]byte, len(greeting))); err != nil {
+		t.Errorf("expected the greeting read after the header timeout got %v", err)
+	}
+}
+
+func TestProxyProtocolAllowed(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	p := &ProxyProtocolPolicy{Allowed: []*net.IPNet{lb}}
+
+	if !p.allowed(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}) {
+		t.Error("expected load balancer to be allowed")
+	}
+	if p.allowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}) {
+		t.Error("expected other source to be disallowed")
+	}
+}
+
+func TestConnectWithProxyProtocol(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	WithProxyProtocol(ProxyProtocolPolicy{Mode: ProxyProtocolRequired})(s)
+	go s.Serve(l)
+	defer s.Close()
+
+	headers := [][]byte{
+		[]byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 1080\r\n"),
+		proxyV2Header(0x01, 0x11, []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x04, 0x38}),
+	}
+	for _, h := range headers {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write(h); err != nil {
+			t.Fatal(err)
+		}
+		if err := rawConnect(c, echo.Addr().(*net.TCPAddr)); err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte(testString))
+		b := make([]byte, len(testString))
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != testString {
+			t.Errorf("expected %q got %q: %v", testString, b, err)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,20 @@
+module github.com/abdullah2993/socks5-server/socks5/quic
+
+go 1.23
+
+require (
+	github.com/abdullah2993/socks5-server v0.0.0
+	github.com/quic-go/quic-go v0.54.0
+)
+
+require (
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
+
+replace github.com/abdullah2993/socks5-server => ../../
@@ -0,0 +1,149 @@
+//Package quic serves SOCKS5 over QUIC, every bidirectional stream of a QUIC connection
+//carries a single SOCKS5 session. It lives in its own module to keep the quic-go
+//dependency out of the socks5 package.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+	"github.com/quic-go/quic-go"
+)
+
+//NextProto is the ALPN protocol negotiated by SOCKS5 over QUIC clients and servers
+const NextProto = "socks5"
+
+//ErrNoTLSConfig is returned by ListenAndServeQUIC when it is called without a tls config
+var ErrNoTLSConfig = errors.New("quic: ListenAndServeQUIC needs a tls config")
+
+//ListenAndServeQUIC listens on the UDP address addr and serves every stream of the accepted
+//QUIC connections with s, it returns socks5.ErrServerClosed once s is closed
+func ListenAndServeQUIC(addr string, tlsConf *tls.Config, s *socks5.Server) error {
+	if tlsConf == nil {
+		return ErrNoTLSConfig
+	}
+	tlsConf = tlsConf.Clone()
+	if len(tlsConf.NextProtos) == 0 {
+		tlsConf.NextProtos = []string{NextProto}
+	}
+
+	l, err := quic.ListenAddrEarly(addr, tlsConf, &quic.Config{
+		Allow0RTT:       true,
+		KeepAlivePeriod: s.KeepAlive,
+	})
+	if err != nil {
+		return err
+	}
+	return Serve(l, s)
+}
+
+//Listener is implemented by *quic.Listener and *quic.EarlyListener
+type Listener interface {
+	Accept(ctx context.Context) (*quic.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+//Serve accepts QUIC connections from l and serves their streams with s, l is closed when
+//s is closed or on return
+func Serve(l Listener, s *socks5.Server) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var once sync.Once
+	sv := &serving{
+		cancel: cancel,
+		close:  func() { once.Do(func() { l.Close() }) },
+	}
+	defer sv.close()
+
+	track(s, sv)
+	defer untrack(s, sv)
+
+	for {
+		conn, err := l.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return socks5.ErrServerClosed
+			}
+			return err
+		}
+		go serveStreams(conn, s)
+	}
+}
+
+//serving is a Serve call in progress
+type serving struct {
+	cancel context.CancelFunc
+	close  func()
+}
+
+//servers holds the Serve calls in progress of every server, a single shutdown hook is
+//registered per server the first time it is served and stops all of its Serve calls
+var (
+	serversMu sync.Mutex
+	servers   = make(map[*socks5.Server]map[*serving]struct{})
+)
+
+func track(s *socks5.Server, sv *serving) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	set, ok := servers[s]
+	if !ok {
+		set = make(map[*serving]struct{})
+		servers[s] = set
+		s.RegisterOnShutdown(func() { shutdown(s) })
+	}
+	set[sv] = struct{}{}
+}
+
+func untrack(s *socks5.Server, sv *serving) {
+	serversMu.Lock()
+	delete(servers[s], sv)
+	serversMu.Unlock()
+}
+
+func shutdown(s *socks5.Server) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	for sv := range servers[s] {
+		sv.cancel()
+		sv.close()
+	}
+}
+
+func serveStreams(conn *quic.Conn, s *socks5.Server) {
+	for {
+		st, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			return
+		}
+		go s.ServeConn(&streamConn{Stream: st, conn: conn})
+	}
+}
+
+//streamConn adapts a QUIC stream to a net.Conn, the addresses are the ones of the QUIC connection
+type streamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+var _ net.Conn = (*streamConn)(nil)
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+//Close closes both directions of the stream, closing a quic.Stream only closes the write direction
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
@@ -0,0 +1,201 @@
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+	"github.com/quic-go/quic-go"
+)
+
+const testString = "Hello World"
+
+func TestServeQUIC(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	tlsConf := selfSignedConfig(t)
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", tlsConf, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(socks5.Server)
+	done := make(chan error, 1)
+	go func() { done <- Serve(l, s) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{NextProto}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	//every stream is an independent session over the same connection
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			st, err := conn.OpenStreamSync(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer st.Close()
+			errs <- connectAndEcho(st, echo.Addr().(*net.TCPAddr))
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.Close()
+	select {
+	case err := <-done:
+		if err != socks5.ErrServerClosed {
+			t.Errorf("expected %v got %v", socks5.ErrServerClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after Close")
+	}
+}
+
+func TestListenAndServeQUICNoTLSConfig(t *testing.T) {
+	if err := ListenAndServeQUIC("127.0.0.1:0", nil, new(socks5.Server)); err != ErrNoTLSConfig {
+		t.Errorf("expected %v got %v", ErrNoTLSConfig, err)
+	}
+}
+
+func TestServeUntracks(t *testing.T) {
+	s := new(socks5.Server)
+	tlsConf := selfSignedConfig(t)
+	listen := func() *quic.EarlyListener {
+		l, err := quic.ListenAddrEarly("127.0.0.1:0", tlsConf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	for i := 0; i < 2; i++ {
+		l := listen()
+		done := make(chan error, 1)
+		go func() { done <- Serve(l, s) }()
+		time.Sleep(50 * time.Millisecond)
+		l.Close()
+		select {
+		case err := <-done:
+			if err == socks5.ErrServerClosed {
+				t.Errorf("expected a listener error got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve didn't return after its listener was closed")
+		}
+	}
+
+	serversMu.Lock()
+	n := len(servers[s])
+	serversMu.Unlock()
+	if n != 0 {
+		t.Errorf("expected the returned Serve calls to be untracked got %d", n)
+	}
+
+	l := listen()
+	done := make(chan error, 1)
+	go func() { done <- Serve(l, s) }()
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-done:
+		if err != socks5.ErrServerClosed {
+			t.Errorf("expected %v got %v", socks5.ErrServerClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after Close")
+	}
+}
+
+func connectAndEcho(rw io.ReadWriter, addr *net.TCPAddr) error {
+	if _, err := rw.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(rw, b[:2]); err != nil {
+		return err
+	}
+
+	req := append([]byte{5, 1, 0, 1}, addr.IP.To4()...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[8:], uint16(addr.Port))
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, b); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	if _, err := rw.Write([]byte(testString)); err != nil {
+		return err
+	}
+	res := make([]byte, len(testString))
+	if _, err := io.ReadFull(rw, res); err != nil {
+		return err
+	}
+	if string(res) != testString {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func selfSignedConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{NextProto},
+	}
+}
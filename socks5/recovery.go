@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"net"
+	"time"
+)
+
+//maxRecoveryBackoff caps the delay between the attempts to listen again
+const maxRecoveryBackoff = time.Minute
+
+//listenerRecovery replaces the listeners failing with a non temporary error
+type listenerRecovery struct {
+	maxRetries int
+	backoff    time.Duration
+	//listen listens again on the address of a failed listener
+	listen func(old net.Listener) (net.Listener, error)
+}
+
+//WithListenerRecovery makes Serve listen again on the address of a listener whose Accept fails
+//with an error that isn't temporary instead of returning it, e.g. once the interface is back.
+//The attempts start after backoff and the delay doubles after each failure up to a minute,
+//Serve gives up after maxRetries failed attempts in a row. The sessions of the old listener
+//keep running and Close and Shutdown stop the attempts. Privileged ports can't be bound again
+//once the privileges are dropped
+func WithListenerRecovery(maxRetries int, backoff time.Duration) Option {
+	return func(s *Server) {
+		s.recovery = &listenerRecovery{maxRetries: maxRetries, backoff: backoff, listen: s.relisten}
+	}
+}
+
+//relisten listens on the address of old the way ListenAll did
+func (s *Server) relisten(old net.Listener) (net.Listener, error) {
+	addr := old.Addr()
+	if addr.Network() == "unix" {
+		return s.listen(UnixScheme + addr.String())
+	}
+	return s.listen(addr.String())
+}
+
+//recover replaces l which failed with err, err is returned once the attempts are exhausted and
+//ErrServerClosed if the server is closed meanwhile
+func (r *listenerRecovery) recover(s *Server, l net.Listener, err error) (net.Listener, error) {
+	backoff := r.backoff
+	for attempt := 1; attempt <= r.maxRetries; attempt++ {
+		s.logf(LevelError, "listener %s failed: %v, listening again in %v (%d/%d)", l.Addr(), err, backoff, attempt, r.maxRetries)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-s.getDoneChan():
+			t.Stop()
+			return nil, ErrServerClosed
+		}
+		if s.Draining() {
+			return nil, ErrServerClosed
+		}
+
+		nl, lerr := r.listen(l)
+		if lerr == nil {
+			if !s.replaceListener(l, nl) {
+				nl.Close()
+				return nil, ErrServerClosed
+			}
+			s.logf(LevelInfo, "listening again on %s", nl.Addr())
+			return nl, nil
+		}
+		err = lerr
+		if backoff *= 2; backoff > maxRecoveryBackoff {
+			backoff = maxRecoveryBackoff
+		}
+	}
+	return nil, err
+}
+
+//replaceListener replaces old with l in the listeners unless the server is closed or draining,
+//old stays tracked until then so the server isn't considered stopped meanwhile
+func (s *Server) replaceListener(old, l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.getDoneChanLocked():
+		return false
+	default:
+	}
+	if s.Draining() {
+		return false
+	}
+	for i, sl := range s.listeners {
+		if sl == old {
+			s.listeners[i] = l
+			return true
+		}
+	}
+	return false
+}
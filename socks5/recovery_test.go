@@ -0,0 +1,160 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//failingListener fails with err once after accepting n connections
+type failingListener struct {
+	net.Listener
+	n      int32
+	err    error
+	failed int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.n, -1) < 0 && atomic.CompareAndSwapInt32(&l.failed, 0, 1) {
+		return nil, l.err
+	}
+	return l.Listener.Accept()
+}
+
+func TestListenerRecovery(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan struct{})
+	s := &Server{Cmds: []Command{CommandConnect}}
+	WithListenerRecovery(3, 10*time.Millisecond)(s)
+	var attempts int32
+	s.recovery.listen = func(old net.Listener) (net.Listener, error) {
+		//the first attempt fails as the interface is still down
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return nil, errors.New("bind: cannot assign requested address")
+		}
+		<-accepted
+		return replacement, nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(&failingListener{Listener: l, n: 1, err: errors.New("accept: invalid argument")})
+	}()
+	defer s.Close()
+
+	//a session established before the failure keeps running
+	c, err := NewClient(l.Addr().String()).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	close(accepted)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ListenAddr() == nil || s.ListenAddr().String() != replacement.Addr().String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the listener to be replaced after %d attempts", atomic.LoadInt32(&attempts))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("expected 2 attempts got %d", n)
+	}
+
+	for _, c := range []net.Conn{c, dialEcho(t, replacement.Addr().String(), echo.Addr().String())} {
+		c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+			t.Errorf("expected ping got %q %v", b, err)
+		}
+	}
+
+	s.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed got %v", err)
+	}
+}
+
+func dialEcho(t *testing.T, proxy, echo string) net.Conn {
+	c, err := NewClient(proxy).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestListenerRecoveryGivesUp(t *testing.T) {
+	tts := []struct {
+		name    string
+		retries int
+		backoff time.Duration
+		close   bool
+		err     string
+	}{
+		{"exhausted", 2, time.Millisecond, false, "bind: address in use"},
+		{"closed", 3, time.Hour, true, ErrServerClosed.Error()},
+		{"disabled", 0, time.Millisecond, false, "accept: invalid argument"},
+	}
+	for _, tt := range tts {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{Cmds: []Command{CommandConnect}}
+		WithListenerRecovery(tt.retries, tt.backoff)(s)
+		s.recovery.listen = func(old net.Listener) (net.Listener, error) {
+			return nil, errors.New("bind: address in use")
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Serve(&failingListener{Listener: l, err: errors.New("accept: invalid argument")})
+		}()
+		if tt.close {
+			<-s.Ready()
+			time.Sleep(10 * time.Millisecond)
+			s.Close()
+		}
+		select {
+		case err := <-done:
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: expected %q got %v", tt.name, tt.err, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: expected Serve to return", tt.name)
+		}
+		if s.ListenAddr() != nil {
+			t.Errorf("%s: expected no listener left", tt.name)
+		}
+		s.Close()
+	}
+}
+
+func TestRelisten(t *testing.T) {
+	s := &Server{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	nl, err := s.relisten(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nl.Close()
+	if nl.Addr().String() != l.Addr().String() {
+		t.Errorf("expected %s got %s", l.Addr(), nl.Addr())
+	}
+}
@@ -0,0 +1,145 @@
+package socks5
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+//Redaction is how a value is redacted before it's logged or recorded
+type Redaction int
+
+const (
+	//RedactNone keeps the value as is
+	RedactNone Redaction = iota
+
+	//RedactDrop leaves the value out
+	RedactDrop
+
+	//RedactPrefix keeps the registrable domain (eTLD+1) of domain names, the /24 of IPv4
+	//addresses and the /48 of IPv6 addresses
+	RedactPrefix
+
+	//RedactHash replaces the value with its HMAC-SHA256 under the Key of the policy, equal
+	//values can be correlated without being disclosed
+	RedactHash
+)
+
+//RedactionPolicy is how client addresses and destinations are redacted, the values are
+//redacted where they're produced so the raw ones never reach logs or records
+type RedactionPolicy struct {
+	//Client is the redaction of client addresses, the port is left out unless it's RedactNone
+	Client Redaction
+
+	//Destination is the redaction of requested destinations and the IPs they resolved to, the
+	//port is kept unless it's RedactDrop
+	Destination Redaction
+
+	//Key is the key of RedactHash
+	Key []byte
+}
+
+//client returns the address of a client as it may be logged, p may be nil
+func (p *RedactionPolicy) client(addr net.Addr) string {
+	if p == nil || p.Client == RedactNone {
+		return addr.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return p.redact(host, p.Client)
+}
+
+//destination returns a requested destination as it may be logged, p may be nil
+func (p *RedactionPolicy) destination(a *AddrSpec) string {
+	if a == nil {
+		return ""
+	}
+	if p == nil || p.Destination == RedactNone {
+		return a.String()
+	}
+	if p.Destination == RedactDrop {
+		return ""
+	}
+	host := a.Host
+	if a.Type != AddrTypeDomain {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(p.redact(host, p.Destination), strconv.Itoa(int(a.Port)))
+}
+
+//destinationHost returns the host of a destination as it may be aggregated, it's empty if
+//destinations are dropped. p may be nil
+func (p *RedactionPolicy) destinationHost(a *AddrSpec) string {
+	if p == nil {
+		return destHost(a)
+	}
+	return p.redact(destHost(a), p.Destination)
+}
+
+//resolved returns the IP a destination resolved to as it may be logged, p may be nil
+func (p *RedactionPolicy) resolved(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if p == nil {
+		return ip.String()
+	}
+	return p.redact(ip.String(), p.Destination)
+}
+
+//error returns the text of err as it may be logged, the addresses errors of the net package
+//carry are left out if anything is redacted. p may be nil
+func (p *RedactionPolicy) error(err error) string {
+	if p == nil || (p.Client == RedactNone && p.Destination == RedactNone) {
+		return err.Error()
+	}
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+			continue
+		case *net.DNSError:
+			return e.Err
+		case *net.AddrError:
+			return e.Err
+		}
+		return err.Error()
+	}
+}
+
+func (p *RedactionPolicy) redact(host string, r Redaction) string {
+	switch r {
+	case RedactDrop:
+		return ""
+	case RedactPrefix:
+		if ip := net.ParseIP(host); ip != nil {
+			return ipPrefix(ip)
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+			return domain
+		}
+		//the domain is a public suffix or a single label like localhost
+		return host
+	case RedactHash:
+		mac := hmac.New(sha256.New, p.Key)
+		mac.Write([]byte(host))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	return host
+}
+
+//ipPrefix returns the /24 of IPv4 addresses and the /48 of IPv6 addresses
+func ipPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
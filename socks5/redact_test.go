@@ -0,0 +1,161 @@
+package socks5
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func hmacHex(key, value string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestRedactionAccessLog(t *testing.T) {
+	//the destination is never dialed, the request is answered right away
+	answer := func(ctx context.Context, conn net.Conn, req *Request) error {
+		return req.Success(nil)
+	}
+
+	tts := []struct {
+		name        string
+		policy      *RedactionPolicy
+		dst         string
+		client      string
+		destination string
+	}{
+		{"none", nil, "www.example.co.uk:443", "", "www.example.co.uk:443"},
+		{"drop", &RedactionPolicy{Client: RedactDrop, Destination: RedactDrop}, "www.example.co.uk:443", "", ""},
+		{"prefix domain", &RedactionPolicy{Client: RedactPrefix, Destination: RedactPrefix}, "www.Example.co.uk:443", "127.0.0.0", "example.co.uk:443"},
+		{"prefix ipv4", &RedactionPolicy{Destination: RedactPrefix}, "192.0.2.77:80", "", "192.0.2.0:80"},
+		{"prefix ipv6", &RedactionPolicy{Destination: RedactPrefix}, "[2001:db8:aaaa:bbbb::1]:80", "", "[2001:db8:aaaa::]:80"},
+		{"hash", &RedactionPolicy{Client: RedactHash, Destination: RedactHash, Key: []byte("key")}, "www.example.co.uk:443",
+			hmacHex("key", "127.0.0.1"), net.JoinHostPort(hmacHex("key", "www.example.co.uk"), "443")},
+	}
+
+	for _, tt := range tts {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := make(lineWriter, 1)
+			opts := []Option{WithAccessLog(lines, JSONLines), WithCommandHandler(CommandConnect, answer)}
+			if tt.policy != nil {
+				opts = append(opts, WithRedaction(*tt.policy))
+			}
+			s, proxy := newTestServer(t, opts...)
+			defer s.Close()
+
+			c, err := NewClient(proxy).Dial("tcp", tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := c.(interface{ LocalAddr() net.Addr }).LocalAddr().String()
+			c.Close()
+
+			var record map[string]interface{}
+			if err := json.Unmarshal([]byte(lines.next(t)), &record); err != nil {
+				t.Fatal(err)
+			}
+
+			expectedClient := tt.client
+			if tt.policy == nil || tt.policy.Client == RedactNone {
+				expectedClient = client
+			}
+			if got, _ := record["client"].(string); got != expectedClient {
+				t.Errorf("expected client %q got %q", expectedClient, got)
+			}
+			if got, _ := record["destination"].(string); got != tt.destination {
+				t.Errorf("expected destination %q got %q", tt.destination, got)
+			}
+		})
+	}
+}
+
+func TestRedactionPolicy(t *testing.T) {
+	p := &RedactionPolicy{Client: RedactPrefix, Destination: RedactPrefix}
+	if got := p.resolved(net.ParseIP("2001:db8:1234:5678::9")); got != "2001:db8:1234::" {
+		t.Errorf("expected the /48 of the resolved IP got %q", got)
+	}
+	if got := p.client(&net.TCPAddr{IP: net.IPv4(198, 51, 100, 23), Port: 40000}); got != "198.51.100.0" {
+		t.Errorf("expected the /24 of the client got %q", got)
+	}
+	if got := p.redact("localhost", RedactPrefix); got != "localhost" {
+		t.Errorf("expected a single label to be kept got %q", got)
+	}
+
+	//errors of the net package carry the destination
+	err := &net.OpError{Op: "dial", Net: "tcp", Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}, Err: errors.New("connect: connection refused")}
+	if got := p.error(err); got != "connect: connection refused" {
+		t.Errorf("expected the address to be left out got %q", got)
+	}
+	dnsErr := &net.DNSError{Err: "no such host", Name: "secret.example.com"}
+	if got := p.error(&net.OpError{Op: "dial", Net: "tcp", Err: dnsErr}); got != "no such host" {
+		t.Errorf("expected the name to be left out got %q", got)
+	}
+	var none *RedactionPolicy
+	if got := none.error(err); got != err.Error() {
+		t.Errorf("expected the error as is got %q", got)
+	}
+}
+
+func TestRedactionBindPeer(t *testing.T) {
+	logs := new(messageLogger)
+	s := &Server{}
+	WithLogger(logs, LevelInfo)(s)
+	WithRedaction(RedactionPolicy{Destination: RedactHash, Key: []byte("key")})(s)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	//the peer connects from 127.0.0.1 while 127.0.0.2 is expected, then the listener is closed
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		for logs.count("info: bind dropped") == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		l.Close()
+	}()
+	if _, err := s.acceptPeer(l, net.IPv4(127, 0, 0, 2)); err == nil {
+		t.Fatal("expected the peer dropped")
+	}
+	expected := "info: bind dropped connection from " + hmacHex("key", "127.0.0.1") + ", expected " + hmacHex("key", "127.0.0.2")
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	if len(logs.messages) != 1 || logs.messages[0] != expected {
+		t.Errorf("expected %q got %q", expected, logs.messages)
+	}
+}
+
+func TestRedactedPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	s := &Server{}
+	WithRedaction(RedactionPolicy{Client: RedactDrop, Destination: RedactHash, Key: []byte("key")})(s)
+	//the remote address of an outbound connection is a destination, of an inbound one a client
+	if got, expected := s.redactedPeer(c, true), net.JoinHostPort(hmacHex("key", "127.0.0.1"), port); got != expected {
+		t.Errorf("expected the destination %q got %q", expected, got)
+	}
+	if got := s.redactedPeer(c, false); got != "" {
+		t.Errorf("expected the client dropped got %q", got)
+	}
+}
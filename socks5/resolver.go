@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+//Resolver returns a resolver looking names up through the proxy with the DNS server at server,
+//a host:port or a host whose port is 53, a domain is resolved by the proxy. The queries are
+//sent over a udp association if the proxy allows one and over a connection to the server
+//through the proxy otherwise, never from the host. The context of a lookup bounds its queries
+func (c *Client) Resolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return c.resolver(server, server)
+}
+
+//resolver returns a Resolver querying the DNS server at udpServer over udp and at tcpServer
+//over TCP
+func (c *Client) resolver(udpServer, tcpServer string) *net.Resolver {
+	r := &proxyResolver{client: c, udpServer: udpServer, tcpServer: tcpServer}
+	return &net.Resolver{PreferGo: true, Dial: r.dial}
+}
+
+//proxyResolver dials the DNS server of a Resolver through the proxy
+type proxyResolver struct {
+	client               *Client
+	udpServer, tcpServer string
+	//noUDP is set once the proxy refused a udp association, the queries go over TCP then
+	noUDP int32
+}
+
+//dial ignores the nameserver the resolver asks for and dials the server of the resolver, a
+//udp association is returned for the udp queries if the proxy allows one and a TCP connection
+//otherwise, the resolver frames its queries as it does over TCP if it isn't a net.PacketConn
+func (r *proxyResolver) dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	if strings.HasPrefix(network, "udp") && atomic.LoadInt32(&r.noUDP) == 0 {
+		pc, err := r.client.ListenPacket(ctx)
+		if err == nil {
+			dst, err := ParseAddr(r.udpServer)
+			if err != nil {
+				pc.Close()
+				return nil, err
+			}
+			return &dnsPacketConn{udpAssociation: pc.(*udpAssociation), server: dst}, nil
+		}
+		if errors.Is(err, ErrCommandNotSupported) || errors.Is(err, ErrNotAllowedByRuleset) || err == ErrChainedUDP {
+			atomic.StoreInt32(&r.noUDP, 1)
+		}
+	}
+	return r.client.DialContext(ctx, "tcp", r.tcpServer)
+}
+
+//dnsPacketConn is a udp association sending what's written to the DNS server, it's read from as
+//a net.Conn by the resolver
+type dnsPacketConn struct {
+	*udpAssociation
+	server *SocksAddr
+}
+
+//Read reads the next datagram relayed back, the association is only used for the server
+func (c *dnsPacketConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *dnsPacketConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.server)
+}
+
+func (c *dnsPacketConn) RemoteAddr() net.Addr {
+	return c.server
+}
@@ -0,0 +1,219 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//dnsResponder answers the A queries for proxied.test over udp and TCP, it records the
+//transports the queries came over
+type dnsResponder struct {
+	udp *net.UDPConn
+	tcp net.Listener
+
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func newDNSResponder(t *testing.T) *dnsResponder {
+	t.Helper()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//TCP has a port of its own, the one picked for udp may be taken for TCP
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		udp.Close()
+		t.Fatal(err)
+	}
+	r := &dnsResponder{udp: udp, tcp: tcp, queries: make(map[string]int)}
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := udp.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if answer := r.answer("udp", b[:n]); answer != nil {
+				udp.WriteTo(answer, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var l [2]byte
+				for {
+					if _, err := io.ReadFull(c, l[:]); err != nil {
+						return
+					}
+					b := make([]byte, binary.BigEndian.Uint16(l[:]))
+					if _, err := io.ReadFull(c, b); err != nil {
+						return
+					}
+					answer := r.answer("tcp", b)
+					binary.BigEndian.PutUint16(l[:], uint16(len(answer)))
+					c.Write(append(l[:], answer...))
+				}
+			}()
+		}
+	}()
+	return r
+}
+
+func (r *dnsResponder) answer(transport string, query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	r.mu.Lock()
+	r.queries[transport]++
+	r.mu.Unlock()
+	q := msg.Questions[0]
+	msg.Header.Response, msg.Header.Authoritative = true, true
+	if q.Name.String() != "proxied.test." {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	} else if q.Type == dnsmessage.TypeA {
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 7}},
+		}}
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (r *dnsResponder) UDPAddr() string {
+	return r.udp.LocalAddr().String()
+}
+
+func (r *dnsResponder) TCPAddr() string {
+	return r.tcp.Addr().String()
+}
+
+func (r *dnsResponder) Queries(transport string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries[transport]
+}
+
+func (r *dnsResponder) Close() {
+	r.udp.Close()
+	r.tcp.Close()
+}
+
+func TestClientResolver(t *testing.T) {
+	dns := newDNSResponder(t)
+	defer dns.Close()
+
+	tts := []struct {
+		name      string
+		cmds      []Command
+		transport string
+	}{
+		{"udp association", []Command{CommandConnect, CommandUDPAssociation}, "udp"},
+		//the proxy refuses the association, the queries go over a connection through it
+		{"tcp fallback", []Command{CommandConnect}, "tcp"},
+	}
+	for _, tt := range tts {
+		dialer, proxyDialed := recordingDialer()
+		s, proxy := newTestServer(t, WithCommands(tt.cmds...), WithDialer(dialer))
+		clientDialer, clientDialed := recordingDialer()
+		r := NewClient(proxy, WithClientDialer(clientDialer)).resolver(dns.UDPAddr(), dns.TCPAddr())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addrs, err := r.LookupHost(ctx, "proxied.test")
+		cancel()
+		if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.7" {
+			t.Errorf("%s: expected 192.0.2.7 got %v %v", tt.name, addrs, err)
+		}
+		udp, tcp := dns.Queries("udp"), dns.Queries("tcp")
+		if tt.transport == "udp" && (udp == 0 || tcp != 0) || tt.transport == "tcp" && (tcp == 0 || udp != 0) {
+			t.Errorf("%s: expected the queries over %s got %d over udp and %d over tcp", tt.name, tt.transport, udp, tcp)
+		}
+		//the client only ever dials the proxy, the proxy dials the DNS server over TCP
+		dialed := clientDialed()
+		for _, addr := range dialed {
+			if addr != proxy {
+				t.Errorf("%s: expected the client to only dial the proxy %s got %v", tt.name, proxy, dialed)
+			}
+		}
+		if len(dialed) == 0 {
+			t.Errorf("%s: expected the client to dial the proxy", tt.name)
+		}
+		for _, addr := range proxyDialed() {
+			if addr != dns.TCPAddr() {
+				t.Errorf("%s: expected the proxy to only dial %s got %s", tt.name, dns.TCPAddr(), addr)
+			}
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		if _, err := r.LookupHost(ctx, "unknown.test"); err == nil {
+			t.Errorf("%s: expected unknown.test not to be found", tt.name)
+		}
+		cancel()
+		s.Close()
+		dns.mu.Lock()
+		dns.queries = make(map[string]int)
+		dns.mu.Unlock()
+	}
+}
+
+func TestClientListenPacket(t *testing.T) {
+	s, proxy := newTestServer(t, WithCommands(CommandUDPAssociation))
+	defer s.Close()
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], from)
+		}
+	}()
+
+	pc, err := NewClient(proxy).ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	n, from, err := pc.ReadFrom(b)
+	if err != nil || string(b[:n]) != "ping" || from.String() != echo.LocalAddr().String() {
+		t.Errorf("expected ping from %v got %q from %v %v", echo.LocalAddr(), b[:n], from, err)
+	}
+
+	c, err := Chain(proxy, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ListenPacket(context.Background()); err != ErrChainedUDP {
+		t.Errorf("expected ErrChainedUDP got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package socks5
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//ReverseOption is a ServeReverse option
+type ReverseOption func(*reverseConfig)
+
+type reverseConfig struct {
+	minBackoff, maxBackoff time.Duration
+	ping                   time.Duration
+	handler                func(c net.Conn) error
+}
+
+//WithReverseBackoff sets the bounds of the exponential backoff between reconnects
+func WithReverseBackoff(min, max time.Duration) ReverseOption {
+	return func(r *reverseConfig) {
+		r.minBackoff = min
+		r.maxBackoff = max
+	}
+}
+
+//WithReversePing probes the outbound connection every interval while it's idle so dead links
+//behind NATs are detected while waiting for a client, the connection is dropped and redialed
+//once three probes in a row are unanswered. The probes are TCP keep-alives as the
+//connection carries the session as is, they're sent on the TCP connection under the ones
+//wrapping it with a NetConn method e.g. *tls.Conn. A connection with none isn't probed, it's
+//logged. Multiplexed connections of the mux package are pinged by the multiplexer instead
+func WithReversePing(interval time.Duration) ReverseOption {
+	return func(r *reverseConfig) {
+		r.ping = interval
+	}
+}
+
+//WithReverseHandler replaces serving a single session over every outbound connection, c must
+//be closed by the handler, a nil error resets the backoff before the next connection is dialed
+//and an error is taken as a failure of the link growing it
+func WithReverseHandler(handler func(c net.Conn) error) ReverseOption {
+	return func(r *reverseConfig) {
+		r.handler = handler
+	}
+}
+
+//ServeReverse dials out using dial and serves a SOCKS5 session over the established connection,
+//it's used when the server can't accept inbound connections e.g. behind CGNAT and a publicly
+//reachable rendezvous point forwards the clients. A new connection is dialed once the session
+//is over, every redial waits for an exponential backoff with jitter. The backoff only grows when
+//dialing fails or the link drops before carrying a session, a session failing e.g. on
+//authentication resets it. The server is Accepting while ServeReverse runs, it returns when ctx
+//is done or ErrServerClosed when the server is closed
+func (s *Server) ServeReverse(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), opts ...ReverseOption) error {
+	s.checkDefaults()
+
+	cfg := reverseConfig{minBackoff: time.Second, maxBackoff: time.Minute, handler: s.serveReverseSession}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	atomic.AddInt32(&s.reverse.serving, 1)
+	defer atomic.AddInt32(&s.reverse.serving, -1)
+
+	closed := s.reverseClosed()
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := cfg.minBackoff
+	for {
+		var wait time.Duration
+		err := s.serveReverseConn(ctx, dial, &cfg)
+		wait, backoff = nextBackoff(backoff, &cfg, err)
+
+		select {
+		case <-time.After(jitter(wait)):
+		case <-ctx.Done():
+			select {
+			case <-closed:
+				return ErrServerClosed
+			default:
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+//nextBackoff returns how long to wait before redialing after a connection ended with err and the
+//backoff of the connection after it
+func nextBackoff(backoff time.Duration, cfg *reverseConfig, err error) (wait, next time.Duration) {
+	if err == nil {
+		return cfg.minBackoff, cfg.minBackoff
+	}
+	if next = backoff * 2; next > cfg.maxBackoff {
+		next = cfg.maxBackoff
+	}
+	return backoff, next
+}
+
+//reverseState is the channel of the ServeReverse calls closed once the server is closed, the
+//hook closing it is registered once and replaces it so the server can serve again
+type reverseState struct {
+	once    sync.Once
+	closed  chan struct{}
+	serving int32
+}
+
+//reverseClosed returns the channel closed once the server is closed or shut down
+func (s *Server) reverseClosed() <-chan struct{} {
+	s.reverse.once.Do(func() {
+		s.mu.Lock()
+		s.reverse.closed = make(chan struct{})
+		s.mu.Unlock()
+		s.RegisterOnShutdown(func() {
+			s.mu.Lock()
+			close(s.reverse.closed)
+			s.reverse.closed = make(chan struct{})
+			s.mu.Unlock()
+		})
+	})
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reverse.closed
+}
+
+//reversePingProbes is how many probes of WithReversePing are unanswered before the connection is
+//dropped, before go1.23 it's the system's default
+const reversePingProbes = 3
+
+//serveReverseConn dials and serves a single connection, the connection is closed if ctx is done
+func (s *Server) serveReverseConn(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), cfg *reverseConfig) error {
+	c, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	if cfg.ping > 0 {
+		if tc := underlyingTCPConn(c); tc != nil {
+			ka := KeepAliveConfig{Enable: true, Idle: cfg.ping, Interval: cfg.ping, Count: reversePingProbes}
+			if err := setKeepAliveConfig(tc, ka); err != nil {
+				s.logKeyed(LevelError, "reverseping", "probing the reverse connection failed: %v", err)
+			}
+		} else {
+			s.logKeyed(LevelInfo, "reverseping", "the reverse connection isn't a TCP one, it isn't probed")
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	return cfg.handler(c)
+}
+
+//serveReverseSession is the default handler of ServeReverse, the link failed if nothing was read
+//from it before the session ended while the error of a session is the one of its client
+func (s *Server) serveReverseSession(c net.Conn) error {
+	s.setKeepAlive(c, false)
+	lc := &linkConn{Conn: c}
+	if err := s.serveConn(lc); err != nil && atomic.LoadInt32(&lc.read) == 0 {
+		return err
+	}
+	return nil
+}
+
+//linkConn records whether anything was read from a reverse connection
+type linkConn struct {
+	net.Conn
+	read int32
+}
+
+var _ net.Conn = (*linkConn)(nil)
+
+func (c *linkConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt32(&c.read, 1)
+	}
+	return n, err
+}
+
+//CloseWrite half closes the wrapped connection if it supports it
+func (c *linkConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+//NetConn returns the wrapped connection
+func (c *linkConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+//underlyingTCPConn returns the TCP connection of c or of the connections it wraps, nil if it has
+//none
+func underlyingTCPConn(c net.Conn) *net.TCPConn {
+	for {
+		switch wc := c.(type) {
+		case *net.TCPConn:
+			return wc
+		case interface{ NetConn() net.Conn }:
+			c = wc.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+//jitter returns a random duration in [d/2, d)
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
@@ -0,0 +1,192 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServeReverse(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	rendezvous, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rendezvous.Close()
+
+	s := new(Server)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		var d net.Dialer
+		done <- s.ServeReverse(ctx, func(ctx context.Context) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", rendezvous.Addr().String())
+		}, WithReverseBackoff(10*time.Millisecond, 50*time.Millisecond), WithReversePing(time.Second))
+	}()
+
+	//kill the first connection, the server must reconnect
+	c, err := rendezvous.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = rendezvous.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rawConnect(c, echo.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte(testString))
+	b := make([]byte, len(testString))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != testString {
+		t.Errorf("expected %q got %q: %v", testString, b, err)
+	}
+	c.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected %v got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeReverse didn't return after cancel")
+	}
+}
+
+func TestServeReverseClose(t *testing.T) {
+	s := new(Server)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeReverse(context.Background(), func(ctx context.Context) (net.Conn, error) {
+			return nil, io.ErrUnexpectedEOF
+		}, WithReverseBackoff(time.Millisecond, time.Millisecond))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Errorf("expected %v got %v", ErrServerClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeReverse didn't return after Close")
+	}
+}
+
+func TestServeReverseBackoff(t *testing.T) {
+	s := new(Server)
+	var mu sync.Mutex
+	var dials []time.Time
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dial := func(ctx context.Context) (net.Conn, error) {
+		mu.Lock()
+		dials = append(dials, time.Now())
+		mu.Unlock()
+		c, peer := net.Pipe()
+		peer.Close()
+		return c, nil
+	}
+	//the sessions end right away without an error, the redials still wait for the backoff
+	handler := func(c net.Conn) error {
+		return c.Close()
+	}
+	for i := 0; i < 3; i++ {
+		go s.ServeReverse(ctx, dial, WithReverseBackoff(40*time.Millisecond, 40*time.Millisecond), WithReverseHandler(handler))
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	s.mu.RLock()
+	hooks := len(s.onShutdown)
+	s.mu.RUnlock()
+	if hooks != 1 {
+		t.Errorf("expected a single shutdown hook for the ServeReverse calls got %d", hooks)
+	}
+	mu.Lock()
+	n := len(dials)
+	mu.Unlock()
+	//3 calls redialing every 20ms to 40ms dial at most 3*(300/20+1) times
+	if n == 0 || n > 48 {
+		t.Errorf("expected the redials to wait for the backoff got %d dials", n)
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	cfg := &reverseConfig{minBackoff: time.Second, maxBackoff: 3 * time.Second}
+	tests := []struct {
+		name    string
+		backoff time.Duration
+		err     error
+		wait    time.Duration
+		next    time.Duration
+	}{
+		{"served", 2 * time.Second, nil, time.Second, time.Second},
+		{"first failure", time.Second, io.EOF, time.Second, 2 * time.Second},
+		{"failure", 2 * time.Second, io.EOF, 2 * time.Second, 3 * time.Second},
+		{"capped", 3 * time.Second, io.EOF, 3 * time.Second, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, next := nextBackoff(tt.backoff, cfg, tt.err)
+			if wait != tt.wait || next != tt.next {
+				t.Errorf("expected to wait %v then %v got %v then %v", tt.wait, tt.next, wait, next)
+			}
+		})
+	}
+}
+
+func TestServeReverseSession(t *testing.T) {
+	tests := []struct {
+		name   string
+		client func(c net.Conn)
+		failed bool
+	}{
+		{"link dropped", func(c net.Conn) { c.Close() }, true},
+		{"session failed", func(c net.Conn) { c.Write([]byte{4, 1}); c.Close() }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := new(Server)
+			s.checkDefaults()
+			c, peer := net.Pipe()
+			go tt.client(peer)
+			if err := s.serveReverseSession(c); (err != nil) != tt.failed {
+				t.Errorf("expected a link failure %v got %v", tt.failed, err)
+			}
+		})
+	}
+}
+
+func TestServeReverseAccepting(t *testing.T) {
+	s := new(Server)
+	if s.Accepting() {
+		t.Fatal("expected a server without listeners not to be accepting")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeReverse(ctx, func(ctx context.Context) (net.Conn, error) {
+			return nil, io.ErrUnexpectedEOF
+		}, WithReverseBackoff(time.Millisecond, time.Millisecond))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if !s.Accepting() {
+		t.Error("expected the server to be accepting while ServeReverse runs")
+	}
+
+	cancel()
+	<-done
+	if s.Accepting() {
+		t.Error("expected the server not to be accepting once ServeReverse returned")
+	}
+}
@@ -0,0 +1,191 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//DefaultRouteALPN is the ALPN protocol of the proxy on a listener shared by RouteTLS
+const DefaultRouteALPN = "socks5"
+
+//routeHandshakeTimeout bounds the TLS handshake of the connections accepted by RouteTLS
+const routeHandshakeTimeout = 10 * time.Second
+
+//ErrNoRoute is returned for the connections RouteTLS has nowhere to send
+var ErrNoRoute = errors.New("socks5: no route for the connection")
+
+//RouteConfig is how RouteTLS tells the connections of the proxy from the ones of another TLS
+//service sharing its listener e.g. an HTTPS server on port 443
+type RouteConfig struct {
+	//TLSConfig completes the handshakes, it needs the certificates of both services, ALPN is
+	//added to the protocols it negotiates
+	TLSConfig *tls.Config
+	//ALPN is the protocol negotiated by the clients of the proxy, DefaultRouteALPN if empty
+	ALPN string
+	//ServerNames are SNI names whose connections go to the proxy whatever their protocol
+	ServerNames []string
+	//Handler serves the other connections over HTTPS
+	Handler http.Handler
+	//Backend is the address the other connections are copied to if there's no Handler, the
+	//TLS is terminated so the backend speaks plain TCP
+	Backend string
+}
+
+//RouteTLS accepts TLS connections from l and serves the ones negotiating the ALPN protocol
+//or naming a server of cfg with the proxy, the other connections are handed to cfg.Handler
+//or copied to cfg.Backend. Failed handshakes and connections without a route are logged and
+//counted without stopping the listener.
+func (s *Server) RouteTLS(l net.Listener, cfg RouteConfig) error {
+	if cfg.TLSConfig == nil {
+		return errors.New("socks5: RouteTLS needs a TLS config")
+	}
+	r := &tlsRouter{s: s, cfg: cfg, config: cfg.TLSConfig.Clone()}
+	if r.cfg.ALPN == "" {
+		r.cfg.ALPN = DefaultRouteALPN
+	}
+	if !containsString(r.config.NextProtos, r.cfg.ALPN) {
+		r.config.NextProtos = append(r.config.NextProtos, r.cfg.ALPN)
+	}
+	if cfg.Handler != nil {
+		r.https = newConnListener(l.Addr())
+		hs := &http.Server{Handler: cfg.Handler}
+		go hs.Serve(r.https)
+		defer hs.Close()
+	}
+	return s.serve(l, r.serveConn, nil)
+}
+
+//tlsRouter is the state of a listener served by RouteTLS
+type tlsRouter struct {
+	s      *Server
+	cfg    RouteConfig
+	config *tls.Config
+	//https hands the connections to the http.Server of cfg.Handler
+	https *connListener
+}
+
+func (r *tlsRouter) serveConn(c net.Conn) error {
+	tc := tls.Server(c, r.config)
+	tc.SetDeadline(time.Now().Add(routeHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		r.fail(c, "TLS handshake from %v failed: %v", c.RemoteAddr(), err)
+		return err
+	}
+	tc.SetDeadline(time.Time{})
+
+	state := tc.ConnectionState()
+	if state.NegotiatedProtocol == r.cfg.ALPN || containsString(r.cfg.ServerNames, state.ServerName) {
+		return r.s.serveConn(tc)
+	}
+	switch {
+	case r.https != nil:
+		if !r.https.hand(tc) {
+			tc.Close()
+			return ErrServerClosed
+		}
+		return nil
+	case r.cfg.Backend != "":
+		return r.copyToBackend(tc)
+	}
+	r.fail(tc, "no route for %v with server name %q and protocol %q", c.RemoteAddr(), state.ServerName, state.NegotiatedProtocol)
+	return ErrNoRoute
+}
+
+//fail closes c and counts its failure
+func (r *tlsRouter) fail(c net.Conn, format string, args ...interface{}) {
+	atomic.AddInt64(&r.s.metrics.routeFailures, 1)
+	r.s.logKeyed(LevelInfo, "route", format, args...)
+	c.Close()
+}
+
+//copyToBackend copies c to and from cfg.Backend until either side is done or the server closes
+func (r *tlsRouter) copyToBackend(c net.Conn) error {
+	d := r.s.Dialer
+	if d == nil {
+		d = &net.Dialer{Timeout: routeHandshakeTimeout}
+	}
+	bc, err := d.Dial("tcp", r.cfg.Backend)
+	if err != nil {
+		r.fail(c, "dial backend %s for %v failed: %v", r.cfg.Backend, c.RemoteAddr(), err)
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-r.s.getDoneChan():
+			c.Close()
+			bc.Close()
+		}
+	}()
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		io.Copy(c, bc)
+		closeWrite(c)
+	}()
+	io.Copy(bc, c)
+	closeWrite(bc)
+	<-copied
+	c.Close()
+	bc.Close()
+	return nil
+}
+
+//connListener is a net.Listener accepting the connections handed to it
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+//hand waits for c to be accepted, it returns false if the listener is closed
+func (l *connListener) hand(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrServerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//routeTLS serves RouteTLS with a test certificate on a new listener and returns its address
+func routeTLS(t *testing.T, s *Server, cfg RouteConfig) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := tls.LoadX509KeyPair(writeTestCert(t, dir, "route"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.RouteTLS(l, cfg)
+	return l.Addr().String()
+}
+
+//connectTLS connects to echo through the proxy at addr over TLS and checks the echo
+func connectTLS(t *testing.T, addr string, config *tls.Config, echo net.Addr) {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	ea := echo.(*net.TCPAddr)
+	req := append([]byte{5, 1, 0, 5, 1, 0, 1}, ea.IP.To4()...)
+	req = append(req, byte(ea.Port>>8), byte(ea.Port), 'p', 'i', 'n', 'g')
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2+10+4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[1] != 0 || b[3] != byte(ReplySucceeded) || string(b[12:]) != "ping" {
+		t.Errorf("unexpected session % x", b)
+	}
+}
+
+func TestRouteTLS(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	s := &Server{Cmds: []Command{CommandConnect}, Logger: LoggerFunc(func(Level, string) {})}
+	defer s.Close()
+	addr := routeTLS(t, s, RouteConfig{
+		ServerNames: []string{"proxy.example"},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "https "+r.Proto)
+		}),
+	})
+
+	//the clients of the proxy are told apart by the ALPN protocol or by the server name
+	connectTLS(t, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{DefaultRouteALPN}}, echo.Addr())
+	connectTLS(t, addr, &tls.Config{InsecureSkipVerify: true, ServerName: "proxy.example"}, echo.Addr())
+
+	//the rest is HTTPS, over HTTP/2 when negotiated
+	for _, h2 := range []bool{false, true} {
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: h2,
+		}}
+		res, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if expected := map[bool]string{false: "https HTTP/1.1", true: "https HTTP/2.0"}[h2]; string(b) != expected {
+			t.Errorf("expected %q got %q", expected, b)
+		}
+	}
+
+	//a failed handshake is counted and the listener keeps serving
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 64)); err != nil && err != io.EOF {
+		t.Errorf("expected the connection to be closed got %v", err)
+	}
+	c.Close()
+	if n := atomic.LoadInt64(&s.metrics.routeFailures); n != 1 {
+		t.Errorf("expected a route failure got %d", n)
+	}
+	connectTLS(t, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{DefaultRouteALPN}}, echo.Addr())
+}
+
+func TestRouteTLSBackend(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	s := &Server{Cmds: []Command{CommandConnect}, Logger: LoggerFunc(func(Level, string) {})}
+	defer s.Close()
+	addr := routeTLS(t, s, RouteConfig{ALPN: "x-socks", Backend: echo.Addr().String()})
+	noRoute := routeTLS(t, s, RouteConfig{})
+
+	//the other connections are copied to the backend once the TLS is terminated
+	c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Errorf("expected the backend echo got %q %v", b, err)
+	}
+	c.Close()
+	connectTLS(t, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"x-socks"}}, echo.Addr())
+
+	//without a handler or a backend the connection is closed and counted
+	c, err = tls.Dial("tcp", noRoute, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	c.Close()
+	if n := atomic.LoadInt64(&s.metrics.routeFailures); n != 1 {
+		t.Errorf("expected a route failure got %d", n)
+	}
+}
@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"net"
+	"syscall"
+)
+
+//Ruleset decides whether the requests of clients are allowed, the denied ones are answered with
+//ReplyNotAllowedByRuleset
+type Ruleset interface {
+	Allow(client net.Addr, req *Request) bool
+}
+
+//RulesetFunc is an adapter to use functions as Ruleset
+type RulesetFunc func(client net.Addr, req *Request) bool
+
+//Allow calls f(client, req)
+func (f RulesetFunc) Allow(client net.Addr, req *Request) bool {
+	return f(client, req)
+}
+
+//Verdict is the decision of a ruleset on a request
+type Verdict struct {
+	Allow bool
+	//Rule identifies the rule that decided, it's empty if the ruleset can't tell
+	Rule string
+	//DryRun is set if the denial of the rule is only observed, the request is served anyway
+	DryRun bool
+}
+
+//VerdictRuleset is a Ruleset which can tell the rule that decided and whether its denial is a
+//dry-run one
+type VerdictRuleset interface {
+	Ruleset
+	Verdict(client net.Addr, req *Request) Verdict
+}
+
+//verdict returns the verdict of r on the request
+func verdict(r Ruleset, client net.Addr, req *Request) Verdict {
+	if vr, ok := r.(VerdictRuleset); ok {
+		return vr.Verdict(client, req)
+	}
+	return Verdict{Allow: r.Allow(client, req)}
+}
+
+//ResolvedRuleset is a Ruleset which also checks the addresses the domains of requests resolve to,
+//a CONNECT is only dialed to the addresses it allows and the datagrams of an association are only
+//sent to the ones it allows
+type ResolvedRuleset interface {
+	Ruleset
+	VerdictResolved(client net.Addr, req *Request, ip net.IP) Verdict
+}
+
+//allowResolved reports whether the session of c may reach ip, the address the destination of req
+//resolved to. Rulesets that aren't ResolvedRulesets check req alone, the denials in dry-run are
+//observed and allowed
+func (s *Server) allowResolved(c *conn, req *Request, ip net.IP) bool {
+	if c.ruleset == nil {
+		return true
+	}
+	var v Verdict
+	if rr, ok := c.ruleset.(ResolvedRuleset); ok {
+		v = rr.VerdictResolved(c.RemoteAddr(), req, ip)
+	} else {
+		v = verdict(c.ruleset, c.RemoteAddr(), req)
+	}
+	if v.Allow {
+		return true
+	}
+	if v.DryRun || s.ruleDryRun {
+		s.wouldDeny(c, req, v.Rule)
+		return true
+	}
+	return false
+}
+
+//dialer returns the Dialer req is dialed with, the addresses the domain of req resolves to are
+//checked against the ruleset of the session before they're connected to
+func (s *Server) dialer(req *Request) *net.Dialer {
+	if req.conn == nil || req.conn.ruleset == nil || req.Dest.Type != AddrTypeDomain {
+		return s.Dialer
+	}
+	d := *s.Dialer
+	control := d.Control
+	d.Control = func(network, address string, rc syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if !s.allowResolved(req.conn, req, net.ParseIP(host)) {
+			return ErrNotAllowedByRuleset
+		}
+		if control != nil {
+			return control(network, address, rc)
+		}
+		return nil
+	}
+	return &d
+}
+
+//WithRuleset sets the ruleset requests are checked against
+func WithRuleset(r Ruleset) Option {
+	return func(s *Server) {
+		s.Ruleset = r
+	}
+}
+
+//SetRuleset replaces the ruleset while serving, the sessions whose request was already checked
+//are unaffected. A nil ruleset allows every request
+func (s *Server) SetRuleset(r Ruleset) {
+	s.mu.Lock()
+	s.Ruleset = r
+	s.mu.Unlock()
+}
+
+//SetAuthenticator replaces the authenticator while serving, only the handshakes starting
+//afterwards use it
+func (s *Server) SetAuthenticator(a Authenticator) {
+	if a == nil {
+		a = NoAuth
+	}
+	s.mu.Lock()
+	s.Auth = a
+	s.mu.Unlock()
+}
+
+//config returns the authenticator and ruleset new sessions are served with
+func (s *Server) config() (Authenticator, Ruleset) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Auth, s.Ruleset
+}
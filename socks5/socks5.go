@@ -1,15 +1,16 @@
 package socks5
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net"
+	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,10 +24,18 @@ type Option func(*Server)
 func WithAuth(username, password string) Option {
 	return func(s *Server) {
 		s.Auth = NewUserPassAuth(username, password)
+		s.validate(func() string {
+			if username == "" || len(username) > 255 || len(password) > 255 {
+				return "WithAuth needs a username of 1 to 255 bytes and a password of at most 255 bytes"
+			}
+			return ""
+		})
 	}
 }
 
-//WithKeepAlive sets tcp KeepAlives for inbound/outbound connections
+//WithKeepAlive sets tcp KeepAlives for inbound connections
+//
+//Deprecated: use WithKeepAliveConfig to set the interval and count of the probes as well
 func WithKeepAlive(interval time.Duration) Option {
 	return func(s *Server) {
 		s.KeepAlive = interval
@@ -54,6 +63,70 @@ func WithAddrProvider(a AddrProvider) Option {
 	}
 }
 
+//WithAddrAdvertiser sets the advertiser of bound addresses, it takes precedence over the AddrProvider
+func WithAddrAdvertiser(a AddrAdvertiser) Option {
+	return func(s *Server) {
+		s.Advertiser = a
+	}
+}
+
+//WithCommandHandler sets the handler of cmd, it overrides the built-in handler of CONNECT, BIND
+//and UDP ASSOCIATE or handles a command the server doesn't know. The command must be allowed
+//by WithCommands like any other
+func WithCommandHandler(cmd Command, h CommandHandler) Option {
+	return func(s *Server) {
+		if s.Handlers == nil {
+			s.Handlers = make(map[Command]CommandHandler)
+		}
+		s.Handlers[cmd] = h
+	}
+}
+
+//WithAccessLog writes a record in format to w for every session once it's over
+func WithAccessLog(w io.Writer, format AccessLogFormat) Option {
+	return func(s *Server) {
+		s.AccessLog = NewAccessLog(w, format)
+	}
+}
+
+//WithRedaction redacts client addresses and destinations before they're logged or recorded
+func WithRedaction(policy RedactionPolicy) Option {
+	return func(s *Server) {
+		s.Redaction = &policy
+	}
+}
+
+//WithLogger sets the logger of the server and the least severe level it logs
+func WithLogger(l Logger, level Level) Option {
+	return func(s *Server) {
+		s.Logger = l
+		s.LogLevel = level
+	}
+}
+
+//WithLogRateLimit logs at most burst messages of a kind every interval, the ones held back are
+//summed up once the interval is over. Session errors are of a kind per error and client /24
+//or /48, other messages per text. Errors bypass the limit if bypassErrors
+func WithLogRateLimit(burst int, interval time.Duration, bypassErrors bool) Option {
+	return func(s *Server) {
+		s.logLimiter = newLogLimiter(burst, interval, bypassErrors)
+	}
+}
+
+//WithDestinationStats aggregates the sessions and bytes of the destination hosts, at most
+//maxEntries hosts are kept and the ones with the least bytes make room for new ones
+func WithDestinationStats(maxEntries int) Option {
+	return func(s *Server) {
+		s.destStats = newDestStats(maxEntries)
+		s.validate(func() string {
+			if maxEntries < 1 {
+				return fmt.Sprintf("WithDestinationStats keeps at most %d hosts, it must keep at least 1", maxEntries)
+			}
+			return ""
+		})
+	}
+}
+
 //WithListener sets the is the listener used by the Bind Command
 func WithListener(l Listener) Option {
 	return func(s *Server) {
@@ -68,17 +141,73 @@ func WithPacketListener(l PacketListener) Option {
 	}
 }
 
+//WithTrustForwardedFor sets whether the X-Forwarded-For header is trusted as the
+//client address of WebSocket connections, only enable it behind a trusted reverse proxy
+func WithTrustForwardedFor(trust bool) Option {
+	return func(s *Server) {
+		s.TrustForwardedFor = trust
+	}
+}
+
+//WithProxyProtocol enables reading the PROXY protocol header sent by load balancers, the
+//advertised address replaces the RemoteAddr of the connection
+func WithProxyProtocol(policy ProxyProtocolPolicy) Option {
+	return func(s *Server) {
+		s.ProxyProtocol = &policy
+	}
+}
+
 //PacketListener is the listner used for udp
 type PacketListener func(network, address string) (net.PacketConn, error)
 
 //Listener is the listner used for bind
 type Listener func(network, address string) (net.Listener, error)
 
+//CommandHandler handles a request after the handshake, it replies to req and relays conn as
+//the command requires. ctx is canceled once the server is closed
+type CommandHandler func(ctx context.Context, conn net.Conn, req *Request) error
+
 //AddrProvider provider address for bind and udp
 type AddrProvider func(addr net.Addr) string
 
+//AdvertisedAddr adapts the AddrProvider to an AddrAdvertiser, the addresses of CONNECT are
+//left unchanged as the provider is only meant for bind and udp
+func (a AddrProvider) AdvertisedAddr(cmd Command, local net.Addr) (string, uint16) {
+	addr := local.String()
+	if cmd != CommandConnect {
+		addr = a(local)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0
+	}
+	return host, uint16(p)
+}
+
+//AddrAdvertiser returns the address written back to the client for the local address bound
+//while handling cmd e.g. the public host and the external port of a mapped socket. An empty
+//host advertises the null address
+type AddrAdvertiser interface {
+	AdvertisedAddr(cmd Command, local net.Addr) (host string, port uint16)
+}
+
+//AddrAdvertiserFunc is an adapter to use functions as AddrAdvertiser
+type AddrAdvertiserFunc func(cmd Command, local net.Addr) (host string, port uint16)
+
+//AdvertisedAddr calls f(cmd, local)
+func (f AddrAdvertiserFunc) AdvertisedAddr(cmd Command, local net.Addr) (string, uint16) {
+	return f(cmd, local)
+}
+
 //Server holds parameters for thr server
 type Server struct {
+	//metrics are first for 64-bit alignment
+	metrics metrics
+
 	//Addr is the address to listen on for incomming connections
 	Addr string
 
@@ -91,6 +220,28 @@ type Server struct {
 	//Cmds are the Commands supported by the server
 	Cmds []Command
 
+	//Ruleset if set decides whether requests are allowed
+	Ruleset Ruleset
+
+	//Handlers are the handlers of commands overriding the built-in ones
+	Handlers map[Command]CommandHandler
+
+	//AccessLog if set gets a record of every session once it's over
+	AccessLog *AccessLog
+
+	//Accounting if set records the stats of every session that got to its request
+	Accounting *AccountingQueue
+
+	//Redaction if set redacts client addresses and destinations before they're logged or recorded
+	Redaction *RedactionPolicy
+
+	//Logger receives the messages of the server, if nil they're written to the standard logger
+	Logger Logger
+
+	//LogLevel is the least severe level logged, LevelTrace dumps the handshakes unless
+	//Redaction is set
+	LogLevel Level
+
 	//Dialer is the Dialer used to create outgoing connections
 	Dialer *net.Dialer
 
@@ -103,9 +254,76 @@ type Server struct {
 	//AddrProvider is the addr provider used for bind and udp
 	AddrProvider AddrProvider
 
-	mu       sync.RWMutex
-	doneChan chan struct{}
-	listener net.Listener
+	//Advertiser is consulted for every address written back to the client, if nil the
+	//AddrProvider is used
+	Advertiser AddrAdvertiser
+
+	//TrustForwardedFor uses the X-Forwarded-For header as the client address of WebSocket connections
+	TrustForwardedFor bool
+
+	//ProxyProtocol is the policy for PROXY protocol headers, if nil the header isn't read
+	ProxyProtocol *ProxyProtocolPolicy
+
+	//UnixSocketMode is the file mode of the unix socket, if 0 the mode isn't changed
+	UnixSocketMode os.FileMode
+
+	//TLSConfig if set serves the listeners of ListenAndServe and ListenAll over TLS
+	TLSConfig *tls.Config
+
+	//Resolver answers the DNS queries intercepted with WithDNSInterception, if nil
+	//net.DefaultResolver is used
+	Resolver Resolver
+
+	//OriginalDst looks up the destination of the connections accepted by ServeTransparent, if
+	//nil the one before the iptables REDIRECT or TPROXY rule is used
+	OriginalDst func(c net.Conn) (*net.TCPAddr, error)
+
+	destStats    *destStats
+	logLimiter   *logLimiter
+	events       *eventBus
+	authFailures *failureCounter
+	bans         bans
+	draining     int32
+	paused       int32
+	pauseMode    PauseMode
+	//certs is the certificate of WithCertReloader
+	certs        *CertReloader
+	capture      *capture
+	captureLimit int64
+	tarpit       *tarpit
+	//dnsInterception is set by WithDNSInterception
+	dnsInterception bool
+	recovery        *listenerRecovery
+	streamWrapper   StreamWrapper
+	udpBatchSize    int
+	//ruleDryRun is set by WithRuleDryRun
+	ruleDryRun bool
+	//idleTimeout is set by WithIdleShutdown
+	idleTimeout time.Duration
+	//keepAliveConfig is set by WithKeepAliveConfig
+	keepAliveConfig *KeepAliveConfig
+	//nat64 is set by WithNAT64Prefix
+	nat64 *nat64
+	//dialCache is set by WithNegativeDialCache
+	dialCache *dialCache
+	//fastOpen is set by WithTCPFastOpen
+	fastOpen *fastOpen
+	//mirror is set by WithMirror
+	mirror *mirror
+	//checks are the validations registered by the options, validated is set by NewServer
+	checks    []func() string
+	validated bool
+
+	mu         sync.RWMutex
+	doneChan   chan struct{}
+	readyChan  chan struct{}
+	listeners  []net.Listener
+	onShutdown []func()
+	conns      map[*conn]net.Conn
+	idle       idleState
+	reverse    reverseState
+	//fds is the descriptor given up once the process is out of them
+	fds fdReserve
 }
 
 // ListenAndServe starts the SOCKS5 server on the given address with the given options
@@ -121,20 +339,110 @@ func ListenAndServe(addr string, opts ...Option) error {
 
 // ListenAndServe starts the SOCKS5 server on the given address with the given options
 // if addrs is empty then it listen on port 1080, with no authentication and only support
-// for connect command
+// for connect command. Addresses prefixed with unix: e.g. unix:/run/socks5.sock listen on
+// a unix domain socket which is removed once the server is closed
 func (s *Server) ListenAndServe() error {
-	l, err := net.Listen("tcp", s.Addr)
+	if s.validated {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+	}
+	l, err := s.listen(s.Addr)
 	if err != nil {
 		return err
 	}
 	return s.Serve(l)
 }
 
-//Serve accepts connections from the given listener and closes the listener on exit
+//ListenAll listens on every address before any is served, addresses are like the Addr of the
+//server. If listening on one fails the listeners are closed and the error names the address
+func (s *Server) ListenAll(addrs ...string) ([]net.Listener, error) {
+	ls := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := s.listen(addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socks5: listen on %s: %v", addr, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+//ServeAll serves every listener until the server is closed, if serving one fails the server is
+//closed. It returns once all of them stopped with the first error other than ErrServerClosed
+func (s *Server) ServeAll(ls ...net.Listener) error {
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) {
+			err := s.Serve(l)
+			if err != ErrServerClosed && err != ErrIdleShutdown {
+				s.Close()
+			}
+			errs <- err
+		}(l)
+	}
+
+	err := ErrServerClosed
+	for range ls {
+		if e := <-errs; e != ErrServerClosed && err == ErrServerClosed {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Server) listen(addr string) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	var l net.Listener
+	var err error
+	if network == "unix" {
+		l, err = listenUnix(address, s.UnixSocketMode)
+	} else {
+		lc := net.ListenConfig{Control: s.listenControl()}
+		l, err = lc.Listen(context.Background(), network, address)
+	}
+	if err != nil || s.TLSConfig == nil {
+		return l, err
+	}
+	return tls.NewListener(l, s.TLSConfig), nil
+}
+
+//Serve accepts connections from the given listener and closes the listener on exit, with
+//WithListenerRecovery the listener is replaced if it fails
 func (s *Server) Serve(l net.Listener) error {
-	defer l.Close()
+	return s.serve(l, s.serveConn, s.recovery)
+}
+
+//serve serves the connections of l with serveConn until the server is closed, l is replaced
+//with r if it fails and r isn't nil
+func (s *Server) serve(l net.Listener, serveConn func(net.Conn) error, r *listenerRecovery) error {
 	s.checkDefaults()
-	s.setNewListener(l)
+	s.checkFastOpen()
+	s.trackListener(l, true)
+	s.watchIdle()
+	for {
+		err := s.accept(l, serveConn)
+		l.Close()
+		if err == ErrServerClosed || err == ErrIdleShutdown || r == nil {
+			s.trackListener(l, false)
+			return err
+		}
+		nl, rerr := r.recover(s, l, err)
+		if rerr != nil {
+			s.trackListener(l, false)
+			return rerr
+		}
+		l = nl
+	}
+}
+
+//accept accepts connections from l and serves them with serveConn until l fails
+func (s *Server) accept(l net.Listener, serveConn func(net.Conn) error) error {
+	s.fds.acquire()
+	var delay time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -143,6 +451,16 @@ func (s *Server) Serve(l net.Listener) error {
 				return ErrServerClosed
 			default:
 			}
+			if s.idleShutdown() {
+				return ErrIdleShutdown
+			}
+			if s.Draining() {
+				return ErrServerClosed
+			}
+			if fdExhausted(err) {
+				delay = s.acceptFailed(l, err, delay)
+				continue
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				//Perhaps add delay like net/http pkg
 				continue
@@ -150,16 +468,55 @@ func (s *Server) Serve(l net.Listener) error {
 			return err
 		}
 
-		if tc, ok := conn.(*net.TCPConn); ok {
-			if s.KeepAlive > 0 {
-				tc.SetKeepAlive(true)
-				tc.SetKeepAlivePeriod(s.KeepAlive)
-			}
-			conn := newConn(tc)
-			go s.handleConnection(conn)
+		delay = 0
+		s.accepted()
+		s.admit()
+		go s.serveAdmitted(conn, serveConn)
+	}
+}
 
+//ServeConn serves a single SOCKS5 session on c and closes it once the session is over unless
+//it's handed to the tarpit, it allows serving connections that don't come from a net.Listener
+//e.g. WebSockets
+func (s *Server) ServeConn(c net.Conn) error {
+	s.checkDefaults()
+	return s.serveConn(c)
+}
+
+func (s *Server) serveConn(c net.Conn) error {
+	s.setKeepAlive(c, false)
+
+	if uc, ok := c.(*net.UnixConn); ok {
+		c = newUnixConn(uc)
+	}
+
+	if s.ProxyProtocol != nil {
+		pc, err := readProxyHeader(c, s.ProxyProtocol)
+		if err != nil {
+			c.Close()
+			return err
+		}
+		c = pc
+	}
+
+	if s.bannedAddr(c.RemoteAddr()) {
+		if !s.tarpitConn(c) {
+			c.Close()
+		}
+		return ErrBanned
+	}
+	if s.tarpit != nil {
+		if _, ruleset := s.config(); ruleset != nil {
+			if cr, ok := ruleset.(ClientRuleset); ok && !s.ruleDryRun && !cr.AllowClient(c.RemoteAddr()) && s.tarpitConn(c) {
+				return ErrNotAllowedByRuleset
+			}
 		}
 	}
+	if s.pauseMode == PauseClose && s.Paused() {
+		c.Close()
+		return ErrPaused
+	}
+	return s.handleConnection(newConn(c))
 }
 
 //Close closes the listener as well as all the underlying connections
@@ -167,10 +524,103 @@ func (s *Server) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.closeDoneChanLocked()
-	if s.listener != nil {
-		return s.listener.Close()
+	for _, c := range s.conns {
+		c.Close()
 	}
-	return nil
+	s.fds.release()
+	return s.closeListenerLocked()
+}
+
+//Shutdown stops accepting connections and waits for the active sessions to end, once ctx is
+//done the remaining sessions are closed with Close and the error of ctx is returned. The
+//notifiers get an EventDrainStarted and an EventDrainFinished
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+	s.mu.Lock()
+	err := s.closeListenerLocked()
+	s.mu.Unlock()
+
+	n := s.ActiveSessions()
+	s.logf(LevelInfo, "draining %d active sessions", n)
+	s.Notify(Event{Type: EventDrainStarted, Data: &Drain{Sessions: n}})
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		n = s.pendingSessions()
+		if n == 0 {
+			s.Notify(Event{Type: EventDrainFinished, Data: &Drain{}})
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.logf(LevelInfo, "closing %d active sessions", n)
+			s.Close()
+			s.Notify(Event{Type: EventDrainFinished, Data: &Drain{Sessions: n, Forced: true}})
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+//shutdownPollInterval is how often Shutdown checks for the sessions to be over
+const shutdownPollInterval = 50 * time.Millisecond
+
+//Draining reports whether Shutdown was called
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+//Accepting reports whether the server serves a listener or ServeReverse runs and it isn't
+//draining or paused
+func (s *Server) Accepting() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	serving := len(s.listeners) > 0 || atomic.LoadInt32(&s.reverse.serving) > 0
+	return serving && !s.Draining() && !s.Paused()
+}
+
+//ActiveSessions returns the number of connections being served
+func (s *Server) ActiveSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) closeListenerLocked() error {
+	for _, f := range s.onShutdown {
+		go f()
+	}
+	var err error
+	for _, l := range s.listeners {
+		if e := l.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+//track adds c to the active connections or removes it, it's added before the handshake is
+//traced so Close closes the underlying connection
+func (s *Server) track(c *conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		return
+	}
+	if s.conns == nil {
+		s.conns = make(map[*conn]net.Conn)
+	}
+	s.conns[c] = c.Conn
+}
+
+//RegisterOnShutdown registers a function to call when the server is closed, it can be
+//used to close listeners of other transports serving through ServeConn
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	s.onShutdown = append(s.onShutdown, f)
+	s.mu.Unlock()
 }
 
 func (s *Server) checkDefaults() {
@@ -200,6 +650,23 @@ func nopAddrProvider(addr net.Addr) string {
 	return addr.String()
 }
 
+//advertise returns the address written back to the client for the local address bound while
+//handling cmd, it's nil if the address isn't to be advertised
+func (s *Server) advertise(cmd Command, local net.Addr) *AddrSpec {
+	var a AddrAdvertiser = s.AddrProvider
+	if s.Advertiser != nil {
+		a = s.Advertiser
+	} else if s.AddrProvider == nil {
+		a = AddrProvider(nopAddrProvider)
+	}
+
+	host, port := a.AdvertisedAddr(cmd, local)
+	if host == "" {
+		return nil
+	}
+	return hostAddrSpec(host, port)
+}
+
 func (s *Server) getDoneChan() <-chan struct{} {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -213,6 +680,32 @@ func (s *Server) getDoneChanLocked() chan struct{} {
 	return s.doneChan
 }
 
+//Ready returns a channel closed once the server serves its first listener, ListenAddr returns
+//its address from then on
+func (s *Server) Ready() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getReadyChanLocked()
+}
+
+func (s *Server) getReadyChanLocked() chan struct{} {
+	if s.readyChan == nil {
+		s.readyChan = make(chan struct{})
+	}
+	return s.readyChan
+}
+
+//ListenAddr returns the address of the first listener being served e.g. with the port picked
+//for port 0, it's nil before Serve installed the listener and once the server is closed
+func (s *Server) ListenAddr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
 func (s *Server) closeDoneChanLocked() {
 	ch := s.getDoneChanLocked()
 	select {
@@ -222,174 +715,292 @@ func (s *Server) closeDoneChanLocked() {
 	}
 }
 
-func (s *Server) setNewListener(l net.Listener) {
-	defer s.mu.Unlock()
+//trackListener adds l to the listeners being served or removes it, the server is ready to be
+//served again once it was closed and all its listeners stopped
+func (s *Server) trackListener(l net.Listener, add bool) {
 	s.mu.Lock()
-	if s.listener != nil {
-		s.listener.Close()
-		s.listener = nil
+	defer s.mu.Unlock()
+	if add {
+		if len(s.listeners) == 0 {
+			s.doneChan = nil
+		}
+		s.listeners = append(s.listeners, l)
+		ready := s.getReadyChanLocked()
+		select {
+		case <-ready:
+		default:
+			close(ready)
+		}
+		return
+	}
+	for i, sl := range s.listeners {
+		if sl == l {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			break
+		}
+	}
+	//the reserved descriptor is only needed while accepting
+	if len(s.listeners) == 0 {
+		s.fds.release()
 	}
-	s.doneChan = nil
-	s.listener = l
 }
 
-func (s *Server) handleConnection(c *conn) {
+func (s *Server) handleConnection(c *conn) (err error) {
+	start := time.Now()
+	c.id = newSessionID()
+	s.track(c, true)
+	defer s.track(c, false)
+	var req *Request
+	//there's no handshake to dump on a transparent connection
+	if s.logEnabled(LevelTrace) && s.Redaction == nil && c.original == nil {
+		c.trace(s)
+	}
 	defer func() {
-		c.Close()
+		c.untrace()
+		//the clients not speaking SOCKS5 at all are tarpitted, not the ones sending a bad request
+		if err != ErrInvalidSocksVer || c.negotiated || !s.tarpitConn(c.Conn) {
+			c.Close()
+		}
+		s.metrics.count(c, err)
+		if err == ErrAuthFailed && s.authFailures != nil {
+			if n, crossed := s.authFailures.fail(); crossed {
+				s.Notify(Event{Type: EventAuthFailures, Data: &AuthFailures{Failures: n, Window: s.authFailures.window}})
+			}
+		}
+		if err != nil {
+			s.logKeyed(LevelInfo, errorKey(err, c.RemoteAddr()), "session %s: %s: %s",
+				c.id, s.Redaction.client(c.RemoteAddr()), s.Redaction.error(err))
+		}
+		if s.AccessLog != nil {
+			s.AccessLog.Log(newAccessRecord(c, req, start, err, s.Redaction))
+		}
+		if s.Accounting != nil && req != nil {
+			s.Accounting.Record(newSessionStats(c, req, start, s.Redaction))
+		}
+		//the destination of an association is the client sending datagrams
+		if s.destStats != nil && req != nil && req.Command != CommandUDPAssociation {
+			if host := s.Redaction.destinationHost(req.Dest); host != "" {
+				s.destStats.add(host, atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out))
+			}
+		}
 	}()
 
-	if err := c.Negoatiate(s.Auth.AuthMethod()); err != nil {
-		return
+	auth, ruleset := s.config()
+	if c.original != nil {
+		req = &Request{Command: CommandConnect, Dest: c.original, conn: c}
+	} else if req, err = handshake(c, []Authenticator{auth}); err != nil {
+		return err
 	}
-
-	if err := s.Auth.Authenticate(c); err != nil {
-		return
+	s.logf(LevelDebug, "session %s: %v %s", c.id, req.Command, s.Redaction.destination(req.Dest))
+	if s.Paused() {
+		if c.original == nil {
+			req.Fail(ReplyGeneralFailure)
+		}
+		return ErrPaused
+	}
+	if c.original == nil && !s.supports(req.Command) {
+		return req.Fail(ReplyCommandNotSupported)
+	}
+	c.decision = DecisionAllowed
+	if ruleset != nil {
+		c.ruleset = ruleset
+		v := verdict(ruleset, c.RemoteAddr(), req)
+		if !v.Allow && !v.DryRun && !s.ruleDryRun {
+			c.decision = DecisionDenied
+			req.Fail(ReplyNotAllowedByRuleset)
+			return ErrNotAllowedByRuleset
+		}
+		if !v.Allow {
+			c.decision = DecisionDryRunDeny
+			s.wouldDeny(c, req, v.Rule)
+		}
+	}
+	h := s.handler(req.Command)
+	if h == nil {
+		return req.Fail(ReplyCommandNotSupported)
+	}
+	info := SessionInfo{
+		ID:       c.id,
+		Client:   c.RemoteAddr(),
+		Username: c.user,
+		Command:  req.Command,
+		Dest:     req.Dest,
+	}
+	if s.capture != nil && s.capture.matches(info) {
+		c.capture = s.capture
+	}
+	if s.mirror != nil && s.mirror.matches(info) {
+		c.mirror = s.mirror
 	}
 
-	cmd, addr, err := c.ReadCommandRequest()
-	if err != nil {
-		switch err {
-		case ErrInvalidSocksVer:
-			c.WriteError(responseGeneralFailure)
-			return
-		case ErrAddressTypeNotSupported:
-			c.WriteError(responseAddressNotSupported)
-			return
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.getDoneChan():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if s.streamWrapper != nil {
+		c.wrap = func(d Direction, rw io.ReadWriter) io.ReadWriter {
+			return s.streamWrapper(ctx, d, info, rw)
 		}
-		return
 	}
-	//Remove
-	log.Println(cmd, addr, err)
+	return h(ctx, c, req)
+}
+
+//handler returns the handler of cmd, the registered one or the built-in one
+func (s *Server) handler(cmd Command) CommandHandler {
+	if h, ok := s.Handlers[cmd]; ok {
+		return h
+	}
 	switch cmd {
 	case CommandConnect:
-		s.handleConnect(c, addr)
+		return s.handleConnect
 	case CommandBind:
-		s.handleBind(c, addr)
+		return s.handleBind
 	case CommandUDPAssociation:
-		s.handleUDPAssociation(c, addr)
-	default:
-		c.WriteError(responseCommandNotSupported)
+		return s.handleUDPAssociation
 	}
+	return nil
+}
+
+//supports reports whether cmd is one of the allowed Cmds, only CONNECT is allowed if Cmds is empty
+func (s *Server) supports(cmd Command) bool {
+	if len(s.Cmds) == 0 {
+		return cmd == CommandConnect
+	}
+	for _, c := range s.Cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
 }
 
 //handles connect command
-func (s *Server) handleConnect(c *conn, addr net.Addr) error {
-	t, err := s.Dialer.Dial("tcp", addr.String())
+func (s *Server) handleConnect(ctx context.Context, _ net.Conn, req *Request) error {
+	dest := s.dialAddr(req)
+	if reply, ok := s.dialCache.lookup(dest); ok {
+		req.Fail(reply)
+		return ErrDialCached
+	}
+	early := s.earlyData(req.conn)
+	t, err := s.dialTCP(ctx, req, early)
+	if errors.Is(err, ErrNotAllowedByRuleset) {
+		//the denial depends on the client, it isn't cached
+		req.conn.decision = DecisionDenied
+		req.Fail(ReplyNotAllowedByRuleset)
+		return ErrNotAllowedByRuleset
+	}
 	if err != nil {
-		c.WriteError(responseHostUnreachable)
+		s.dialCache.failed(dest, s.dialFailed(req, err), err)
 		return err
 	}
-	err = c.WriteCommandResponse(responseSuccess, t.LocalAddr().String())
+	s.dialCache.succeeded(dest)
+	atomic.AddInt64(&req.conn.in, int64(len(early)))
+	s.setKeepAlive(t, true)
+	if ta, ok := t.RemoteAddr().(*net.TCPAddr); ok {
+		req.conn.resolved = ta.IP
+	}
+	err = req.Success(s.advertise(CommandConnect, t.LocalAddr()))
 	if err != nil {
 		return err
 	}
-	c.Relay(t)
+	req.Relay(t)
 	return nil
 }
 
 //handles bind commmand
-func (s *Server) handleBind(c *conn, addr net.Addr) error {
+func (s *Server) handleBind(_ context.Context, _ net.Conn, req *Request) error {
+	c := req.conn
 	l, err := s.Listen("tcp", "")
 	if err != nil {
-		c.WriteError(responseGeneralFailure)
+		req.Fail(ReplyGeneralFailure)
 		return err
 	}
+	defer l.Close()
 
-	err = c.WriteCommandResponse(responseSuccess, s.AddrProvider(l.Addr()))
+	err = req.Success(s.advertise(CommandBind, bindAddr(l.Addr(), c.LocalAddr())))
 	if err != nil {
 		return err
 	}
 
-	nc, err := l.Accept()
+	//the client doesn't send anything until the peer connects, a read returning means the
+	//control connection is gone and there's no one to hand the peer to
+	var accepted int32
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		var b [1]byte
+		c.Read(b[:])
+		if atomic.LoadInt32(&accepted) == 0 {
+			l.Close()
+		}
+	}()
+
+	nc, err := s.acceptPeer(l, req.Dest.IP)
+	atomic.StoreInt32(&accepted, 1)
+	c.SetReadDeadline(time.Now())
+	<-watched
+	c.SetReadDeadline(time.Time{})
 	if err != nil {
-		c.WriteError(responseGeneralFailure)
+		req.Fail(ReplyGeneralFailure)
+		return err
 	}
 
-	err = c.WriteCommandResponse(responseSuccess, nc.RemoteAddr().String())
+	if ta, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
+		c.resolved = ta.IP
+	}
+	err = req.Success(nc.RemoteAddr())
 	if err != nil {
+		nc.Close()
 		return err
 	}
 	c.Relay(nc)
 	return nil
 }
 
-//TODO implement later
-func (s *Server) handleUDPAssociation(c *conn, addr net.Addr) error {
-	c.WriteError(responseCommandNotSupported)
-	l, err := s.ListenPacket("udp", "")
-	if err != nil {
-		c.WriteError(responseGeneralFailure)
-		return err
-	}
-	err = c.WriteCommandResponse(responseSuccess, s.AddrProvider(l.LocalAddr()))
-	if err != nil {
-		return err
+//bindAddr returns the address of a bind listener or udp relay to advertise, an unspecified
+//IP is replaced with the IP the client reached the server on
+func bindAddr(addr, local net.Addr) net.Addr {
+	la, ok := local.(*net.TCPAddr)
+	if !ok {
+		return addr
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a.IP.IsUnspecified() {
+			return &net.TCPAddr{IP: la.IP, Port: a.Port}
+		}
+	case *net.UDPAddr:
+		if a.IP.IsUnspecified() {
+			return &net.UDPAddr{IP: la.IP, Port: a.Port}
+		}
 	}
+	return addr
+}
 
-	go func() {
-		defer func() {
-			recover()
-		}()
-		buf := make([]byte, 65536)
-		for {
-			n, _, err := l.ReadFrom(buf)
-
-			if err != nil || n < 7 {
-				continue
-			}
-
-			//two reserve bytes and one fragment number
-			if !bytes.Equal(buf[:3], []byte{0, 0, 0}) {
-				continue
-			}
-
-			addrLength := 0
-			domain := false
-			offset := 4
-
-			switch AddrType(c.buf[3]) {
-			case AddrTypeIPv4:
-				addrLength = net.IPv4len
-			case AddrTypeIPv6:
-				addrLength = net.IPv6len
-
-			case AddrTypeDomain:
-				addrLength = int(c.buf[4])
-				domain = true
-				offset++
-			default:
-				continue
-			}
-
-			addrBytes := buf[offset : offset+addrLength+1]
-
-			port := int(binary.BigEndian.Uint16(c.buf[offset+addrLength+1 : offset+addrLength+2]))
-
-			targetHost := string(addrBytes)
-
-			if !domain {
-				ip := net.IP(addrBytes)
-				targetHost = ip.String()
-			}
-
-			raddr := net.JoinHostPort(targetHost, strconv.Itoa(port))
-
-			rconn, err := net.Dial("udp", raddr)
-			if err != nil { //not sure
-				continue
-			}
-			_, err = rconn.Write(buf[offset+addrLength+2 : n])
-			if err != nil { //not sure
-				continue
-			}
+//acceptPeer accepts the connection of the peer the client expects, if the client gave an IP
+//connections from other hosts are dropped
+func (s *Server) acceptPeer(l net.Listener, ip net.IP) (net.Conn, error) {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return nil, err
 		}
-
-	}()
-
-	err = c.WriteCommandResponse(responseSuccess, l.LocalAddr().String())
-	if err != nil {
-		return err
+		if ip == nil || ip.IsUnspecified() {
+			return nc, nil
+		}
+		var peer net.IP
+		if ra, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
+			peer = ra.IP
+		}
+		if peer.Equal(ip) {
+			return nc, nil
+		}
+		s.logf(LevelInfo, "bind dropped connection from %s, expected %s", s.Redaction.resolved(peer), s.Redaction.resolved(ip))
+		nc.Close()
 	}
-	io.Copy(ioutil.Discard, c)
-	return nil
 }
@@ -0,0 +1,643 @@
+//Package socks5test is a conformance suite for SOCKS5 servers (RFC 1928 and RFC 1929). The
+//checks drive the server with raw bytes and assert the exact bytes of its responses, so it
+//can be pointed at any implementation with Run
+package socks5test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	//Version is the SOCKS protocol version
+	Version byte = 0x05
+
+	//MethodNoAuth is the no authentication required method
+	MethodNoAuth byte = 0x00
+	//MethodGSSAPI is the GSSAPI method
+	MethodGSSAPI byte = 0x01
+	//MethodUserPass is the username/password method of RFC 1929
+	MethodUserPass byte = 0x02
+	//MethodNoAcceptable is selected by the server if none of the offered methods is acceptable
+	MethodNoAcceptable byte = 0xFF
+
+	//CmdConnect is the CONNECT command
+	CmdConnect byte = 0x01
+	//CmdBind is the BIND command
+	CmdBind byte = 0x02
+	//CmdUDPAssociate is the UDP ASSOCIATE command
+	CmdUDPAssociate byte = 0x03
+
+	//AtypIPv4 is an IPv4 address
+	AtypIPv4 byte = 0x01
+	//AtypDomain is a length prefixed domain name
+	AtypDomain byte = 0x03
+	//AtypIPv6 is an IPv6 address
+	AtypIPv6 byte = 0x04
+
+	//ReplySucceeded is the reply of a successful request
+	ReplySucceeded byte = 0x00
+	//ReplyNotAllowedByRuleset is the reply to a request denied by the ruleset
+	ReplyNotAllowedByRuleset byte = 0x02
+	//ReplyCommandNotSupported is the reply to an unsupported command
+	ReplyCommandNotSupported byte = 0x07
+	//ReplyAddressNotSupported is the reply to an unsupported address type
+	ReplyAddressNotSupported byte = 0x08
+)
+
+//Options describes the server under test
+type Options struct {
+	//Username and Password are the credentials the server accepts, if both are empty the server
+	//is expected to require no authentication
+	Username, Password string
+
+	//Target is the address of a TCP echo server reachable from the server, if empty one is
+	//started on the loopback interface
+	Target string
+
+	//UDPTarget is the address of a UDP echo server reachable from the server, if empty one is
+	//started on the loopback interface
+	UDPTarget string
+
+	//Bind enables the checks of the BIND command, it's expected to be rejected otherwise
+	Bind bool
+
+	//UDP enables the checks of the UDP ASSOCIATE command, it's expected to be rejected otherwise
+	UDP bool
+
+	//Timeout bounds every exchange with the server, if 0 it's 5 seconds
+	Timeout time.Duration
+}
+
+func (o *Options) auth() bool {
+	return o.Username != "" || o.Password != ""
+}
+
+func (o *Options) method() byte {
+	if o.auth() {
+		return MethodUserPass
+	}
+	return MethodNoAuth
+}
+
+func (o *Options) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return o.Timeout
+}
+
+//Run runs the conformance checks against the server at addr as subtests of t
+func Run(t *testing.T, addr string, opts Options) {
+	if opts.Target == "" {
+		l := listenEcho(t, "tcp4", "127.0.0.1:0")
+		defer l.Close()
+		opts.Target = l.Addr().String()
+	}
+
+	t.Run("greeting", func(t *testing.T) { checkGreeting(t, addr, &opts) })
+	if opts.auth() {
+		t.Run("auth", func(t *testing.T) { checkAuth(t, addr, &opts) })
+	}
+	t.Run("connect", func(t *testing.T) { checkConnect(t, addr, &opts) })
+	t.Run("commands", func(t *testing.T) { checkCommands(t, addr, &opts) })
+	if opts.Bind {
+		t.Run("bind", func(t *testing.T) { checkBind(t, addr, &opts) })
+	}
+	if opts.UDP {
+		t.Run("udp", func(t *testing.T) { checkUDP(t, addr, &opts) })
+	}
+}
+
+//Driver exchanges raw bytes with a server, unexpected responses fail the test
+type Driver struct {
+	t       testing.TB
+	conn    net.Conn
+	timeout time.Duration
+}
+
+//Dial connects a Driver to the server at addr, every exchange is bounded by timeout
+func Dial(t testing.TB, addr string, timeout time.Duration) *Driver {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	return &Driver{t: t, conn: c, timeout: timeout}
+}
+
+//Conn returns the connection to the server
+func (d *Driver) Conn() net.Conn {
+	return d.conn
+}
+
+//Close closes the connection to the server
+func (d *Driver) Close() error {
+	return d.conn.Close()
+}
+
+//Send writes b to the server
+func (d *Driver) Send(b ...byte) {
+	d.t.Helper()
+	d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	if _, err := d.conn.Write(b); err != nil {
+		d.t.Fatalf("write % x: %v", b, err)
+	}
+}
+
+//Read reads exactly n bytes from the server
+func (d *Driver) Read(n int) []byte {
+	d.t.Helper()
+	b := make([]byte, n)
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	if _, err := io.ReadFull(d.conn, b); err != nil {
+		d.t.Fatalf("read %d bytes: %v", n, err)
+	}
+	return b
+}
+
+//Expect reads len(b) bytes from the server and asserts they are b
+func (d *Driver) Expect(b ...byte) {
+	d.t.Helper()
+	if got := d.Read(len(b)); !bytes.Equal(got, b) {
+		d.t.Fatalf("expected % x got % x", b, got)
+	}
+}
+
+//ExpectClosed asserts the server closes the connection without sending anything else
+func (d *Driver) ExpectClosed() {
+	d.t.Helper()
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	b := make([]byte, 1)
+	n, err := d.conn.Read(b)
+	if n > 0 {
+		d.t.Fatalf("expected the connection to be closed got % x", b[:n])
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		d.t.Fatal("expected the connection to be closed but it's still open")
+	}
+}
+
+//Greet sends a greeting offering methods and returns the method selected by the server
+func (d *Driver) Greet(methods ...byte) byte {
+	d.t.Helper()
+	d.Send(append([]byte{Version, byte(len(methods))}, methods...)...)
+	res := d.Read(2)
+	if res[0] != Version {
+		d.t.Fatalf("expected version %d in the method selection got % x", Version, res)
+	}
+	return res[1]
+}
+
+//Authenticate performs the RFC 1929 exchange and returns the status sent by the server
+func (d *Driver) Authenticate(username, password string) byte {
+	d.t.Helper()
+	req := []byte{0x01, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	d.Send(req...)
+
+	res := d.Read(2)
+	if res[0] != 0x01 {
+		d.t.Fatalf("expected subnegotiation version 1 got % x", res)
+	}
+	return res[1]
+}
+
+//Request sends a request for cmd, addr is the encoded address of type atyp without the port
+func (d *Driver) Request(cmd, atyp byte, addr []byte, port uint16) {
+	d.t.Helper()
+	req := append([]byte{Version, cmd, 0x00, atyp}, addr...)
+	req = append(req, byte(port>>8), byte(port))
+	d.Send(req...)
+}
+
+//RequestAddr sends a request for cmd to the host:port addr encoded with the matching type
+func (d *Driver) RequestAddr(cmd byte, addr string) {
+	d.t.Helper()
+	atyp, a, port := encodeAddr(d.t, addr)
+	d.Request(cmd, atyp, a, port)
+}
+
+//Reply is a reply of the server
+type Reply struct {
+	Code     byte
+	AddrType byte
+	//Addr is the encoded address without the port
+	Addr []byte
+	Port uint16
+}
+
+//Host returns the address of the reply as a string
+func (r *Reply) Host() string {
+	if r.AddrType == AtypDomain {
+		return string(r.Addr[1:])
+	}
+	return net.IP(r.Addr).String()
+}
+
+//String returns the host:port of the reply
+func (r *Reply) String() string {
+	return net.JoinHostPort(r.Host(), strconv.Itoa(int(r.Port)))
+}
+
+//ExpectReply reads a reply asserting the version, the reserved byte, the address type and
+//that the address is complete
+func (d *Driver) ExpectReply() *Reply {
+	d.t.Helper()
+	hdr := d.Read(4)
+	if hdr[0] != Version {
+		d.t.Fatalf("expected version %d in the reply got % x", Version, hdr)
+	}
+	if hdr[2] != 0x00 {
+		d.t.Fatalf("expected a zero reserved byte in the reply got % x", hdr)
+	}
+
+	r := &Reply{Code: hdr[1], AddrType: hdr[3]}
+	switch r.AddrType {
+	case AtypIPv4:
+		r.Addr = d.Read(net.IPv4len)
+	case AtypIPv6:
+		r.Addr = d.Read(net.IPv6len)
+	case AtypDomain:
+		l := d.Read(1)
+		if l[0] == 0 {
+			d.t.Fatal("expected a non empty domain in the reply")
+		}
+		r.Addr = append(l, d.Read(int(l[0]))...)
+	default:
+		d.t.Fatalf("invalid address type in the reply % x", hdr)
+	}
+	r.Port = binary.BigEndian.Uint16(d.Read(2))
+	return r
+}
+
+//ExpectSuccess reads a reply and asserts it succeeded
+func (d *Driver) ExpectSuccess() *Reply {
+	d.t.Helper()
+	r := d.ExpectReply()
+	if r.Code != ReplySucceeded {
+		d.t.Fatalf("expected success got reply code %d", r.Code)
+	}
+	return r
+}
+
+//Handshake negotiates the method of opts and authenticates if required
+func (d *Driver) Handshake(opts Options) {
+	d.t.Helper()
+	if m := d.Greet(opts.method()); m != opts.method() {
+		d.t.Fatalf("expected method %d got %d", opts.method(), m)
+	}
+	if opts.auth() {
+		if status := d.Authenticate(opts.Username, opts.Password); status != 0x00 {
+			d.t.Fatalf("expected authentication to succeed got status %d", status)
+		}
+	}
+}
+
+//Echo sends payload over the relayed connection and expects it back
+func (d *Driver) Echo(payload string) {
+	d.t.Helper()
+	d.Send([]byte(payload)...)
+	d.Expect([]byte(payload)...)
+}
+
+func checkGreeting(t *testing.T, addr string, opts *Options) {
+	accepted := opts.method()
+	tts := []struct {
+		name    string
+		methods []byte
+	}{
+		{"no auth", []byte{MethodNoAuth}},
+		{"username", []byte{MethodUserPass}},
+		{"both", []byte{MethodNoAuth, MethodUserPass}},
+		{"both reversed", []byte{MethodUserPass, MethodNoAuth}},
+		{"gssapi", []byte{MethodGSSAPI}},
+		{"private and both", []byte{0x80, MethodNoAuth, MethodUserPass}},
+		{"none", []byte{}},
+	}
+
+	for _, tt := range tts {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Dial(t, addr, opts.timeout())
+			defer d.Close()
+
+			expected := MethodNoAcceptable
+			if bytes.IndexByte(tt.methods, accepted) >= 0 {
+				expected = accepted
+			}
+			if m := d.Greet(tt.methods...); m != expected {
+				t.Fatalf("offered % x expected method %d got %d", tt.methods, expected, m)
+			}
+			if expected == MethodNoAcceptable {
+				d.ExpectClosed()
+			}
+		})
+	}
+
+	t.Run("version", func(t *testing.T) {
+		d := Dial(t, addr, opts.timeout())
+		defer d.Close()
+		d.Send(0x04, 0x01, MethodNoAuth)
+		d.ExpectClosed()
+	})
+}
+
+func checkAuth(t *testing.T, addr string, opts *Options) {
+	t.Run("success", func(t *testing.T) {
+		d := Dial(t, addr, opts.timeout())
+		defer d.Close()
+		d.Greet(MethodUserPass)
+		if status := d.Authenticate(opts.Username, opts.Password); status != 0x00 {
+			t.Fatalf("expected status 0 got %d", status)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		d := Dial(t, addr, opts.timeout())
+		defer d.Close()
+		d.Greet(MethodUserPass)
+		if status := d.Authenticate(opts.Username, opts.Password+"x"); status == 0x00 {
+			t.Fatal("expected a failure status for a wrong password")
+		}
+		d.ExpectClosed()
+	})
+}
+
+func checkConnect(t *testing.T, addr string, opts *Options) {
+	connect := func(t *testing.T, target string) {
+		d := Dial(t, addr, opts.timeout())
+		defer d.Close()
+		d.Handshake(*opts)
+		d.RequestAddr(CmdConnect, target)
+		d.ExpectSuccess()
+		d.Echo("conformance " + target)
+	}
+
+	t.Run("ipv4", func(t *testing.T) {
+		connect(t, opts.Target)
+	})
+
+	t.Run("domain", func(t *testing.T) {
+		host, port, _ := net.SplitHostPort(opts.Target)
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsLoopback() {
+				t.Skip("the target has no domain name")
+			}
+			host = "localhost"
+		}
+		connect(t, net.JoinHostPort(host, port))
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		l, err := net.Listen("tcp6", "[::1]:0")
+		if err != nil {
+			t.Skip("ipv6 isn't available")
+		}
+		l.Close()
+		l = listenEcho(t, "tcp6", "[::1]:0")
+		defer l.Close()
+		connect(t, l.Addr().String())
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := l.Addr().String()
+		l.Close()
+
+		d := Dial(t, addr, opts.timeout())
+		defer d.Close()
+		d.Handshake(*opts)
+		d.RequestAddr(CmdConnect, closed)
+		r := d.ExpectReply()
+		if r.Code == ReplySucceeded || r.Code > ReplyAddressNotSupported {
+			t.Fatalf("expected a failure reply code got %d", r.Code)
+		}
+		d.ExpectClosed()
+	})
+
+	t.Run("address type", func(t *testing.T) {
+		d := Dial(t, addr, opts.timeout())
+		defer d.Close()
+		d.Handshake(*opts)
+		d.Request(CmdConnect, 0x05, []byte{127, 0, 0, 1}, 80)
+		if r := d.ExpectReply(); r.Code != ReplyAddressNotSupported {
+			t.Fatalf("expected reply code %d got %d", ReplyAddressNotSupported, r.Code)
+		}
+	})
+}
+
+func checkCommands(t *testing.T, addr string, opts *Options) {
+	unsupported := []byte{0xFE}
+	if !opts.Bind {
+		unsupported = append(unsupported, CmdBind)
+	}
+	if !opts.UDP {
+		unsupported = append(unsupported, CmdUDPAssociate)
+	}
+
+	for _, cmd := range unsupported {
+		t.Run(strconv.Itoa(int(cmd)), func(t *testing.T) {
+			d := Dial(t, addr, opts.timeout())
+			defer d.Close()
+			d.Handshake(*opts)
+			d.RequestAddr(cmd, opts.Target)
+			if r := d.ExpectReply(); r.Code != ReplyCommandNotSupported {
+				t.Fatalf("expected reply code %d got %d", ReplyCommandNotSupported, r.Code)
+			}
+		})
+	}
+}
+
+func checkBind(t *testing.T, addr string, opts *Options) {
+	d := Dial(t, addr, opts.timeout())
+	defer d.Close()
+	d.Handshake(*opts)
+	d.Request(CmdBind, AtypIPv4, []byte{0, 0, 0, 0}, 0)
+
+	first := d.ExpectSuccess()
+	if first.Port == 0 {
+		t.Fatal("expected a port in the first reply")
+	}
+
+	peer, err := net.DialTimeout("tcp", reachable(first, addr), opts.timeout())
+	if err != nil {
+		t.Fatalf("dial the bound address %s: %v", first, err)
+	}
+	defer peer.Close()
+
+	second := d.ExpectSuccess()
+	local := peer.LocalAddr().(*net.TCPAddr)
+	if int(second.Port) != local.Port || !net.ParseIP(second.Host()).Equal(local.IP) {
+		t.Fatalf("expected the peer address %v in the second reply got %v", local, second)
+	}
+
+	//data flows both ways
+	peer.SetDeadline(time.Now().Add(opts.timeout()))
+	d.Send([]byte("to peer")...)
+	b := make([]byte, len("to peer"))
+	if _, err := io.ReadFull(peer, b); err != nil || string(b) != "to peer" {
+		t.Fatalf("expected %q at the peer got %q: %v", "to peer", b, err)
+	}
+	if _, err := peer.Write([]byte("to client")); err != nil {
+		t.Fatal(err)
+	}
+	d.Expect([]byte("to client")...)
+}
+
+func checkUDP(t *testing.T, addr string, opts *Options) {
+	target := opts.UDPTarget
+	if target == "" {
+		c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		go func() {
+			b := make([]byte, 65535)
+			for {
+				n, src, err := c.ReadFrom(b)
+				if err != nil {
+					return
+				}
+				c.WriteTo(b[:n], src)
+			}
+		}()
+		target = c.LocalAddr().String()
+	}
+	targetAtyp, targetAddr, targetPort := encodeAddr(t, target)
+
+	d := Dial(t, addr, opts.timeout())
+	defer d.Close()
+	d.Handshake(*opts)
+	d.Request(CmdUDPAssociate, AtypIPv4, []byte{0, 0, 0, 0}, 0)
+	relay := d.ExpectSuccess()
+	if relay.Port == 0 {
+		t.Fatal("expected a port in the reply")
+	}
+
+	c, err := net.Dial("udp", reachable(relay, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	//the reply header carries the address of the target whatever the request header used
+	expectedHdr := append([]byte{0, 0, 0, targetAtyp}, targetAddr...)
+	expectedHdr = append(expectedHdr, byte(targetPort>>8), byte(targetPort))
+
+	exchange := func(t *testing.T, hdr []byte, payload string) {
+		datagram := append(append([]byte{}, hdr...), payload...)
+		b := make([]byte, 65535)
+		//datagrams may be lost, retry a few times
+		for i := 0; i < 3; i++ {
+			if _, err := c.Write(datagram); err != nil {
+				t.Fatal(err)
+			}
+			c.SetReadDeadline(time.Now().Add(opts.timeout() / 3))
+			n, err := c.Read(b)
+			if err != nil {
+				continue
+			}
+			expected := append(append([]byte{}, expectedHdr...), payload...)
+			if !bytes.Equal(b[:n], expected) {
+				t.Fatalf("expected % x got % x", expected, b[:n])
+			}
+			return
+		}
+		t.Fatal("no response from the relay")
+	}
+
+	t.Run("ipv4", func(t *testing.T) {
+		exchange(t, expectedHdr, "udp ipv4")
+	})
+
+	t.Run("domain", func(t *testing.T) {
+		host, _, _ := net.SplitHostPort(target)
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsLoopback() {
+				t.Skip("the target has no domain name")
+			}
+			host = "localhost"
+		}
+		hdr := []byte{0, 0, 0, AtypDomain, byte(len(host))}
+		hdr = append(hdr, host...)
+		hdr = append(hdr, byte(targetPort>>8), byte(targetPort))
+		exchange(t, hdr, "udp domain")
+	})
+
+	t.Run("fragment", func(t *testing.T) {
+		hdr := append([]byte{}, expectedHdr...)
+		hdr[2] = 1
+		if _, err := c.Write(append(hdr, "fragment"...)); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		b := make([]byte, 65535)
+		if n, err := c.Read(b); err == nil {
+			t.Fatalf("expected fragments to be dropped got % x", b[:n])
+		}
+	})
+}
+
+//reachable returns the address of r with an unspecified IP replaced by the host of the server
+func reachable(r *Reply, server string) string {
+	host := r.Host()
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host, _, _ = net.SplitHostPort(server)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+}
+
+//encodeAddr returns the address type, the encoded address and the port of the host:port addr
+func encodeAddr(t testing.TB, addr string) (byte, []byte, uint16) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return AtypDomain, append([]byte{byte(len(host))}, host...), uint16(p)
+	case ip.To4() != nil:
+		return AtypIPv4, ip.To4(), uint16(p)
+	default:
+		return AtypIPv6, ip.To16(), uint16(p)
+	}
+}
+
+func listenEcho(t testing.TB, network, addr string) net.Listener {
+	t.Helper()
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
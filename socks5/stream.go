@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"context"
+	"io"
+)
+
+//Direction is the direction bytes are relayed in
+type Direction int
+
+const (
+	//DirectionClientToTarget is the stream from the client to the target
+	DirectionClientToTarget Direction = iota
+	//DirectionTargetToClient is the stream from the target to the client
+	DirectionTargetToClient
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionClientToTarget:
+		return "client->target"
+	case DirectionTargetToClient:
+		return "target->client"
+	}
+	return "unknown"
+}
+
+//StreamWrapper wraps a stream of a relay, rw reads from the source and writes to the
+//destination of the direction. The relay copies from the returned ReadWriter to itself until
+//its Read fails, io.EOF included, and closes it then if it's an io.Closer so buffered bytes can
+//be flushed. Returning rw keeps the relay as if there was no wrapper, e.g. splicing on linux.
+//ctx is canceled once the session is over or the server is closed
+type StreamWrapper func(ctx context.Context, d Direction, info SessionInfo, rw io.ReadWriter) io.ReadWriter
+
+//WithStreamWrapper wraps both streams of every relayed session with w, it's called once per
+//direction just before the copying starts
+func WithStreamWrapper(w StreamWrapper) Option {
+	return func(s *Server) {
+		s.streamWrapper = w
+	}
+}
+
+//relayStream is the stream handed to a StreamWrapper
+type relayStream struct {
+	io.Reader
+	io.Writer
+}
+
+//copy copies src to dst through the stream wrapper of the session if there's one
+func (c *conn) copy(d Direction, dst io.Writer, src io.Reader) (int64, error) {
+	if c.wrap == nil {
+		return io.Copy(dst, src)
+	}
+	rs := &relayStream{Reader: src, Writer: dst}
+	w := c.wrap(d, rs)
+	if w == nil || w == io.ReadWriter(rs) {
+		return io.Copy(dst, src)
+	}
+	//the wrapper's own ReadFrom or WriteTo would skip its Read or Write
+	n, err := io.Copy(struct{ io.Writer }{w}, struct{ io.Reader }{w})
+	if wc, ok := w.(io.Closer); ok {
+		if cerr := wc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return n, err
+}
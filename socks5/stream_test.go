@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//upperStream uppercases what's read from its source and records how it was used
+type upperStream struct {
+	io.ReadWriter
+	eof    bool
+	closed bool
+}
+
+func (u *upperStream) Read(b []byte) (int, error) {
+	n, err := u.ReadWriter.Read(b)
+	copy(b, bytes.ToUpper(b[:n]))
+	if err == io.EOF {
+		u.eof = true
+	}
+	return n, err
+}
+
+func (u *upperStream) Close() error {
+	u.closed = true
+	return nil
+}
+
+func TestStreamWrapper(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("hello from the target"))
+		b, _ := ioutil.ReadAll(c)
+		received <- b
+	}()
+
+	var mu sync.Mutex
+	var upper *upperStream
+	directions := make(map[Direction]SessionInfo)
+	wrapped := make(chan struct{})
+	s, proxy := newTestServer(t, WithStreamWrapper(func(ctx context.Context, d Direction, info SessionInfo, rw io.ReadWriter) io.ReadWriter {
+		mu.Lock()
+		defer mu.Unlock()
+		directions[d] = info
+		if d != DirectionClientToTarget {
+			return rw
+		}
+		upper = &upperStream{ReadWriter: rw}
+		go func() {
+			<-ctx.Done()
+			close(wrapped)
+		}()
+		return upper
+	}))
+	defer s.Close()
+
+	c, err := NewClient(proxy).Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("hello from the client"))
+	c.(interface{ CloseWrite() error }).CloseWrite()
+
+	//the bytes to the target are transformed and the ones from the target aren't
+	b := make([]byte, len("hello from the target"))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello from the target" {
+		t.Errorf("expected the target's bytes untouched got %q %v", b, err)
+	}
+	select {
+	case b := <-received:
+		if string(b) != "HELLO FROM THE CLIENT" {
+			t.Errorf("expected the client's bytes uppercased got %q", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the target received nothing")
+	}
+	c.Close()
+
+	select {
+	case <-wrapped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the context of the wrapper wasn't canceled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !upper.eof || !upper.closed {
+		t.Errorf("expected the wrapper to see EOF and be closed got %+v", upper)
+	}
+	for _, d := range []Direction{DirectionClientToTarget, DirectionTargetToClient} {
+		if info, ok := directions[d]; !ok || info.Command != CommandConnect || info.Dest.String() != target.Addr().String() {
+			t.Errorf("%v: unexpected session %+v", d, info)
+		}
+	}
+}
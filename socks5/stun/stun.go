@@ -0,0 +1,289 @@
+//Package stun discovers the public address of the host using STUN binding requests (RFC 5389)
+//so BIND and UDP ASSOCIATE replies advertise an address reachable from behind a NAT
+package stun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+const (
+	magicCookie     uint32 = 0x2112A442
+	headerLen              = 20
+	bindingRequest  uint16 = 0x0001
+	bindingResponse uint16 = 0x0101
+
+	attrMappedAddress    uint16 = 0x0001
+	attrXorMappedAddress uint16 = 0x0020
+
+	familyIPv4 byte = 0x01
+	familyIPv6 byte = 0x02
+)
+
+//ErrInvalidResponse is returned if the STUN server sends a malformed or unexpected response
+var ErrInvalidResponse = errors.New("stun: invalid response")
+
+//ErrNoAddress is returned if none of the servers returned a mapped address
+var ErrNoAddress = errors.New("stun: no mapped address")
+
+//Discoverer periodically queries STUN servers for the public IPv4 and IPv6 address
+type Discoverer struct {
+	//Servers are the host:port addresses of the STUN servers, they are tried in order
+	Servers []string
+
+	//TTL is how long a discovered address is used before querying again
+	TTL time.Duration
+
+	//Timeout is the time to wait for a response from a single server
+	Timeout time.Duration
+
+	//MinBackoff and MaxBackoff bound the delay between queries after a failure or a change
+	MinBackoff, MaxBackoff time.Duration
+
+	//Logger receives the discovered addresses and the failures of Run, nothing is logged if nil
+	Logger socks5.Logger
+
+	mu   sync.RWMutex
+	ipv4 net.IP
+	ipv6 net.IP
+}
+
+//New returns a Discoverer for the given STUN servers with sane defaults
+func New(servers ...string) *Discoverer {
+	return &Discoverer{
+		Servers:    servers,
+		TTL:        5 * time.Minute,
+		Timeout:    3 * time.Second,
+		MinBackoff: time.Second,
+		MaxBackoff: 5 * time.Minute,
+	}
+}
+
+//Run queries the servers until ctx is done, the address is refreshed every TTL and retried
+//with exponential backoff if the query fails or the mapped address changed
+func (d *Discoverer) Run(ctx context.Context) error {
+	backoff := d.MinBackoff
+	for {
+		changed, err := d.Refresh(ctx)
+		if err != nil {
+			d.logf(socks5.LevelError, "stun: discovery failed: %v", err)
+		}
+
+		wait := d.TTL
+		if err != nil || changed {
+			wait = backoff
+			if backoff *= 2; backoff > d.MaxBackoff {
+				backoff = d.MaxBackoff
+			}
+		} else {
+			backoff = d.MinBackoff
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//Refresh queries the servers once for both address families and reports whether the
+//discovered address changed
+func (d *Discoverer) Refresh(ctx context.Context) (changed bool, err error) {
+	ipv4, err4 := d.Discover(ctx, "udp4")
+	ipv6, err6 := d.Discover(ctx, "udp6")
+	if err4 != nil && err6 != nil {
+		return false, err4
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err4 == nil && !ipv4.Equal(d.ipv4) {
+		d.logf(socks5.LevelInfo, "stun: discovered public address %v", ipv4)
+		d.ipv4, changed = ipv4, d.ipv4 != nil
+	}
+	if err6 == nil && !ipv6.Equal(d.ipv6) {
+		d.logf(socks5.LevelInfo, "stun: discovered public address %v", ipv6)
+		d.ipv6, changed = ipv6, changed || d.ipv6 != nil
+	}
+	return changed, nil
+}
+
+func (d *Discoverer) logf(level socks5.Level, format string, args ...interface{}) {
+	if d.Logger != nil {
+		d.Logger.Log(level, fmt.Sprintf(format, args...))
+	}
+}
+
+//Discover returns the mapped address of the first server that answers over network
+func (d *Discoverer) Discover(ctx context.Context, network string) (net.IP, error) {
+	err := ErrNoAddress
+	for _, server := range d.Servers {
+		var addr *net.UDPAddr
+		addr, err = query(ctx, network, server, d.Timeout)
+		if err == nil {
+			return addr.IP, nil
+		}
+	}
+	return nil, err
+}
+
+//IP returns the discovered address of the same family as ip, or the other family if unknown
+func (d *Discoverer) IP(ip net.IP) net.IP {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if ip.To4() == nil && d.ipv6 != nil {
+		return d.ipv6
+	}
+	if d.ipv4 != nil {
+		return d.ipv4
+	}
+	return d.ipv6
+}
+
+//AddrProvider returns a socks5.AddrProvider replacing the host of the bound address with the
+//discovered public address, the address is left unchanged until one is discovered
+func (d *Discoverer) AddrProvider() socks5.AddrProvider {
+	return func(addr net.Addr) string {
+		host, port, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		ip := d.IP(net.ParseIP(host))
+		if ip == nil {
+			return addr.String()
+		}
+		return net.JoinHostPort(ip.String(), port)
+	}
+}
+
+func query(ctx context.Context, network, server string, timeout time.Duration) (*net.UDPAddr, error) {
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.SetDeadline(deadline)
+
+	req := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(req[0:], bindingRequest)
+	binary.BigEndian.PutUint32(req[4:], magicCookie)
+	if _, err := rand.Read(req[8:headerLen]); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 1500)
+	for {
+		n, err := c.Read(res)
+		if err != nil {
+			return nil, err
+		}
+		//ignore stray datagrams of other transactions
+		if n < headerLen || string(res[8:headerLen]) != string(req[8:headerLen]) {
+			continue
+		}
+		return parseResponse(res[:n])
+	}
+}
+
+//parseResponse returns the (XOR-)MAPPED-ADDRESS of a binding success response
+func parseResponse(b []byte) (*net.UDPAddr, error) {
+	if len(b) < headerLen || binary.BigEndian.Uint16(b[0:]) != bindingResponse ||
+		binary.BigEndian.Uint32(b[4:]) != magicCookie {
+		return nil, ErrInvalidResponse
+	}
+
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if headerLen+length > len(b) {
+		return nil, ErrInvalidResponse
+	}
+
+	var mapped *net.UDPAddr
+	attrs := b[headerLen : headerLen+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			return nil, ErrInvalidResponse
+		}
+		value := attrs[4 : 4+l]
+
+		switch typ {
+		case attrXorMappedAddress:
+			addr, err := parseAddress(value, b[4:headerLen])
+			if err != nil {
+				return nil, err
+			}
+			return addr, nil
+		case attrMappedAddress:
+			addr, err := parseAddress(value, nil)
+			if err != nil {
+				return nil, err
+			}
+			mapped = addr
+		}
+
+		//attributes are padded to a multiple of 4 bytes
+		pad := (4 - l%4) % 4
+		if 4+l+pad > len(attrs) {
+			break
+		}
+		attrs = attrs[4+l+pad:]
+	}
+
+	if mapped == nil {
+		return nil, ErrNoAddress
+	}
+	return mapped, nil
+}
+
+//parseAddress decodes an address attribute, xor is the magic cookie followed by the
+//transaction id for XOR-MAPPED-ADDRESS or nil for MAPPED-ADDRESS
+func parseAddress(b, xor []byte) (*net.UDPAddr, error) {
+	if len(b) < 4 {
+		return nil, ErrInvalidResponse
+	}
+
+	ipLen := 0
+	switch b[1] {
+	case familyIPv4:
+		ipLen = net.IPv4len
+	case familyIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, ErrInvalidResponse
+	}
+	if len(b) < 4+ipLen {
+		return nil, ErrInvalidResponse
+	}
+
+	port := binary.BigEndian.Uint16(b[2:])
+	ip := make(net.IP, ipLen)
+	copy(ip, b[4:4+ipLen])
+
+	if xor != nil {
+		port ^= uint16(magicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
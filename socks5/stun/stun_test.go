@@ -0,0 +1,187 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abdullah2993/socks5-server/socks5"
+)
+
+//responder is a minimal STUN server answering binding requests with a mocked mapping
+type responder struct {
+	c net.PacketConn
+
+	mu     sync.Mutex
+	mapped *net.UDPAddr
+	xor    bool
+}
+
+func newResponder(t *testing.T, mapped *net.UDPAddr) *responder {
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &responder{c: c, mapped: mapped, xor: true}
+	go r.serve()
+	return r
+}
+
+func (r *responder) setMapped(addr *net.UDPAddr) {
+	r.mu.Lock()
+	r.mapped = addr
+	r.mu.Unlock()
+}
+
+func (r *responder) serve() {
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := r.c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if n < headerLen || binary.BigEndian.Uint16(b) != bindingRequest {
+			continue
+		}
+		r.mu.Lock()
+		res := encodeResponse(b[8:headerLen], r.mapped, r.xor)
+		r.mu.Unlock()
+		r.c.WriteTo(res, addr)
+	}
+}
+
+func encodeResponse(txID []byte, mapped *net.UDPAddr, xor bool) []byte {
+	ip := mapped.IP.To4()
+	family := familyIPv4
+	if ip == nil {
+		ip = mapped.IP.To16()
+		family = familyIPv6
+	}
+
+	res := make([]byte, headerLen+8+len(ip))
+	binary.BigEndian.PutUint16(res[0:], bindingResponse)
+	binary.BigEndian.PutUint16(res[2:], uint16(4+4+len(ip)))
+	binary.BigEndian.PutUint32(res[4:], magicCookie)
+	copy(res[8:], txID)
+
+	attr := res[headerLen:]
+	binary.BigEndian.PutUint16(attr[0:], attrMappedAddress)
+	if xor {
+		binary.BigEndian.PutUint16(attr[0:], attrXorMappedAddress)
+	}
+	binary.BigEndian.PutUint16(attr[2:], uint16(4+len(ip)))
+	attr[5] = family
+	port := uint16(mapped.Port)
+	value := append([]byte{}, ip...)
+	if xor {
+		port ^= uint16(magicCookie >> 16)
+		for i := range value {
+			value[i] ^= res[4+i]
+		}
+	}
+	binary.BigEndian.PutUint16(attr[6:], port)
+	copy(attr[8:], value)
+	return res
+}
+
+func TestParseResponse(t *testing.T) {
+	txID := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	tts := []*net.UDPAddr{
+		{IP: net.ParseIP("203.0.113.1").To4(), Port: 41000},
+		{IP: net.ParseIP("2001:db8::1"), Port: 5555},
+	}
+
+	for _, tt := range tts {
+		for _, xor := range []bool{true, false} {
+			addr, err := parseResponse(encodeResponse(txID, tt, xor))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !addr.IP.Equal(tt.IP) || addr.Port != tt.Port {
+				t.Errorf("expected %v got %v", tt, addr)
+			}
+		}
+	}
+
+	if _, err := parseResponse([]byte{1, 1, 0, 0}); err != ErrInvalidResponse {
+		t.Errorf("expected %v got %v", ErrInvalidResponse, err)
+	}
+}
+
+func TestAddrProviderUpdates(t *testing.T) {
+	r := newResponder(t, &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 41000})
+	defer r.c.Close()
+
+	d := New("127.0.0.1:1", r.c.LocalAddr().String())
+	d.Timeout = 100 * time.Millisecond
+	d.TTL = 10 * time.Millisecond
+	d.MinBackoff = 10 * time.Millisecond
+	logs := &recordingLogger{}
+	d.Logger = logs
+
+	provider := d.AddrProvider()
+	local := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5555}
+	if addr := provider(local); addr != "192.168.1.10:5555" {
+		t.Errorf("expected unchanged address before discovery got %s", addr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	waitFor(t, func() bool { return provider(local) == "203.0.113.1:5555" })
+
+	r.setMapped(&net.UDPAddr{IP: net.ParseIP("203.0.113.2"), Port: 41000})
+	waitFor(t, func() bool { return provider(local) == "203.0.113.2:5555" })
+	waitFor(t, func() bool { return logs.has(socks5.LevelInfo, "stun: discovered public address 203.0.113.2") })
+}
+
+func TestRunLogsFailures(t *testing.T) {
+	d := New("127.0.0.1:1")
+	d.Timeout = 10 * time.Millisecond
+	d.MinBackoff = 10 * time.Millisecond
+	logs := &recordingLogger{}
+	d.Logger = logs
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	waitFor(t, func() bool { return logs.has(socks5.LevelError, "stun: discovery failed") })
+}
+
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (r *recordingLogger) Log(level socks5.Level, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, level.String()+": "+msg)
+}
+
+func (r *recordingLogger) has(level socks5.Level, prefix string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, msg := range r.msgs {
+		if strings.HasPrefix(msg, level.String()+": "+prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
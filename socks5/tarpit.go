@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//tarpitReadSize and tarpitReadInterval are how much of what a held client sends is read and
+	//how often, slow enough for its sends to stall once the windows are full
+	tarpitReadSize     = 16
+	tarpitReadInterval = time.Second
+	//tarpitWriteInterval is how often a byte is written to a held client so it keeps waiting
+	tarpitWriteInterval = 5 * time.Second
+)
+
+//ClientRuleset is a Ruleset which can tell the clients it denies every request of, with a tarpit
+//those are held before their handshake instead of being answered with ReplyNotAllowedByRuleset
+type ClientRuleset interface {
+	Ruleset
+	AllowClient(client net.Addr) bool
+}
+
+//tarpit holds the connections of unwanted clients until maxHold is over
+type tarpit struct {
+	//held is first for 64-bit alignment
+	held    int64
+	maxHold time.Duration
+	max     int64
+}
+
+//WithTarpit holds the connections of banned clients, of clients the ClientRuleset denies and of
+//clients not speaking SOCKS5 for up to maxHold instead of closing them, trickling what they send
+//and writing a byte every few seconds so scanners waste their time. At most maxConcurrent
+//connections are held, the others are closed as without a tarpit. The held connections aren't
+//sessions, they don't count in ActiveSessions nor hold Shutdown back
+func WithTarpit(maxHold time.Duration, maxConcurrent int) Option {
+	return func(s *Server) {
+		s.tarpit = &tarpit{maxHold: maxHold, max: int64(maxConcurrent)}
+	}
+}
+
+//Tarpitted returns the number of connections held by the tarpit
+func (s *Server) Tarpitted() int {
+	if s.tarpit == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&s.tarpit.held))
+}
+
+//tarpitConn holds c in the background if the tarpit has room and reports whether it does, c is
+//closed once it's released
+func (s *Server) tarpitConn(c net.Conn) bool {
+	t := s.tarpit
+	if t == nil || t.maxHold <= 0 {
+		return false
+	}
+	if atomic.AddInt64(&t.held, 1) > t.max {
+		atomic.AddInt64(&t.held, -1)
+		return false
+	}
+	s.logf(LevelDebug, "tarpitting %s", s.Redaction.client(c.RemoteAddr()))
+	go func() {
+		defer atomic.AddInt64(&t.held, -1)
+		t.hold(c, s.getDoneChan())
+	}()
+	return true
+}
+
+//hold reads and writes c slowly until maxHold is over, the client gives up or done is closed
+func (t *tarpit) hold(c net.Conn, done <-chan struct{}) {
+	defer c.Close()
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		buf := make([]byte, tarpitReadSize)
+		for {
+			if _, err := c.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(tarpitReadInterval)
+		}
+	}()
+
+	timer := time.NewTimer(t.maxHold)
+	defer timer.Stop()
+	ticker := time.NewTicker(tarpitWriteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.SetWriteDeadline(time.Now().Add(tarpitWriteInterval))
+			if _, err := c.Write([]byte{0}); err != nil {
+				return
+			}
+		case <-timer.C:
+			return
+		case <-gone:
+			return
+		case <-done:
+			return
+		}
+	}
+}
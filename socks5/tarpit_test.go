@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//closedWithin reports whether the server closes c within d
+func closedWithin(c net.Conn, d time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(d))
+	_, err := io.Copy(ioutil.Discard, c)
+	return err == nil
+}
+
+func TestTarpit(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader("deny client 127.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const hold = 300 * time.Millisecond
+	s, addr := newTestServer(t, WithTarpit(hold, 2), WithRuleset(acl))
+	defer s.Close()
+
+	tts := []struct {
+		name  string
+		dial  func() (net.Conn, error)
+		setup func()
+		send  []byte
+	}{
+		{"not socks5", func() (net.Conn, error) { return net.Dial("tcp", addr) }, nil, []byte("GET / HTTP/1.1\r\n\r\n")},
+		{"banned", func() (net.Conn, error) { return net.Dial("tcp", addr) },
+			func() { s.Ban(net.ParseIP("127.0.0.1"), time.Minute, "scanning") }, []byte{5, 1, 0}},
+		{"denied client", func() (net.Conn, error) {
+			return (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}).Dial("tcp", addr)
+		}, nil, []byte{5, 1, 0}},
+	}
+	for _, tt := range tts {
+		if tt.setup != nil {
+			tt.setup()
+		}
+		c, err := tt.dial()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		start := time.Now()
+		c.Write(tt.send)
+		if !closedWithin(c, 5*time.Second) {
+			t.Errorf("%s: expected the connection to be closed", tt.name)
+		}
+		if d := time.Since(start); d < hold-50*time.Millisecond {
+			t.Errorf("%s: expected the connection to be held for %v got %v", tt.name, hold, d)
+		}
+		c.Close()
+	}
+}
+
+func TestTarpitCap(t *testing.T) {
+	s, addr := newTestServer(t, WithTarpit(time.Minute, 2))
+	defer s.Close()
+
+	var held []net.Conn
+	defer func() {
+		for _, c := range held {
+			c.Close()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, c)
+		c.Write([]byte{4, 1})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Tarpitted() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Tarpitted() != 2 {
+		t.Fatalf("expected 2 tarpitted connections got %d", s.Tarpitted())
+	}
+	if n := s.ActiveSessions(); n != 0 {
+		t.Errorf("expected the tarpitted connections not to be sessions got %d", n)
+	}
+
+	//over the cap the connections are closed right away
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{4, 1})
+	if !closedWithin(c, time.Second) {
+		t.Error("expected the connection over the cap to be closed")
+	}
+
+	//a legit client isn't affected by the tarpit being full
+	echo := newEchoServer(t)
+	defer echo.Close()
+	pc, err := NewClient(addr).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(pc, b); err != nil || !bytes.Equal(b, []byte("ping")) {
+		t.Errorf("expected ping got %q %v", b, err)
+	}
+
+	//closing the server releases the tarpitted connections
+	s.Close()
+	for _, c := range held {
+		if !closedWithin(c, 5*time.Second) {
+			t.Error("expected the tarpitted connection to be closed with the server")
+		}
+	}
+}
+
+func TestACLAllowClient(t *testing.T) {
+	tts := []struct {
+		acl     string
+		client  string
+		allowed bool
+	}{
+		{"", "192.0.2.1", true},
+		{"default deny", "192.0.2.1", false},
+		{"deny client 192.0.2.0/24", "192.0.2.1", false},
+		{"deny client 192.0.2.0/24", "198.51.100.1", true},
+		{"deny client 192.0.2.1 ports 25\ndefault deny", "192.0.2.1", false},
+		{"deny client 192.0.2.1 ports 25", "192.0.2.1", true},
+		{"allow client 192.0.2.1 dst example.com\ndeny client 192.0.2.1", "192.0.2.1", true},
+		{"allow dst example.com\ndefault deny", "192.0.2.1", true},
+	}
+	for _, tt := range tts {
+		acl, err := ParseACL(strings.NewReader(tt.acl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := acl.AllowClient(&net.TCPAddr{IP: net.ParseIP(tt.client)}); allowed != tt.allowed {
+			t.Errorf("%q %s: expected %v got %v", tt.acl, tt.client, tt.allowed, allowed)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+//ErrNoCertReloader is returned by ReloadTLS if the server wasn't given a CertReloader
+var ErrNoCertReloader = errors.New("socks5: no certificate to reload")
+
+//WithTLS serves the listeners of ListenAndServe and ListenAll over TLS with config, the
+//config needs a certificate e.g. from GetCertificate of a CertReloader
+func WithTLS(config *tls.Config) Option {
+	return func(s *Server) {
+		s.TLSConfig = config
+	}
+}
+
+//WithCertReloader serves the certificate of r, it's reloaded by ReloadTLS and WatchTLS and its
+//expiry is exposed by MetricsHandler. The listeners are served over TLS with r.Config unless
+//TLSConfig is already set
+func WithCertReloader(r *CertReloader) Option {
+	return func(s *Server) {
+		s.certs = r
+		if s.TLSConfig == nil {
+			s.TLSConfig = r.Config()
+		}
+	}
+}
+
+//ReloadTLS reads the files of the CertReloader again, on failure the current certificate is
+//kept. The sessions already established aren't affected either way
+func (s *Server) ReloadTLS() error {
+	if s.certs == nil {
+		return ErrNoCertReloader
+	}
+	if err := s.certs.Reload(); err != nil {
+		s.logf(LevelError, "reloading the tls certificate failed, keeping the current one: %v", err)
+		return err
+	}
+	s.logf(LevelInfo, "reloaded the tls certificate, valid until %s", s.certs.NotAfter().Format(time.RFC3339))
+	return nil
+}
+
+//WatchTLS checks the files of the CertReloader every interval and reloads them once they
+//changed, e.g. when the certificate was renewed, until ctx is done
+func (s *Server) WatchTLS(ctx context.Context, interval time.Duration) error {
+	if s.certs == nil {
+		return ErrNoCertReloader
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.certs.Changed() {
+				s.ReloadTLS()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//CertReloader holds a certificate loaded from a pair of PEM files, Reload reads the files again
+//so a renewed certificate is served without restarting
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	//notAfter is when the certificate expires
+	notAfter time.Time
+	//stamp is the modification time and size of the files when they were last read
+	stamp [2]fileStamp
+}
+
+//fileStamp tells whether a file changed since it was read
+type fileStamp struct {
+	modTime, size int64
+}
+
+//NewCertReloader loads the certificate and key of certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//stamps returns the stamps of the files, a file that can't be read has a zero stamp
+func (r *CertReloader) stamps() [2]fileStamp {
+	var stamps [2]fileStamp
+	for i, path := range []string{r.certFile, r.keyFile} {
+		if fi, err := os.Stat(path); err == nil {
+			stamps[i] = fileStamp{fi.ModTime().UnixNano(), fi.Size()}
+		}
+	}
+	return stamps
+}
+
+//Reload reads the files again, on failure the current certificate is kept
+func (r *CertReloader) Reload() error {
+	stamp := r.stamps()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	//the files aren't read again by Changed until they change once more, whether they loaded
+	//or not
+	r.stamp = stamp
+	if err != nil {
+		return err
+	}
+	r.cert, r.notAfter = &cert, cert.Leaf.NotAfter
+	return nil
+}
+
+//Changed reports whether the files changed since they were last read by Reload
+func (r *CertReloader) Changed() bool {
+	stamp := r.stamps()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return stamp != r.stamp
+}
+
+//NotAfter returns when the current certificate expires
+func (r *CertReloader) NotAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.notAfter
+}
+
+//GetCertificate returns the current certificate, it's meant for tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+//Config returns a TLS config serving the current certificate
+func (r *CertReloader) Config() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate}
+}
@@ -0,0 +1,219 @@
+package socks5
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//writeTestCert writes a self-signed certificate named cn and its key to dir
+func writeTestCert(t *testing.T, dir, cn string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Cmds: []Command{CommandConnect}, TLSConfig: certs.Config()}
+	ls, err := s.ListenAll("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeAll(ls...)
+	defer s.Close()
+
+	//the greeting is answered over TLS with the current certificate
+	greet := func() string {
+		t.Helper()
+		c, err := tls.Dial("tcp", ls[0].Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write([]byte{5, 1, 0}); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c, b); err != nil || b[0] != 5 || b[1] != 0 {
+			t.Fatalf("unexpected greeting reply % x %v", b, err)
+		}
+		return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if cn := greet(); cn != "first" {
+		t.Errorf("expected the first certificate got %q", cn)
+	}
+
+	//a pair that fails to load keeps the current certificate
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := certs.Reload(); err == nil {
+		t.Error("expected the reload to fail")
+	}
+	if cn := greet(); cn != "first" {
+		t.Errorf("expected the first certificate to be kept got %q", cn)
+	}
+
+	writeTestCert(t, dir, "second")
+	if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := greet(); cn != "second" {
+		t.Errorf("expected the reloaded certificate got %q", cn)
+	}
+}
+
+func TestWatchTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	s := &Server{Cmds: []Command{CommandConnect}}
+	WithCertReloader(certs)(s)
+	ls, err := s.ListenAll("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeAll(ls...)
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.WatchTLS(ctx, 10*time.Millisecond)
+
+	//connect dials the echo server through the proxy and returns the name of the certificate
+	connect := func() (*tls.Conn, string) {
+		t.Helper()
+		c, err := tls.Dial("tcp", ls[0].Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		addr := echo.Addr().(*net.TCPAddr)
+		req := append([]byte{5, byte(CommandConnect), 0, 1}, addr.IP.To4()...)
+		c.Write([]byte{5, 1, 0})
+		c.Write(append(req, byte(addr.Port>>8), byte(addr.Port)))
+		b := make([]byte, 2+10)
+		if _, err := io.ReadFull(c, b); err != nil || b[1] != 0 || b[3] != 0 {
+			t.Fatalf("unexpected replies % x %v", b, err)
+		}
+		return c, c.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	echoes := func(c net.Conn) {
+		t.Helper()
+		b := make([]byte, 4)
+		c.Write([]byte("ping"))
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+			t.Errorf("expected the echo got %q %v", b, err)
+		}
+	}
+	notAfter := func() string {
+		rec := httptest.NewRecorder()
+		s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, "socks5_tls_cert_not_after_seconds ") {
+				return strings.TrimPrefix(line, "socks5_tls_cert_not_after_seconds ")
+			}
+		}
+		return ""
+	}
+
+	c, cn := connect()
+	defer c.Close()
+	if cn != "first" {
+		t.Errorf("expected the first certificate got %q", cn)
+	}
+	if n := notAfter(); n != strconv.FormatInt(certs.NotAfter().Unix(), 10) {
+		t.Errorf("expected the expiry of the first certificate got %q", n)
+	}
+	first := certs.NotAfter()
+
+	//the files are swapped and picked up without a signal
+	time.Sleep(time.Second)
+	writeTestCert(t, dir, "second")
+	deadline := time.Now().Add(5 * time.Second)
+	for certs.Changed() || certs.NotAfter().Equal(first) {
+		if time.Now().After(deadline) {
+			t.Fatal("the certificate wasn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c2, cn := connect()
+	defer c2.Close()
+	if cn != "second" {
+		t.Errorf("expected the reloaded certificate got %q", cn)
+	}
+	if n := notAfter(); n != strconv.FormatInt(certs.NotAfter().Unix(), 10) {
+		t.Errorf("expected the expiry of the second certificate got %q", n)
+	}
+	echoes(c2)
+	//the session established with the first certificate goes on
+	echoes(c)
+
+	if err := (&Server{}).ReloadTLS(); err != ErrNoCertReloader {
+		t.Errorf("expected %v got %v", ErrNoCertReloader, err)
+	}
+}
@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"net"
+	"strings"
+)
+
+const (
+	traceNegotiate = "negotiate"
+	traceAuth      = "auth"
+	traceRequest   = "request"
+	traceReply     = "reply"
+)
+
+//traceConn dumps the bytes exchanged with the client at LevelTrace, it wraps the conn of a
+//session until the reply to the request is written so relayed data is never dumped
+type traceConn struct {
+	net.Conn
+	s     *Server
+	id    string
+	phase string
+
+	//method is the negotiated method, the bytes a client sends to authenticate are masked
+	//except for the username of RFC1929
+	method AuthMethod
+	//auth is the RFC1929 request read so far
+	auth []byte
+}
+
+//trace starts dumping the handshake of c
+func (c *conn) trace(s *Server) {
+	c.Conn = &traceConn{Conn: c.Conn, s: s, id: c.id, phase: traceNegotiate}
+}
+
+//tracePhase labels the following bytes with phase, method is the negotiated method
+func (c *conn) tracePhase(phase string, method AuthMethod) {
+	if t, ok := c.Conn.(*traceConn); ok {
+		t.phase, t.method = phase, method
+	}
+}
+
+//untrace stops dumping the bytes exchanged with the client
+func (c *conn) untrace() {
+	if t, ok := c.Conn.(*traceConn); ok {
+		c.Conn = t.Conn
+	}
+}
+
+func (t *traceConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	if n > 0 {
+		t.dump("C->S", b[:n], t.masked)
+	}
+	return n, err
+}
+
+func (t *traceConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	if n > 0 {
+		t.dump("S->C", b[:n], nil)
+	}
+	return n, err
+}
+
+func (t *traceConn) dump(direction string, b []byte, masked func(byte) bool) {
+	var sb strings.Builder
+	for i, v := range b {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		if masked != nil && masked(v) {
+			sb.WriteString("**")
+			continue
+		}
+		sb.WriteByte("0123456789abcdef"[v>>4])
+		sb.WriteByte("0123456789abcdef"[v&0x0f])
+	}
+	t.s.logf(LevelTrace, "session %s %s %s %d bytes: %s", t.id, t.phase, direction, len(b), sb.String())
+}
+
+//masked reports whether v, the next byte read from the client, is to be masked
+func (t *traceConn) masked(v byte) bool {
+	if t.phase != traceAuth {
+		return false
+	}
+	if t.method != userPassAuth {
+		return true
+	}
+
+	//VER ULEN UNAME PLEN PASSWD
+	p := len(t.auth)
+	t.auth = append(t.auth, v)
+	if p < 2 {
+		return false
+	}
+	plen := 2 + int(t.auth[1])
+	return p > plen && p <= plen+int(t.auth[plen])
+}
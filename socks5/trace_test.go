@@ -0,0 +1,117 @@
+package socks5
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//captureLogger keeps the messages logged at LevelTrace
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *captureLogger) Log(level Level, msg string) {
+	if level != LevelTrace {
+		return
+	}
+	c.mu.Lock()
+	c.lines = append(c.lines, msg)
+	c.mu.Unlock()
+}
+
+//dumps returns the bytes dumped for every phase and direction joined in order
+func (c *captureLogger) dumps(t *testing.T) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dumps := make(map[string]string)
+	for _, line := range c.lines {
+		//session <id> <phase> <direction> <n> bytes: <hex>
+		f := strings.SplitN(line, " ", 7)
+		if len(f) != 7 || f[0] != "session" || f[5] != "bytes:" {
+			t.Fatalf("unexpected trace %q", line)
+		}
+		key := f[2] + " " + f[3]
+		if dumps[key] != "" {
+			dumps[key] += " "
+		}
+		dumps[key] += f[6]
+	}
+	return dumps
+}
+
+func TestTraceHandshake(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	tts := []struct {
+		name     string
+		opts     []Option
+		expected map[string]string
+		untraced bool
+	}{
+		{
+			name: "auth",
+			opts: []Option{WithAuth("user", "secret")},
+			expected: map[string]string{
+				"negotiate C->S": "05 02 00 02",
+				"negotiate S->C": "05 02",
+				"auth C->S":      "01 04 75 73 65 72 06 ** ** ** ** ** **",
+				"auth S->C":      "01 00",
+				"request C->S":   "05 01 00 01 7f 00 00 01",
+				"reply S->C":     "05 00 00 01 7f 00 00 01",
+			},
+		},
+		{
+			name:     "redacted",
+			opts:     []Option{WithAuth("user", "secret"), WithRedaction(RedactionPolicy{})},
+			untraced: true,
+		},
+	}
+
+	for _, tt := range tts {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := new(captureLogger)
+			s, proxy := newTestServer(t, append(tt.opts, WithLogger(logger, LevelTrace))...)
+			defer s.Close()
+
+			c, err := NewClient(proxy, WithClientAuth("user", "secret")).Dial("tcp", echo.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err := c.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+				t.Fatal(err)
+			}
+
+			dumps := logger.dumps(t)
+			if tt.untraced {
+				if len(dumps) != 0 {
+					t.Fatalf("expected no dumps got %v", dumps)
+				}
+				return
+			}
+			for key, prefix := range tt.expected {
+				if !strings.HasPrefix(dumps[key], prefix) {
+					t.Errorf("%s: expected %q got %q", key, prefix, dumps[key])
+				}
+			}
+			for key, dump := range dumps {
+				if _, ok := tt.expected[key]; !ok {
+					t.Errorf("unexpected dump %s: %s", key, dump)
+				}
+				if strings.Contains(dump, "68 65 6c 6c 6f") {
+					t.Errorf("%s: relayed payload dumped", key)
+				}
+				if strings.Contains(dump, "73 65 63 72 65 74") {
+					t.Errorf("%s: password dumped", key)
+				}
+			}
+		})
+	}
+}
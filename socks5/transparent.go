@@ -0,0 +1,42 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+//ErrNoOriginalDst is returned by ServeTransparent for the connections that weren't redirected
+//to the listener, e.g. clients connecting to it directly
+var ErrNoOriginalDst = errors.New("socks5: no original destination")
+
+//ServeTransparent accepts connections redirected to l by iptables REDIRECT or TPROXY rules and
+//serves each as a CONNECT to its original destination without a SOCKS5 handshake. The requests
+//go through the Ruleset, the Dialer, the capture and the accounting like the others and are
+//served even if CONNECT isn't one of Cmds. The original destination is looked up with
+//OriginalDst, by default with SO_ORIGINAL_DST or on a TPROXY listener from ListenTProxy the
+//local address, which is only supported on linux. l is closed on exit
+func (s *Server) ServeTransparent(l net.Listener) error {
+	return s.serve(l, s.serveTransparentConn, nil)
+}
+
+func (s *Server) serveTransparentConn(c net.Conn) error {
+	s.setKeepAlive(c, false)
+	if s.bannedAddr(c.RemoteAddr()) {
+		c.Close()
+		return ErrBanned
+	}
+
+	lookup := s.OriginalDst
+	if lookup == nil {
+		lookup = originalDst
+	}
+	dst, err := lookup(c)
+	if err != nil {
+		s.logf(LevelInfo, "transparent connection from %s: %v", s.Redaction.client(c.RemoteAddr()), err)
+		c.Close()
+		return err
+	}
+	tc := newConn(c)
+	tc.original = netAddrSpec(dst)
+	return s.handleConnection(tc)
+}
@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+//soOriginalDst is SO_ORIGINAL_DST of SOL_IP and IP6T_SO_ORIGINAL_DST of SOL_IPV6
+const soOriginalDst = 80
+
+//ListenTProxy listens on address with IP_TRANSPARENT set for ServeTransparent to accept the
+//connections of iptables TPROXY rules, it requires CAP_NET_ADMIN
+func ListenTProxy(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, raw syscall.RawConn) error {
+		var err error
+		raw.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			if err == nil && network == "tcp6" {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			}
+		})
+		return err
+	}}
+	return lc.Listen(context.Background(), network, address)
+}
+
+//originalDst returns the destination c was sent to before it was redirected: the one recorded
+//by conntrack for REDIRECT rules or the local address for TPROXY ones
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, ErrNoOriginalDst
+	}
+	local, _ := tc.LocalAddr().(*net.TCPAddr)
+	if local == nil {
+		return nil, ErrNoOriginalDst
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var transparent bool
+	raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			if mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst); err == nil {
+				//the option is a sockaddr_in
+				b := mreq.Multiaddr
+				dst = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+			}
+			v, _ := unix.GetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT)
+			transparent = v == 1
+			return
+		}
+		if info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst); err == nil {
+			//the option is a sockaddr_in6 whose port is in network order
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			dst = &net.TCPAddr{IP: append(net.IP(nil), info.Addr.Addr[:]...), Port: int(port[0])<<8 | int(port[1])}
+		}
+		v, _ := unix.GetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT)
+		transparent = v == 1
+	})
+
+	switch {
+	case dst != nil && !(dst.IP.Equal(local.IP) && dst.Port == local.Port):
+		return dst, nil
+	case transparent:
+		return local, nil
+	}
+	//conntrack has the local address for the connections that weren't redirected
+	return nil, ErrNoOriginalDst
+}
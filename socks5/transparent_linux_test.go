@@ -0,0 +1,34 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDstNotRedirected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := <-accepted
+	if sc == nil {
+		t.Fatal("accept failed")
+	}
+	defer sc.Close()
+
+	//without a REDIRECT or TPROXY rule there's no original destination
+	if dst, err := originalDst(sc); err != ErrNoOriginalDst {
+		t.Errorf("expected ErrNoOriginalDst got %v %v", dst, err)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoTransparent = errors.New("socks5: transparent proxying is only supported on linux")
+
+//ListenTProxy isn't supported on this platform
+func ListenTProxy(network, address string) (net.Listener, error) {
+	return nil, errNoTransparent
+}
+
+//originalDst isn't supported on this platform
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errNoTransparent
+}
@@ -0,0 +1,100 @@
+package socks5
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeTransparent(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	original := echo.Addr().(*net.TCPAddr)
+
+	acl, err := ParseACL(strings.NewReader("deny ports 25"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(lineWriter, 10)
+	//CONNECT isn't needed among the commands for transparent connections
+	s := &Server{Cmds: []Command{CommandBind}, Dialer: new(net.Dialer)}
+	WithAccessLog(lines, JSONLines)(s)
+	WithRuleset(acl)(s)
+	lookups := make(chan *net.TCPAddr, 1)
+	s.OriginalDst = func(c net.Conn) (*net.TCPAddr, error) {
+		select {
+		case dst := <-lookups:
+			return dst, nil
+		default:
+			return nil, ErrNoOriginalDst
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTransparent(l)
+	defer s.Close()
+
+	//the connection is relayed to the original destination without a handshake
+	lookups <- original
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("expected hello got %q %v", b, err)
+	}
+	c.Close()
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines.next(t)), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["transparent"] != true || record["command"] != "connect" || record["destination"] != original.String() {
+		t.Errorf("expected a transparent connect to %s got %v", original, record)
+	}
+	if _, ok := record["reply"]; ok {
+		t.Errorf("expected no reply got %v", record["reply"])
+	}
+
+	tts := []struct {
+		name string
+		dst  *net.TCPAddr
+		err  string
+	}{
+		{"denied", &net.TCPAddr{IP: original.IP, Port: 25}, ErrNotAllowedByRuleset.Error()},
+		{"not redirected", nil, ErrNoOriginalDst.Error()},
+	}
+	for _, tt := range tts {
+		if tt.dst != nil {
+			lookups <- tt.dst
+		}
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := c.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("%s: expected the connection to be closed got %d %v", tt.name, n, err)
+		}
+		c.Close()
+		if tt.dst != nil {
+			if line := lines.next(t); !strings.Contains(line, tt.err) {
+				t.Errorf("%s: expected %q in %s", tt.name, tt.err, line)
+			}
+		}
+	}
+
+	if n := atomic.LoadInt64(&s.metrics.transparent); n != 2 {
+		t.Errorf("expected 2 transparent sessions got %d", n)
+	}
+}
@@ -0,0 +1,468 @@
+package socks5
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//ErrFragmented is returned for UDP datagrams with a non zero fragment number, they aren't supported
+var ErrFragmented = errors.New("socks5: fragmented datagrams are not supported")
+
+//UDPBatchSize is the default number of datagrams an association reads or writes per syscall
+//on linux
+const UDPBatchSize = 8
+
+const (
+	//udpResolveTimeout bounds the resolution of the domain of a datagram
+	udpResolveTimeout = 5 * time.Second
+	//udpResolvedTTL is how long the address a domain resolved to is used
+	udpResolvedTTL = dnsTTL * time.Second
+	//udpDestinationTimeout is how long the replies of a destination are relayed after the
+	//last datagram the client sent it
+	udpDestinationTimeout = 2 * time.Minute
+	//udpDestinations bounds the destinations an association keeps, the least recently used
+	//one is forgotten for a new one
+	udpDestinations = 1024
+	//udpPendingDomains bounds the domains an association resolves at once and
+	//udpPendingDatagrams the datagrams waiting for each of them, the ones beyond are dropped
+	udpPendingDomains   = 64
+	udpPendingDatagrams = 8
+)
+
+//WithUDPBatchSize sets the number of datagrams an association reads or writes per syscall with
+//recvmmsg and sendmmsg on linux, 1 reads and writes them one by one as on other platforms. It's
+//UDPBatchSize by default, every datagram of a batch has a 64KiB buffer
+func WithUDPBatchSize(n int) Option {
+	return func(s *Server) {
+		s.udpBatchSize = n
+	}
+}
+
+func (s *Server) udpBatch() int {
+	if s.udpBatchSize <= 0 {
+		return UDPBatchSize
+	}
+	return s.udpBatchSize
+}
+
+//handles udp association command
+func (s *Server) handleUDPAssociation(_ context.Context, _ net.Conn, req *Request) error {
+	c := req.conn
+	l, err := s.ListenPacket("udp", "")
+	if err != nil {
+		req.Fail(ReplyGeneralFailure)
+		return err
+	}
+	defer l.Close()
+
+	err = req.Success(s.advertise(CommandUDPAssociation, bindAddr(l.LocalAddr(), c.LocalAddr())))
+	if err != nil {
+		return err
+	}
+
+	go relayUDP(l, udpClient(req.Dest, c.RemoteAddr()), c, newUDPRoutes(s.allowDatagram(c), s.nat64.forUDP()), s.dnsInterceptor(c), s.udpBatch())
+
+	//the association lasts as long as the control connection
+	io.Copy(ioutil.Discard, c)
+	atomic.CompareAndSwapInt32(&c.ended, 0, endedByClient)
+	return nil
+}
+
+//udpClient returns the address datagrams of the client are accepted from, it's the address of
+//the request if the client gave one or the IP of the control connection otherwise
+func udpClient(requested *AddrSpec, control net.Addr) *net.UDPAddr {
+	client := &net.UDPAddr{IP: requested.IP, Port: int(requested.Port)}
+	if client.IP == nil || client.IP.IsUnspecified() {
+		client.IP = nil
+		if ta, ok := control.(*net.TCPAddr); ok {
+			client.IP = ta.IP
+		}
+	}
+	return client
+}
+
+//allowDatagram returns the check of the destinations the client of the association of c sends
+//datagrams to against the ruleset of the session, nil if there's no ruleset
+func (s *Server) allowDatagram(c *conn) func(dst *AddrSpec, raddr *net.UDPAddr) bool {
+	if c.ruleset == nil {
+		return nil
+	}
+	return func(dst *AddrSpec, raddr *net.UDPAddr) bool {
+		return s.allowResolved(c, &Request{Command: CommandUDPAssociation, Dest: dst, conn: c}, raddr.IP)
+	}
+}
+
+//relayUDP relays datagrams between the client and the destinations it sent datagrams to, the
+//first datagram matching expected fixes the address of the client. The payloads are counted
+//in the bytes relayed by c. The datagrams are routed to their destinations with routes. The DNS
+//queries dns intercepts are answered instead, it may be nil.
+//Up to batch datagrams are read and written at once where the platform supports it
+func relayUDP(l net.PacketConn, expected *net.UDPAddr, c *conn, routes *udpRoutes, dns *dnsInterceptor, batch int) {
+	if batch < 1 {
+		batch = 1
+	}
+	dc := newDatagramConn(l, batch)
+	var client *net.UDPAddr
+	in := make([]datagram, batch)
+	for i := range in {
+		in[i].buf = make([]byte, udpHeaderRoom+65535)
+	}
+	out := make([]datagram, 0, batch)
+	hdr := make([]byte, 0, udpHeaderRoom)
+	//the datagrams to the domains resolved after they were read are sent on their own
+	send := func(raddr *net.UDPAddr, payload []byte) {
+		if _, err := l.WriteTo(payload, raddr); err == nil {
+			atomic.AddInt64(&c.in, int64(len(payload)))
+		}
+	}
+
+	for {
+		n, err := dc.readBatch(in)
+		if err != nil {
+			return
+		}
+		out = out[:0]
+		for i := range in[:n] {
+			d := &in[i]
+			from := d.addr
+
+			if client == nil && matchesClient(from, expected) {
+				client = from
+			}
+
+			if client != nil && from.IP.Equal(client.IP) && from.Port == client.Port {
+				dst, payload, err := parseUDPDatagram(d.b)
+				if err != nil {
+					continue
+				}
+				if h, q, ok := dns.query(dst, payload); ok {
+					atomic.AddInt64(&c.in, int64(len(payload)))
+					go answerDNS(l, client, dst, dns, h, q, c)
+					continue
+				}
+				if raddr, ok := routes.route(dst, payload, send); ok {
+					out = append(out, datagram{b: payload, addr: raddr, counter: &c.in, payload: len(payload)})
+				}
+				continue
+			}
+
+			//only replies of the destinations are relayed back to the client
+			if client == nil || !routes.destination(from) {
+				continue
+			}
+			if nat := routes.nat; nat != nil {
+				if ip4 := extractNAT64(nat.prefix, from.IP); ip4 != nil {
+					from = &net.UDPAddr{IP: ip4, Port: from.Port}
+				}
+			}
+			hdr, err = appendUDPHeader(hdr[:0], from)
+			if err != nil {
+				continue
+			}
+			//the header goes in the room left before the payload
+			start := udpHeaderRoom - len(hdr)
+			copy(d.buf[start:], hdr)
+			out = append(out, datagram{b: d.buf[start : udpHeaderRoom+len(d.b)], addr: client, counter: &c.out, payload: len(d.b)})
+		}
+		dc.writeBatch(out)
+	}
+}
+
+//udpRoutes routes the datagrams the client of an association sends to their destinations. The
+//domains are resolved in the background so the relay doesn't wait for them, the datagrams read
+//meanwhile are sent once they're resolved. The datagrams to the destinations allow denies are
+//dropped, allow may be nil. The datagrams to IPv4 destinations are sent through NAT64 with nat
+//unless it's nil. Every cache is bounded by udpDestinations
+type udpRoutes struct {
+	allow    func(dst *AddrSpec, raddr *net.UDPAddr) bool
+	nat      *nat64
+	resolver Resolver
+
+	mu sync.Mutex
+	//resolved holds the addresses the domains resolved to, allowed the verdicts of allow and
+	//contacted the addresses the client sent datagrams to
+	resolved, allowed, contacted *udpCache
+	//pending holds the datagrams waiting for their domain to be resolved
+	pending map[string][][]byte
+}
+
+func newUDPRoutes(allow func(dst *AddrSpec, raddr *net.UDPAddr) bool, nat *nat64) *udpRoutes {
+	return &udpRoutes{
+		allow:     allow,
+		nat:       nat,
+		resolver:  net.DefaultResolver,
+		resolved:  newUDPCache(udpResolvedTTL, udpDestinations),
+		allowed:   newUDPCache(udpDestinationTimeout, udpDestinations),
+		contacted: newUDPCache(udpDestinationTimeout, udpDestinations),
+		pending:   make(map[string][][]byte),
+	}
+}
+
+//route returns the address the datagram with payload is sent to dst at, it returns false if
+//the datagram is dropped or waits for the domain of dst to be resolved, send is called once
+//it's resolved
+func (r *udpRoutes) route(dst *AddrSpec, payload []byte, send func(raddr *net.UDPAddr, payload []byte)) (*net.UDPAddr, bool) {
+	if dst.Type != AddrTypeDomain {
+		return r.admit(dst, &net.UDPAddr{IP: dst.IP, Port: int(dst.Port)})
+	}
+
+	key := dst.String()
+	r.mu.Lock()
+	if v, ok := r.resolved.get(key); ok {
+		r.mu.Unlock()
+		return r.admit(dst, v.(*net.UDPAddr))
+	}
+	//the payload is read into a buffer the relay reuses
+	queued, resolving := r.pending[key]
+	switch {
+	case resolving && len(queued) < udpPendingDatagrams:
+		r.pending[key] = append(queued, append([]byte(nil), payload...))
+	case !resolving && len(r.pending) < udpPendingDomains:
+		r.pending[key] = [][]byte{append([]byte(nil), payload...)}
+		go r.resolve(dst, key, send)
+	}
+	r.mu.Unlock()
+	return nil, false
+}
+
+//resolve resolves the domain of dst and sends the datagrams waiting for it
+func (r *udpRoutes) resolve(dst *AddrSpec, key string, send func(raddr *net.UDPAddr, payload []byte)) {
+	ctx, cancel := context.WithTimeout(context.Background(), udpResolveTimeout)
+	addrs, err := r.resolver.LookupIPAddr(ctx, dst.Host)
+	cancel()
+
+	var raddr *net.UDPAddr
+	if err == nil && len(addrs) > 0 {
+		//IPv4 is preferred as net.ResolveUDPAddr does
+		raddr = &net.UDPAddr{IP: addrs[0].IP, Port: int(dst.Port)}
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				raddr.IP = a.IP
+				break
+			}
+		}
+	}
+
+	r.mu.Lock()
+	queued := r.pending[key]
+	delete(r.pending, key)
+	if raddr != nil {
+		r.resolved.put(key, raddr)
+	}
+	r.mu.Unlock()
+	if raddr == nil {
+		return
+	}
+	for _, payload := range queued {
+		if to, ok := r.admit(dst, raddr); ok {
+			send(to, payload)
+		}
+	}
+}
+
+//admit returns the address the datagram to dst resolved to raddr is sent to, it returns false
+//if the datagram is denied. Every destination and the address it resolved to are checked once
+func (r *udpRoutes) admit(dst *AddrSpec, raddr *net.UDPAddr) (*net.UDPAddr, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.allow != nil {
+		key := dst.String() + " " + raddr.String()
+		v, checked := r.allowed.get(key)
+		ok, _ := v.(bool)
+		if !checked {
+			ok = r.allow(dst, raddr)
+		}
+		//the verdict is put again to keep the destinations in use
+		r.allowed.put(key, ok)
+		if !ok {
+			return nil, false
+		}
+	}
+	if synthesized := r.nat.synthesize(raddr.IP); synthesized != nil {
+		raddr = &net.UDPAddr{IP: synthesized, Port: raddr.Port}
+	}
+	r.contacted.put(raddr.String(), true)
+	return raddr, true
+}
+
+//destination reports whether the client sent datagrams to from recently
+func (r *udpRoutes) destination(from *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.contacted.get(from.String())
+	return ok
+}
+
+//udpCache keeps at most max entries for ttl since they were last put, once it's full the least
+//recently put one is evicted. It isn't safe for concurrent use
+type udpCache struct {
+	ttl     time.Duration
+	max     int
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+type udpCacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newUDPCache(ttl time.Duration, max int) *udpCache {
+	return &udpCache{ttl: ttl, max: max, entries: make(map[string]*list.Element)}
+}
+
+//get returns the value of key if it hasn't expired
+func (u *udpCache) get(key string) (interface{}, bool) {
+	e, ok := u.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*udpCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		u.remove(e)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+//put sets the value of key for ttl
+func (u *udpCache) put(key string, value interface{}) {
+	expires := time.Now().Add(u.ttl)
+	if e, ok := u.entries[key]; ok {
+		entry := e.Value.(*udpCacheEntry)
+		entry.value, entry.expires = value, expires
+		u.lru.MoveToFront(e)
+		return
+	}
+	for u.lru.Len() >= u.max {
+		u.remove(u.lru.Back())
+	}
+	u.entries[key] = u.lru.PushFront(&udpCacheEntry{key: key, value: value, expires: expires})
+}
+
+func (u *udpCache) remove(e *list.Element) {
+	delete(u.entries, e.Value.(*udpCacheEntry).key)
+	u.lru.Remove(e)
+}
+
+//answerDNS sends the answer to the query of client as if it came from dst
+func answerDNS(l net.PacketConn, client *net.UDPAddr, dst *AddrSpec, dns *dnsInterceptor, h dnsmessage.Header, q dnsmessage.Question, c *conn) {
+	res, err := dns.answer(h, q)
+	if err != nil {
+		return
+	}
+	b, err := dst.AppendTo([]byte{reserve, reserve, 0})
+	if err != nil {
+		return
+	}
+	if _, err := l.WriteTo(append(b, res...), client); err == nil {
+		atomic.AddInt64(&c.out, int64(len(res)))
+	}
+}
+
+func matchesClient(from, expected *net.UDPAddr) bool {
+	if expected.IP != nil && !expected.IP.Equal(from.IP) {
+		return false
+	}
+	return expected.Port == 0 || expected.Port == from.Port
+}
+
+//parseUDPDatagram returns the destination and the payload of a datagram sent by the client
+func parseUDPDatagram(b []byte) (*AddrSpec, []byte, error) {
+	if len(b) < 4 || b[0] != reserve || b[1] != reserve {
+		return nil, nil, ErrInvalidAddr
+	}
+	if b[2] != 0 {
+		return nil, nil, ErrFragmented
+	}
+
+	r := bytes.NewReader(b[3:])
+	addr, err := ReadAddrSpec(r)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = ErrInvalidAddr
+		}
+		return nil, nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
+
+//appendUDPHeader appends the header of a datagram relayed to the client from addr
+func appendUDPHeader(b []byte, addr *net.UDPAddr) ([]byte, error) {
+	return netAddrSpec(addr).AppendTo(append(b, reserve, reserve, 0))
+}
+
+//udpHeaderRoom is the room for the header of a datagram relayed to the client, the longest
+//header is the one of an IPv6 address
+const udpHeaderRoom = 3 + 1 + net.IPv6len + 2
+
+//datagram is a datagram read from or written to the socket of an association
+type datagram struct {
+	//buf holds a datagram read after udpHeaderRoom bytes
+	buf []byte
+	//b is the datagram read or to write
+	b    []byte
+	addr *net.UDPAddr
+	//counter counts the payload once the datagram is written
+	counter *int64
+	payload int
+}
+
+//written counts the payload of a datagram that was written
+func (d *datagram) written() {
+	if d.counter != nil {
+		atomic.AddInt64(d.counter, int64(d.payload))
+	}
+}
+
+//datagramConn reads and writes the datagrams of an association, several per syscall where
+//the platform supports it
+type datagramConn interface {
+	//readBatch reads at least a datagram into the buffers of ds and returns how many were read
+	readBatch(ds []datagram) (int, error)
+	//writeBatch writes ds in order, the ones failing to be written are dropped
+	writeBatch(ds []datagram)
+}
+
+//packetDatagramConn reads and writes a datagram per syscall
+type packetDatagramConn struct {
+	net.PacketConn
+}
+
+func (c packetDatagramConn) readBatch(ds []datagram) (int, error) {
+	for {
+		n, src, err := c.ReadFrom(ds[0].buf[udpHeaderRoom:])
+		if err != nil {
+			return 0, err
+		}
+		if from, ok := src.(*net.UDPAddr); ok {
+			ds[0].b, ds[0].addr = ds[0].buf[udpHeaderRoom:udpHeaderRoom+n], from
+			return 1, nil
+		}
+	}
+}
+
+func (c packetDatagramConn) writeBatch(ds []datagram) {
+	for i := range ds {
+		c.write(&ds[i])
+	}
+}
+
+func (c packetDatagramConn) write(d *datagram) error {
+	_, err := c.WriteTo(d.b, d.addr)
+	if err == nil {
+		d.written()
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+//batchConn is the recvmmsg and sendmmsg of an ipv4 or ipv6 PacketConn
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+//mmsgDatagramConn reads and writes the datagrams in batches with recvmmsg and sendmmsg, it falls
+//back to a datagram per syscall if they fail while ReadFrom and WriteTo work
+type mmsgDatagramConn struct {
+	packetDatagramConn
+	bc batchConn
+	//ipv4 is set if the socket is an IPv4 one, an IPv6 one can't send to IPv4 addresses with
+	//sendmmsg as their addresses are marshaled as IPv4 ones
+	ipv4                    bool
+	readFailed, writeFailed bool
+	rms, wms                []ipv4.Message
+	rbufs, wbufs            [][1][]byte
+}
+
+func newDatagramConn(l net.PacketConn, batch int) datagramConn {
+	uc, ok := l.(*net.UDPConn)
+	if !ok || batch <= 1 {
+		return packetDatagramConn{l}
+	}
+	c := &mmsgDatagramConn{
+		packetDatagramConn: packetDatagramConn{l},
+		rms:                make([]ipv4.Message, batch),
+		wms:                make([]ipv4.Message, batch),
+		rbufs:              make([][1][]byte, batch),
+		wbufs:              make([][1][]byte, batch),
+	}
+	if la, ok := uc.LocalAddr().(*net.UDPAddr); ok && la.IP.To4() != nil {
+		c.bc, c.ipv4 = ipv4.NewPacketConn(uc), true
+	} else {
+		c.bc = ipv6.NewPacketConn(uc)
+	}
+	return c
+}
+
+func (c *mmsgDatagramConn) readBatch(ds []datagram) (int, error) {
+	if c.readFailed {
+		return c.packetDatagramConn.readBatch(ds)
+	}
+	ms := c.rms[:len(ds)]
+	for i := range ms {
+		c.rbufs[i][0] = ds[i].buf[udpHeaderRoom:]
+		ms[i].Buffers, ms[i].Addr = c.rbufs[i][:], nil
+	}
+	for {
+		n, err := c.bc.ReadBatch(ms, 0)
+		if err != nil {
+			n, err := c.packetDatagramConn.readBatch(ds)
+			c.readFailed = err == nil
+			return n, err
+		}
+		read := 0
+		for _, m := range ms[:n] {
+			if from, ok := m.Addr.(*net.UDPAddr); ok {
+				ds[read].b, ds[read].addr = ds[read].buf[udpHeaderRoom:udpHeaderRoom+m.N], from
+				read++
+			}
+		}
+		if read > 0 {
+			return read, nil
+		}
+	}
+}
+
+func (c *mmsgDatagramConn) writeBatch(ds []datagram) {
+	for len(ds) > 0 {
+		n := 0
+		for n < len(ds) && n < len(c.wms) && (c.ipv4 || ds[n].addr.IP.To4() == nil) {
+			n++
+		}
+		if n == 0 || c.writeFailed {
+			c.write(&ds[0])
+			ds = ds[1:]
+			continue
+		}
+
+		ms := c.wms[:n]
+		for i := range ms {
+			c.wbufs[i][0] = ds[i].b
+			ms[i].Buffers, ms[i].Addr = c.wbufs[i][:], ds[i].addr
+		}
+		sent, err := c.bc.WriteBatch(ms, 0)
+		if sent < 0 {
+			sent = 0
+		}
+		for i := range ds[:sent] {
+			ds[i].written()
+		}
+		ds = ds[sent:]
+		if (err != nil || sent == 0) && len(ds) > 0 {
+			//the datagram the batch failed on is dropped if it can't be written alone either,
+			//otherwise it's the batch that failed
+			c.writeFailed = c.write(&ds[0]) == nil
+			ds = ds[1:]
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMmsgDatagramConn(t *testing.T) {
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dc, ok := newDatagramConn(l, 4).(*mmsgDatagramConn)
+	if !ok {
+		t.Fatal("expected batches on linux")
+	}
+	if _, ok := newDatagramConn(l, 1).(packetDatagramConn); !ok {
+		t.Error("expected a batch of 1 to read and write one by one")
+	}
+
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	for i := 0; i < 6; i++ {
+		sender.WriteTo(udpPayload(i), l.LocalAddr())
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	//the queued datagrams are read a batch per call
+	ds := make([]datagram, 4)
+	for i := range ds {
+		ds[i].buf = make([]byte, udpHeaderRoom+2048)
+	}
+	for _, expected := range [][]int{{0, 1, 2, 3}, {4, 5}} {
+		l.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := dc.readBatch(ds)
+		if err != nil || n != len(expected) {
+			t.Fatalf("expected %d datagrams got %d %v", len(expected), n, err)
+		}
+		for i, p := range expected {
+			if string(ds[i].b) != string(udpPayload(p)) || ds[i].addr.String() != sender.LocalAddr().String() {
+				t.Errorf("expected datagram %d from %v got % x from %v", p, sender.LocalAddr(), ds[i].b, ds[i].addr)
+			}
+		}
+	}
+	if dc.readFailed {
+		t.Error("expected the batches not to fall back")
+	}
+
+	var written int64
+	dc.writeBatch([]datagram{
+		{b: []byte("one"), addr: sender.LocalAddr().(*net.UDPAddr), counter: &written, payload: 3},
+		//an IPv6 destination fails on an IPv4 socket without failing the batch
+		{b: []byte("lost"), addr: &net.UDPAddr{IP: net.IPv6loopback, Port: 9}, counter: &written, payload: 4},
+		{b: []byte("two"), addr: sender.LocalAddr().(*net.UDPAddr), counter: &written, payload: 3},
+	})
+	b := make([]byte, 64)
+	for _, expected := range []string{"one", "two"} {
+		sender.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := sender.ReadFrom(b)
+		if err != nil || string(b[:n]) != expected {
+			t.Errorf("expected %q got %q %v", expected, b[:n], err)
+		}
+	}
+	if written != 6 || dc.writeFailed {
+		t.Errorf("expected the 6 bytes written in batches got %d %v", written, dc.writeFailed)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import "net"
+
+func newDatagramConn(l net.PacketConn, batch int) datagramConn {
+	return packetDatagramConn{l}
+}
@@ -0,0 +1,242 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//udpRelay is a client and a destination relaying through relayUDP
+type udpRelay struct {
+	client, dst *net.UDPConn
+	relay       *net.UDPAddr
+	c           *conn
+	l           net.PacketConn
+}
+
+func newUDPRelay(t testing.TB, network, addr string, batch int) *udpRelay {
+	t.Helper()
+	return newUDPRelayRoutes(t, network, addr, batch, newUDPRoutes(nil, nil))
+}
+
+//newUDPRelayRoutes returns a relay routing the datagrams of the client with routes
+func newUDPRelayRoutes(t testing.TB, network, addr string, batch int, routes *udpRoutes) *udpRelay {
+	t.Helper()
+	r := &udpRelay{c: &conn{}}
+	var err error
+	if r.client, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if r.dst, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if r.l, err = net.ListenPacket(network, addr); err != nil {
+		t.Fatal(err)
+	}
+	r.relay = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: r.l.LocalAddr().(*net.UDPAddr).Port}
+	go relayUDP(r.l, r.client.LocalAddr().(*net.UDPAddr), r.c, routes, nil, batch)
+	return r
+}
+
+func (r *udpRelay) Close() {
+	r.l.Close()
+	r.client.Close()
+	r.dst.Close()
+}
+
+//udpPayload is the payload of the i-th datagram
+func udpPayload(i int) []byte {
+	return bytes.Repeat([]byte{byte(i)}, 1+i*7)
+}
+
+func TestRelayUDPBatch(t *testing.T) {
+	const datagrams = 100
+	tts := []struct {
+		network, addr string
+		batch         int
+	}{
+		{"udp4", "127.0.0.1:0", 1},
+		{"udp4", "127.0.0.1:0", UDPBatchSize},
+		{"udp4", "127.0.0.1:0", 64},
+		//the IPv4 client and destination can't be batched on an IPv6 socket
+		{"udp", ":0", UDPBatchSize},
+	}
+	for _, tt := range tts {
+		name := fmt.Sprintf("%s %s batch %d", tt.network, tt.addr, tt.batch)
+		r := newUDPRelay(t, tt.network, tt.addr, tt.batch)
+
+		//the datagrams of a burst keep their order and payloads both ways
+		dst := r.dst.LocalAddr().(*net.UDPAddr)
+		hdr, _ := appendUDPHeader(nil, dst)
+		for i := 0; i < datagrams; i++ {
+			if _, err := r.client.WriteTo(append(hdr[:len(hdr):len(hdr)], udpPayload(i)...), r.relay); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b := make([]byte, 2048)
+		var relay net.Addr
+		for i := 0; i < datagrams; i++ {
+			r.dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, from, err := r.dst.ReadFrom(b)
+			if err != nil {
+				t.Fatalf("%s: datagram %d: %v", name, i, err)
+			}
+			if !bytes.Equal(b[:n], udpPayload(i)) {
+				t.Fatalf("%s: expected datagram %d got % x", name, i, b[:n])
+			}
+			relay = from
+		}
+
+		for i := 0; i < datagrams; i++ {
+			if _, err := r.dst.WriteTo(udpPayload(i), relay); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < datagrams; i++ {
+			r.client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := r.client.ReadFrom(b)
+			if err != nil {
+				t.Fatalf("%s: reply %d: %v", name, i, err)
+			}
+			src, payload, err := parseUDPDatagram(b[:n])
+			if err != nil || src.String() != dst.String() || !bytes.Equal(payload, udpPayload(i)) {
+				t.Fatalf("%s: expected reply %d from %v got %v % x %v", name, i, dst, src, payload, err)
+			}
+		}
+
+		var total int64
+		for i := 0; i < datagrams; i++ {
+			total += int64(len(udpPayload(i)))
+		}
+		if in, out := atomic.LoadInt64(&r.c.in), atomic.LoadInt64(&r.c.out); in != total || out != total {
+			t.Errorf("%s: expected %d bytes each way got %d and %d", name, total, in, out)
+		}
+		r.Close()
+	}
+}
+
+//blockingResolver resolves every domain to 127.0.0.1 once release is closed
+type blockingResolver struct {
+	release chan struct{}
+}
+
+func (r *blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	select {
+	case <-r.release:
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestRelayUDPResolvesInBackground(t *testing.T) {
+	resolver := &blockingResolver{release: make(chan struct{})}
+	routes := newUDPRoutes(nil, nil)
+	routes.resolver = resolver
+	r := newUDPRelayRoutes(t, "udp4", "127.0.0.1:0", 1, routes)
+	defer r.Close()
+
+	dst := r.dst.LocalAddr().(*net.UDPAddr)
+	domain := &AddrSpec{Type: AddrTypeDomain, Host: "slow.test", Port: uint16(dst.Port)}
+	domainHdr, err := domain.AppendTo([]byte{0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipHdr, _ := appendUDPHeader(nil, dst)
+
+	//the datagrams to an IP are relayed while the domain is being resolved
+	b := make([]byte, 512)
+	for i, hdr := range [][]byte{domainHdr, domainHdr, ipHdr} {
+		if _, err := r.client.WriteTo(append(hdr[:len(hdr):len(hdr)], udpPayload(i)...), r.relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := r.dst.ReadFrom(b)
+	if err != nil || !bytes.Equal(b[:n], udpPayload(2)) {
+		t.Fatalf("expected the datagram to the IP first got % x %v", b[:n], err)
+	}
+
+	//the datagrams waiting for the domain are sent once it's resolved
+	close(resolver.release)
+	for i := 0; i < 2; i++ {
+		r.dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := r.dst.ReadFrom(b)
+		if err != nil || !bytes.Equal(b[:n], udpPayload(i)) {
+			t.Fatalf("expected datagram %d got % x %v", i, b[:n], err)
+		}
+	}
+	if in := atomic.LoadInt64(&r.c.in); in != int64(len(udpPayload(0))+len(udpPayload(1))+len(udpPayload(2))) {
+		t.Errorf("expected the payloads counted got %d bytes", in)
+	}
+}
+
+func TestUDPCache(t *testing.T) {
+	u := newUDPCache(time.Minute, 2)
+	u.put("a", 1)
+	u.put("b", 2)
+	u.put("a", 3)
+	//the least recently put entry is evicted once the cache is full
+	u.put("c", 4)
+	tts := []struct {
+		key   string
+		value interface{}
+		ok    bool
+	}{
+		{"a", 3, true},
+		{"b", nil, false},
+		{"c", 4, true},
+	}
+	for _, tt := range tts {
+		if v, ok := u.get(tt.key); v != tt.value || ok != tt.ok {
+			t.Errorf("%s: expected %v %v got %v %v", tt.key, tt.value, tt.ok, v, ok)
+		}
+	}
+
+	expiring := newUDPCache(time.Millisecond, 2)
+	expiring.put("a", 1)
+	time.Sleep(5 * time.Millisecond)
+	if v, ok := expiring.get("a"); ok {
+		t.Errorf("expected the entry expired got %v", v)
+	}
+	if len(expiring.entries) != 0 || expiring.lru.Len() != 0 {
+		t.Errorf("expected the expired entry removed got %d entries", len(expiring.entries))
+	}
+}
+
+//BenchmarkRelayUDP relays windows of datagrams from the client to the destination
+func BenchmarkRelayUDP(b *testing.B) {
+	const window = 32
+	for _, batch := range []int{1, UDPBatchSize, 64} {
+		b.Run(fmt.Sprintf("batch %d", batch), func(b *testing.B) {
+			r := newUDPRelay(b, "udp4", "127.0.0.1:0", batch)
+			defer r.Close()
+			hdr, _ := appendUDPHeader(nil, r.dst.LocalAddr().(*net.UDPAddr))
+			datagram := append(hdr, make([]byte, 512)...)
+			buf := make([]byte, 2048)
+
+			b.ResetTimer()
+			start := time.Now()
+			for sent := 0; sent < b.N; sent += window {
+				n := window
+				if b.N-sent < n {
+					n = b.N - sent
+				}
+				for i := 0; i < n; i++ {
+					r.client.WriteTo(datagram, r.relay)
+				}
+				for i := 0; i < n; i++ {
+					r.dst.SetReadDeadline(time.Now().Add(time.Second))
+					if _, _, err := r.dst.ReadFrom(buf); err != nil {
+						b.Fatalf("%d datagrams relayed: %v", sent+i, err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pkts/s")
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//serveTest serves s on an ephemeral port and returns the address of the listener
+func serveTest(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+//request sends a no auth handshake and a request for cmd to dst and returns the reply
+func request(t *testing.T, c net.Conn, cmd Command, dst *net.TCPAddr) []byte {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		t.Fatal(err)
+	}
+	req := append([]byte{5, byte(cmd), 0, 1}, dst.IP.To4()...)
+	req = append(req, byte(dst.Port>>8), byte(dst.Port))
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUDPAssociation(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], from)
+		}
+	}()
+
+	s := &Server{Cmds: []Command{CommandUDPAssociation}, Dialer: new(net.Dialer)}
+	defer s.Close()
+	ctrl, err := net.Dial("tcp", serveTest(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	reply := request(t, ctrl, CommandUDPAssociation, &net.TCPAddr{IP: net.IPv4zero})
+	if reply[1] != 0 {
+		t.Fatalf("expected the association granted got reply %d", reply[1])
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	ea := echo.LocalAddr().(*net.UDPAddr)
+	header := append([]byte{0, 0, 0, 1}, ea.IP.To4()...)
+	header = append(header, byte(ea.Port>>8), byte(ea.Port))
+	if _, err := pc.WriteTo(append(header, testString...), relay); err != nil {
+		t.Fatal(err)
+	}
+	//the reply carries the header of the destination it came from
+	b := make([]byte, 512)
+	n, _, err := pc.ReadFrom(b)
+	if err != nil || !bytes.Equal(b[:n], append(header, testString...)) {
+		t.Errorf("expected % x got % x %v", append(header, testString...), b[:n], err)
+	}
+
+	//a fragmented datagram is dropped
+	header[2] = 1
+	pc.WriteTo(append(header, testString...), relay)
+	pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(b); err == nil {
+		t.Error("expected the fragmented datagram dropped")
+	}
+}
+
+func TestUDPAssociationRuleset(t *testing.T) {
+	udpEcho := func() *net.UDPConn {
+		echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			b := make([]byte, 512)
+			for {
+				n, from, err := echo.ReadFrom(b)
+				if err != nil {
+					return
+				}
+				echo.WriteTo(b[:n], from)
+			}
+		}()
+		return echo
+	}
+	allowed, denied := udpEcho(), udpEcho()
+	defer allowed.Close()
+	defer denied.Close()
+
+	acl, err := ParseACL(strings.NewReader("deny dst 127.0.0.0/8,::1 ports " + portOf(denied.LocalAddr()) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Cmds: []Command{CommandUDPAssociation}, Dialer: new(net.Dialer), Ruleset: acl}
+	defer s.Close()
+	ctrl, err := net.Dial("tcp", serveTest(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	reply := request(t, ctrl, CommandUDPAssociation, &net.TCPAddr{IP: net.IPv4zero})
+	if reply[1] != 0 {
+		t.Fatalf("expected the association granted got reply %d", reply[1])
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ipHeader := func(a net.Addr) []byte {
+		ua := a.(*net.UDPAddr)
+		return append(append([]byte{0, 0, 0, 1}, ua.IP.To4()...), byte(ua.Port>>8), byte(ua.Port))
+	}
+	domainHeader := func(a net.Addr) []byte {
+		port := a.(*net.UDPAddr).Port
+		return append(append([]byte{0, 0, 0, 3, byte(len("localhost"))}, "localhost"...), byte(port>>8), byte(port))
+	}
+	tts := []struct {
+		name    string
+		header  []byte
+		replied bool
+	}{
+		{"allowed", ipHeader(allowed.LocalAddr()), true},
+		{"denied", ipHeader(denied.LocalAddr()), false},
+		{"allowed domain", domainHeader(allowed.LocalAddr()), true},
+		{"domain resolving to a denied address", domainHeader(denied.LocalAddr()), false},
+	}
+	b := make([]byte, 512)
+	for _, tt := range tts {
+		if _, err := pc.WriteTo(append(tt.header, testString...), relay); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := pc.ReadFrom(b)
+		if replied := err == nil; replied != tt.replied {
+			t.Errorf("%s: expected a reply %v got % x %v", tt.name, tt.replied, b[:n], err)
+		}
+	}
+}
+
+func TestCommandNotSupported(t *testing.T) {
+	tts := []struct {
+		cmds  []Command
+		cmd   Command
+		reply byte
+	}{
+		{[]Command{CommandConnect}, CommandBind, 7},
+		{[]Command{CommandConnect}, CommandUDPAssociation, 7},
+		//CONNECT is the only command allowed without Cmds
+		{nil, CommandBind, 7},
+		{[]Command{CommandBind}, CommandConnect, 7},
+	}
+	for _, tt := range tts {
+		s := &Server{Cmds: tt.cmds, Dialer: new(net.Dialer)}
+		c, err := net.Dial("tcp", serveTest(t, s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply := request(t, c, tt.cmd, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); reply[1] != tt.reply {
+			t.Errorf("%v with %v: expected reply %d got %d", tt.cmd, tt.cmds, tt.reply, reply[1])
+		}
+		c.Close()
+		s.Close()
+	}
+}
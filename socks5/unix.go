@@ -0,0 +1,80 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+//UnixScheme is the prefix of Server addresses that listen on a unix domain socket e.g. unix:/run/socks5.sock
+const UnixScheme = "unix:"
+
+//ErrSocketInUse is returned if the unix socket is already used by a running server
+var ErrSocketInUse = errors.New("socks5: unix socket already in use")
+
+//WithUnixSocketMode sets the file mode of the unix socket created by ListenAndServe
+func WithUnixSocketMode(mode os.FileMode) Option {
+	return func(s *Server) {
+		s.UnixSocketMode = mode
+	}
+}
+
+//splitAddr returns the network and address to listen on for a Server address
+func splitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, UnixScheme) {
+		return "unix", strings.TrimPrefix(addr, UnixScheme)
+	}
+	return "tcp", addr
+}
+
+//listenUnix removes a stale socket left behind by a previous run and listens on path, the
+//socket is created with mode if it isn't 0
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, ErrSocketInUse
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return listenUnixMode(path, mode)
+}
+
+//unixPeerAddr is reported as the client address of connections over unix sockets as the
+//peers are usually unnamed
+type unixPeerAddr struct {
+	path string
+	cred string
+}
+
+var _ net.Addr = (*unixPeerAddr)(nil)
+
+func (u *unixPeerAddr) Network() string {
+	return "unix"
+}
+
+func (u *unixPeerAddr) String() string {
+	if u.cred == "" {
+		return u.path
+	}
+	return u.path + "(" + u.cred + ")"
+}
+
+type unixConn struct {
+	*net.UnixConn
+	remote net.Addr
+}
+
+var _ net.Conn = (*unixConn)(nil)
+
+func (u *unixConn) RemoteAddr() net.Addr {
+	return u.remote
+}
+
+func newUnixConn(c *net.UnixConn) net.Conn {
+	return &unixConn{UnixConn: c, remote: &unixPeerAddr{path: c.LocalAddr().String(), cred: peerCred(c)}}
+}
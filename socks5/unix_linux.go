@@ -0,0 +1,56 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+//peerCred returns the credentials of the process on the other end of c
+func peerCred(c *net.UnixConn) string {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return ""
+	}
+
+	var cred *unix.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ""
+	}
+	return fmt.Sprintf("pid=%d,uid=%d,gid=%d", cred.Pid, cred.Uid, cred.Gid)
+}
+
+//umaskMu serializes the umask changes of listenUnixMode
+var umaskMu sync.Mutex
+
+//listenUnixMode listens on path with a umask that only lets mode through, the socket is
+//never reachable with wider permissions than mode. The umask is only ever made more
+//restrictive so files created concurrently by other goroutines aren't exposed
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	if mode == 0 {
+		return net.Listen("unix", path)
+	}
+
+	umaskMu.Lock()
+	old := unix.Umask(0777)
+	unix.Umask(old | int(^mode&os.ModePerm))
+	l, err := net.Listen("unix", path)
+	unix.Umask(old)
+	umaskMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	//the umask may have taken bits of mode away
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
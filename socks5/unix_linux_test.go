@@ -0,0 +1,39 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestListenUnixModeUmask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := unix.Umask(0)
+	defer unix.Umask(old)
+
+	path := filepath.Join(dir, "socks5.sock")
+	l, err := listenUnixMode(path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if umask := unix.Umask(0); umask != 0 {
+		t.Errorf("expected the umask to be restored got %#o", umask)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("expected mode 0660 got %v", fi.Mode().Perm())
+	}
+}
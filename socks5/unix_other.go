@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"net"
+	"os"
+)
+
+//peerCred isn't supported on this platform
+func peerCred(c *net.UnixConn) string {
+	return ""
+}
+
+//listenUnixMode listens on path and changes the mode of the socket afterwards, unlike on
+//linux the socket has the default mode until then
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
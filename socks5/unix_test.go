@@ -0,0 +1,124 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestUnixSocket(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks5.sock")
+
+	//leave a stale socket behind like a crashed server would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := &Server{Addr: UnixScheme + path}
+	WithUnixSocketMode(0600)(s)
+	l, err := s.listen(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 got %v", fi.Mode().Perm())
+	}
+
+	if _, err := (&Server{}).listen(UnixScheme + path); err != ErrSocketInUse {
+		t.Errorf("expected %v got %v", ErrSocketInUse, err)
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := rawConnect(c, echo.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte(testString))
+	b := make([]byte, len(testString))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != testString {
+		t.Errorf("expected %q got %q: %v", testString, b, err)
+	}
+
+	s.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected socket to be removed: %v", err)
+	}
+}
+
+func TestUnixPeerAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks5.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	addr := newUnixConn(sc.(*net.UnixConn)).RemoteAddr().String()
+	if !strings.HasPrefix(addr, path) {
+		t.Errorf("expected client address to be the socket path got %q", addr)
+	}
+	if runtime.GOOS == "linux" && !strings.Contains(addr, fmt.Sprintf("uid=%d", os.Getuid())) {
+		t.Errorf("expected peer credentials in %q", addr)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	//the reply to a client doesn't leak or choke on the socket path
+	go func() {
+		newConn(a).WriteCommandResponse(ReplySucceeded, netAddrSpec(&net.UnixAddr{Name: "/run/socks5.sock", Net: "unix"}))
+	}()
+	res := make([]byte, 10)
+	if _, err := io.ReadFull(b, res); err != nil {
+		t.Fatal(err)
+	}
+	if res[1] != byte(ReplySucceeded) || res[3] != byte(AddrTypeIPv4) {
+		t.Errorf("unexpected reply %v", res)
+	}
+}
@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//ValidationError lists every problem Validate found in the configuration of a server
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "socks5: invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+//NewServer returns a server listening on addr with only the connect command enabled and
+//configured with opts, it fails with a *ValidationError if the configuration can't work. The
+//server is validated again by ListenAndServe before listening
+func NewServer(addr string, opts ...Option) (*Server, error) {
+	s := &Server{Addr: addr, Cmds: []Command{CommandConnect}, Dialer: new(net.Dialer)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	s.validated = true
+	return s, nil
+}
+
+//validate registers a check of an option for Validate, it returns the problem or ""
+func (s *Server) validate(check func() string) {
+	s.checks = append(s.checks, check)
+}
+
+//Validate cross-checks the configuration of the server and returns a *ValidationError listing
+//every problem, or nil. Servers that weren't created by NewServer are only validated when it's
+//called
+func (s *Server) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	for _, check := range s.checks {
+		if p := check(); p != "" {
+			problems = append(problems, p)
+		}
+	}
+
+	if network, address := splitAddr(s.Addr); network != "unix" && s.Addr != "" {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			problem("Addr %q isn't host:port or %s/path e.g. :1080", s.Addr, UnixScheme)
+		} else if p, err := strconv.Atoi(port); err == nil && (p < 0 || p > 65535) {
+			problem("Addr %q has port %d out of 0-65535", s.Addr, p)
+		}
+	}
+	if s.UnixSocketMode&^os.ModePerm != 0 {
+		problem("UnixSocketMode %v isn't only permissions e.g. 0660", s.UnixSocketMode)
+	}
+	if s.KeepAlive < 0 {
+		problem("KeepAlive is %v, use 0 to disable the keep-alives", s.KeepAlive)
+	}
+
+	if len(s.Cmds) == 0 {
+		problem("no command is enabled, enable one with WithCommands e.g. CommandConnect")
+	}
+	enabled := make(map[Command]bool)
+	for _, cmd := range s.Cmds {
+		enabled[cmd] = true
+		switch cmd {
+		case CommandConnect, CommandBind, CommandUDPAssociation:
+		default:
+			if _, ok := s.Handlers[cmd]; !ok {
+				problem("command %v has no handler, add one with WithCommandHandler", cmd)
+			}
+		}
+	}
+	for cmd := range s.Handlers {
+		if !enabled[cmd] {
+			problem("the handler of command %v is never used, enable the command with WithCommands", cmd)
+		}
+	}
+	if s.dnsInterception && !enabled[CommandUDPAssociation] {
+		problem("WithDNSInterception intercepts nothing without the udp-associate command, enable it with WithCommands")
+	}
+	if s.ruleDryRun && s.Ruleset == nil {
+		problem("WithRuleDryRun has no ruleset to observe, set one with WithRuleset")
+	}
+
+	if c := s.TLSConfig; c != nil && len(c.Certificates) == 0 && c.GetCertificate == nil && c.GetConfigForClient == nil {
+		problem("TLSConfig has no certificate, set Certificates or GetCertificate e.g. with WithCertReloader")
+	}
+	if s.tarpit != nil {
+		if s.tarpit.maxHold <= 0 {
+			problem("WithTarpit holds the connections for %v, it must be longer than 0", s.tarpit.maxHold)
+		}
+		if s.tarpit.max < 1 {
+			problem("WithTarpit holds at most %d connections, it must hold at least 1", s.tarpit.max)
+		}
+	}
+	if r := s.recovery; r != nil && (r.maxRetries < 0 || r.backoff <= 0) {
+		problem("WithListenerRecovery needs 0 or more retries and a backoff longer than 0, got %d and %v", r.maxRetries, r.backoff)
+	}
+	if a := s.authFailures; a != nil && (a.threshold < 1 || a.window <= 0) {
+		problem("WithAuthFailureAlert needs a threshold of at least 1 and a window longer than 0, got %d and %v", a.threshold, a.window)
+	}
+	if l := s.logLimiter; l != nil && (l.burst < 1 || l.interval <= 0) {
+		problem("WithLogRateLimit needs a burst of at least 1 and an interval longer than 0, got %d and %v", l.burst, l.interval)
+	}
+	if s.capture != nil && s.capture.dir == "" {
+		problem("WithCapture needs a directory to write the captures to")
+	}
+	if s.captureLimit < 0 {
+		problem("WithCaptureLimit is %d bytes, use 0 for CaptureMaxBytes", s.captureLimit)
+	}
+	if s.udpBatchSize < 0 {
+		problem("WithUDPBatchSize is %d datagrams, use 1 to read and write them one by one", s.udpBatchSize)
+	}
+	if s.idleTimeout < 0 {
+		problem("WithIdleShutdown is %v, use 0 to disable it", s.idleTimeout)
+	}
+	if s.pauseMode != PauseRefuse && s.pauseMode != PauseClose {
+		problem("WithPauseMode %d isn't PauseRefuse or PauseClose", s.pauseMode)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewServer(t *testing.T) {
+	handler := func(ctx context.Context, conn net.Conn, req *Request) error { return nil }
+	tts := []struct {
+		name    string
+		addr    string
+		opts    []Option
+		problem string
+	}{
+		{"valid", "127.0.0.1:1080", []Option{WithAuth("user", "pass"), WithCommands(CommandConnect, CommandUDPAssociation), WithDNSInterception(true), WithTarpit(time.Minute, 10)}, ""},
+		{"bad addr", "localhost", nil, `Addr "localhost" isn't host:port or unix:/path`},
+		{"port out of range", ":70000", nil, `Addr ":70000" has port 70000 out of 0-65535`},
+		{"socket mode", "unix:/tmp/socks5.sock", []Option{WithUnixSocketMode(0660 | 1<<31)}, "isn't only permissions"},
+		{"keep-alive", ":1080", []Option{WithKeepAlive(-time.Second)}, "KeepAlive is -1s, use 0 to disable"},
+		{"no command", ":1080", []Option{WithCommands()}, "no command is enabled"},
+		{"unknown command", ":1080", []Option{WithCommands(CommandConnect, Command(0x09))}, "command 0x09 has no handler"},
+		{"unused handler", ":1080", []Option{WithCommandHandler(Command(0x09), handler)}, "the handler of command 0x09 is never used"},
+		{"empty username", ":1080", []Option{WithAuth("", "pass")}, "WithAuth needs a username of 1 to 255 bytes"},
+		{"dns without udp", ":1080", []Option{WithDNSInterception(true)}, "WithDNSInterception intercepts nothing without the udp-associate command"},
+		{"dry-run without ruleset", ":1080", []Option{WithRuleDryRun(true)}, "WithRuleDryRun has no ruleset"},
+		{"tls without certificate", ":1080", []Option{WithTLS(&tls.Config{})}, "TLSConfig has no certificate"},
+		{"tarpit", ":1080", []Option{WithTarpit(0, 10)}, "WithTarpit holds the connections for 0s"},
+		{"listener recovery", ":1080", []Option{WithListenerRecovery(-1, time.Second)}, "WithListenerRecovery needs 0 or more retries"},
+		{"auth failure alert", ":1080", []Option{WithAuthFailureAlert(0, time.Minute)}, "WithAuthFailureAlert needs a threshold of at least 1"},
+		{"log rate limit", ":1080", []Option{WithLogRateLimit(10, 0, false)}, "WithLogRateLimit needs a burst of at least 1 and an interval longer than 0"},
+		{"destination stats", ":1080", []Option{WithDestinationStats(0)}, "WithDestinationStats keeps at most 0 hosts"},
+		{"udp batch", ":1080", []Option{WithUDPBatchSize(-1)}, "WithUDPBatchSize is -1 datagrams"},
+		{"idle shutdown", ":1080", []Option{WithIdleShutdown(-time.Second)}, "WithIdleShutdown is -1s"},
+		{"pause mode", ":1080", []Option{WithPauseMode(PauseMode(7))}, "WithPauseMode 7 isn't PauseRefuse or PauseClose"},
+		{"mirror", ":1080", []Option{WithMirror("unix:", nil)}, "WithMirror needs the address of a collector"},
+	}
+	for _, tt := range tts {
+		s, err := NewServer(tt.addr, tt.opts...)
+		if tt.problem == "" {
+			if err != nil || s == nil {
+				t.Errorf("%s: expected a server got %v", tt.name, err)
+			}
+			continue
+		}
+		ve, ok := err.(*ValidationError)
+		if !ok || s != nil {
+			t.Errorf("%s: expected a validation error got %v", tt.name, err)
+			continue
+		}
+		if len(ve.Problems) != 1 || !strings.Contains(ve.Problems[0], tt.problem) {
+			t.Errorf("%s: expected only %q got %q", tt.name, tt.problem, ve.Problems)
+		}
+	}
+
+	//every problem is listed
+	_, err := NewServer("localhost", WithCommands(), WithIdleShutdown(-time.Second))
+	if ve, ok := err.(*ValidationError); !ok || len(ve.Problems) != 3 {
+		t.Errorf("expected the 3 problems got %v", err)
+	}
+
+	//ListenAndServe validates the servers of NewServer before listening but not the others
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.KeepAlive = -time.Second
+	if err := s.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "KeepAlive is -1s") {
+		t.Errorf("expected the validation to fail got %v", err)
+	}
+	if err := (&Server{}).Validate(); err == nil {
+		t.Error("expected a server without commands to be invalid")
+	}
+}
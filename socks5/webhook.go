@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+//WebhookSignatureHeader is the header holding the HMAC-SHA256 of the body of a webhook request
+//as sha256=<hex> when the Webhook has a Secret
+const WebhookSignatureHeader = "X-Socks5-Signature"
+
+//Webhook POSTs events as JSON to a URL, it's used as a notifier with WithNotifier(w.Notify)
+type Webhook struct {
+	//URL is where the events are POSTed
+	URL string
+
+	//Secret signs the body of the requests, if empty they aren't signed
+	Secret []byte
+
+	//Client is the client of the requests, if nil a client with a 10s timeout is used
+	Client *http.Client
+
+	//Retries is the number of times a failed request is retried
+	Retries int
+
+	//Backoff is the delay before the first retry, it doubles with every retry
+	Backoff time.Duration
+
+	//OnError if set is called with the error of an event that couldn't be delivered
+	OnError func(e Event, err error)
+}
+
+//NewWebhook returns a Webhook POSTing to url signed with secret, failed requests are retried 3
+//times
+func NewWebhook(url string, secret []byte) *Webhook {
+	return &Webhook{URL: url, Secret: secret, Retries: 3, Backoff: time.Second}
+}
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+//Notify POSTs e retrying failed requests, it returns once the event is delivered or dropped
+func (w *Webhook) Notify(e Event) {
+	body, err := json.Marshal(e)
+	if err == nil {
+		err = w.post(body)
+		backoff := w.Backoff
+		for i := 0; err != nil && i < w.Retries; i++ {
+			time.Sleep(backoff)
+			backoff *= 2
+			err = w.post(body)
+		}
+	}
+	if err != nil && w.OnError != nil {
+		w.OnError(e, err)
+	}
+}
+
+//Sign returns the value of the signature header for body
+func (w *Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, w.Secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, w.Sign(body))
+	}
+
+	client := w.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("socks5: webhook returned %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+//websocketMaxPayload limits the size of a single WebSocket message
+const websocketMaxPayload = 64 << 10
+
+//WebsocketHandler returns a http.Handler that upgrades requests to WebSocket and
+//serves a SOCKS5 session over each of them using binary messages
+func (s *Server) WebsocketHandler() http.Handler {
+	return websocket.Server{
+		//accept any Origin, SOCKS clients aren't browsers
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			ws.MaxPayloadBytes = websocketMaxPayload
+			s.ServeConn(&websocketConn{Conn: ws, remoteAddr: s.websocketRemoteAddr(ws.Request())})
+		},
+	}
+}
+
+//DialWebsocket connects to a SOCKS5 server served by WebsocketHandler, the returned
+//net.Conn can be used like a TCP connection to the server
+func DialWebsocket(url, origin string) (net.Conn, error) {
+	ws, err := websocket.Dial(url, "", origin)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = websocketMaxPayload
+	return ws, nil
+}
+
+func (s *Server) websocketRemoteAddr(r *http.Request) net.Addr {
+	addr := r.RemoteAddr
+	if s.TrustForwardedFor {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			//the left most address is the one of the originating client
+			addr = strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "0"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &SocksAddr{Type: AddrTypeDomain, Addr: net.JoinHostPort(host, port)}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+//websocketConn reports the HTTP client as the remote address instead of the Origin
+type websocketConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+var _ net.Conn = (*websocketConn)(nil)
+
+func (w *websocketConn) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
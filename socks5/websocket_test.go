@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebsocketHandler(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	ts := httptest.NewServer(new(Server).WebsocketHandler())
+	defer ts.Close()
+
+	c, err := DialWebsocket("ws"+strings.TrimPrefix(ts.URL, "http"), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := rawConnect(c, echo.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Write([]byte(testString)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(testString))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != testString {
+		t.Errorf("expected %q got %q", testString, b)
+	}
+}
+
+func TestWebsocketRemoteAddr(t *testing.T) {
+	tts := []struct {
+		trust    bool
+		xff      string
+		expected string
+	}{
+		{false, "", "192.0.2.1:4321"},
+		{false, "198.51.100.7", "192.0.2.1:4321"},
+		{true, "", "192.0.2.1:4321"},
+		{true, "198.51.100.7", "198.51.100.7:0"},
+		{true, "198.51.100.7, 10.0.0.1", "198.51.100.7:0"},
+		{true, "2001:db8::1", "[2001:db8::1]:0"},
+	}
+
+	for _, tt := range tts {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		s := &Server{TrustForwardedFor: tt.trust}
+		if addr := s.websocketRemoteAddr(r).String(); addr != tt.expected {
+			t.Errorf("expected %s got %s", tt.expected, addr)
+		}
+	}
+}
+
+func newEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+//rawConnect performs a no auth CONNECT handshake to addr over c
+func rawConnect(c net.Conn, addr *net.TCPAddr) error {
+	if _, err := c.Write([]byte{socksVer5, 1, byte(noAuth)}); err != nil {
+		return err
+	}
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return err
+	}
+	if !bytes.Equal(b[:2], []byte{socksVer5, byte(noAuth)}) {
+		return ErrNoAcceptableMethod
+	}
+
+	req := []byte{socksVer5, byte(CommandConnect), reserve, byte(AddrTypeIPv4)}
+	req = append(req, addr.IP.To4()...)
+	req = append(req, byte(addr.Port>>8), byte(addr.Port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if b[1] != byte(ReplySucceeded) {
+		return ErrInvalidAddr
+	}
+	return nil
+}